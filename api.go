@@ -1,8 +1,9 @@
 package gowasmtk
 
 import (
-	"bytes"
+	"fmt"
 	"os"
+	"slices"
 
 	"github.com/Orphoros/gowasmtk/instructions"
 	"github.com/Orphoros/gowasmtk/types"
@@ -13,20 +14,39 @@ type WasmExportable interface {
 }
 
 type WasmFunctionBuilder struct {
-	paramTypes   []types.WasmType
-	resultTypes  []types.WasmType
+	paramTypes   []WasmValueType
+	resultTypes  []WasmValueType
 	code         []byte
-	locals       [][]byte
+	locals       []wasmLocalDecl
+	refFuncs     []uint64
 	instructions []byte
+	controlStack []wasmControlFrame
+	localInits   wasmLocalInits
 	symbolTable  *wasmSymbolTable
+	err          error
 	codeIndex    int
+	features     WasmFeatures
+	alwaysInline bool
+	// Whether float arithmetic is followed by NaN canonicalization, and the positions of the
+	// local indices that canonicalization of each type uses.
+	canonicalizeNaNs bool
+	nanTemps         map[types.WasmType][]int
+	dataAddresses    []wasmDataAddressDecl
 }
 
 type WasmFunctionModule struct {
-	sectionCode []byte
-	typeIndex   int
-	codeIndex   int
-	funcType    wasmSectionFunctionType
+	err          error
+	features     WasmFeatures
+	sectionCode  []byte
+	paramTypes   []WasmValueType
+	resultTypes  []WasmValueType
+	refFuncs     []uint64
+	typeIndex    int
+	codeIndex    int
+	funcType     wasmSectionFunctionType
+	alwaysInline bool
+	// The instructions that push the addresses of data symbols.
+	dataAddresses []wasmDataAddressDecl
 }
 
 type WasmImportDeclaration struct {
@@ -49,28 +69,41 @@ func NewWasmFunctionBuilder(symbolTable *wasmSymbolTable) *WasmFunctionBuilder {
 	index := len(symbolTable.functions) + lenImports
 
 	return &WasmFunctionBuilder{
-		paramTypes:   []types.WasmType{},
-		resultTypes:  []types.WasmType{},
+		paramTypes:   []WasmValueType{},
+		resultTypes:  []WasmValueType{},
 		code:         []byte{},
-		locals:       [][]byte{},
+		locals:       []wasmLocalDecl{},
 		instructions: []byte{},
+		controlStack: []wasmControlFrame{{}},
 		symbolTable:  symbolTable,
 		codeIndex:    index,
 	}
 }
 
+// Returns the first error that occurred while building the function, or nil. Builder methods
+// that fail record the error and leave the function body unchanged.
+func (b *WasmFunctionBuilder) Err() error {
+	return b.err
+}
+
+func (b *WasmFunctionBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
 func (b *WasmFunctionBuilder) AddParam(paramType types.WasmType) *WasmFunctionBuilder {
-	b.paramTypes = append(b.paramTypes, paramType)
+	b.addParam(ValType(paramType))
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddReturn(resultType types.WasmType) *WasmFunctionBuilder {
-	b.resultTypes = append(b.resultTypes, resultType)
+	b.resultTypes = append(b.resultTypes, ValType(resultType))
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddLocal(n uint32, localType types.WasmType) *WasmFunctionBuilder {
-	b.locals = append(b.locals, locals(n, localType))
+	b.declareLocals(n, ValType(localType))
 	return b
 }
 
@@ -87,18 +120,30 @@ func (boolean *WasmFunctionBuilder) AddInstrConstI64(n int64) *WasmFunctionBuild
 }
 
 func (b *WasmFunctionBuilder) AddInstrSetLocal(idx uint64) *WasmFunctionBuilder {
+	if !b.checkLocalSet(idx) {
+		return b
+	}
+
 	b.instructions = append(b.instructions, instructions.SetLocal)
 	b.instructions = append(b.instructions, leb128EncodeU(idx)...)
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddInstrGetLocal(idx uint64) *WasmFunctionBuilder {
+	if !b.checkLocalGet(idx) {
+		return b
+	}
+
 	b.instructions = append(b.instructions, instructions.GetLocal)
 	b.instructions = append(b.instructions, leb128EncodeU(idx)...)
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddInstrLocalTee(idx uint64) *WasmFunctionBuilder {
+	if !b.checkLocalSet(idx) {
+		return b
+	}
+
 	b.instructions = append(b.instructions, instructions.TeeLocal)
 	b.instructions = append(b.instructions, leb128EncodeU(idx)...)
 	return b
@@ -127,10 +172,19 @@ func (b *WasmFunctionBuilder) AddInstrDivI32() *WasmFunctionBuilder {
 func (b *WasmFunctionBuilder) AddInstrIf(returnType types.PrimitiveType) *WasmFunctionBuilder {
 	b.instructions = append(b.instructions, instructions.If)
 	b.instructions = append(b.instructions, returnType)
+	b.pushFrame(instructions.If, blockTypes(returnType))
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddInstrElse() *WasmFunctionBuilder {
+	if len(b.controlStack) < 2 || b.controlStack[len(b.controlStack)-1].opcode != instructions.If {
+		b.fail(fmt.Errorf("%w: else without an open if", ErrUnbalancedControl))
+		return b
+	}
+
+	// The else branch starts with the locals initialized before the if.
+	b.localInits.reset(b.controlStack[len(b.controlStack)-1].initHeight)
+
 	b.instructions = append(b.instructions, instructions.Else)
 	return b
 }
@@ -223,10 +277,7 @@ func (b *WasmFunctionBuilder) AddInstrCallImport(f *WasmImportDeclaration) *Wasm
 
 func (b *WasmFunctionBuilder) AddInstrCallSelf() *WasmFunctionBuilder {
 	b.instructions = append(b.instructions, instructions.CallFunc)
-
-	index := len(b.symbolTable.functions)
-
-	b.instructions = append(b.instructions, leb128EncodeU(uint64(index))...)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(b.codeIndex))...)
 
 	return b
 }
@@ -234,50 +285,120 @@ func (b *WasmFunctionBuilder) AddInstrCallSelf() *WasmFunctionBuilder {
 func (b *WasmFunctionBuilder) AddInstrLoop(returnType types.PrimitiveType) *WasmFunctionBuilder {
 	b.instructions = append(b.instructions, instructions.Loop)
 	b.instructions = append(b.instructions, returnType)
+	// A branch to a loop jumps back to its start, which takes no values.
+	b.pushFrame(instructions.Loop, []WasmValueType{})
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddInstrBr(idx uint64) *WasmFunctionBuilder {
+	if !b.checkLabel(idx) {
+		return b
+	}
+
 	b.instructions = append(b.instructions, instructions.Br)
 	b.instructions = append(b.instructions, leb128EncodeU(idx)...)
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddInstrBrIf(idx uint64) *WasmFunctionBuilder {
+	if !b.checkLabel(idx) {
+		return b
+	}
+
 	b.instructions = append(b.instructions, instructions.BrIf)
 	b.instructions = append(b.instructions, leb128EncodeU(idx)...)
 	return b
 }
 
+// Branches to the label at the position given by the i32 operand, or to the default label if
+// the operand is out of range. All labels must take the same types of values.
+func (b *WasmFunctionBuilder) AddInstrBrTable(labels []uint64, defaultLabel uint64) *WasmFunctionBuilder {
+	if !b.checkLabel(defaultLabel) {
+		return b
+	}
+	defaultTypes, _ := b.labelTypes(defaultLabel)
+	for _, label := range labels {
+		if !b.checkLabel(label) {
+			return b
+		}
+		if labelTypes, _ := b.labelTypes(label); !slices.Equal(labelTypes, defaultTypes) {
+			b.fail(fmt.Errorf("%w: label %d takes %v, default label %d takes %v", ErrLabelTypeMismatch, label, labelTypes, defaultLabel, defaultTypes))
+			return b
+		}
+	}
+
+	b.instructions = append(b.instructions, instructions.BrTable)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(len(labels)))...)
+	for _, label := range labels {
+		b.instructions = append(b.instructions, leb128EncodeU(label)...)
+	}
+	b.instructions = append(b.instructions, leb128EncodeU(defaultLabel)...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrUnreachable() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.Unreachable)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrDrop() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.Drop)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrSelect() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.Select)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrReturn() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.Return)
+	return b
+}
+
 func (b *WasmFunctionBuilder) AddInstrBlock(returnType types.PrimitiveType) *WasmFunctionBuilder {
 	b.instructions = append(b.instructions, instructions.Block)
 	b.instructions = append(b.instructions, returnType)
+	b.pushFrame(instructions.Block, blockTypes(returnType))
 	return b
 }
 
 func (b *WasmFunctionBuilder) AddInstrEnd() *WasmFunctionBuilder {
 	b.instructions = append(b.instructions, instructions.End)
+	b.popFrame()
 	return b
 }
 
 func (b *WasmFunctionBuilder) Build() WasmFunctionModule {
-	funcType := funcType(b.paramTypes, b.resultTypes)
-	typeIndex := -1
-	for i, f := range b.symbolTable.functionTypes {
-		if bytes.Equal(f, funcType) {
-			typeIndex = i
-			break
-		}
+	if len(b.controlStack) > 0 {
+		b.fail(fmt.Errorf("%w: %d blocks are not closed by end", ErrUnbalancedControl, len(b.controlStack)))
+	}
+
+	signature := FuncType(b.paramTypes, b.resultTypes)
+	funcType := signature.encode(0, false)
+	typeIndex := 0
+	if definedType := b.symbolTable.AddType(signature); definedType != nil {
+		typeIndex = definedType.GetIndex()
+	} else {
+		b.fail(fmt.Errorf("%w: signature with parameters %v and results %v", ErrUnknownType, b.paramTypes, b.resultTypes))
 	}
-	if typeIndex == -1 {
-		typeIndex = len(b.symbolTable.functionTypes)
-		b.symbolTable.functionTypes = append(b.symbolTable.functionTypes, funcType)
+
+	b.declareNaNTemps()
+	for _, decl := range b.locals {
+		b.use(valueTypeFeatures(decl.valueType))
 	}
 
 	m := WasmFunctionModule{
-		sectionCode: b.buildFunctionCode(),
-		typeIndex:   typeIndex,
-		funcType:    funcType,
+		err:           b.err,
+		features:      b.features,
+		sectionCode:   b.buildFunctionCode(),
+		paramTypes:    b.paramTypes,
+		resultTypes:   b.resultTypes,
+		refFuncs:      b.refFuncs,
+		typeIndex:     typeIndex,
+		funcType:      funcType,
+		alwaysInline:  b.alwaysInline,
+		dataAddresses: b.dataAddresses,
 	}
 
 	// Use the precomputed absolute code index (includes imports) that was
@@ -290,67 +411,70 @@ func (b *WasmFunctionBuilder) Build() WasmFunctionModule {
 }
 
 func (b *WasmFunctionBuilder) buildFunctionCode() []byte {
-	return code(function(b.locals, b.instructions))
+	localDecls := [][]byte{}
+	for _, decl := range b.locals {
+		localDecls = append(localDecls, locals(decl.count, decl.valueType.encode(0, false)...))
+	}
+
+	return code(function(localDecls, b.instructions))
 }
 
 type WasmModuleBuilder struct {
-	metaLanguages        []wasmMetadata
-	metaTools            []wasmMetadata
-	metaSdks             []wasmMetadata
-	sectionFunctionTypes []wasmSectionFunctionType
-	sectionFunction      []int // FIXME: Should be uint32
-	sectionExports       []wasmSectionExportedModule
-	sectionImports       []wasmSectionImportedModule
-	sectionCode          [][]byte
-	exportNames          []string
-	imports              *[]WasmImportDeclaration
-	symbolTable          *wasmSymbolTable
-	functionsMap         map[int]*WasmFunctionModule
+	metaLanguages   []wasmMetadata
+	metaTools       []wasmMetadata
+	metaSdks        []wasmMetadata
+	sectionFunction []int // FIXME: Should be uint32
+	sectionExports  []wasmSectionExportedModule
+	sectionImports  []wasmSectionImportedModule
+	sectionCode     [][]byte
+	sectionTables   [][]byte
+	tables          []*WasmTable
+	sectionElements [][]byte
+	sectionData     [][]byte
+	exportNames     []string
+	imports         *[]WasmImportDeclaration
+	symbolTable     *wasmSymbolTable
+	functionsMap    map[int]*WasmFunctionModule
+	initFunctions   []wasmInitFunctionDecl
+	comdats         []wasmComdatDecl
+	objectFile      bool
+	err             error
+	features        WasmFeatures
+	usedFeatures    WasmFeatures
 }
 
 func NewWasmModuleBuilder(wasmSymbolTable *wasmSymbolTable) *WasmModuleBuilder {
+	if wasmSymbolTable == nil {
+		wasmSymbolTable = NewSymbolTable(nil)
+	}
+
 	importData := []WasmImportDeclaration{}
 	allImports := []wasmSectionImportedModule{}
 
-	typesSlice := []wasmSectionFunctionType{}
-	if wasmSymbolTable != nil {
-		typesSlice = append(typesSlice, wasmSymbolTable.functionTypes...)
-	}
-
-	if wasmSymbolTable != nil && wasmSymbolTable.imports != nil {
+	if wasmSymbolTable.imports != nil {
 		importData = *wasmSymbolTable.imports
 		for _, imp := range importData {
-			sig := funcType(imp.ParamTypes, imp.ResultTypes)
-
-			typeIndex := -1
-			for i, existing := range typesSlice {
-				if bytes.Equal(existing, sig) {
-					typeIndex = i
-					break
-				}
-			}
-			if typeIndex == -1 {
-				typeIndex = len(typesSlice)
-				typesSlice = append(typesSlice, sig)
-			}
-
+			typeIndex := wasmSymbolTable.internFuncType(imp.ParamTypes, imp.ResultTypes)
 			allImports = append(allImports, imports(imp.ModuleName, imp.FunctionName, importdesc.function(uint32(typeIndex))))
 		}
 	}
 
 	return &WasmModuleBuilder{
-		metaLanguages:        []wasmMetadata{},
-		metaTools:            []wasmMetadata{},
-		metaSdks:             []wasmMetadata{},
-		sectionFunctionTypes: typesSlice,
-		sectionExports:       []wasmSectionExportedModule{},
-		sectionImports:       allImports,
-		sectionCode:          [][]byte{},
-		sectionFunction:      []int{},
-		exportNames:          []string{},
-		imports:              &importData,
-		symbolTable:          wasmSymbolTable,
-		functionsMap:         map[int]*WasmFunctionModule{},
+		metaLanguages:   []wasmMetadata{},
+		metaTools:       []wasmMetadata{},
+		metaSdks:        []wasmMetadata{},
+		sectionExports:  []wasmSectionExportedModule{},
+		sectionImports:  allImports,
+		sectionCode:     [][]byte{},
+		sectionData:     [][]byte{},
+		sectionTables:   [][]byte{},
+		sectionElements: [][]byte{},
+		sectionFunction: []int{},
+		exportNames:     []string{},
+		imports:         &importData,
+		symbolTable:     wasmSymbolTable,
+		functionsMap:    map[int]*WasmFunctionModule{},
+		features:        FeaturesAll,
 	}
 }
 
@@ -389,18 +513,52 @@ func (b *WasmModuleBuilder) AddMetaSdk(name, version string) *WasmModuleBuilder
 }
 
 // Register a function in the module. The function must be built using the WasmFunctionBuilder.
+// If the function builder recorded an error, the module builder reports it through Err.
 func (b *WasmModuleBuilder) AddFunction(function *WasmFunctionModule) *WasmModuleBuilder {
+	if function.err != nil {
+		b.fail(function.err)
+	}
+	b.usedFeatures |= function.features
 	b.functionsMap[function.codeIndex] = function
 	return b
 }
 
-// Save the WASM module to a ".wasm" file. May return an error if the file cannot be created or written to.
-func (b *WasmModuleBuilder) BuildWasmFile(fileName string) error {
+// Returns the first error that occurred while assembling the module, including errors of the
+// registered functions and features used outside of the enabled set, or nil if the module is
+// valid so far.
+func (b *WasmModuleBuilder) Err() error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.symbolTable.err != nil {
+		return b.symbolTable.err
+	}
+	return b.checkFeatures()
+}
+
+func (b *WasmModuleBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Save the WASM module to a ".wasm" file, after applying the build options. May return an error
+// if the module is invalid, if an option fails, or if the file cannot be created or written to.
+func (b *WasmModuleBuilder) BuildWasmFile(fileName string, options ...WasmBuildOption) error {
+	if err := b.Err(); err != nil {
+		return err
+	}
+
 	if len(fileName) < 5 || fileName[len(fileName)-5:] != ".wasm" {
 		fileName += ".wasm"
 	}
 
-	return os.WriteFile(fileName, b.Build(), 0644)
+	wasm := b.Build(options...)
+	if err := b.Err(); err != nil {
+		return err
+	}
+
+	return os.WriteFile(fileName, wasm, 0644)
 }
 
 // Export an item (function) from the module. The item must implement the WasmExportable interface.
@@ -422,6 +580,10 @@ func (b *WasmModuleBuilder) Export(name string, exportType types.WasmExportType,
 	// item.GetIndex() returns the absolute function index (includes imports).
 	// export(...) expects a function index relative to the functions section,
 	// because it will add numImportDeclarations back in. Convert to relative.
+	if global, ok := item.(*WasmGlobal); ok && global.Mutable {
+		b.usedFeatures |= FeatureMutableGlobals
+	}
+
 	absIndex := item.GetIndex()
 	relIndex := absIndex
 	if b.lenImports() > 0 {
@@ -448,12 +610,100 @@ func (b *WasmModuleBuilder) lenImports() int {
 	return len(*b.imports)
 }
 
-// Build the WASM bytecode. Returns the WASM bytecode as a byte slice.
-func (b *WasmModuleBuilder) Build() []byte {
+// WasmBuildOption is a pass that rewrites the module after it was assembled, such as
+// WithTreeShaking.
+type WasmBuildOption func(m *WasmDecodedModule) error
+
+// Build the WASM bytecode and apply the options to it in order. Returns the WASM bytecode as a
+// byte slice, or as a relocatable object file if ObjectFile was called. If an option fails, the
+// error is recorded for Err and the module is returned as it was before the options were applied.
+func (b *WasmModuleBuilder) Build(options ...WasmBuildOption) []byte {
+	wasm := b.build()
+	if len(options) == 0 && !b.objectFile {
+		return wasm
+	}
+
+	m, err := DecodeModule(wasm)
+	if err != nil {
+		b.fail(err)
+		return wasm
+	}
+	for _, f := range b.functionsMap {
+		if f.alwaysInline {
+			m.SetAlwaysInline(uint32(f.GetIndex()))
+		}
+	}
+	imported := m.importCount(types.ImportFunctionType)
+	for _, f := range b.functionsMap {
+		for _, decl := range f.dataAddresses {
+			m.Code[f.GetIndex()-imported].Body[decl.instr].data = &decl.address
+		}
+	}
+	for _, d := range b.symbolTable.data {
+		m.Data[d.index].pointers = d.pointers
+	}
+	for _, init := range b.initFunctions {
+		m.AddInitFunction(uint32(init.function.GetIndex()), init.priority)
+	}
+	for _, c := range b.comdats {
+		functions := []uint32{}
+		for _, f := range c.functions {
+			functions = append(functions, uint32(f.GetIndex()))
+		}
+		m.AddComdat(c.name, functions...)
+	}
+	for _, option := range options {
+		if err := option(m); err != nil {
+			b.fail(err)
+			return wasm
+		}
+	}
+	if b.objectFile {
+		object, err := m.EncodeObject()
+		if err != nil {
+			b.fail(err)
+			return wasm
+		}
+		return object
+	}
+	return m.Encode()
+}
+
+func (b *WasmModuleBuilder) build() []byte {
 	sections := []wasmSection{}
 
-	sections = append(sections, sectionType(b.sectionFunctionTypes...))
-	sections = append(sections, sectionImports(b.sectionImports...))
+	importSections := append([]wasmSectionImportedModule{}, b.sectionImports...)
+	memorySections := [][]byte{}
+	for _, memory := range b.symbolTable.memories {
+		if memory.imported() {
+			importSections = append(importSections, imports(memory.moduleName, memory.name, importdesc.memory(limits(memory))))
+		} else {
+			memorySections = append(memorySections, limits(memory))
+		}
+	}
+
+	globals := []*WasmGlobal{}
+	for _, global := range b.symbolTable.globals {
+		if global.imported() {
+			importSections = append(importSections, imports(global.moduleName, global.name, importdesc.global(globalType(global))))
+		} else {
+			globals = append(globals, global)
+		}
+	}
+
+	tagSections := [][]byte{}
+	if b.symbolTable != nil {
+		for _, tag := range b.symbolTable.tags {
+			if tag.imported() {
+				importSections = append(importSections, imports(tag.moduleName, tag.name, importdesc.tag(uint32(tag.typeIndex))))
+			} else {
+				tagSections = append(tagSections, tagType(uint32(tag.typeIndex)))
+			}
+		}
+	}
+
+	sections = append(sections, sectionType(b.symbolTable.encodeTypes()...))
+	sections = append(sections, sectionImports(importSections...))
 
 	funcIndices := make([]uint64, 0)
 	codeSections := make([][]byte, 0)
@@ -476,15 +726,54 @@ func (b *WasmModuleBuilder) Build() []byte {
 
 	sections = append(sections, sectionFunc(funcIndices...))
 
+	if len(b.sectionTables) > 0 {
+		sections = append(sections, sectionTable(b.sectionTables...))
+	}
+
+	if len(memorySections) > 0 {
+		sections = append(sections, sectionMemory(memorySections...))
+	}
+
+	if len(tagSections) > 0 {
+		sections = append(sections, sectionTag(tagSections...))
+	}
+
+	if len(globals) > 0 {
+		sections = append(sections, sectionGlobal(globals...))
+	}
+
 	if len(b.sectionExports) > 0 {
 		sections = append(sections, sectionExport(b.sectionExports...))
 	}
 
+	elementSegments := append([][]byte{}, b.sectionElements...)
+	if declared := b.declaredFunctions(); len(declared) > 0 {
+		elementSegments = append(elementSegments, declarativeElementSegment(declared))
+	}
+
+	if len(elementSegments) > 0 {
+		sections = append(sections, sectionElement(elementSegments...))
+	}
+
 	sections = append(sections, sectionCode(codeSections...))
 
+	// data symbols come first, so that their segment indices are known when code refers to them
+	dataSegments := [][]byte{}
+	for _, d := range b.symbolTable.data {
+		dataSegments = append(dataSegments, dataSegment(b.symbolTable.memory(0), NewWasmConstExpr().AddInstrConstI32(int32(d.offset)), d.bytes))
+	}
+	dataSegments = append(dataSegments, b.sectionData...)
+	if len(dataSegments) > 0 {
+		sections = append(sections, sectionData(dataSegments...))
+	}
+
 	if len(b.metaLanguages) > 0 || len(b.metaTools) > 0 || len(b.metaSdks) > 0 {
 		sections = append(sections, sectionProducers(b.metaLanguages, b.metaTools, b.metaSdks))
 	}
 
+	if features := b.UsedFeatures(); features != FeaturesMVP {
+		sections = append(sections, sectionTargetFeatures(features))
+	}
+
 	return module(sections...)
 }
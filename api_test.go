@@ -15,6 +15,7 @@ type apiTestCase struct {
 	nameOfMain string
 	args       []interface{}
 	expected   interface{}
+	options    []WasmBuildOption
 }
 
 func TestModule(t *testing.T) {
@@ -255,7 +256,7 @@ func runModValueTest(t *testing.T, test apiTestCase) {
 	engine := wasmer.NewEngine()
 	store := wasmer.NewStore(engine)
 
-	module, err := wasmer.NewModule(store, test.input.Build())
+	module, err := wasmer.NewModule(store, test.input.Build(test.options...))
 
 	if err != nil {
 		log.Fatal("module compilation error: %w\n", err)
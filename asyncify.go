@@ -0,0 +1,620 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Instruments the functions that can reach a call of one of the imports, which are named as
+// module.name, so that their stack can be unwound into linear memory and rewound later, like
+// Binaryen's Asyncify. The module exports asyncify_start_unwind, asyncify_stop_unwind,
+// asyncify_start_rewind, asyncify_stop_rewind and asyncify_get_state.
+//
+// An import suspends the program by calling asyncify_start_unwind with the address of two i32s,
+// the start and end of the memory that the stack is unwound into, and returning. When the
+// export that was called returns, the host calls asyncify_stop_unwind. To resume, the host
+// calls asyncify_start_rewind with the same address and the export again, and the import calls
+// asyncify_stop_rewind when it is called again and returns its result. Locals, results and
+// operand stack values at the calls of instrumented functions must be numbers.
+func WithAsyncify(imports ...string) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		return Asyncify(m, imports...)
+	}
+}
+
+// Applies the instrumentation of WithAsyncify to the module.
+func Asyncify(m *WasmDecodedModule, imports ...string) error {
+	a := &wasmAsyncifier{m: m, imported: uint32(m.importCount(types.ImportFunctionType))}
+	a.findAsync(imports)
+
+	i32 := WasmDecodedValType{Code: types.I32, Heap: noHeapType}
+	a.state = uint64(m.importCount(types.ImportGlobalType) + len(m.Globals))
+	a.data = a.state + 1
+	for range 2 {
+		m.Globals = append(m.Globals, WasmDecodedGlobal{
+			Type:    i32,
+			Mutable: true,
+			Init:    []WasmInstr{i32Const(0).instr(), Instr(WasmOpcode(instructions.End))},
+		})
+	}
+
+	for i := range m.Code {
+		if !a.async[a.imported+uint32(i)] {
+			continue
+		}
+		memory := m.memoryZero()
+		if memory == nil {
+			return fmt.Errorf("%w: the module has no memory to unwind into", ErrUnsupportedAsyncify)
+		}
+		if memory.Flags&0x04 != 0 { // memory64
+			return fmt.Errorf("%w: the data of unwinding is addressed with i32, but memory 0 is a 64-bit memory", ErrUnsupportedAsyncify)
+		}
+		if err := a.instrument(i); err != nil {
+			return err
+		}
+	}
+
+	setState := func(state uint32) []WasmInstr {
+		return []WasmInstr{i32Const(state).instr(), Instr(WasmOpcode(instructions.GlobalSet), a.state)}
+	}
+	start := func(state uint32) []WasmInstr {
+		return append(setState(state), Instr(WasmOpcode(instructions.GetLocal), 0), Instr(WasmOpcode(instructions.GlobalSet), a.data))
+	}
+	a.export("asyncify_start_unwind", []WasmDecodedValType{i32}, []WasmDecodedValType{}, start(asyncUnwinding))
+	a.export("asyncify_stop_unwind", []WasmDecodedValType{}, []WasmDecodedValType{}, setState(asyncNormal))
+	a.export("asyncify_start_rewind", []WasmDecodedValType{i32}, []WasmDecodedValType{}, start(asyncRewinding))
+	a.export("asyncify_stop_rewind", []WasmDecodedValType{}, []WasmDecodedValType{}, setState(asyncNormal))
+	a.export("asyncify_get_state", []WasmDecodedValType{}, []WasmDecodedValType{i32}, []WasmInstr{Instr(WasmOpcode(instructions.GlobalGet), a.state)})
+	return nil
+}
+
+// The values of the state global.
+const (
+	asyncNormal uint32 = iota
+	asyncUnwinding
+	asyncRewinding
+)
+
+type wasmAsyncifier struct {
+	m        *WasmDecodedModule
+	imported uint32
+	// Whether the functions can reach a call of one of the imports.
+	async []bool
+	// Whether an indirect call can reach a call of one of the imports.
+	indirect bool
+	// The globals that hold the state and the address of the unwound stack.
+	state, data uint64
+}
+
+// Marks the imports and the functions that can call them, directly or through other functions.
+func (a *wasmAsyncifier) findAsync(imports []string) {
+	m := a.m
+	a.async = make([]bool, int(a.imported)+len(m.Code))
+	f := 0
+	for _, imp := range m.Imports {
+		if imp.Kind == types.ImportFunctionType {
+			a.async[f] = slices.Contains(imports, imp.Module+"."+imp.Name)
+			f++
+		}
+	}
+
+	targets := m.indirectTargets()
+	for changed := true; changed; {
+		changed = false
+		for f, target := range targets {
+			if target && a.async[f] && !a.indirect {
+				a.indirect, changed = true, true
+			}
+		}
+		for i, c := range m.Code {
+			f := a.imported + uint32(i)
+			if !a.async[f] && slices.ContainsFunc(c.Body, a.isSite) {
+				a.async[f], changed = true, true
+			}
+		}
+	}
+}
+
+// Returns whether the instruction is a call that can reach a call of one of the imports.
+func (a *wasmAsyncifier) isSite(instr WasmInstr) bool {
+	switch instr.Opcode {
+	case WasmOpcode(instructions.CallFunc), WasmOpcode(instructions.ReturnCall):
+		return a.async[instr.Immediates[0]]
+	case WasmOpcode(instructions.CallIndirect), WasmOpcode(instructions.CallRef),
+		WasmOpcode(instructions.ReturnCallIndirect), WasmOpcode(instructions.ReturnCallRef):
+		return a.indirect
+	}
+	return false
+}
+
+// Appends an exported function with the given body.
+func (a *wasmAsyncifier) export(name string, params, results []WasmDecodedValType, body []WasmInstr) {
+	index := a.imported + uint32(len(a.m.Code))
+	a.m.Functions = append(a.m.Functions, a.m.funcType(params, results))
+	a.m.Code = append(a.m.Code, WasmDecodedCode{Locals: []WasmDecodedLocals{}, Body: append(body, Instr(WasmOpcode(instructions.End)))})
+	a.m.Exports = append(a.m.Exports, WasmDecodedExport{Name: name, Kind: types.ExportFunctionType, Index: index})
+}
+
+// wasmAsyncNode is an instruction of a body, together with the instructions of the blocks it
+// opens. The call sites that can unwind are numbered in the order they appear, and those in
+// the node are numbered from first up to last.
+type wasmAsyncNode struct {
+	instr        WasmInstr
+	body, orElse []*wasmAsyncNode
+	hasElse      bool
+	first, last  int
+}
+
+func (n *wasmAsyncNode) hasSites() bool {
+	return n.first < n.last
+}
+
+type wasmAsyncFunction struct {
+	*wasmAsyncifier
+	index uint32
+	// The types of the parameters and locals, including the locals added for spilled values.
+	locals []WasmDecodedValType
+	// The locals that hold the index of the call site that unwound and the unwound stack.
+	site, ptr uint64
+	sites     int
+	out       []WasmInstr
+	// The number of blocks open in the output, and the output depth of the blocks of the
+	// original body.
+	depth  int
+	labels []int
+	err    error
+}
+
+func (f *wasmAsyncFunction) fail(format string, args ...any) {
+	if f.err == nil {
+		f.err = fmt.Errorf("%w: function %d %s", ErrUnsupportedAsyncify, f.index, fmt.Sprintf(format, args...))
+	}
+}
+
+// Returns whether values of the type can be stored in linear memory.
+func isNumeric(t WasmDecodedValType) bool {
+	switch t.Code {
+	case types.I32, types.I64, types.F32, types.F64:
+		return true
+	}
+	return false
+}
+
+// Adds a local of the type and returns its index.
+func (f *wasmAsyncFunction) temp(t WasmDecodedValType) uint64 {
+	if !isNumeric(t) {
+		f.fail("has a value of type 0x%x at a call", t.Code)
+	}
+	f.locals = append(f.locals, t)
+	return uint64(len(f.locals) - 1)
+}
+
+// Rewrites the defined function so that it saves its locals and the call site when a call
+// unwinds, and skips to the call site and restores them when it is called while rewinding.
+func (a *wasmAsyncifier) instrument(i int) error {
+	m := a.m
+	c := &m.Code[i]
+	funcType := m.typeAt(m.Functions[i])
+	f := &wasmAsyncFunction{wasmAsyncifier: a, index: a.imported + uint32(i)}
+
+	f.locals = slices.Clone(funcType.Params)
+	for _, l := range c.Locals {
+		for range l.Count {
+			f.locals = append(f.locals, l.Type)
+		}
+	}
+	declared := len(f.locals)
+	for _, t := range append(slices.Clone(f.locals), funcType.Results...) {
+		if !isNumeric(t) {
+			f.fail("has a local or result of type 0x%x", t.Code)
+		}
+	}
+	i32 := WasmDecodedValType{Code: types.I32, Heap: noHeapType}
+	f.site, f.ptr = f.temp(i32), f.temp(i32)
+
+	pos := 0
+	nodes := f.parse(c.Body, &pos)
+
+	// unwinding branches out of the outer block, the body falls through the inner one
+	empty := blockTypeImmediates(WasmDecodedValType{Code: types.EmptyType, Heap: noHeapType})
+	f.open(Instr(WasmOpcode(instructions.Block), empty...))
+	f.open(Instr(WasmOpcode(instructions.Block), m.blockType(funcType.Results)...))
+	f.labels = []int{1}
+	f.sequence(nodes)
+	f.close()
+	f.out = append(f.out, Instr(WasmOpcode(instructions.Return)))
+	f.close()
+	if f.err != nil {
+		return f.err
+	}
+
+	saved := []uint64{}
+	for l := range f.locals {
+		if uint64(l) != f.site && uint64(l) != f.ptr {
+			saved = append(saved, uint64(l))
+		}
+	}
+	size := uint32(8 * len(saved))
+	get := func(l uint64) WasmInstr { return Instr(WasmOpcode(instructions.GetLocal), l) }
+	set := func(l uint64) WasmInstr { return Instr(WasmOpcode(instructions.SetLocal), l) }
+	global := func(g uint64) WasmInstr { return Instr(WasmOpcode(instructions.GlobalGet), g) }
+	loadI32 := func(offset uint32) WasmInstr { return Instr(WasmOpcode(instructions.LoadI32), 2, 0, uint64(offset)) }
+	storeI32 := func(offset uint32) WasmInstr { return Instr(WasmOpcode(instructions.StoreI32), 2, 0, uint64(offset)) }
+
+	// when rewinding, pops the frame of the function and restores the locals from it
+	body := []WasmInstr{
+		global(a.state), i32Const(asyncRewinding).instr(), Instr(WasmOpcode(instructions.EqualI32)),
+		Instr(WasmOpcode(instructions.If), empty...),
+		global(a.data),
+		global(a.data), loadI32(0), i32Const(size + 4).instr(), Instr(WasmOpcode(instructions.SubI32)),
+		Instr(WasmOpcode(instructions.TeeLocal), f.ptr),
+		storeI32(0),
+	}
+	for k, l := range saved {
+		slot := asyncSlots[f.locals[l].Code]
+		body = append(body, get(f.ptr), Instr(slot.load, slot.align, 0, uint64(8*k)), set(l))
+	}
+	body = append(body, get(f.ptr), loadI32(size), set(f.site), Instr(WasmOpcode(instructions.End)))
+
+	body = append(body, f.out...)
+
+	// after unwinding, pushes the frame of the function, and traps if it does not fit
+	body = append(body,
+		global(a.data), loadI32(0), set(f.ptr),
+		get(f.ptr), i32Const(size+4).instr(), Instr(WasmOpcode(instructions.AddI32)),
+		global(a.data), loadI32(4), Instr(WasmOpcode(instructions.GreaterThanUnsignedI32)),
+		Instr(WasmOpcode(instructions.If), empty...), Instr(WasmOpcode(instructions.Unreachable)), Instr(WasmOpcode(instructions.End)),
+	)
+	for k, l := range saved {
+		slot := asyncSlots[f.locals[l].Code]
+		body = append(body, get(f.ptr), get(l), Instr(slot.store, slot.align, 0, uint64(8*k)))
+	}
+	body = append(body,
+		get(f.ptr), get(f.site), storeI32(size),
+		global(a.data), get(f.ptr), i32Const(size+4).instr(), Instr(WasmOpcode(instructions.AddI32)), storeI32(0),
+	)
+	for _, t := range funcType.Results {
+		zero, _ := defaultValue(t)
+		body = append(body, zero)
+	}
+	c.Body = append(body, Instr(WasmOpcode(instructions.End)))
+
+	for _, t := range f.locals[declared:] {
+		if n := len(c.Locals); n > 0 && c.Locals[n-1].Type == t {
+			c.Locals[n-1].Count++
+		} else {
+			c.Locals = append(c.Locals, WasmDecodedLocals{Count: 1, Type: t})
+		}
+	}
+	return nil
+}
+
+// The instructions that load and store a local of a numeric type in its slot of the unwound
+// stack, and the alignment of the slot.
+var asyncSlots = map[types.WasmType]struct {
+	load, store WasmOpcode
+	align       uint64
+}{
+	types.I32: {WasmOpcode(instructions.LoadI32), WasmOpcode(instructions.StoreI32), 2},
+	types.I64: {WasmOpcode(instructions.LoadI64), WasmOpcode(instructions.StoreI64), 3},
+	types.F32: {0x2A, 0x38, 2}, // f32.load and f32.store
+	types.F64: {WasmOpcode(instructions.LoadF64), WasmOpcode(instructions.StoreF64), 3},
+}
+
+// Parses the instructions from body[*i] up to the end or else of the enclosing block, which is
+// left at body[*i], and numbers the call sites among them.
+func (f *wasmAsyncFunction) parse(body []WasmInstr, i *int) []*wasmAsyncNode {
+	nodes := []*wasmAsyncNode{}
+	for *i < len(body) && f.err == nil {
+		instr := body[*i]
+		if instr.Opcode == WasmOpcode(instructions.End) || instr.Opcode == WasmOpcode(instructions.Else) {
+			break
+		}
+		*i++
+
+		n := &wasmAsyncNode{instr: instr, first: f.sites}
+		switch op := instr.Opcode; {
+		case f.isSite(instr):
+			if _, ok := tailCallTargets[op]; ok {
+				f.fail("makes a tail call that can unwind")
+			}
+			if op == WasmOpcode(instructions.CallRef) {
+				f.fail("makes a call by reference that can unwind")
+			}
+			f.sites++
+		case op == 0x06: // try
+			f.fail("uses legacy exception handling")
+		case op.opensBlock():
+			n.body = f.parse(body, i)
+			if *i < len(body) && body[*i].Opcode == WasmOpcode(instructions.Else) {
+				*i++
+				n.hasElse = true
+				n.orElse = f.parse(body, i)
+			}
+			*i++
+		}
+		n.last = f.sites
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// Appends a block of the instrumentation to the output.
+func (f *wasmAsyncFunction) open(instr WasmInstr) {
+	f.out = append(f.out, instr)
+	f.depth++
+}
+
+// Closes the innermost block of the output.
+func (f *wasmAsyncFunction) close() {
+	f.out = append(f.out, Instr(WasmOpcode(instructions.End)))
+	f.depth--
+}
+
+// Returns the label of a branch to the outer block that unwinds.
+func (f *wasmAsyncFunction) unwind() uint64 {
+	return uint64(f.depth - 1)
+}
+
+// Appends an instruction of the original body to the output, with its labels adjusted to the
+// blocks of the instrumentation, and the blocks it opens.
+func (f *wasmAsyncFunction) node(n *wasmAsyncNode) {
+	instr := n.instr
+	instr.Immediates = slices.Clone(instr.Immediates)
+	instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+		if kind == immLabel {
+			*value = uint64(f.depth - 1 - f.labels[len(f.labels)-1-int(*value)])
+		}
+	})
+	f.out = append(f.out, instr)
+	if !instr.Opcode.opensBlock() {
+		return
+	}
+
+	f.labels = append(f.labels, f.depth)
+	f.depth++
+	f.sequence(n.body)
+	if n.hasElse {
+		f.out = append(f.out, Instr(WasmOpcode(instructions.Else)))
+		f.sequence(n.orElse)
+	}
+	f.close()
+	f.labels = f.labels[:len(f.labels)-1]
+}
+
+// Appends the instructions of a block to the output. Up to the last node with call sites, the
+// operand stack is spilled into locals before each such node, the node only runs if the state
+// is normal or the call site that unwound is in it, and the instructions in between only run
+// if the state is normal. Calls that return while unwinding save their call site and branch to
+// the end of the function.
+func (f *wasmAsyncFunction) sequence(nodes []*wasmAsyncNode) {
+	last := -1
+	for k, n := range nodes {
+		if n.hasSites() {
+			last = k
+		}
+	}
+
+	empty := blockTypeImmediates(WasmDecodedValType{Code: types.EmptyType, Heap: noHeapType})
+	state := Instr(WasmOpcode(instructions.GlobalGet), f.state)
+	// the types of the operand stack, or nil if they are not known, and the locals that hold it
+	// while no instructions are guarded
+	stack := []WasmDecodedValType{}
+	spilled := []uint64{}
+	guarded := false
+
+	for _, n := range nodes[:last+1] {
+		if f.err != nil {
+			return
+		}
+		if !n.hasSites() {
+			if !guarded {
+				f.out = append(f.out, state, Instr(WasmOpcode(instructions.EqzI32)))
+				f.open(Instr(WasmOpcode(instructions.If), empty...))
+				for _, l := range spilled {
+					f.out = append(f.out, Instr(WasmOpcode(instructions.GetLocal), l))
+				}
+				guarded = true
+			}
+			f.node(n)
+			if isUnconditional(n.instr.Opcode) {
+				// the rest of the block is not reachable
+				f.close()
+				f.out = append(f.out, Instr(WasmOpcode(instructions.Unreachable)))
+				return
+			}
+			if stack != nil {
+				stack = f.apply(stack, n.instr)
+			}
+			continue
+		}
+
+		if stack == nil {
+			f.fail("has operand stack values of unknown types at a call")
+			return
+		}
+		if guarded {
+			spilled = make([]uint64, len(stack))
+			for k := len(stack) - 1; k >= 0; k-- {
+				spilled[k] = f.temp(stack[k])
+				f.out = append(f.out, Instr(WasmOpcode(instructions.SetLocal), spilled[k]))
+			}
+			f.close()
+			guarded = false
+		}
+
+		params, results, inputs := f.signature(n.instr)
+		if n.instr.Opcode.opensBlock() && len(params) > 0 {
+			f.fail("has a block with parameters that can unwind")
+			return
+		}
+		if inputs > len(stack) {
+			f.fail("has too few operands at a call")
+			return
+		}
+		below := len(stack) - inputs
+
+		f.out = append(f.out,
+			state, Instr(WasmOpcode(instructions.EqzI32)),
+			Instr(WasmOpcode(instructions.GetLocal), f.site), i32Const(uint32(n.first)).instr(), Instr(WasmOpcode(instructions.SubI32)),
+			i32Const(uint32(n.last-n.first)).instr(), Instr(WasmOpcode(instructions.LessThanUnsignedI32)),
+			Instr(WasmOpcode(instructions.OrI32)),
+		)
+		f.open(Instr(WasmOpcode(instructions.If), empty...))
+		for _, l := range spilled[below:] {
+			f.out = append(f.out, Instr(WasmOpcode(instructions.GetLocal), l))
+		}
+		f.node(n)
+		spilled = slices.Clone(spilled[:below])
+		for _, t := range results {
+			spilled = append(spilled, f.temp(t))
+		}
+		for k := len(spilled) - 1; k >= below; k-- {
+			f.out = append(f.out, Instr(WasmOpcode(instructions.SetLocal), spilled[k]))
+		}
+		if !n.instr.Opcode.opensBlock() {
+			f.out = append(f.out, state, i32Const(asyncUnwinding).instr(), Instr(WasmOpcode(instructions.EqualI32)))
+			f.open(Instr(WasmOpcode(instructions.If), empty...))
+			f.out = append(f.out,
+				i32Const(uint32(n.first)).instr(), Instr(WasmOpcode(instructions.SetLocal), f.site),
+				Instr(WasmOpcode(instructions.Br), f.unwind()),
+			)
+			f.close()
+		}
+		f.close()
+		stack = append(slices.Clone(stack[:below]), results...)
+	}
+
+	for _, l := range spilled {
+		f.out = append(f.out, Instr(WasmOpcode(instructions.GetLocal), l))
+	}
+	for _, n := range nodes[last+1:] {
+		f.node(n)
+	}
+}
+
+// Returns whether the instruction never continues with the next instruction.
+func isUnconditional(op WasmOpcode) bool {
+	switch op {
+	case WasmOpcode(instructions.Br), WasmOpcode(instructions.BrTable), WasmOpcode(instructions.Return),
+		WasmOpcode(instructions.Unreachable), WasmOpcode(instructions.Throw), WasmOpcode(instructions.ThrowRef),
+		0x09, // rethrow
+		WasmOpcode(instructions.ReturnCall), WasmOpcode(instructions.ReturnCallIndirect), WasmOpcode(instructions.ReturnCallRef):
+		return true
+	}
+	return false
+}
+
+// Returns the parameters and results of a call or block, and the number of operands it takes.
+func (f *wasmAsyncFunction) signature(instr WasmInstr) ([]WasmDecodedValType, []WasmDecodedValType, int) {
+	switch op := instr.Opcode; {
+	case op == WasmOpcode(instructions.CallFunc):
+		index, _ := f.m.funcTypeIndex(uint32(instr.Immediates[0]))
+		t := f.m.typeAt(index)
+		return t.Params, t.Results, len(t.Params)
+	case op == WasmOpcode(instructions.CallIndirect):
+		t := f.m.typeAt(uint32(instr.Immediates[0]))
+		return t.Params, t.Results, len(t.Params) + 1
+	case op.opensBlock():
+		params, results := f.m.blockSignature(instr)
+		if op == WasmOpcode(instructions.If) {
+			return params, results, len(params) + 1
+		}
+		return params, results, len(params)
+	}
+	return nil, nil, 0
+}
+
+// Returns the type of the global with the given index, counting imports first.
+func (m *WasmDecodedModule) globalType(index uint32) WasmDecodedValType {
+	for _, imp := range m.Imports {
+		if imp.Kind != types.ImportGlobalType {
+			continue
+		}
+		if index == 0 {
+			return imp.Global.Type
+		}
+		index--
+	}
+	return m.Globals[index].Type
+}
+
+// Returns the types of the operand stack after the instruction, or nil if the effect of the
+// instruction is not known.
+func (f *wasmAsyncFunction) apply(stack []WasmDecodedValType, instr WasmInstr) []WasmDecodedValType {
+	value := func(t types.WasmType) []WasmDecodedValType {
+		return []WasmDecodedValType{{Code: t, Heap: noHeapType}}
+	}
+	pops, pushes := 0, []WasmDecodedValType{}
+	switch op := instr.Opcode; {
+	case op == WasmOpcode(instructions.ConstI32):
+		pushes = value(types.I32)
+	case op == WasmOpcode(instructions.ConstI64):
+		pushes = value(types.I64)
+	case op == WasmOpcode(instructions.ConstF32):
+		pushes = value(types.F32)
+	case op == WasmOpcode(instructions.ConstF64):
+		pushes = value(types.F64)
+	case op == WasmOpcode(instructions.GetLocal):
+		pushes = []WasmDecodedValType{f.locals[instr.Immediates[0]]}
+	case op == WasmOpcode(instructions.TeeLocal):
+		pops, pushes = 1, []WasmDecodedValType{f.locals[instr.Immediates[0]]}
+	case op == WasmOpcode(instructions.GlobalGet):
+		pushes = []WasmDecodedValType{f.m.globalType(uint32(instr.Immediates[0]))}
+	case op == WasmOpcode(instructions.SetLocal), op == WasmOpcode(instructions.GlobalSet),
+		op == WasmOpcode(instructions.Drop), op == WasmOpcode(instructions.BrIf):
+		pops = 1
+	case op == 0x01: // nop
+	case op == WasmOpcode(instructions.Select):
+		if len(stack) < 3 {
+			return nil
+		}
+		pops, pushes = 3, []WasmDecodedValType{stack[len(stack)-2]}
+	case op >= 0x28 && op <= 0x35: // loads
+		pops = 1
+		switch op {
+		case 0x29, 0x30, 0x31, 0x32, 0x33, 0x34, 0x35:
+			pushes = value(types.I64)
+		case 0x2A:
+			pushes = value(types.F32)
+		case 0x2B:
+			pushes = value(types.F64)
+		default:
+			pushes = value(types.I32)
+		}
+	case op >= 0x36 && op <= 0x3E: // stores
+		pops = 2
+	case op == 0x3F: // memory.size
+		pushes = value(types.I32)
+	case op == 0x40: // memory.grow
+		pops, pushes = 1, value(types.I32)
+	case op >= 0xBC && op <= 0xC4: // reinterpretations and sign extensions
+		pops = 1
+		pushes = value([]types.WasmType{types.I32, types.I64, types.F32, types.F64, types.I32, types.I32, types.I64, types.I64, types.I64}[op-0xBC])
+	case op == WasmOpcode(instructions.CallFunc), op == WasmOpcode(instructions.CallIndirect), op.opensBlock():
+		_, results, inputs := f.signature(instr)
+		pops, pushes = inputs, results
+	default:
+		if c, ok := conversions[op]; ok {
+			pops, pushes = 1, value(c.to)
+		} else if t, ok := numericOperand(op); ok {
+			pops = 1
+			if isBinary(op) {
+				pops = 2
+			}
+			if op <= 0x66 {
+				t = types.I32 // comparisons
+			}
+			pushes = value(t)
+		} else {
+			return nil
+		}
+	}
+	if pops > len(stack) {
+		return nil
+	}
+	return append(slices.Clone(stack[:len(stack)-pops]), pushes...)
+}
@@ -0,0 +1,191 @@
+package gowasmtk
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Calls main of the module instrumented for env.wait with the argument until it returns
+// without unwinding. Every call of env.wait unwinds, and returns 10 when it is rewound.
+// Returns the result and the number of suspensions.
+func runAsync(t *testing.T, mod *WasmModuleBuilder, arg int32) (any, int) {
+	t.Helper()
+	wasm := mod.Build(WithAsyncify("env.wait"))
+	if err := mod.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const data, start, end = 16, 24, 1024
+	var instance *wasmer.Instance
+	export := func(name string) wasmer.NativeFunction {
+		f, err := instance.Exports.GetFunction(name)
+		if err != nil {
+			t.Fatalf("missing export %s: %v", name, err)
+		}
+		return f
+	}
+
+	store := wasmer.NewStore(wasmer.NewEngine())
+	suspended := 0
+	wait := wasmer.NewFunction(store,
+		wasmer.NewFunctionType(wasmer.NewValueTypes(), wasmer.NewValueTypes(wasmer.I32)),
+		func(args []wasmer.Value) ([]wasmer.Value, error) {
+			if state, _ := export("asyncify_get_state")(); state == int32(2) {
+				_, err := export("asyncify_stop_rewind")()
+				return []wasmer.Value{wasmer.NewI32(10)}, err
+			}
+			suspended++
+			_, err := export("asyncify_start_unwind")(data)
+			return []wasmer.Value{wasmer.NewI32(0)}, err
+		})
+	instance = instantiate(t, store, wasm, map[string]wasmer.IntoExtern{"wait": wait})
+
+	mem, _ := instance.Exports.GetMemory("memory")
+	binary.LittleEndian.PutUint32(mem.Data()[data:], start)
+	binary.LittleEndian.PutUint32(mem.Data()[data+4:], end)
+
+	result, err := export("main")(arg)
+	for err == nil {
+		if state, _ := export("asyncify_get_state")(); state != int32(1) {
+			break
+		}
+		export("asyncify_stop_unwind")()
+		export("asyncify_start_rewind")(data)
+		result, err = export("main")(arg)
+	}
+	if err != nil {
+		t.Fatalf("unexpected trap: %v", err)
+	}
+	if pos := binary.LittleEndian.Uint32(mem.Data()[data:]); pos != start {
+		t.Fatalf("expected the unwound stack to be empty, got position %d", pos)
+	}
+	return result, suspended
+}
+
+func TestAsyncify(t *testing.T) {
+	t.Run("should unwind and rewind the stack at every call of the import", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "wait", ParamTypes: []types.WasmType{}, ResultTypes: []types.WasmType{types.I32}},
+		}
+		wasmSymbolTable := NewSymbolTable(&imports)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		// adds the result of the import to x, which is on the stack during the call
+		step := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrCallImport(&imports[0]).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+		// sums step(k) for k from n down to 1
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddInstrLoop(types.EmptyType).
+			AddInstrGetLocal(1).
+			AddInstrGetLocal(0).
+			AddInstrCall(&step).
+			AddInstrAddI32().
+			AddInstrSetLocal(1).
+			AddInstrGetLocal(0).
+			AddInstrConstI32(1).
+			AddInstrSubI32().
+			AddInstrLocalTee(0).
+			AddInstrBrIf(0).
+			AddInstrEnd().
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&step).
+			AddFunction(&main).
+			Export("memory", types.ExportMemoryType, memory).
+			Export("main", types.ExportFunctionType, &main)
+
+		result, suspended := runAsync(t, mod, 5)
+		// 5 + 4 + 3 + 2 + 1 and 10 for every call
+		if result != int32(65) || suspended != 5 {
+			t.Fatalf("expected 65 after 5 suspensions, got %v after %d", result, suspended)
+		}
+	})
+
+	t.Run("should rewind into the taken branch of an if", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "wait", ParamTypes: []types.WasmType{}, ResultTypes: []types.WasmType{types.I32}},
+		}
+		wasmSymbolTable := NewSymbolTable(&imports)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		// returns the result of the import from within the if, or 7
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrBlock(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrIf(types.I32).
+			AddInstrCallImport(&imports[0]).
+			AddInstrConstI32(1).
+			AddInstrBrIf(1).
+			AddInstrElse().
+			AddInstrConstI32(7).
+			AddInstrEnd().
+			AddInstrEnd().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("memory", types.ExportMemoryType, memory).
+			Export("main", types.ExportFunctionType, &main)
+
+		if result, suspended := runAsync(t, mod, 1); result != int32(10) || suspended != 1 {
+			t.Fatalf("expected 10 after a suspension, got %v after %d", result, suspended)
+		}
+		if result, suspended := runAsync(t, mod, 0); result != int32(7) || suspended != 0 {
+			t.Fatalf("expected 7 without suspensions, got %v after %d", result, suspended)
+		}
+	})
+
+	t.Run("should fail without memory to unwind into", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "wait", ParamTypes: []types.WasmType{}, ResultTypes: []types.WasmType{}},
+		}
+		wasmSymbolTable := NewSymbolTable(&imports)
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrCallImport(&imports[0]).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).AddFunction(&main)
+		mod.Build(WithAsyncify("env.wait"))
+		if err := mod.Err(); !errors.Is(err, ErrUnsupportedAsyncify) {
+			t.Fatalf("expected ErrUnsupportedAsyncify, got %v", err)
+		}
+	})
+
+	t.Run("should fail with a 64-bit memory to unwind into", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "wait", ParamTypes: []types.WasmType{}, ResultTypes: []types.WasmType{}},
+		}
+		wasmSymbolTable := NewSymbolTable(&imports)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1, Memory64: true})
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrCallImport(&imports[0]).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).AddFunction(&main)
+		mod.Build(WithAsyncify("env.wait"))
+		if err := mod.Err(); !errors.Is(err, ErrUnsupportedAsyncify) {
+			t.Fatalf("expected ErrUnsupportedAsyncify, got %v", err)
+		}
+	})
+}
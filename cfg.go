@@ -0,0 +1,454 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+type wasmTerminatorKind int
+
+const (
+	terminatorExit wasmTerminatorKind = iota
+	terminatorJump
+	terminatorBranch
+	terminatorSwitch
+	terminatorReturn
+	terminatorUnreachable
+)
+
+// WasmCFG is a control-flow graph of basic blocks, which AddCFG turns into structured
+// control instructions. Arbitrary graphs are supported: reducible graphs are emitted as
+// nested blocks and loops, and irreducible graphs as a loop that dispatches on a label local.
+type WasmCFG struct {
+	blocks []*WasmBasicBlock
+}
+
+// WasmBasicBlock is a straight-line sequence of instructions followed by a terminator that
+// transfers control to other blocks. The code must leave the stack as it found it. A block
+// without a terminator leaves the graph, and execution continues after the AddCFG call.
+type WasmBasicBlock struct {
+	cfg        *WasmCFG
+	code       func(b *WasmFunctionBuilder)
+	cond       I32Expr
+	value      WasmExpr
+	targets    []*WasmBasicBlock
+	terminator wasmTerminatorKind
+}
+
+func NewWasmCFG() *WasmCFG {
+	return &WasmCFG{blocks: []*WasmBasicBlock{}}
+}
+
+// Adds a basic block whose instructions are emitted by the given function. The code may be
+// nil for blocks that only branch.
+func (c *WasmCFG) AddBlock(code func(b *WasmFunctionBuilder)) *WasmBasicBlock {
+	block := &WasmBasicBlock{cfg: c, code: code}
+	c.blocks = append(c.blocks, block)
+	return block
+}
+
+// Continues with the target block.
+func (bb *WasmBasicBlock) Jump(target *WasmBasicBlock) {
+	bb.terminator = terminatorJump
+	bb.targets = []*WasmBasicBlock{target}
+}
+
+// Continues with then if the condition is not zero, and with otherwise if it is.
+func (bb *WasmBasicBlock) Branch(cond I32Expr, then *WasmBasicBlock, otherwise *WasmBasicBlock) {
+	bb.terminator = terminatorBranch
+	bb.cond = cond
+	bb.targets = []*WasmBasicBlock{then, otherwise}
+}
+
+// Continues with the case at the position given by the selector, or with the default block if
+// the selector is out of range.
+func (bb *WasmBasicBlock) Switch(selector I32Expr, cases []*WasmBasicBlock, defaultCase *WasmBasicBlock) {
+	bb.terminator = terminatorSwitch
+	bb.cond = selector
+	bb.targets = append(slices.Clone(cases), defaultCase)
+}
+
+// Returns from the function with the value of the expression, which may be nil for
+// functions without results.
+func (bb *WasmBasicBlock) Return(value WasmExpr) {
+	bb.terminator = terminatorReturn
+	bb.value = value
+	bb.targets = nil
+}
+
+// Traps when control reaches the end of the block.
+func (bb *WasmBasicBlock) Unreachable() {
+	bb.terminator = terminatorUnreachable
+	bb.targets = nil
+}
+
+// The kinds of structured instructions the relooper opens, which determine where a branch
+// to a basic block goes.
+type wasmCFGScopeKind int
+
+const (
+	scopeExit wasmCFGScopeKind = iota
+	scopeBlockFollowedBy
+	scopeLoopHeadedBy
+	scopeDispatch
+	scopeOther
+)
+
+type wasmCFGScope struct {
+	kind   wasmCFGScopeKind
+	target int
+}
+
+// Translates a graph into structured control flow, following "Beyond Relooper" by Norman
+// Ramsey: blocks are visited along the dominator tree, loop headers open a loop and blocks
+// with several forward predecessors are placed right after a block that forward branches
+// leave. Irreducible graphs fall back to a dispatch loop.
+type wasmRelooper struct {
+	b          *WasmFunctionBuilder
+	order      []*WasmBasicBlock
+	number     map[*WasmBasicBlock]int
+	preds      [][]int
+	idom       []int
+	children   [][]int
+	loopHeader []bool
+	merge      []bool
+	scopes     []wasmCFGScope
+	label      WasmLocal
+	dispatch   bool
+	exits      bool
+}
+
+// Emits the graph, starting at the entry block, as structured control instructions. Blocks
+// that cannot be reached from the entry are not emitted. If no block leaves the graph, the
+// code is followed by unreachable, so that the function can end right after it.
+func (b *WasmFunctionBuilder) AddCFG(cfg *WasmCFG, entry *WasmBasicBlock) *WasmFunctionBuilder {
+	if entry == nil || entry.cfg != cfg {
+		b.fail(fmt.Errorf("%w: entry block does not belong to the graph", ErrInvalidCFG))
+		return b
+	}
+
+	r := &wasmRelooper{b: b, number: map[*WasmBasicBlock]int{}}
+	if err := r.computeOrder(entry); err != nil {
+		b.fail(err)
+		return b
+	}
+	r.analyze()
+
+	r.dispatch = !r.reducible()
+	if r.dispatch {
+		r.label = b.NewLocal(types.I32)
+		b.AddExprSetLocalHandle(r.label, I32(0))
+	}
+
+	b.AddInstrBlock(types.EmptyType)
+	r.scopes = []wasmCFGScope{{kind: scopeExit}}
+	if r.dispatch {
+		r.emitDispatch()
+	} else {
+		r.emitTree(0)
+	}
+	b.AddInstrEnd()
+
+	if !r.exits {
+		b.AddInstrUnreachable()
+	}
+	return b
+}
+
+// Numbers the blocks reachable from the entry in reverse postorder.
+func (r *wasmRelooper) computeOrder(entry *WasmBasicBlock) error {
+	visited := map[*WasmBasicBlock]bool{}
+	postorder := []*WasmBasicBlock{}
+
+	var visit func(block *WasmBasicBlock) error
+	visit = func(block *WasmBasicBlock) error {
+		visited[block] = true
+		for _, target := range block.targets {
+			if target == nil || target.cfg != entry.cfg {
+				return fmt.Errorf("%w: branch target does not belong to the graph", ErrInvalidCFG)
+			}
+			if !visited[target] {
+				if err := visit(target); err != nil {
+					return err
+				}
+			}
+		}
+		postorder = append(postorder, block)
+		return nil
+	}
+	if err := visit(entry); err != nil {
+		return err
+	}
+
+	slices.Reverse(postorder)
+	r.order = postorder
+	for i, block := range r.order {
+		r.number[block] = i
+	}
+	return nil
+}
+
+// Computes the immediate dominator of every node of a graph whose nodes are numbered in
+// reverse postorder from the entry node 0, using the iterative algorithm of Cooper, Harvey
+// and Kennedy. The entry node is its own immediate dominator.
+func dominators(preds [][]int) []int {
+	idom := make([]int, len(preds))
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[0] = 0
+
+	intersect := func(a, b int) int {
+		for a != b {
+			for a > b {
+				a = idom[a]
+			}
+			for b > a {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := 1; i < len(preds); i++ {
+			dom := -1
+			for _, p := range preds[i] {
+				if idom[p] == -1 {
+					continue
+				}
+				if dom == -1 {
+					dom = p
+				} else {
+					dom = intersect(p, dom)
+				}
+			}
+			if dom != idom[i] {
+				idom[i] = dom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+// Returns whether node a dominates node b.
+func dominates(idom []int, a, b int) bool {
+	for b != a && b != 0 {
+		b = idom[b]
+	}
+	return a == b
+}
+
+// Computes predecessors, the dominator tree, loop headers and merge nodes.
+func (r *wasmRelooper) analyze() {
+	n := len(r.order)
+	r.preds = make([][]int, n)
+	r.loopHeader = make([]bool, n)
+	r.merge = make([]bool, n)
+	r.children = make([][]int, n)
+
+	forward := make([]int, n)
+	for i, block := range r.order {
+		for _, target := range block.targets {
+			t := r.number[target]
+			if slices.Contains(r.preds[t], i) {
+				continue
+			}
+			r.preds[t] = append(r.preds[t], i)
+			if t <= i {
+				r.loopHeader[t] = true
+			} else {
+				forward[t]++
+			}
+		}
+	}
+
+	r.idom = dominators(r.preds)
+
+	for i := 1; i < n; i++ {
+		r.children[r.idom[i]] = append(r.children[r.idom[i]], i)
+		r.merge[i] = forward[i] > 1
+	}
+}
+
+// A graph is reducible if the target of every retreating edge dominates its source, which
+// means that every loop has a single entry.
+func (r *wasmRelooper) reducible() bool {
+	for t, preds := range r.preds {
+		for _, p := range preds {
+			if t <= p && !dominates(r.idom, t, p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *wasmRelooper) push(kind wasmCFGScopeKind, target int) {
+	r.scopes = append(r.scopes, wasmCFGScope{kind: kind, target: target})
+}
+
+func (r *wasmRelooper) pop() {
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// Returns the relative depth of the innermost scope of the given kind and target.
+func (r *wasmRelooper) depth(kind wasmCFGScopeKind, target int) uint64 {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if r.scopes[i].kind == kind && (kind == scopeExit || kind == scopeDispatch || r.scopes[i].target == target) {
+			return uint64(len(r.scopes) - 1 - i)
+		}
+	}
+	r.b.fail(fmt.Errorf("%w: no scope for a branch to block %d", ErrInvalidCFG, target))
+	return 0
+}
+
+func (r *wasmRelooper) emitTree(x int) {
+	// Merge nodes among the children are placed after blocks around the code of x, the
+	// one with the highest number outermost.
+	merges := []int{}
+	for _, child := range r.children[x] {
+		if r.merge[child] {
+			merges = append(merges, child)
+		}
+	}
+	slices.Sort(merges)
+	slices.Reverse(merges)
+
+	if r.loopHeader[x] {
+		r.b.AddInstrLoop(types.EmptyType)
+		r.push(scopeLoopHeadedBy, x)
+		r.emitWithin(x, merges)
+		r.pop()
+		r.b.AddInstrEnd()
+		return
+	}
+	r.emitWithin(x, merges)
+}
+
+func (r *wasmRelooper) emitWithin(x int, merges []int) {
+	if len(merges) == 0 {
+		r.emitBlock(x)
+		return
+	}
+
+	r.b.AddInstrBlock(types.EmptyType)
+	r.push(scopeBlockFollowedBy, merges[0])
+	r.emitWithin(x, merges[1:])
+	r.pop()
+	r.b.AddInstrEnd()
+	r.emitTree(merges[0])
+}
+
+// Emits the code and the terminator of a block. Every terminator ends with a branch, return
+// or trap, so control never falls out of the structure emitted for a block.
+func (r *wasmRelooper) emitBlock(x int) {
+	block := r.order[x]
+	if block.code != nil {
+		block.code(r.b)
+	}
+
+	switch block.terminator {
+	case terminatorExit:
+		r.exits = true
+		r.b.AddInstrBr(r.depth(scopeExit, 0))
+	case terminatorJump:
+		r.emitBranch(x, block.targets[0])
+	case terminatorBranch:
+		r.b.AddExpr(block.cond)
+		r.b.AddInstrIf(types.EmptyType)
+		r.push(scopeOther, 0)
+		r.emitBranch(x, block.targets[0])
+		r.b.AddInstrElse()
+		r.emitBranch(x, block.targets[1])
+		r.pop()
+		r.b.AddInstrEnd()
+	case terminatorSwitch:
+		r.emitSwitch(x, block.cond, block.targets)
+	case terminatorReturn:
+		if block.value != nil {
+			r.b.AddExpr(block.value)
+		}
+		r.b.AddInstrReturn()
+	case terminatorUnreachable:
+		r.b.AddInstrUnreachable()
+	}
+}
+
+// Emits a br_table into one block per distinct target. Leaving the i-th innermost block
+// continues with the branch to the i-th target.
+func (r *wasmRelooper) emitSwitch(x int, selector I32Expr, targets []*WasmBasicBlock) {
+	distinct := []*WasmBasicBlock{}
+	for _, target := range targets {
+		if !slices.Contains(distinct, target) {
+			distinct = append(distinct, target)
+		}
+	}
+
+	for range distinct {
+		r.b.AddInstrBlock(types.EmptyType)
+		r.push(scopeOther, 0)
+	}
+
+	labels := []uint64{}
+	for _, target := range targets {
+		labels = append(labels, uint64(slices.Index(distinct, target)))
+	}
+	r.b.AddExpr(selector)
+	r.b.AddInstrBrTable(labels[:len(labels)-1], labels[len(labels)-1])
+
+	for _, target := range distinct {
+		r.pop()
+		r.b.AddInstrEnd()
+		r.emitBranch(x, target)
+	}
+}
+
+func (r *wasmRelooper) emitBranch(from int, to *WasmBasicBlock) {
+	target := r.number[to]
+
+	switch {
+	case r.dispatch:
+		r.b.AddExprSetLocalHandle(r.label, I32(int32(target)))
+		r.b.AddInstrBr(r.depth(scopeDispatch, 0))
+	case target <= from:
+		r.b.AddInstrBr(r.depth(scopeLoopHeadedBy, target))
+	case r.merge[target]:
+		r.b.AddInstrBr(r.depth(scopeBlockFollowedBy, target))
+	default:
+		// The target has no other forward predecessor, so it is placed inline.
+		r.emitTree(target)
+	}
+}
+
+// Emits every block inside a loop that selects the next block by the label local, which
+// handles graphs with loops that can be entered at several blocks.
+func (r *wasmRelooper) emitDispatch() {
+	r.b.AddInstrLoop(types.EmptyType)
+	r.push(scopeDispatch, 0)
+
+	for range r.order {
+		r.b.AddInstrBlock(types.EmptyType)
+		r.push(scopeOther, 0)
+	}
+
+	labels := []uint64{}
+	for i := range r.order {
+		labels = append(labels, uint64(i))
+	}
+	r.b.AddExpr(LocalExpr[I32Expr](r.label))
+	r.b.AddInstrBrTable(labels[:len(labels)-1], labels[len(labels)-1])
+
+	for i := range r.order {
+		r.pop()
+		r.b.AddInstrEnd()
+		r.emitBlock(i)
+	}
+
+	r.pop()
+	r.b.AddInstrEnd()
+}
@@ -0,0 +1,199 @@
+package gowasmtk
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// A randomly generated graph, described independently of WasmCFG so that it can be both
+// emitted and interpreted.
+type randomCFGBlock struct {
+	terminator wasmTerminatorKind
+	mask       int32
+	targets    []int
+}
+
+func randomCFG(rng *rand.Rand, n int) []randomCFGBlock {
+	blocks := make([]randomCFGBlock, n)
+	for i := range blocks {
+		target := func() int { return rng.Intn(n) }
+		switch kind := rng.Intn(10); {
+		case kind < 3:
+			blocks[i] = randomCFGBlock{terminator: terminatorJump, targets: []int{target()}}
+		case kind < 7:
+			blocks[i] = randomCFGBlock{terminator: terminatorBranch, mask: 1 << rng.Intn(8), targets: []int{target(), target()}}
+		case kind < 9:
+			cases := []int{target(), target(), target(), target()}
+			blocks[i] = randomCFGBlock{terminator: terminatorSwitch, targets: cases}
+		default:
+			blocks[i] = randomCFGBlock{terminator: []wasmTerminatorKind{terminatorExit, terminatorReturn}[rng.Intn(2)]}
+		}
+	}
+	return blocks
+}
+
+// Interprets the graph like the emitted code: every block mixes its index into the state and
+// spends one unit of fuel, and running out of fuel returns the state.
+func interpretCFG(blocks []randomCFGBlock, fuel int32) int32 {
+	state, current := int32(7), 0
+	for {
+		state = state*31 + int32(current)
+		fuel--
+		if fuel <= 0 {
+			return state
+		}
+
+		block := blocks[current]
+		switch block.terminator {
+		case terminatorJump:
+			current = block.targets[0]
+		case terminatorBranch:
+			if state&block.mask != 0 {
+				current = block.targets[0]
+			} else {
+				current = block.targets[1]
+			}
+		case terminatorSwitch:
+			selector := state & 7
+			if selector < 3 {
+				current = block.targets[selector]
+			} else {
+				current = block.targets[3]
+			}
+		case terminatorExit:
+			return state + 1
+		case terminatorReturn:
+			return state
+		}
+	}
+}
+
+func buildRandomCFG(blocks []randomCFGBlock, fuel int32) *WasmModuleBuilder {
+	wasmSymbolTable := NewSymbolTable(nil)
+	builder := NewWasmFunctionBuilder(wasmSymbolTable).AddReturn(types.I32)
+	stateLocal := builder.NewLocal(types.I32)
+	fuelLocal := builder.NewLocal(types.I32)
+	state, remaining := LocalExpr[I32Expr](stateLocal), LocalExpr[I32Expr](fuelLocal)
+
+	cfg := NewWasmCFG()
+	wasmBlocks := make([]*WasmBasicBlock, len(blocks))
+	for i := range blocks {
+		index := int32(i)
+		wasmBlocks[i] = cfg.AddBlock(func(b *WasmFunctionBuilder) {
+			b.AddExprSetLocalHandle(stateLocal, state.Mul(I32(31)).Add(I32(index))).
+				AddExprSetLocalHandle(fuelLocal, remaining.Sub(I32(1))).
+				AddIfElse(remaining.LeS(I32(0)), func(b *WasmFunctionBuilder) {
+					b.AddExprReturn(state)
+				}, nil)
+		})
+	}
+
+	for i, block := range blocks {
+		targets := []*WasmBasicBlock{}
+		for _, target := range block.targets {
+			targets = append(targets, wasmBlocks[target])
+		}
+
+		switch block.terminator {
+		case terminatorJump:
+			wasmBlocks[i].Jump(targets[0])
+		case terminatorBranch:
+			wasmBlocks[i].Branch(state.And(I32(block.mask)).Ne(I32(0)), targets[0], targets[1])
+		case terminatorSwitch:
+			wasmBlocks[i].Switch(state.And(I32(7)), targets[:3], targets[3])
+		case terminatorReturn:
+			wasmBlocks[i].Return(state)
+		}
+	}
+
+	main := builder.
+		AddExprSetLocalHandle(stateLocal, I32(7)).
+		AddExprSetLocalHandle(fuelLocal, I32(fuel)).
+		AddCFG(cfg, wasmBlocks[0]).
+		AddExpr(state.Add(I32(1))).
+		AddInstrEnd().
+		Build()
+
+	return NewWasmModuleBuilder(wasmSymbolTable).
+		AddFunction(&main).
+		Export("main", types.ExportFunctionType, &main)
+}
+
+func TestCFG(t *testing.T) {
+	t.Run("should emit random graphs that behave like the graph", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		engine := wasmer.NewEngine()
+
+		for i := 0; i < 300; i++ {
+			blocks := randomCFG(rng, 1+rng.Intn(12))
+			fuel := int32(1 + rng.Intn(60))
+
+			mod := buildRandomCFG(blocks, fuel)
+			if err := mod.Err(); err != nil {
+				t.Fatalf("graph %d: unexpected error: %v", i, err)
+			}
+
+			store := wasmer.NewStore(engine)
+			module, err := wasmer.NewModule(store, mod.Build())
+			if err != nil {
+				t.Fatalf("graph %d: %v: %+v", i, err, blocks)
+			}
+			instance, err := wasmer.NewInstance(module, wasmer.NewImportObject())
+			if err != nil {
+				t.Fatalf("graph %d: %v", i, err)
+			}
+			main, err := instance.Exports.GetFunction("main")
+			if err != nil {
+				t.Fatalf("graph %d: %v", i, err)
+			}
+			result, err := main()
+			if err != nil {
+				t.Fatalf("graph %d: %v", i, err)
+			}
+
+			if expected := interpretCFG(blocks, fuel); result != expected {
+				t.Fatalf("graph %d: expected %d, got %d: %+v", i, expected, result, blocks)
+			}
+		}
+	})
+
+	t.Run("should use a dispatch loop only for irreducible graphs", func(t *testing.T) {
+		build := func(irreducible bool) *WasmFunctionBuilder {
+			builder := NewWasmFunctionBuilder(NewSymbolTable(nil)).AddParam(types.I32)
+			cfg := NewWasmCFG()
+			entry, a, b := cfg.AddBlock(nil), cfg.AddBlock(nil), cfg.AddBlock(nil)
+
+			entry.Branch(LocalI32(0), a, b)
+			a.Branch(LocalI32(0), b, cfg.AddBlock(nil))
+			if irreducible {
+				// the loop between a and b can be entered at both blocks
+				b.Jump(a)
+			} else {
+				b.Return(nil)
+			}
+			return builder.AddCFG(cfg, entry)
+		}
+
+		if reducible := build(false); len(reducible.locals) != 0 || reducible.Err() != nil {
+			t.Fatalf("expected no label local, got %d local declarations and %v", len(reducible.locals), reducible.Err())
+		}
+		if irreducible := build(true); len(irreducible.locals) != 1 || irreducible.Err() != nil {
+			t.Fatalf("expected a label local, got %d local declarations and %v", len(irreducible.locals), irreducible.Err())
+		}
+	})
+
+	t.Run("should reject branches to blocks of another graph", func(t *testing.T) {
+		cfg, other := NewWasmCFG(), NewWasmCFG()
+		entry := cfg.AddBlock(nil)
+		entry.Jump(other.AddBlock(nil))
+
+		builder := NewWasmFunctionBuilder(NewSymbolTable(nil)).AddCFG(cfg, entry)
+		if err := builder.Err(); !errors.Is(err, ErrInvalidCFG) {
+			t.Fatalf("expected %v, got %v", ErrInvalidCFG, err)
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package gowasmtk
+
+import (
+	"math/bits"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+)
+
+// Merges locals of the same type whose values are never needed at the same time, so that
+// functions that use a new local for every temporary value need only a few locals. Locals
+// that are never used are removed, and the remaining locals are declared grouped by type.
+func WithLocalCoalescing() WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		CoalesceLocals(m)
+		return nil
+	}
+}
+
+// Applies the local coalescing of WithLocalCoalescing to the module.
+func CoalesceLocals(m *WasmDecodedModule) {
+	for i := range m.Code {
+		coalesceLocals(&m.Code[i], m.typeAt(m.Functions[i]).Params)
+	}
+}
+
+// A set of locals, with one bit per local index.
+type wasmLocalSet []uint64
+
+func newLocalSet(n int) wasmLocalSet {
+	return make(wasmLocalSet, (n+63)/64)
+}
+
+func (s wasmLocalSet) has(i uint32) bool {
+	return s[i/64]&(1<<(i%64)) != 0
+}
+
+func (s wasmLocalSet) add(i uint32) {
+	s[i/64] |= 1 << (i % 64)
+}
+
+func (s wasmLocalSet) remove(i uint32) {
+	s[i/64] &^= 1 << (i % 64)
+}
+
+func (s wasmLocalSet) union(other wasmLocalSet) {
+	for w := range s {
+		s[w] |= other[w]
+	}
+}
+
+// Calls fn for every local in the set.
+func (s wasmLocalSet) each(fn func(i uint32)) {
+	for w, word := range s {
+		for word != 0 {
+			fn(uint32(w*64 + bits.TrailingZeros64(word)))
+			word &= word - 1
+		}
+	}
+}
+
+// Returns the local that the instruction reads or writes, and whether it writes it.
+func localAccess(instr WasmInstr) (local uint32, write bool, ok bool) {
+	switch instr.Opcode {
+	case WasmOpcode(instructions.GetLocal):
+		return uint32(instr.Immediates[0]), false, true
+	case WasmOpcode(instructions.SetLocal), WasmOpcode(instructions.TeeLocal):
+		return uint32(instr.Immediates[0]), true, true
+	}
+	return 0, false, false
+}
+
+// Returns for every instruction of the body the instructions that can be executed after it.
+// Branches to a block continue at its end and branches to a loop at the loop itself. An
+// instruction in a try block can continue at any of the handlers of the enclosing try blocks,
+// since it may throw. Leaving the function has no successor.
+func controlFlow(body []WasmInstr) [][]int {
+	ends := map[int]int{}
+	elses := map[int]int{}
+	catches := map[int][]int{}
+	open := []int{}
+	for i, instr := range body {
+		switch {
+		case instr.Opcode.opensBlock():
+			open = append(open, i)
+		case len(open) == 0:
+		case instr.Opcode == WasmOpcode(instructions.Else):
+			elses[open[len(open)-1]] = i
+		case instr.Opcode == 0x07, instr.Opcode == 0x19: // catch, catch_all
+			catches[open[len(open)-1]] = append(catches[open[len(open)-1]], i)
+		case instr.Opcode == WasmOpcode(instructions.End), instr.Opcode == 0x18: // delegate
+			ends[open[len(open)-1]] = i
+			open = open[:len(open)-1]
+		}
+	}
+
+	type frame struct {
+		start    int
+		handlers []int
+		// whether the instructions are in a catch of a try block, where its handlers do not apply
+		inHandler bool
+	}
+	frames := []frame{}
+	target := func(depth uint64) []int {
+		if depth >= uint64(len(frames)) {
+			return nil
+		}
+		f := frames[len(frames)-1-int(depth)]
+		if body[f.start].Opcode == WasmOpcode(instructions.Loop) {
+			return []int{f.start}
+		}
+		return []int{ends[f.start]}
+	}
+
+	successors := make([][]int, len(body))
+	for i, instr := range body {
+		next := []int{}
+		for _, f := range frames {
+			if !f.inHandler {
+				next = append(next, f.handlers...)
+			}
+		}
+
+		switch instr.Opcode {
+		case WasmOpcode(instructions.Unreachable), WasmOpcode(instructions.Throw), WasmOpcode(instructions.ThrowRef),
+			0x09, // rethrow
+			WasmOpcode(instructions.Return), WasmOpcode(instructions.ReturnCall),
+			WasmOpcode(instructions.ReturnCallIndirect), WasmOpcode(instructions.ReturnCallRef):
+		case WasmOpcode(instructions.Br), WasmOpcode(instructions.BrTable):
+			instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+				if kind == immLabel {
+					next = append(next, target(*value)...)
+				}
+			})
+		case WasmOpcode(instructions.If):
+			next = append(next, i+1)
+			if e, ok := elses[i]; ok {
+				next = append(next, e+1)
+			} else {
+				next = append(next, ends[i])
+			}
+		case WasmOpcode(instructions.Else), 0x07, 0x19:
+			// reached at the end of the previous branch or handler
+			next = append(next, ends[frames[len(frames)-1].start])
+			frames[len(frames)-1].inHandler = instr.Opcode != WasmOpcode(instructions.Else)
+		case WasmOpcode(instructions.TryTable), 0x18, 0x06:
+			next = append(next, i+1)
+		default:
+			if i+1 < len(body) {
+				next = append(next, i+1)
+			}
+			instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+				if kind == immLabel {
+					next = append(next, target(*value)...)
+				}
+			})
+		}
+		successors[i] = next
+
+		switch {
+		case instr.Opcode == WasmOpcode(instructions.TryTable):
+			handlers := []int{}
+			instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+				// the labels of catch clauses are relative to the block around the try_table
+				if kind == immLabel {
+					handlers = append(handlers, target(*value)...)
+				}
+			})
+			frames = append(frames, frame{start: i, handlers: handlers})
+		case instr.Opcode == 0x06: // try
+			handlers := []int{}
+			for _, c := range catches[i] {
+				handlers = append(handlers, c+1)
+			}
+			frames = append(frames, frame{start: i, handlers: handlers})
+		case instr.Opcode.opensBlock():
+			frames = append(frames, frame{start: i})
+		case len(frames) > 0 && (instr.Opcode == WasmOpcode(instructions.End) || instr.Opcode == 0x18):
+			frames = frames[:len(frames)-1]
+		}
+	}
+	return successors
+}
+
+// Merges the locals of the code whose values are never live at the same time. A local is live
+// where its value can still be read before it is written again. Parameters keep their
+// indices, and locals that are read before they are written, which read their default value,
+// are not merged with locals that are live at the start of the function.
+func coalesceLocals(c *WasmDecodedCode, params []WasmDecodedValType) {
+	localTypes := append([]WasmDecodedValType{}, params...)
+	for _, l := range c.Locals {
+		for k := uint32(0); k < l.Count; k++ {
+			localTypes = append(localTypes, l.Type)
+		}
+	}
+	n := len(localTypes)
+
+	used := newLocalSet(n)
+	for _, instr := range c.Body {
+		if local, _, ok := localAccess(instr); ok {
+			used.add(local)
+		}
+	}
+
+	successors := controlFlow(c.Body)
+	liveIn := make([]wasmLocalSet, len(c.Body))
+	for i := range liveIn {
+		liveIn[i] = newLocalSet(n)
+	}
+	liveOut := func(i int) wasmLocalSet {
+		live := newLocalSet(n)
+		for _, s := range successors[i] {
+			live.union(liveIn[s])
+		}
+		return live
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(c.Body) - 1; i >= 0; i-- {
+			live := liveOut(i)
+			if local, write, ok := localAccess(c.Body[i]); ok && write {
+				live.remove(local)
+			} else if ok {
+				live.add(local)
+			}
+			if !slices.Equal(live, liveIn[i]) {
+				liveIn[i] = live
+				changed = true
+			}
+		}
+	}
+
+	interferes := make([]wasmLocalSet, n)
+	for i := range interferes {
+		interferes[i] = newLocalSet(n)
+	}
+	interfere := func(a uint32, live wasmLocalSet) {
+		live.each(func(b uint32) {
+			if a != b && localTypes[a] == localTypes[b] {
+				interferes[a].add(b)
+				interferes[b].add(a)
+			}
+		})
+	}
+	for i, instr := range c.Body {
+		if local, write, ok := localAccess(instr); ok && write {
+			interfere(local, liveOut(i))
+		}
+	}
+	// the parameters and the locals that are read before they are written are all set when
+	// the function is called
+	entry := newLocalSet(n)
+	if len(c.Body) > 0 {
+		entry.union(liveIn[0])
+	}
+	for p := range params {
+		entry.add(uint32(p))
+	}
+	entry.each(func(local uint32) { interfere(local, entry) })
+
+	type slot struct {
+		t         WasmDecodedValType
+		neighbors wasmLocalSet
+	}
+	slots := []slot{}
+	slotOf := make([]int, n)
+	for local := 0; local < n; local++ {
+		if local >= len(params) && !used.has(uint32(local)) {
+			continue
+		}
+		s := len(slots)
+		for k := 0; k < len(slots) && local >= len(params); k++ {
+			if slots[k].t == localTypes[local] && !slots[k].neighbors.has(uint32(local)) {
+				s = k
+				break
+			}
+		}
+		if s == len(slots) {
+			slots = append(slots, slot{t: localTypes[local], neighbors: newLocalSet(n)})
+		}
+		slots[s].neighbors.union(interferes[local])
+		slotOf[local] = s
+	}
+
+	// the new locals are declared grouped by type, in the order their types first appear
+	indices := make([]uint32, len(slots))
+	for p := range params {
+		indices[p] = uint32(p)
+	}
+	declared := make([]bool, len(slots))
+	locals := []WasmDecodedLocals{}
+	next := uint32(len(params))
+	for s := len(params); s < len(slots); s++ {
+		if declared[s] {
+			continue
+		}
+		decl := WasmDecodedLocals{Type: slots[s].t}
+		for k := s; k < len(slots); k++ {
+			if !declared[k] && slots[k].t == decl.Type {
+				declared[k] = true
+				indices[k] = next
+				next++
+				decl.Count++
+			}
+		}
+		locals = append(locals, decl)
+	}
+
+	for i, instr := range c.Body {
+		if local, _, ok := localAccess(instr); ok {
+			c.Body[i].Immediates[0] = uint64(indices[slotOf[local]])
+		}
+	}
+	c.Locals = locals
+}
@@ -0,0 +1,114 @@
+package gowasmtk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestLocalCoalescing(t *testing.T) {
+	i32 := WasmDecodedValType{Code: types.I32, Heap: noHeapType}
+	f64 := WasmDecodedValType{Code: types.F64, Heap: noHeapType}
+
+	t.Run("should merge locals that are not live at the same time", func(t *testing.T) {
+		code := WasmDecodedCode{
+			Locals: []WasmDecodedLocals{{Count: 3, Type: i32}, {Count: 1, Type: f64}},
+			Body: []WasmInstr{
+				ins(instructions.GetLocal, 0), ins(instructions.SetLocal, 1),
+				ins(instructions.GetLocal, 1), ins(instructions.SetLocal, 2),
+				ins(instructions.GetLocal, 2), ins(instructions.SetLocal, 3),
+				ins(instructions.GetLocal, 3),
+				ins(instructions.End),
+			},
+		}
+		coalesceLocals(&code, []WasmDecodedValType{i32})
+
+		// every temporary reuses the parameter, and the unused f64 local is removed
+		expected := WasmDecodedCode{
+			Locals: []WasmDecodedLocals{},
+			Body: []WasmInstr{
+				ins(instructions.GetLocal, 0), ins(instructions.SetLocal, 0),
+				ins(instructions.GetLocal, 0), ins(instructions.SetLocal, 0),
+				ins(instructions.GetLocal, 0), ins(instructions.SetLocal, 0),
+				ins(instructions.GetLocal, 0),
+				ins(instructions.End),
+			},
+		}
+		if !reflect.DeepEqual(code, expected) {
+			t.Fatalf("expected %v, got %v", expected, code)
+		}
+	})
+
+	t.Run("should not merge locals that are read before they are written", func(t *testing.T) {
+		body := []WasmInstr{
+			constI32(5), ins(instructions.SetLocal, 0),
+			ins(instructions.GetLocal, 0), ins(instructions.Drop),
+			// local 2 is still zero here
+			ins(instructions.GetLocal, 2),
+			ins(instructions.End),
+		}
+		code := WasmDecodedCode{
+			Locals: []WasmDecodedLocals{{Count: 1, Type: i32}, {Count: 1, Type: f64}, {Count: 1, Type: i32}},
+			Body:   body,
+		}
+		coalesceLocals(&code, nil)
+
+		expected := []WasmDecodedLocals{{Count: 2, Type: i32}}
+		if !reflect.DeepEqual(code.Locals, expected) {
+			t.Fatalf("expected locals %v, got %v", expected, code.Locals)
+		}
+		if code.Body[1].Immediates[0] == code.Body[4].Immediates[0] {
+			t.Fatalf("expected two different locals, got %v", code.Body)
+		}
+	})
+
+	t.Run("should keep values that are live around loops", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		// sums n + (n-1) + ... + 1 with a new local for every temporary value
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddLocal(2, types.F64).
+			AddLocal(4, types.I32).
+			AddInstrLoop(types.EmptyType).
+			AddExprSetLocal(4, LocalI32(1).Add(LocalI32(0))).
+			AddExprSetLocal(1, LocalI32(4)).
+			AddExprSetLocal(5, LocalI32(0).Sub(I32(1))).
+			AddExprSetLocal(0, LocalI32(5)).
+			AddExprSetLocal(6, LocalI32(0).GtS(I32(0))).
+			AddInstrGetLocal(6).
+			AddInstrBrIf(0).
+			AddInstrEnd().
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		m, err := DecodeModule(mod.Build(WithLocalCoalescing()))
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		// the temporaries share the locals of the sum and the counter, except for the condition
+		expected := []WasmDecodedLocals{{Count: 2, Type: i32}}
+		if !reflect.DeepEqual(m.Code[0].Locals, expected) {
+			t.Fatalf("expected locals %v, got %v", expected, m.Code[0].Locals)
+		}
+
+		checkRoundTrip(t, mod.Build(WithLocalCoalescing()))
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{10},
+			expected:   int32(55),
+			options:    []WasmBuildOption{WithLocalCoalescing()},
+		})
+	})
+}
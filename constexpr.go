@@ -0,0 +1,139 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmConstExpr is a constant expression, used to initialize globals and to compute the
+// offsets of data and element segments. Besides constants, it may read immutable globals and
+// combine integers with add, sub and mul, such as the base address of a relocatable module
+// plus an offset. The expression must produce exactly one value.
+type WasmConstExpr struct {
+	instructions []byte
+	stack        []WasmValueType
+	globals      []*WasmGlobal
+	err          error
+	features     WasmFeatures
+}
+
+func NewWasmConstExpr() *WasmConstExpr {
+	return &WasmConstExpr{
+		instructions: []byte{},
+		stack:        []WasmValueType{},
+	}
+}
+
+// Returns the first error that occurred while building the expression, or nil.
+func (e *WasmConstExpr) Err() error {
+	return e.err
+}
+
+func (e *WasmConstExpr) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *WasmConstExpr) AddInstrConstI32(value int32) *WasmConstExpr {
+	e.instructions = append(e.instructions, instructions.ConstI32)
+	e.instructions = append(e.instructions, leb128EncodeI(int64(value))...)
+	e.stack = append(e.stack, ValType(types.I32))
+	return e
+}
+
+func (e *WasmConstExpr) AddInstrConstI64(value int64) *WasmConstExpr {
+	e.instructions = append(e.instructions, instructions.ConstI64)
+	e.instructions = append(e.instructions, leb128EncodeI(value)...)
+	e.stack = append(e.stack, ValType(types.I64))
+	return e
+}
+
+// Reads the value of an immutable global. The global must be declared on the symbol table
+// the expression is used with.
+func (e *WasmConstExpr) AddInstrGlobalGet(global *WasmGlobal) *WasmConstExpr {
+	if global.Mutable {
+		e.fail(fmt.Errorf("%w: constant expressions cannot read mutable globals", ErrInvalidConstExpr))
+		return e
+	}
+
+	e.instructions = append(e.instructions, instructions.GlobalGet)
+	e.instructions = append(e.instructions, leb128EncodeU(uint64(global.index))...)
+	e.stack = append(e.stack, global.Type)
+	e.globals = append(e.globals, global)
+	return e
+}
+
+func (e *WasmConstExpr) AddInstrAddI32() *WasmConstExpr {
+	return e.addInstrBinary(instructions.AddI32, types.I32)
+}
+
+func (e *WasmConstExpr) AddInstrSubI32() *WasmConstExpr {
+	return e.addInstrBinary(instructions.SubI32, types.I32)
+}
+
+func (e *WasmConstExpr) AddInstrMulI32() *WasmConstExpr {
+	return e.addInstrBinary(instructions.MulI32, types.I32)
+}
+
+func (e *WasmConstExpr) AddInstrAddI64() *WasmConstExpr {
+	return e.addInstrBinary(instructions.AddI64, types.I64)
+}
+
+func (e *WasmConstExpr) AddInstrSubI64() *WasmConstExpr {
+	return e.addInstrBinary(instructions.SubI64, types.I64)
+}
+
+func (e *WasmConstExpr) AddInstrMulI64() *WasmConstExpr {
+	return e.addInstrBinary(instructions.MulI64, types.I64)
+}
+
+func (e *WasmConstExpr) addInstrBinary(op instructions.WasmInstruction, operandType types.WasmType) *WasmConstExpr {
+	operand := ValType(operandType)
+	height := len(e.stack)
+	if height < 2 || e.stack[height-1] != operand || e.stack[height-2] != operand {
+		e.fail(fmt.Errorf("%w: instruction 0x%02X expects two %v operands, got %v", ErrInvalidConstExpr, op, operand, e.stack))
+		return e
+	}
+
+	e.instructions = append(e.instructions, op)
+	e.stack = e.stack[:height-1]
+	e.features |= FeatureExtendedConst
+	return e
+}
+
+// Returns the features required by the expression. Reading globals defined by the module,
+// rather than imported ones, was introduced by the GC proposal.
+func (e *WasmConstExpr) requiredFeatures() WasmFeatures {
+	features := e.features
+	for _, global := range e.globals {
+		if !global.imported() {
+			features |= FeatureGC
+		}
+	}
+	return features
+}
+
+// Checks that the expression produces a single value of the expected type and only reads
+// globals of the symbol table whose index is below the limit.
+func (e *WasmConstExpr) validate(s *wasmSymbolTable, expected WasmValueType, globalLimit int) error {
+	if e.err != nil {
+		return e.err
+	}
+	if len(e.stack) != 1 || e.stack[0] != expected {
+		return fmt.Errorf("%w: expected a single %v value, got %v", ErrInvalidConstExpr, expected, e.stack)
+	}
+
+	for _, global := range e.globals {
+		if s.global(global.index) != global || global.index >= globalLimit {
+			return fmt.Errorf("%w: global %d cannot be read by this constant expression", ErrUnknownGlobal, global.index)
+		}
+	}
+	return nil
+}
+
+func (e *WasmConstExpr) encode() []byte {
+	return append(append([]byte{}, e.instructions...), instructions.End)
+}
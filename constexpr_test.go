@@ -0,0 +1,145 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestConstExpr(t *testing.T) {
+	t.Run("should read and write globals", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		step := wasmSymbolTable.AddGlobal(ValType(types.I32), false, NewWasmConstExpr().AddInstrConstI32(40))
+		counter := wasmSymbolTable.AddGlobal(ValType(types.I32), true, NewWasmConstExpr().AddInstrConstI32(2))
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrGlobalGet(counter).
+			AddInstrGlobalGet(step).
+			AddInstrAddI32().
+			AddInstrGlobalSet(counter).
+			AddInstrGlobalGet(counter).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main).
+			Export("counter", types.ExportGlobalType, counter)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{},
+			expected:   int32(42),
+		})
+	})
+
+	t.Run("should place data relative to an imported memory base", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memoryBase := wasmSymbolTable.ImportGlobal("env", "__memory_base", ValType(types.I32), false)
+		wasmSymbolTable.ImportMemory("env", "memory", &WasmMemory{Min: 1})
+
+		end := wasmSymbolTable.AddGlobal(ValType(types.I32), false, NewWasmConstExpr().
+			AddInstrGlobalGet(memoryBase).
+			AddInstrConstI32(4).
+			AddInstrConstI32(3).
+			AddInstrMulI32().
+			AddInstrAddI32())
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddDataAt(nil, NewWasmConstExpr().
+				AddInstrGlobalGet(memoryBase).
+				AddInstrConstI32(16).
+				AddInstrAddI32(), []byte("hi")).
+			Export("end", types.ExportGlobalType, end)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+		checkRoundTrip(t, wasm)
+
+		importSection := []byte{
+			0x03, 'e', 'n', 'v', 0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00, 0x01,
+			0x03, 'e', 'n', 'v', 0x0D, '_', '_', 'm', 'e', 'm', 'o', 'r', 'y', '_', 'b', 'a', 's', 'e', 0x03, 0x7F, 0x00,
+		}
+		if !bytes.Contains(wasm, importSection) {
+			t.Fatalf("expected imports %x in %x", importSection, wasm)
+		}
+
+		globalSection := []byte{0x06, 0x0C, 0x01, 0x7F, 0x00, 0x23, 0x00, 0x41, 0x04, 0x41, 0x03, 0x6C, 0x6A, 0x0B}
+		if !bytes.Contains(wasm, globalSection) {
+			t.Fatalf("expected global section %x in %x", globalSection, wasm)
+		}
+
+		dataSection := []byte{0x0B, 0x0B, 0x01, 0x00, 0x23, 0x00, 0x41, 0x10, 0x6A, 0x0B, 0x02, 'h', 'i'}
+		if !bytes.Contains(wasm, dataSection) {
+			t.Fatalf("expected data section %x in %x", dataSection, wasm)
+		}
+	})
+
+	t.Run("should reject ill-typed constant expressions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		mixed := NewWasmConstExpr().
+			AddInstrConstI32(1).
+			AddInstrConstI64(2).
+			AddInstrAddI32()
+		if err := mixed.Err(); !errors.Is(err, ErrInvalidConstExpr) {
+			t.Fatalf("expected %v, got %v", ErrInvalidConstExpr, err)
+		}
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddDataAt(nil, NewWasmConstExpr().AddInstrConstI64(0), []byte{0})
+		if err := mod.Err(); !errors.Is(err, ErrInvalidConstExpr) {
+			t.Fatalf("expected %v, got %v", ErrInvalidConstExpr, err)
+		}
+	})
+
+	t.Run("should only read immutable and previously declared globals", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		mutable := wasmSymbolTable.AddGlobal(ValType(types.I32), true, NewWasmConstExpr().AddInstrConstI32(0))
+
+		if err := NewWasmConstExpr().AddInstrGlobalGet(mutable).Err(); !errors.Is(err, ErrInvalidConstExpr) {
+			t.Fatalf("expected %v, got %v", ErrInvalidConstExpr, err)
+		}
+
+		foreign := NewSymbolTable(nil).AddGlobal(ValType(types.I32), false, NewWasmConstExpr().AddInstrConstI32(0))
+		wasmSymbolTable.AddGlobal(ValType(types.I32), false, NewWasmConstExpr().AddInstrGlobalGet(foreign))
+		if err := wasmSymbolTable.err; !errors.Is(err, ErrUnknownGlobal) {
+			t.Fatalf("expected %v, got %v", ErrUnknownGlobal, err)
+		}
+	})
+
+	t.Run("should reject writes to immutable globals", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		constant := wasmSymbolTable.AddGlobal(ValType(types.I64), false, NewWasmConstExpr().AddInstrConstI64(1))
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrConstI64(2).
+			AddInstrGlobalSet(constant)
+
+		if err := main.Err(); !errors.Is(err, ErrImmutableGlobal) {
+			t.Fatalf("expected %v, got %v", ErrImmutableGlobal, err)
+		}
+	})
+
+	t.Run("should import globals before defining globals", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddGlobal(ValType(types.I32), false, NewWasmConstExpr().AddInstrConstI32(0))
+		wasmSymbolTable.ImportGlobal("env", "__table_base", ValType(types.I32), false)
+
+		if err := wasmSymbolTable.err; !errors.Is(err, ErrImportOrder) {
+			t.Fatalf("expected %v, got %v", ErrImportOrder, err)
+		}
+	})
+}
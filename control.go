@@ -0,0 +1,64 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// A structured control instruction that is open in the function body. The frame at the
+// bottom of the stack is the function body itself, whose label carries the function results.
+type wasmControlFrame struct {
+	labelTypes []WasmValueType
+	initHeight int
+	opcode     instructions.WasmInstruction
+}
+
+func blockTypes(returnType types.PrimitiveType) []WasmValueType {
+	if returnType == types.EmptyType {
+		return []WasmValueType{}
+	}
+	return []WasmValueType{ValType(returnType)}
+}
+
+func (b *WasmFunctionBuilder) pushFrame(opcode instructions.WasmInstruction, labelTypes []WasmValueType) {
+	b.controlStack = append(b.controlStack, wasmControlFrame{
+		labelTypes: labelTypes,
+		initHeight: len(b.localInits.log),
+		opcode:     opcode,
+	})
+}
+
+func (b *WasmFunctionBuilder) popFrame() {
+	if len(b.controlStack) == 0 {
+		b.fail(fmt.Errorf("%w: end without an open block", ErrUnbalancedControl))
+		return
+	}
+
+	// Locals initialized inside a block are uninitialized again after it.
+	b.localInits.reset(b.controlStack[len(b.controlStack)-1].initHeight)
+	b.controlStack = b.controlStack[:len(b.controlStack)-1]
+}
+
+// Returns the types a branch to the given relative label depth has to provide. The second
+// result is false if no such label is in scope.
+func (b *WasmFunctionBuilder) labelTypes(depth uint64) ([]WasmValueType, bool) {
+	if depth >= uint64(len(b.controlStack)) {
+		return nil, false
+	}
+
+	index := len(b.controlStack) - 1 - int(depth)
+	if index == 0 {
+		return b.resultTypes, true
+	}
+	return b.controlStack[index].labelTypes, true
+}
+
+func (b *WasmFunctionBuilder) checkLabel(depth uint64) bool {
+	if _, ok := b.labelTypes(depth); !ok {
+		b.fail(fmt.Errorf("%w: depth %d with %d open blocks", ErrInvalidLabel, depth, len(b.controlStack)))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,270 @@
+package gowasmtk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmCoverage selects how an instrumented module counts the executions of its basic blocks.
+type WasmCoverage struct {
+	// If ImportName is set, every block calls the imported function with this module and name,
+	// which takes the index of the block as an i32.
+	ImportModule string
+	ImportName   string
+	// Otherwise, every block increments an i64 counter at Offset plus eight times its index in
+	// the first memory, so the program must not use these bytes.
+	Offset uint32
+	// Returns the source position of an instruction of a defined function, given by the index
+	// of the function and of the instruction in its body. Optional.
+	Position func(function uint32, instr int) (WasmSourcePosition, bool)
+}
+
+type WasmSourcePosition struct {
+	File   string
+	Line   int
+	Column int
+}
+
+// WasmCoverageBlock is a basic block of a defined function. Functions and instructions are
+// numbered as in the module before it was instrumented.
+type WasmCoverageBlock struct {
+	Function uint32
+	Name     string
+	// The instructions of the block, from First up to Last.
+	First, Last int
+	// The positions of the first and last instruction of the block. Without a source position,
+	// the file is the name of the function and the line the index of the instruction plus one.
+	Start, End WasmSourcePosition
+}
+
+// WasmCoverageMap describes the counters of an instrumented module, in the order of their
+// indices.
+type WasmCoverageMap struct {
+	Offset uint32
+	Blocks []WasmCoverageBlock
+}
+
+// Counts how often every basic block of the defined functions runs, which are the
+// straight-line sequences that gas metering charges for. If blocks is not nil, it is set to
+// the map of the counters.
+func WithCoverage(coverage WasmCoverage, blocks *WasmCoverageMap) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		c, err := InstrumentCoverage(m, coverage)
+		if blocks != nil {
+			*blocks = c
+		}
+		return err
+	}
+}
+
+// Applies the instrumentation of WithCoverage to the module, and returns the map of its
+// counters.
+func InstrumentCoverage(m *WasmDecodedModule, coverage WasmCoverage) (WasmCoverageMap, error) {
+	c := WasmCoverageMap{Offset: coverage.Offset}
+	names := m.functionNames()
+	imported := uint32(m.importCount(types.ImportFunctionType))
+
+	// the index of the first block of every function, and the positions of its blocks
+	firsts := []int{}
+	for i, code := range m.Code {
+		f := imported + uint32(i)
+		firsts = append(firsts, len(c.Blocks))
+		for _, start := range blockStarts(code.Body) {
+			c.Blocks = append(c.Blocks, WasmCoverageBlock{Function: f, Name: names[f], First: start})
+		}
+	}
+	for k := range c.Blocks {
+		b := &c.Blocks[k]
+		b.Last = len(m.Code[b.Function-imported].Body) - 1
+		if k+1 < len(c.Blocks) && c.Blocks[k+1].Function == b.Function {
+			b.Last = c.Blocks[k+1].First - 1
+		}
+		b.Start, b.End = b.position(coverage, b.First), b.position(coverage, b.Last)
+	}
+
+	var count func(block int) []WasmInstr
+	if coverage.ImportName != "" {
+		i32 := WasmDecodedValType{Code: types.I32, Heap: noHeapType}
+		hook := addFunctionImport(m, coverage.ImportModule, coverage.ImportName, m.funcType([]WasmDecodedValType{i32}, []WasmDecodedValType{}))
+		count = func(block int) []WasmInstr {
+			return []WasmInstr{i32Const(uint32(block)).instr(), Instr(WasmOpcode(instructions.CallFunc), uint64(hook))}
+		}
+	} else {
+		var memory *WasmDecodedLimits
+		for _, imp := range m.Imports {
+			if imp.Kind == types.ImportMemoryType && memory == nil {
+				memory = &imp.Memory
+			}
+		}
+		if memory == nil && len(m.Memories) > 0 {
+			memory = &m.Memories[0]
+		}
+		if memory == nil {
+			return c, fmt.Errorf("%w: coverage counters need a memory", ErrUnknownMemory)
+		}
+		address := i32Const(0).instr()
+		if memory.Flags&0x04 != 0 { // memory64
+			address = i64Const(0).instr()
+		}
+		count = func(block int) []WasmInstr {
+			offset := uint64(coverage.Offset) + 8*uint64(block)
+			return []WasmInstr{
+				address, address,
+				Instr(WasmOpcode(instructions.LoadI64), 3, 0, offset),
+				i64Const(1).instr(), Instr(WasmOpcode(instructions.AddI64)),
+				Instr(WasmOpcode(instructions.StoreI64), 3, 0, offset),
+			}
+		}
+	}
+
+	for i := range m.Code {
+		body := m.Code[i].Body
+		counted := []WasmInstr{}
+		block := firsts[i]
+		for k, instr := range body {
+			if block < len(c.Blocks) && c.Blocks[block].First == k && c.Blocks[block].Function == imported+uint32(i) {
+				counted = append(counted, count(block)...)
+				block++
+			}
+			counted = append(counted, instr)
+		}
+		m.Code[i].Body = counted
+	}
+	return c, nil
+}
+
+// Returns the indices of the instructions that start a straight-line sequence of the body.
+func blockStarts(body []WasmInstr) []int {
+	starts := []int{0}
+	for k, instr := range body[:len(body)-1] {
+		if endsStraightLine(instr.Opcode) {
+			starts = append(starts, k+1)
+		}
+	}
+	return starts
+}
+
+func (b *WasmCoverageBlock) position(coverage WasmCoverage, instr int) WasmSourcePosition {
+	if coverage.Position != nil {
+		if p, ok := coverage.Position(b.Function, instr); ok {
+			return p
+		}
+	}
+	return WasmSourcePosition{File: b.Name, Line: instr + 1}
+}
+
+// Returns the names of the functions from the name section, or else from their exports.
+// Functions without a name are named after their index.
+func (m *WasmDecodedModule) functionNames() map[uint32]string {
+	names := map[uint32]string{}
+	for f := range m.importCount(types.ImportFunctionType) + len(m.Code) {
+		names[uint32(f)] = fmt.Sprintf("func%d", f)
+	}
+	for _, e := range m.Exports {
+		if e.Kind == types.ExportFunctionType {
+			names[e.Index] = e.Name
+		}
+	}
+	for _, c := range m.Customs {
+		if c.Name != "name" {
+			continue
+		}
+		r := &wasmReader{data: c.Payload}
+		for !r.done() {
+			id := r.byte()
+			contents := r.bytes(uint64(r.u32()))
+			if r.err != nil || id != 0x01 {
+				continue
+			}
+			sub := &wasmReader{data: contents}
+			for n := sub.count(); n > 0 && sub.err == nil; n-- {
+				f, name := sub.u32(), sub.name()
+				if sub.err == nil {
+					names[f] = name
+				}
+			}
+		}
+	}
+	return names
+}
+
+// Reads the counters from the memory of an instance of a module that was instrumented to
+// count in memory.
+func (c WasmCoverageMap) ReadCounters(memory []byte) ([]uint64, error) {
+	end := uint64(c.Offset) + 8*uint64(len(c.Blocks))
+	if end > uint64(len(memory)) {
+		return nil, fmt.Errorf("%w: counters end at %d after the memory of %d bytes", ErrUnknownMemory, end, len(memory))
+	}
+	counts := make([]uint64, len(c.Blocks))
+	for k := range counts {
+		counts[k] = binary.LittleEndian.Uint64(memory[c.Offset+uint32(8*k):])
+	}
+	return counts, nil
+}
+
+// Writes the counts of the blocks as an lcov tracefile. The count of a line is the highest
+// count of the blocks that start on it, and the count of a function that of its first block.
+func (c WasmCoverageMap) WriteLCOV(w io.Writer, counts []uint64) error {
+	files := []string{}
+	byFile := map[string][]int{}
+	for k, b := range c.Blocks {
+		if _, ok := byFile[b.Start.File]; !ok {
+			files = append(files, b.Start.File)
+		}
+		byFile[b.Start.File] = append(byFile[b.Start.File], k)
+	}
+
+	var out strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&out, "TN:\nSF:%s\n", file)
+		functions, hit := 0, 0
+		lines := map[int]uint64{}
+		for _, k := range byFile[file] {
+			b := c.Blocks[k]
+			if k == 0 || c.Blocks[k-1].Function != b.Function {
+				fmt.Fprintf(&out, "FN:%d,%s\nFNDA:%d,%s\n", b.Start.Line, b.Name, counts[k], b.Name)
+				functions++
+				if counts[k] > 0 {
+					hit++
+				}
+			}
+			lines[b.Start.Line] = max(lines[b.Start.Line], counts[k])
+		}
+		fmt.Fprintf(&out, "FNF:%d\nFNH:%d\n", functions, hit)
+
+		sorted := []int{}
+		for line := range lines {
+			sorted = append(sorted, line)
+		}
+		slices.Sort(sorted)
+		hit = 0
+		for _, line := range sorted {
+			fmt.Fprintf(&out, "DA:%d,%d\n", line, lines[line])
+			if lines[line] > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(&out, "LF:%d\nLH:%d\nend_of_record\n", len(sorted), hit)
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// Writes the counts of the blocks as a Go cover profile in count mode, with a statement for
+// every instruction of a block.
+func (c WasmCoverageMap) WriteGoCover(w io.Writer, counts []uint64) error {
+	var out strings.Builder
+	out.WriteString("mode: count\n")
+	for k, b := range c.Blocks {
+		fmt.Fprintf(&out, "%s:%d.%d,%d.%d %d %d\n", b.Start.File, b.Start.Line, max(b.Start.Column, 1),
+			b.End.Line, max(b.End.Column, 1), b.Last-b.First+1, counts[k])
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
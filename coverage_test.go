@@ -0,0 +1,114 @@
+package gowasmtk
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Returns a module that exports abs, whose body has four blocks: the condition, both branches
+// of the if and the end of the function.
+func coverageTestModule(wasmSymbolTable *wasmSymbolTable) *WasmModuleBuilder {
+	abs := NewWasmFunctionBuilder(wasmSymbolTable).
+		AddParam(types.I32).
+		AddReturn(types.I32).
+		AddInstrGetLocal(0).
+		AddInstrConstI32(0).
+		AddInstrLessThanI32S().
+		AddInstrIf(types.I32).
+		AddInstrConstI32(0).
+		AddInstrGetLocal(0).
+		AddInstrSubI32().
+		AddInstrElse().
+		AddInstrGetLocal(0).
+		AddInstrEnd().
+		AddInstrEnd().
+		Build()
+
+	return NewWasmModuleBuilder(wasmSymbolTable).
+		AddFunction(&abs).
+		Export("abs", types.ExportFunctionType, &abs)
+}
+
+func TestCoverage(t *testing.T) {
+	t.Run("should count blocks in memory and report them with source positions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+		mod := coverageTestModule(wasmSymbolTable).Export("memory", types.ExportMemoryType, memory)
+
+		var blocks WasmCoverageMap
+		wasm := mod.Build(WithCoverage(WasmCoverage{
+			Offset: 1024,
+			Position: func(function uint32, instr int) (WasmSourcePosition, bool) {
+				return WasmSourcePosition{File: "abs.go", Line: 10 + instr}, true
+			},
+		}, &blocks))
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		instance := instantiate(t, wasmer.NewStore(wasmer.NewEngine()), wasm, nil)
+		abs, _ := instance.Exports.GetFunction("abs")
+		for _, x := range []int32{-3, 4, 5} {
+			abs(x)
+		}
+
+		mem, _ := instance.Exports.GetMemory("memory")
+		counts, err := blocks.ReadCounters(mem.Data())
+		if err != nil || !slices.Equal(counts, []uint64{3, 1, 2, 3}) {
+			t.Fatalf("expected counts 3, 1, 2 and 3, got %v and %v", counts, err)
+		}
+
+		var lcov strings.Builder
+		if err := blocks.WriteLCOV(&lcov, counts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := "TN:\nSF:abs.go\nFN:10,abs\nFNDA:3,abs\nFNF:1\nFNH:1\n" +
+			"DA:10,3\nDA:14,1\nDA:18,2\nDA:20,3\nLF:4\nLH:4\nend_of_record\n"
+		if lcov.String() != expected {
+			t.Fatalf("expected lcov report\n%s\ngot\n%s", expected, lcov.String())
+		}
+
+		var cover strings.Builder
+		if err := blocks.WriteGoCover(&cover, counts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !strings.HasPrefix(cover.String(), "mode: count\nabs.go:10.1,13.1 4 3\nabs.go:14.1,17.1 4 1\n") {
+			t.Fatalf("unexpected cover profile\n%s", cover.String())
+		}
+	})
+
+	t.Run("should count blocks through an imported hook", func(t *testing.T) {
+		mod := coverageTestModule(NewSymbolTable(nil))
+
+		var blocks WasmCoverageMap
+		wasm := mod.Build(WithCoverage(WasmCoverage{ImportModule: "env", ImportName: "cover"}, &blocks))
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		store := wasmer.NewStore(wasmer.NewEngine())
+		counts := make([]uint64, len(blocks.Blocks))
+		cover := wasmer.NewFunction(store,
+			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
+			func(args []wasmer.Value) ([]wasmer.Value, error) {
+				counts[args[0].I32()]++
+				return []wasmer.Value{}, nil
+			})
+		instance := instantiate(t, store, wasm, map[string]wasmer.IntoExtern{"cover": cover})
+		abs, _ := instance.Exports.GetFunction("abs")
+		if result, err := abs(-7); err != nil || result != int32(7) {
+			t.Fatalf("expected 7, got %v and %v", result, err)
+		}
+
+		if !slices.Equal(counts, []uint64{1, 1, 0, 1}) {
+			t.Fatalf("expected counts 1, 1, 0 and 1, got %v", counts)
+		}
+		// blocks refer to the function and instructions before instrumentation
+		if b := blocks.Blocks[2]; b.Function != 0 || b.Name != "abs" || b.First != 8 || b.Last != 9 || b.Start.File != "abs" || b.Start.Line != 9 {
+			t.Fatalf("unexpected block %+v", b)
+		}
+	})
+}
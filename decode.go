@@ -0,0 +1,1106 @@
+package gowasmtk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmDecodedModule is a binary module split into its sections, so that passes can inspect and
+// rewrite modules built with WasmModuleBuilder as well as modules produced by other tools.
+// Indices are kept as they are encoded, so imports come first in every index space.
+type WasmDecodedModule struct {
+	Types     []WasmDecodedRecGroup
+	Imports   []WasmDecodedImport
+	Functions []uint32
+	Tables    []WasmDecodedTable
+	Memories  []WasmDecodedLimits
+	Tags      []uint32
+	Globals   []WasmDecodedGlobal
+	Exports   []WasmDecodedExport
+	Start     *uint32
+	Elements  []WasmDecodedElement
+	Code      []WasmDecodedCode
+	Data      []WasmDecodedData
+	Customs   []WasmDecodedCustom
+
+	// Ids of the sections that were present, so that empty sections are encoded again.
+	sections []byte
+	// Whether the module had a data count section.
+	dataCount bool
+	// Functions that are inlined regardless of their size.
+	alwaysInline map[uint32]bool
+	// Functions that EncodeObject declares as init functions and comdats.
+	initFunctions []WasmInitFunction
+	comdats       []WasmComdat
+}
+
+// WasmDecodedValType is a value type as encoded: a type code, followed by a heap type for the
+// reference type prefixes 0x63 and 0x64. A heap type that is not negative is a type index.
+type WasmDecodedValType struct {
+	Code types.WasmType
+	Heap int64
+}
+
+// The heap type of value types without one.
+const noHeapType int64 = -1
+
+type WasmDecodedFieldType struct {
+	Type    WasmDecodedValType
+	Mutable bool
+}
+
+// WasmDecodedSubType is an entry of a rec group. Sub is set for types encoded with the sub or
+// sub final prefix, which is required for types with supertypes and non-final types.
+type WasmDecodedSubType struct {
+	Sub        bool
+	Final      bool
+	Supertypes []uint32
+	Composite  byte
+	Fields     []WasmDecodedFieldType
+	Params     []WasmDecodedValType
+	Results    []WasmDecodedValType
+}
+
+// WasmDecodedRecGroup is an entry of the type section. Explicit groups are encoded with the rec
+// prefix, others consist of a single type.
+type WasmDecodedRecGroup struct {
+	Explicit bool
+	Types    []WasmDecodedSubType
+}
+
+type WasmDecodedLimits struct {
+	Flags byte
+	Min   uint64
+	Max   uint64
+}
+
+type WasmDecodedTable struct {
+	Type   WasmDecodedValType
+	Limits WasmDecodedLimits
+	// The initializer of the table, or nil if its elements are null.
+	Init []WasmInstr
+}
+
+type WasmDecodedGlobal struct {
+	Type    WasmDecodedValType
+	Mutable bool
+	Init    []WasmInstr
+}
+
+// WasmDecodedImport is an import of the given kind. Functions and tags refer to their type
+// with TypeIndex.
+type WasmDecodedImport struct {
+	Module    string
+	Name      string
+	Kind      types.WasmImportType
+	TypeIndex uint32
+	Table     WasmDecodedTable
+	Memory    WasmDecodedLimits
+	Global    WasmDecodedGlobal
+}
+
+type WasmDecodedExport struct {
+	Name  string
+	Kind  types.WasmExportType
+	Index uint32
+}
+
+// WasmDecodedElement is an element segment in one of the eight encodings selected by Flags.
+// Segments with the expression bit 0x04 hold Exprs, the others function indices.
+type WasmDecodedElement struct {
+	Flags  uint32
+	Table  uint32
+	Offset []WasmInstr
+	Type   WasmDecodedValType
+	Funcs  []uint32
+	Exprs  [][]WasmInstr
+}
+
+type WasmDecodedLocals struct {
+	Count uint32
+	Type  WasmDecodedValType
+}
+
+type WasmDecodedCode struct {
+	Locals []WasmDecodedLocals
+	// The instructions of the body, including the end of the function.
+	Body []WasmInstr
+}
+
+type WasmDecodedData struct {
+	Flags  uint32
+	Memory uint32
+	Offset []WasmInstr
+	Bytes  []byte
+	// The addresses of data symbols that are stored in the bytes.
+	pointers []wasmDataPointer
+}
+
+// WasmDecodedCustom is a custom section, kept after the section with the id it followed.
+type WasmDecodedCustom struct {
+	Name    string
+	Payload []byte
+	After   byte
+}
+
+// Element segment flags.
+const (
+	elemPassiveOrDeclarative uint32 = 0x01
+	elemExplicitTable        uint32 = 0x02
+	elemExpressions          uint32 = 0x04
+)
+
+const (
+	sectionIdStart     sectionId = 0x08
+	sectionIdDataCount sectionId = 0x0C
+)
+
+// The order of the non-custom sections in a module.
+var sectionOrder = []sectionId{
+	sectionIdType, sectionIdImport, sectionIdFunction, sectionIdTable, sectionIdMemory, sectionIdTag,
+	sectionIdGlobal, sectionIdExport, sectionIdStart, sectionIdElement, sectionIdDataCount, sectionIdCode,
+	sectionIdData,
+}
+
+type wasmReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wasmReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: %s at offset %d", ErrInvalidModule, fmt.Sprintf(format, args...), r.pos)
+	}
+	r.pos = len(r.data)
+}
+
+func (r *wasmReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *wasmReader) byte() byte {
+	if r.done() {
+		r.fail("unexpected end")
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+// Returns the next byte without consuming it, or zero at the end of the input.
+func (r *wasmReader) peek() byte {
+	if r.done() {
+		return 0
+	}
+	return r.data[r.pos]
+}
+
+func (r *wasmReader) bytes(n uint64) []byte {
+	if n > uint64(len(r.data)-r.pos) {
+		r.fail("unexpected end")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// Reads n bytes, which are zero past the end of the input so that they can always be decoded.
+func (r *wasmReader) fixed(n uint64) []byte {
+	if b := r.bytes(n); b != nil {
+		return b
+	}
+	return make([]byte, n)
+}
+
+func (r *wasmReader) leb(bits uint, signed bool) uint64 {
+	var result uint64
+	var shift uint
+	for {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		result |= uint64(b&0x7F) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			if signed && shift < 64 && b&0x40 != 0 {
+				result |= ^uint64(0) << shift
+			}
+			return result
+		}
+		if shift >= bits+7 {
+			r.fail("integer representation too long")
+			return 0
+		}
+	}
+}
+
+func (r *wasmReader) u32() uint32 { return uint32(r.leb(32, false)) }
+func (r *wasmReader) u64() uint64 { return r.leb(64, false) }
+func (r *wasmReader) s64() int64  { return int64(r.leb(64, true)) }
+
+// Reads the length of a vector, which cannot be larger than the remaining input.
+func (r *wasmReader) count() int {
+	n := r.u32()
+	if int(n) > len(r.data)-r.pos {
+		r.fail("vector of %d elements is too long", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (r *wasmReader) name() string {
+	return string(r.bytes(uint64(r.u32())))
+}
+
+func (r *wasmReader) valType() WasmDecodedValType {
+	v := WasmDecodedValType{Code: r.byte(), Heap: noHeapType}
+	if v.Code == refTypePrefix || v.Code == refNullTypePrefix {
+		v.Heap = r.s64()
+	}
+	return v
+}
+
+func (r *wasmReader) valTypes() []WasmDecodedValType {
+	values := []WasmDecodedValType{}
+	for n := r.count(); n > 0; n-- {
+		values = append(values, r.valType())
+	}
+	return values
+}
+
+func (r *wasmReader) fieldType() WasmDecodedFieldType {
+	return WasmDecodedFieldType{Type: r.valType(), Mutable: r.byte() == 0x01}
+}
+
+func (r *wasmReader) subType() WasmDecodedSubType {
+	t := WasmDecodedSubType{Final: true}
+
+	if prefix := r.peek(); prefix == subTypePrefix || prefix == subFinalPrefix {
+		r.byte()
+		t.Sub = true
+		t.Final = prefix == subFinalPrefix
+		for n := r.count(); n > 0; n-- {
+			t.Supertypes = append(t.Supertypes, r.u32())
+		}
+	}
+
+	t.Composite = r.byte()
+	switch t.Composite {
+	case compositeArray:
+		t.Fields = []WasmDecodedFieldType{r.fieldType()}
+	case compositeStruct:
+		for n := r.count(); n > 0; n-- {
+			t.Fields = append(t.Fields, r.fieldType())
+		}
+	case compositeFunc:
+		t.Params = r.valTypes()
+		t.Results = r.valTypes()
+	default:
+		r.fail("unknown composite type 0x%02X", t.Composite)
+	}
+	return t
+}
+
+func (r *wasmReader) limits() WasmDecodedLimits {
+	l := WasmDecodedLimits{Flags: r.byte()}
+	l.Min = r.u64()
+	if l.Flags&0x01 != 0 {
+		l.Max = r.u64()
+	}
+	return l
+}
+
+func (r *wasmReader) tableType() WasmDecodedTable {
+	return WasmDecodedTable{Type: r.valType(), Limits: r.limits()}
+}
+
+func (r *wasmReader) globalType() WasmDecodedGlobal {
+	return WasmDecodedGlobal{Type: r.valType(), Mutable: r.byte() == 0x01}
+}
+
+func (r *wasmReader) instr() WasmInstr {
+	op := WasmOpcode(r.byte())
+	if b := byte(op); b == prefixGC || b == prefixMisc || b == prefixSIMD || b == prefixAtomics {
+		op = PrefixedOpcode(b, r.u32())
+	}
+	if !validOpcode(op) {
+		prefix, sub := op.Split()
+		r.fail("unknown instruction 0x%02X %d", prefix, sub)
+		return WasmInstr{}
+	}
+
+	in := WasmInstr{Opcode: op}
+	for _, kind := range opcodeImmediates[op] {
+		switch kind {
+		case immByte:
+			in.Immediates = append(in.Immediates, uint64(r.byte()))
+		case immI32:
+			in.Immediates = append(in.Immediates, uint64(int64(int32(r.leb(32, true)))))
+		case immI64, immHeapType:
+			in.Immediates = append(in.Immediates, uint64(r.s64()))
+		case immBlockType:
+			if code := r.peek(); code == refTypePrefix || code == refNullTypePrefix {
+				v := r.valType()
+				in.Immediates = append(in.Immediates, uint64(int64(v.Code)-0x80), uint64(v.Heap))
+			} else {
+				heap := noHeapType
+				in.Immediates = append(in.Immediates, uint64(r.s64()), uint64(heap))
+			}
+		case immF32:
+			in.Immediates = append(in.Immediates, uint64(binary.LittleEndian.Uint32(r.fixed(4))))
+		case immF64:
+			in.Immediates = append(in.Immediates, binary.LittleEndian.Uint64(r.fixed(8)))
+		case immV128:
+			b := r.fixed(16)
+			in.Immediates = append(in.Immediates, binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint64(b[8:]))
+		case immMemArg:
+			align := r.u32()
+			memory := uint32(0)
+			if align&0x40 != 0 {
+				align &^= 0x40
+				memory = r.u32()
+			}
+			in.Immediates = append(in.Immediates, uint64(align), uint64(memory), r.u64())
+		case immLabels:
+			n := r.count()
+			in.Immediates = append(in.Immediates, uint64(n))
+			for k := 0; k <= n; k++ {
+				in.Immediates = append(in.Immediates, uint64(r.u32()))
+			}
+		case immValTypes:
+			n := r.count()
+			in.Immediates = append(in.Immediates, uint64(n))
+			for k := 0; k < n; k++ {
+				v := r.valType()
+				in.Immediates = append(in.Immediates, uint64(v.Code), uint64(v.Heap))
+			}
+		case immCatches:
+			n := r.count()
+			in.Immediates = append(in.Immediates, uint64(n))
+			for k := 0; k < n; k++ {
+				kind := r.byte()
+				tag := uint32(0)
+				if kind == instructions.Catch || kind == instructions.CatchRef {
+					tag = r.u32()
+				}
+				in.Immediates = append(in.Immediates, uint64(kind), uint64(tag), uint64(r.u32()))
+			}
+		default:
+			in.Immediates = append(in.Immediates, uint64(r.u32()))
+		}
+	}
+	return in
+}
+
+// Reads instructions up to and including the end that closes the outermost block, which ends a
+// function body or a constant expression.
+func (r *wasmReader) expr() []WasmInstr {
+	body := []WasmInstr{}
+	depth := 0
+	for r.err == nil {
+		in := r.instr()
+		body = append(body, in)
+		switch {
+		case in.Opcode.opensBlock():
+			depth++
+		case in.Opcode == WasmOpcode(instructions.End) && depth == 0:
+			return body
+		case in.Opcode == WasmOpcode(instructions.End):
+			depth--
+		case in.Opcode == 0x18 && depth == 0:
+			r.fail("delegate outside of a try")
+		case in.Opcode == 0x18:
+			// the legacy delegate closes a try like an end
+			depth--
+		}
+	}
+	return body
+}
+
+func (r *wasmReader) funcIndices() []uint32 {
+	indices := []uint32{}
+	for n := r.count(); n > 0; n-- {
+		indices = append(indices, r.u32())
+	}
+	return indices
+}
+
+func (r *wasmReader) element() WasmDecodedElement {
+	e := WasmDecodedElement{Flags: r.u32(), Type: WasmDecodedValType{Code: types.FuncRef, Heap: noHeapType}}
+	if e.Flags > 7 {
+		r.fail("unknown element segment flags %d", e.Flags)
+		return e
+	}
+
+	active := e.Flags&elemPassiveOrDeclarative == 0
+	if active && e.Flags&elemExplicitTable != 0 {
+		e.Table = r.u32()
+	}
+	if active {
+		e.Offset = r.expr()
+	}
+	// Segments other than the basic active segment of table 0 state the kind of their elements.
+	if e.Flags&^elemExpressions != 0 {
+		if e.Flags&elemExpressions != 0 {
+			e.Type = r.valType()
+		} else if kind := r.byte(); kind != 0x00 {
+			r.fail("unknown element kind 0x%02X", kind)
+		}
+	}
+
+	if e.Flags&elemExpressions != 0 {
+		for n := r.count(); n > 0; n-- {
+			e.Exprs = append(e.Exprs, r.expr())
+		}
+	} else {
+		e.Funcs = r.funcIndices()
+	}
+	return e
+}
+
+func (r *wasmReader) dataSegment() WasmDecodedData {
+	d := WasmDecodedData{Flags: r.u32()}
+	switch d.Flags {
+	case 0:
+		d.Offset = r.expr()
+	case 1:
+	case 2:
+		d.Memory = r.u32()
+		d.Offset = r.expr()
+	default:
+		r.fail("unknown data segment flags %d", d.Flags)
+	}
+	d.Bytes = slices.Clone(r.bytes(uint64(r.u32())))
+	return d
+}
+
+func (r *wasmReader) code() WasmDecodedCode {
+	size := r.u32()
+	body := &wasmReader{data: r.bytes(uint64(size))}
+
+	c := WasmDecodedCode{Locals: []WasmDecodedLocals{}}
+	for n := body.count(); n > 0; n-- {
+		c.Locals = append(c.Locals, WasmDecodedLocals{Count: body.u32(), Type: body.valType()})
+	}
+	c.Body = body.expr()
+	if !body.done() {
+		body.fail("instructions after the end of the function")
+	}
+	if body.err != nil && r.err == nil {
+		r.err = body.err
+	}
+	return c
+}
+
+func (r *wasmReader) section(m *WasmDecodedModule, id sectionId) {
+	switch id {
+	case sectionIdType:
+		for n := r.count(); n > 0; n-- {
+			if r.peek() == recGroupPrefix {
+				r.byte()
+				group := WasmDecodedRecGroup{Explicit: true}
+				for k := r.count(); k > 0; k-- {
+					group.Types = append(group.Types, r.subType())
+				}
+				m.Types = append(m.Types, group)
+			} else {
+				m.Types = append(m.Types, WasmDecodedRecGroup{Types: []WasmDecodedSubType{r.subType()}})
+			}
+		}
+	case sectionIdImport:
+		for n := r.count(); n > 0; n-- {
+			imp := WasmDecodedImport{Module: r.name(), Name: r.name(), Kind: r.byte()}
+			switch imp.Kind {
+			case types.ImportFunctionType:
+				imp.TypeIndex = r.u32()
+			case types.ImportTableType:
+				imp.Table = r.tableType()
+			case types.ImportMemoryType:
+				imp.Memory = r.limits()
+			case types.ImportGlobalType:
+				imp.Global = r.globalType()
+			case types.ImportTagType:
+				r.byte()
+				imp.TypeIndex = r.u32()
+			default:
+				r.fail("unknown import kind 0x%02X", imp.Kind)
+			}
+			m.Imports = append(m.Imports, imp)
+		}
+	case sectionIdFunction:
+		m.Functions = r.funcIndices()
+	case sectionIdTable:
+		for n := r.count(); n > 0; n-- {
+			if r.peek() == 0x40 {
+				r.bytes(2)
+				table := r.tableType()
+				table.Init = r.expr()
+				m.Tables = append(m.Tables, table)
+			} else {
+				m.Tables = append(m.Tables, r.tableType())
+			}
+		}
+	case sectionIdMemory:
+		for n := r.count(); n > 0; n-- {
+			m.Memories = append(m.Memories, r.limits())
+		}
+	case sectionIdTag:
+		for n := r.count(); n > 0; n-- {
+			r.byte()
+			m.Tags = append(m.Tags, r.u32())
+		}
+	case sectionIdGlobal:
+		for n := r.count(); n > 0; n-- {
+			global := r.globalType()
+			global.Init = r.expr()
+			m.Globals = append(m.Globals, global)
+		}
+	case sectionIdExport:
+		for n := r.count(); n > 0; n-- {
+			m.Exports = append(m.Exports, WasmDecodedExport{Name: r.name(), Kind: r.byte(), Index: r.u32()})
+		}
+	case sectionIdStart:
+		start := r.u32()
+		m.Start = &start
+	case sectionIdElement:
+		for n := r.count(); n > 0; n-- {
+			m.Elements = append(m.Elements, r.element())
+		}
+	case sectionIdDataCount:
+		r.u32()
+		m.dataCount = true
+	case sectionIdCode:
+		for n := r.count(); n > 0; n-- {
+			m.Code = append(m.Code, r.code())
+		}
+	case sectionIdData:
+		for n := r.count(); n > 0; n-- {
+			m.Data = append(m.Data, r.dataSegment())
+		}
+	default:
+		r.fail("unknown section id %d", id)
+	}
+
+	if !r.done() {
+		r.fail("section %d is longer than its contents", id)
+	}
+}
+
+// Decodes a binary module. Returns an error wrapping ErrInvalidModule if the module is
+// malformed or uses instructions the decoder does not know.
+func DecodeModule(wasm []byte) (*WasmDecodedModule, error) {
+	r := &wasmReader{data: wasm}
+	if !slices.Equal(r.bytes(4), magic()) || !slices.Equal(r.bytes(4), version()) {
+		return nil, fmt.Errorf("%w: not a version 1 binary module", ErrInvalidModule)
+	}
+
+	m := &WasmDecodedModule{}
+	last := sectionId(0)
+	for !r.done() && r.err == nil {
+		id := r.byte()
+		contents := &wasmReader{data: r.bytes(uint64(r.u32()))}
+		if r.err != nil {
+			break
+		}
+
+		if id == sectionIdCustom {
+			m.Customs = append(m.Customs, WasmDecodedCustom{Name: contents.name(), Payload: slices.Clone(contents.data[contents.pos:]), After: last})
+		} else {
+			if slices.Index(sectionOrder, id) <= slices.Index(sectionOrder, last) && last != 0 {
+				return nil, fmt.Errorf("%w: section %d out of order", ErrInvalidModule, id)
+			}
+			contents.section(m, id)
+			m.sections = append(m.sections, id)
+			last = id
+		}
+
+		if contents.err != nil {
+			return nil, contents.err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(m.Functions) != len(m.Code) {
+		return nil, fmt.Errorf("%w: %d functions but %d bodies", ErrInvalidModule, len(m.Functions), len(m.Code))
+	}
+
+	return m, nil
+}
+
+// Returns the number of imports of the given kind, which come first in the index space of
+// that kind.
+func (m *WasmDecodedModule) importCount(kind types.WasmImportType) int {
+	count := 0
+	for _, imp := range m.Imports {
+		if imp.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+// Returns the limits of memory 0, which is the first imported memory if there is one, or nil if
+// the module has no memory.
+func (m *WasmDecodedModule) memoryZero() *WasmDecodedLimits {
+	for i, imp := range m.Imports {
+		if imp.Kind == types.ImportMemoryType {
+			return &m.Imports[i].Memory
+		}
+	}
+	if len(m.Memories) > 0 {
+		return &m.Memories[0]
+	}
+	return nil
+}
+
+// Returns the subtype at the type index, or nil if the index is out of range.
+func (m *WasmDecodedModule) typeAt(index uint32) *WasmDecodedSubType {
+	for g := range m.Types {
+		if int(index) < len(m.Types[g].Types) {
+			return &m.Types[g].Types[index]
+		}
+		index -= uint32(len(m.Types[g].Types))
+	}
+	return nil
+}
+
+// Returns the type index of the function with the given index, counting imports first.
+func (m *WasmDecodedModule) funcTypeIndex(index uint32) (uint32, bool) {
+	for _, imp := range m.Imports {
+		if imp.Kind != types.ImportFunctionType {
+			continue
+		}
+		if index == 0 {
+			return imp.TypeIndex, true
+		}
+		index--
+	}
+	if int(index) < len(m.Functions) {
+		return m.Functions[index], true
+	}
+	return 0, false
+}
+
+// Returns the type of the tag with the given index, counting imports first, or nil if the
+// index is out of range.
+func (m *WasmDecodedModule) tagType(index uint32) *WasmDecodedSubType {
+	for _, imp := range m.Imports {
+		if imp.Kind != types.ImportTagType {
+			continue
+		}
+		if index == 0 {
+			return m.typeAt(imp.TypeIndex)
+		}
+		index--
+	}
+	if int(index) < len(m.Tags) {
+		return m.typeAt(m.Tags[index])
+	}
+	return nil
+}
+
+// Returns the index of a function type with the given parameters and results that is not part
+// of an explicit rec group, and adds such a type if there is none.
+func (m *WasmDecodedModule) funcType(params, results []WasmDecodedValType) uint32 {
+	index := uint32(0)
+	for _, g := range m.Types {
+		for _, t := range g.Types {
+			if !g.Explicit && !t.Sub && t.Composite == compositeFunc && slices.Equal(t.Params, params) && slices.Equal(t.Results, results) {
+				return index
+			}
+			index++
+		}
+	}
+	m.Types = append(m.Types, WasmDecodedRecGroup{Types: []WasmDecodedSubType{{
+		Final:     true,
+		Composite: compositeFunc,
+		Params:    params,
+		Results:   results,
+	}}})
+	return index
+}
+
+func encodeValType(v WasmDecodedValType) []byte {
+	if v.Code == refTypePrefix || v.Code == refNullTypePrefix {
+		return append([]byte{v.Code}, leb128EncodeI(v.Heap)...)
+	}
+	return []byte{v.Code}
+}
+
+func encodeValTypes(values []WasmDecodedValType) []byte {
+	result := leb128EncodeU(uint64(len(values)))
+	for _, v := range values {
+		result = append(result, encodeValType(v)...)
+	}
+	return result
+}
+
+func encodeFieldType(f WasmDecodedFieldType) []byte {
+	if f.Mutable {
+		return append(encodeValType(f.Type), 0x01)
+	}
+	return append(encodeValType(f.Type), 0x00)
+}
+
+func (t WasmDecodedSubType) encode() []byte {
+	var result []byte
+	if t.Sub {
+		if t.Final {
+			result = append(result, subFinalPrefix)
+		} else {
+			result = append(result, subTypePrefix)
+		}
+		result = append(result, leb128EncodeU(uint64(len(t.Supertypes)))...)
+		for _, super := range t.Supertypes {
+			result = append(result, leb128EncodeU(uint64(super))...)
+		}
+	}
+
+	result = append(result, t.Composite)
+	switch t.Composite {
+	case compositeArray:
+		result = append(result, encodeFieldType(t.Fields[0])...)
+	case compositeStruct:
+		result = append(result, leb128EncodeU(uint64(len(t.Fields)))...)
+		for _, f := range t.Fields {
+			result = append(result, encodeFieldType(f)...)
+		}
+	case compositeFunc:
+		result = append(result, encodeValTypes(t.Params)...)
+		result = append(result, encodeValTypes(t.Results)...)
+	}
+	return result
+}
+
+func encodeLimits(l WasmDecodedLimits) []byte {
+	result := append([]byte{l.Flags}, leb128EncodeU(l.Min)...)
+	if l.Flags&0x01 != 0 {
+		result = append(result, leb128EncodeU(l.Max)...)
+	}
+	return result
+}
+
+func encodeTableType(t WasmDecodedTable) []byte {
+	return append(encodeValType(t.Type), encodeLimits(t.Limits)...)
+}
+
+func encodeGlobalType(g WasmDecodedGlobal) []byte {
+	if g.Mutable {
+		return append(encodeValType(g.Type), 0x01)
+	}
+	return append(encodeValType(g.Type), 0x00)
+}
+
+func (in WasmInstr) encode() []byte {
+	return in.encodeIndices(encodeIndex)
+}
+
+// Appends an unsigned immediate in its shortest encoding, which is signed for block types.
+func encodeIndex(result []byte, kind wasmImmediate, index uint64) []byte {
+	if kind == immBlockType {
+		return append(result, leb128EncodeI(int64(index))...)
+	}
+	return append(result, leb128EncodeU(index)...)
+}
+
+// Encodes the instruction, appending its unsigned immediates and the type index of a block type
+// with index, which is given the kind of the immediate.
+func (in WasmInstr) encodeIndices(index func(result []byte, kind wasmImmediate, index uint64) []byte) []byte {
+	prefix, sub := in.Opcode.Split()
+	var result []byte
+	if prefix != 0 {
+		result = append([]byte{prefix}, leb128EncodeU(uint64(sub))...)
+	} else {
+		result = []byte{byte(sub)}
+	}
+
+	imms := in.Immediates
+	for _, kind := range opcodeImmediates[in.Opcode] {
+		switch kind {
+		case immByte:
+			result = append(result, byte(imms[0]))
+			imms = imms[1:]
+		case immI32, immI64, immHeapType:
+			result = append(result, leb128EncodeI(int64(imms[0]))...)
+			imms = imms[1:]
+		case immBlockType:
+			if code := byte(int64(imms[0]) + 0x80); code == refTypePrefix || code == refNullTypePrefix {
+				result = append(result, encodeValType(WasmDecodedValType{Code: code, Heap: int64(imms[1])})...)
+			} else if int64(imms[0]) >= 0 {
+				result = index(result, immBlockType, imms[0])
+			} else {
+				result = append(result, leb128EncodeI(int64(imms[0]))...)
+			}
+			imms = imms[2:]
+		case immF32:
+			result = binary.LittleEndian.AppendUint32(result, uint32(imms[0]))
+			imms = imms[1:]
+		case immF64:
+			result = binary.LittleEndian.AppendUint64(result, imms[0])
+			imms = imms[1:]
+		case immV128:
+			result = binary.LittleEndian.AppendUint64(result, imms[0])
+			result = binary.LittleEndian.AppendUint64(result, imms[1])
+			imms = imms[2:]
+		case immMemArg:
+			if imms[1] != 0 {
+				result = append(result, leb128EncodeU(imms[0]|0x40)...)
+				result = append(result, leb128EncodeU(imms[1])...)
+			} else {
+				result = append(result, leb128EncodeU(imms[0])...)
+			}
+			result = append(result, leb128EncodeU(imms[2])...)
+			imms = imms[3:]
+		case immLabels:
+			n := int(imms[0])
+			result = append(result, leb128EncodeU(uint64(n))...)
+			for _, label := range imms[1 : n+2] {
+				result = append(result, leb128EncodeU(label)...)
+			}
+			imms = imms[n+2:]
+		case immValTypes:
+			n := int(imms[0])
+			result = append(result, leb128EncodeU(uint64(n))...)
+			for k := 0; k < n; k++ {
+				result = append(result, encodeValType(WasmDecodedValType{Code: byte(imms[1+2*k]), Heap: int64(imms[2+2*k])})...)
+			}
+			imms = imms[1+2*n:]
+		case immCatches:
+			n := int(imms[0])
+			result = append(result, leb128EncodeU(uint64(n))...)
+			for k := 0; k < n; k++ {
+				clause := imms[1+3*k:]
+				result = append(result, byte(clause[0]))
+				if byte(clause[0]) == instructions.Catch || byte(clause[0]) == instructions.CatchRef {
+					result = index(result, immTag, clause[1])
+				}
+				result = append(result, leb128EncodeU(clause[2])...)
+			}
+			imms = imms[1+3*n:]
+		default:
+			result = index(result, kind, imms[0])
+			imms = imms[1:]
+		}
+	}
+	return result
+}
+
+// Encodes a sequence of instructions, such as a function body or a constant expression.
+func EncodeInstrs(body []WasmInstr) []byte {
+	var result []byte
+	for _, in := range body {
+		result = append(result, in.encode()...)
+	}
+	return result
+}
+
+// Decodes a sequence of instructions that ends with the end of its outermost block.
+func DecodeInstrs(code []byte) ([]WasmInstr, error) {
+	r := &wasmReader{data: code}
+	body := r.expr()
+	if r.err == nil && !r.done() {
+		r.fail("instructions after the end")
+	}
+	return body, r.err
+}
+
+func funcIndexVector(indices []uint32) []byte {
+	result := leb128EncodeU(uint64(len(indices)))
+	for _, idx := range indices {
+		result = append(result, leb128EncodeU(uint64(idx))...)
+	}
+	return result
+}
+
+func (e WasmDecodedElement) encode() []byte {
+	result := leb128EncodeU(uint64(e.Flags))
+
+	active := e.Flags&elemPassiveOrDeclarative == 0
+	if active && e.Flags&elemExplicitTable != 0 {
+		result = append(result, leb128EncodeU(uint64(e.Table))...)
+	}
+	if active {
+		result = append(result, EncodeInstrs(e.Offset)...)
+	}
+	if e.Flags&^elemExpressions != 0 {
+		if e.Flags&elemExpressions != 0 {
+			result = append(result, encodeValType(e.Type)...)
+		} else {
+			result = append(result, 0x00)
+		}
+	}
+
+	if e.Flags&elemExpressions == 0 {
+		return append(result, funcIndexVector(e.Funcs)...)
+	}
+	result = append(result, leb128EncodeU(uint64(len(e.Exprs)))...)
+	for _, expr := range e.Exprs {
+		result = append(result, EncodeInstrs(expr)...)
+	}
+	return result
+}
+
+func (c WasmDecodedCode) encode() []byte {
+	return code(function(c.localDecls(), EncodeInstrs(c.Body)))
+}
+
+func (c WasmDecodedCode) localDecls() [][]byte {
+	decls := [][]byte{}
+	for _, l := range c.Locals {
+		decls = append(decls, append(leb128EncodeU(uint64(l.Count)), encodeValType(l.Type)...))
+	}
+	return decls
+}
+
+func (m *WasmDecodedModule) encodeSection(id sectionId) []byte {
+	entries := [][]byte{}
+	switch id {
+	case sectionIdType:
+		for _, g := range m.Types {
+			if !g.Explicit && len(g.Types) == 1 {
+				entries = append(entries, g.Types[0].encode())
+				continue
+			}
+			subtypes := [][]byte{}
+			for _, t := range g.Types {
+				subtypes = append(subtypes, t.encode())
+			}
+			entries = append(entries, append([]byte{recGroupPrefix}, vecNested(subtypes)...))
+		}
+	case sectionIdImport:
+		for _, imp := range m.Imports {
+			var desc []byte
+			switch imp.Kind {
+			case types.ImportFunctionType:
+				desc = leb128EncodeU(uint64(imp.TypeIndex))
+			case types.ImportTableType:
+				desc = encodeTableType(imp.Table)
+			case types.ImportMemoryType:
+				desc = encodeLimits(imp.Memory)
+			case types.ImportGlobalType:
+				desc = encodeGlobalType(imp.Global)
+			case types.ImportTagType:
+				desc = tagType(imp.TypeIndex)
+			}
+			entries = append(entries, imports(imp.Module, imp.Name, append([]byte{imp.Kind}, desc...)))
+		}
+	case sectionIdFunction:
+		return funcIndexVector(m.Functions)
+	case sectionIdTable:
+		for _, t := range m.Tables {
+			if t.Init != nil {
+				entries = append(entries, append(append([]byte{0x40, 0x00}, encodeTableType(t)...), EncodeInstrs(t.Init)...))
+			} else {
+				entries = append(entries, encodeTableType(t))
+			}
+		}
+	case sectionIdMemory:
+		for _, l := range m.Memories {
+			entries = append(entries, encodeLimits(l))
+		}
+	case sectionIdTag:
+		for _, t := range m.Tags {
+			entries = append(entries, tagType(t))
+		}
+	case sectionIdGlobal:
+		for _, g := range m.Globals {
+			entries = append(entries, append(encodeGlobalType(g), EncodeInstrs(g.Init)...))
+		}
+	case sectionIdExport:
+		for _, e := range m.Exports {
+			entries = append(entries, append(name(e.Name), append([]byte{e.Kind}, leb128EncodeU(uint64(e.Index))...)...))
+		}
+	case sectionIdStart:
+		return leb128EncodeU(uint64(*m.Start))
+	case sectionIdElement:
+		for _, e := range m.Elements {
+			entries = append(entries, e.encode())
+		}
+	case sectionIdDataCount:
+		return leb128EncodeU(uint64(len(m.Data)))
+	case sectionIdCode:
+		for _, c := range m.Code {
+			entries = append(entries, c.encode())
+		}
+	case sectionIdData:
+		for _, d := range m.Data {
+			entry := leb128EncodeU(uint64(d.Flags))
+			if d.Flags == 2 {
+				entry = append(entry, leb128EncodeU(uint64(d.Memory))...)
+			}
+			if d.Flags != 1 {
+				entry = append(entry, EncodeInstrs(d.Offset)...)
+			}
+			entries = append(entries, append(entry, vec(d.Bytes)...))
+		}
+	}
+	return vecNested(entries)
+}
+
+// Returns whether a section has contents. Sections that were present in the decoded module
+// are kept even if they became empty.
+func (m *WasmDecodedModule) hasSection(id sectionId) bool {
+	if slices.Contains(m.sections, id) {
+		return id != sectionIdStart || m.Start != nil
+	}
+
+	switch id {
+	case sectionIdType:
+		return len(m.Types) > 0
+	case sectionIdImport:
+		return len(m.Imports) > 0
+	case sectionIdFunction, sectionIdCode:
+		return len(m.Functions) > 0
+	case sectionIdTable:
+		return len(m.Tables) > 0
+	case sectionIdMemory:
+		return len(m.Memories) > 0
+	case sectionIdTag:
+		return len(m.Tags) > 0
+	case sectionIdGlobal:
+		return len(m.Globals) > 0
+	case sectionIdExport:
+		return len(m.Exports) > 0
+	case sectionIdStart:
+		return m.Start != nil
+	case sectionIdElement:
+		return len(m.Elements) > 0
+	case sectionIdDataCount:
+		return m.dataCount
+	case sectionIdData:
+		return len(m.Data) > 0
+	}
+	return false
+}
+
+// Encodes the module. Decoding a module and encoding it again without changes produces the
+// same bytes, unless the module used integer encodings that are longer than necessary.
+func (m *WasmDecodedModule) Encode() []byte {
+	sections := []wasmSection{}
+	emitCustoms := func(after sectionId) {
+		for _, c := range m.Customs {
+			if c.After == after {
+				sections = append(sections, sectionCustom(c.Name, c.Payload))
+			}
+		}
+	}
+
+	emitCustoms(0)
+	for _, id := range sectionOrder {
+		if m.hasSection(id) {
+			sections = append(sections, section(id, m.encodeSection(id)))
+		}
+		emitCustoms(id)
+	}
+
+	return module(sections...)
+}
@@ -0,0 +1,39 @@
+package gowasmtk
+
+import "errors"
+
+var (
+	ErrUnknownInstruction  = errors.New("unknown instruction")
+	ErrUnalignedAtomic     = errors.New("atomic memory access must be naturally aligned")
+	ErrOveralignedAccess   = errors.New("memory access alignment must not exceed natural alignment")
+	ErrInvalidMemoryLimits = errors.New("invalid memory limits")
+	ErrSharedMemoryMax     = errors.New("shared memory must declare a maximum size")
+	ErrUnknownMemory       = errors.New("unknown memory")
+	ErrInvalidMemArg       = errors.New("invalid memory argument")
+	ErrImportOrder         = errors.New("imports must be declared before definitions of the same kind")
+	ErrUnbalancedControl   = errors.New("unbalanced structured control instructions")
+	ErrInvalidLabel        = errors.New("branch target label is not in scope")
+	ErrLabelTypeMismatch   = errors.New("values do not match the types of the branch target label")
+	ErrTailCallResults     = errors.New("tail call results do not match the results of the caller")
+	ErrInvalidTableLimits  = errors.New("invalid table limits")
+	ErrUnknownTable        = errors.New("unknown table")
+	ErrUnknownType         = errors.New("unknown type")
+	ErrInvalidSubtype      = errors.New("invalid subtype declaration")
+	ErrTypeMismatch        = errors.New("instruction does not match the type it operates on")
+	ErrUnknownLocal        = errors.New("unknown local")
+	ErrUninitializedLocal  = errors.New("local of a non-defaultable type is read before it is set")
+	ErrLocalOrder          = errors.New("parameters must be declared before locals")
+	ErrForeignLocal        = errors.New("local handle belongs to another function")
+	ErrUnknownGlobal       = errors.New("unknown global")
+	ErrUnknownFunction     = errors.New("unknown function")
+	ErrUnknownData         = errors.New("unknown data symbol")
+	ErrImmutableGlobal     = errors.New("immutable global cannot be set")
+	ErrInvalidConstExpr    = errors.New("invalid constant expression")
+	ErrFeatureDisabled     = errors.New("feature is not enabled for the module")
+	ErrInvalidExpr         = errors.New("invalid expression")
+	ErrInvalidCFG          = errors.New("invalid control-flow graph")
+	ErrInvalidSSA          = errors.New("invalid SSA function")
+	ErrInvalidModule       = errors.New("invalid binary module")
+	ErrUnsupportedAsyncify = errors.New("function cannot be instrumented for asyncify")
+	ErrUnsupportedObject   = errors.New("module cannot be encoded as a relocatable object file")
+)
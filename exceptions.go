@@ -0,0 +1,157 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmTag is an exception tag. Its parameter types describe the values that an exception
+// thrown with the tag carries. Tags are declared on the symbol table, so that every function
+// built on the same table can throw and catch them.
+type WasmTag struct {
+	moduleName string
+	name       string
+	paramTypes []types.WasmType
+	index      int
+	typeIndex  int
+}
+
+// WasmCatch is a catch clause of a try_table instruction. The label is a relative depth that
+// is resolved outside of the try_table block, exactly like the label of a branch placed right
+// before the try_table instruction.
+type WasmCatch struct {
+	tag   *WasmTag
+	label uint32
+	kind  instructions.WasmCatchKind
+}
+
+func (t *WasmTag) GetIndex() int {
+	return t.index
+}
+
+func (t *WasmTag) imported() bool {
+	return t.moduleName != "" || t.name != ""
+}
+
+// Catches exceptions with the given tag and branches to the label with the exception values.
+func Catch(tag *WasmTag, label uint32) WasmCatch {
+	return WasmCatch{tag: tag, label: label, kind: instructions.Catch}
+}
+
+// Catches exceptions with the given tag and branches to the label with the exception values,
+// followed by an exnref that can be rethrown with throw_ref.
+func CatchRef(tag *WasmTag, label uint32) WasmCatch {
+	return WasmCatch{tag: tag, label: label, kind: instructions.CatchRef}
+}
+
+// Catches every exception and branches to the label without any values.
+func CatchAll(label uint32) WasmCatch {
+	return WasmCatch{label: label, kind: instructions.CatchAll}
+}
+
+// Catches every exception and branches to the label with an exnref of the exception.
+func CatchAllRef(label uint32) WasmCatch {
+	return WasmCatch{label: label, kind: instructions.CatchAllRef}
+}
+
+// Returns the values the catch clause passes to its label.
+func (c WasmCatch) types() []WasmValueType {
+	values := []WasmValueType{}
+	if c.tag != nil {
+		values = append(values, valTypes(c.tag.paramTypes)...)
+	}
+	if c.kind == instructions.CatchRef || c.kind == instructions.CatchAllRef {
+		values = append(values, ValType(types.ExnRef))
+	}
+	return values
+}
+
+func (c WasmCatch) encode() []byte {
+	clause := []byte{c.kind}
+	if c.kind == instructions.Catch || c.kind == instructions.CatchRef {
+		clause = append(clause, leb128EncodeU(uint64(c.tag.GetIndex()))...)
+	}
+	return append(clause, leb128EncodeU(uint64(c.label))...)
+}
+
+// Declares an exception tag defined by the module. The tag can be exported with the
+// ExportTagType export type.
+func (s *wasmSymbolTable) AddTag(paramTypes ...types.WasmType) *WasmTag {
+	tag := &WasmTag{
+		paramTypes: paramTypes,
+		index:      len(s.tags),
+		typeIndex:  s.internFuncType(paramTypes, []types.WasmType{}),
+	}
+	s.tags = append(s.tags, tag)
+
+	return tag
+}
+
+// Imports an exception tag from the host. Imported tags come first in the tag index space,
+// so all tag imports must be declared before any tag is added with AddTag.
+func (s *wasmSymbolTable) ImportTag(moduleName, name string, paramTypes ...types.WasmType) *WasmTag {
+	if len(s.tags) > s.importedTags {
+		s.fail(fmt.Errorf("%w: tag %s.%s imported after a tag definition", ErrImportOrder, moduleName, name))
+	}
+
+	tag := &WasmTag{
+		moduleName: moduleName,
+		name:       name,
+		paramTypes: paramTypes,
+		index:      len(s.tags),
+		typeIndex:  s.internFuncType(paramTypes, []types.WasmType{}),
+	}
+	s.tags = append(s.tags, tag)
+	s.importedTags++
+
+	return tag
+}
+
+func (b *WasmFunctionBuilder) AddInstrThrow(tag *WasmTag) *WasmFunctionBuilder {
+	b.use(FeatureExceptions)
+	b.instructions = append(b.instructions, instructions.Throw)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(tag.GetIndex()))...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrThrowRef() *WasmFunctionBuilder {
+	b.use(FeatureExceptions)
+	b.instructions = append(b.instructions, instructions.ThrowRef)
+	return b
+}
+
+// Opens a try_table block. Exceptions thrown inside the block are matched against the catch
+// clauses in order, and the first matching clause branches to its label. Every label must be
+// in scope and accept exactly the values the clause provides.
+func (b *WasmFunctionBuilder) AddInstrTryTable(returnType types.PrimitiveType, catches ...WasmCatch) *WasmFunctionBuilder {
+	clauses := []byte{}
+	for _, c := range catches {
+		if (c.kind == instructions.Catch || c.kind == instructions.CatchRef) && c.tag == nil {
+			b.fail(fmt.Errorf("%w: catch clause without a tag", ErrUnknownInstruction))
+			return b
+		}
+
+		labelTypes, ok := b.labelTypes(uint64(c.label))
+		if !ok {
+			b.fail(fmt.Errorf("%w: catch to depth %d with %d open blocks", ErrInvalidLabel, c.label, len(b.controlStack)))
+			return b
+		}
+		if !slices.Equal(labelTypes, c.types()) {
+			b.fail(fmt.Errorf("%w: catch provides %v, label at depth %d expects %v", ErrLabelTypeMismatch, c.types(), c.label, labelTypes))
+			return b
+		}
+
+		clauses = append(clauses, c.encode()...)
+	}
+
+	b.use(FeatureExceptions)
+	b.instructions = append(b.instructions, instructions.TryTable)
+	b.instructions = append(b.instructions, returnType)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(len(catches)))...)
+	b.instructions = append(b.instructions, clauses...)
+	b.pushFrame(instructions.TryTable, blockTypes(returnType))
+	return b
+}
@@ -0,0 +1,133 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestExceptions(t *testing.T) {
+	t.Run("should encode tags, throw and try_table", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		tag := wasmSymbolTable.AddTag(types.I32)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			// throw the parameter and return it from the catch clause
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrBlock(types.I32).
+			AddInstrTryTable(types.I32, Catch(tag, 0)).
+			AddInstrGetLocal(0).
+			AddInstrThrow(tag).
+			AddInstrEnd().
+			AddInstrEnd().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main).
+			Export("error", types.ExportTagType, tag)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+		checkRoundTrip(t, wasm)
+
+		tagSection := []byte{0x0D, 0x03, 0x01, 0x00, 0x00}
+		if !bytes.Contains(wasm, tagSection) {
+			t.Fatalf("expected tag section %x in %x", tagSection, wasm)
+		}
+
+		exportedTag := []byte{0x05, 0x65, 0x72, 0x72, 0x6F, 0x72, 0x04, 0x00}
+		if !bytes.Contains(wasm, exportedTag) {
+			t.Fatalf("expected tag export %x in %x", exportedTag, wasm)
+		}
+
+		body := []byte{
+			0x02, 0x7F, // block (result i32)
+			0x1F, 0x7F, 0x01, 0x00, 0x00, 0x00, // try_table (result i32) (catch 0 0)
+			0x20, 0x00, // local.get 0
+			0x08, 0x00, // throw 0
+			0x0B, 0x0B, 0x0B,
+		}
+		if !bytes.Contains(wasm, body) {
+			t.Fatalf("expected function body %x in %x", body, wasm)
+		}
+	})
+
+	t.Run("should import tags before defined tags", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		imported := wasmSymbolTable.ImportTag("env", "panic")
+		defined := wasmSymbolTable.AddTag(types.I64)
+
+		if imported.GetIndex() != 0 || defined.GetIndex() != 1 {
+			t.Fatalf("expected tag indices 0 and 1, got %d and %d", imported.GetIndex(), defined.GetIndex())
+		}
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable)
+		importedTag := []byte{0x03, 0x65, 0x6E, 0x76, 0x05, 0x70, 0x61, 0x6E, 0x69, 0x63, 0x04, 0x00, 0x00}
+		if wasm := mod.Build(); !bytes.Contains(wasm, importedTag) {
+			t.Fatalf("expected tag import %x in %x", importedTag, wasm)
+		}
+
+		wasmSymbolTable.ImportTag("env", "late")
+		if err := mod.Err(); !errors.Is(err, ErrImportOrder) {
+			t.Fatalf("expected %v, got %v", ErrImportOrder, err)
+		}
+	})
+
+	t.Run("should pass an exnref to catch_all_ref labels", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			// rethrow the parameter and return the caught exception
+			AddParam(types.ExnRef).
+			AddReturn(types.ExnRef).
+			AddInstrTryTable(types.EmptyType, CatchAllRef(0)).
+			AddInstrGetLocal(0).
+			AddInstrThrowRef().
+			AddInstrEnd().
+			AddInstrGetLocal(0).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("should reject catch clauses that do not match their label", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		tag := wasmSymbolTable.AddTag(types.I32, types.I32)
+
+		builder := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrBlock(types.I32).
+			AddInstrTryTable(types.EmptyType, Catch(tag, 0))
+
+		if err := builder.Err(); !errors.Is(err, ErrLabelTypeMismatch) {
+			t.Fatalf("expected %v, got %v", ErrLabelTypeMismatch, err)
+		}
+		if err := builder.Err().Error(); !strings.Contains(err, "catch provides [i32 i32], label at depth 0 expects [i32]") {
+			t.Fatalf("expected the value types in the message, got %q", err)
+		}
+	})
+
+	t.Run("should reject catch clauses to labels out of scope", func(t *testing.T) {
+		builder := NewWasmFunctionBuilder(NewSymbolTable(nil)).
+			AddInstrTryTable(types.EmptyType, CatchAll(1))
+
+		if err := builder.Err(); !errors.Is(err, ErrInvalidLabel) {
+			t.Fatalf("expected %v, got %v", ErrInvalidLabel, err)
+		}
+	})
+}
@@ -0,0 +1,488 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Typed expressions are trees of values that are lowered into the instruction stream of a
+// WasmFunctionBuilder, operands first. Operators are only defined between expressions of the
+// same type, so that most type errors are caught by the Go compiler. References to locals,
+// globals and functions are checked when the expression is lowered, and mismatches are
+// reported through the Err of the builder. An expression is lowered again every time it is
+// used, so a subtree with side effects should be stored in a local first.
+type wasmExprNode struct {
+	lower     func(b *WasmFunctionBuilder)
+	valueType types.WasmType
+}
+
+// I32Expr is an expression that produces an i32. Comparisons of all types produce an I32Expr,
+// which is the type of conditions.
+type I32Expr struct{ node *wasmExprNode }
+
+// I64Expr is an expression that produces an i64.
+type I64Expr struct{ node *wasmExprNode }
+
+// F64Expr is an expression that produces an f64.
+type F64Expr struct{ node *wasmExprNode }
+
+// WasmExpr is implemented by every typed expression.
+type WasmExpr interface {
+	exprNode() *wasmExprNode
+}
+
+// WasmTypedExpr constrains generic expression helpers, such as Call and IfElse, whose result
+// type is chosen by the caller.
+type WasmTypedExpr interface {
+	I32Expr | I64Expr | F64Expr
+	WasmExpr
+}
+
+func (e I32Expr) exprNode() *wasmExprNode { return e.node }
+func (e I64Expr) exprNode() *wasmExprNode { return e.node }
+func (e F64Expr) exprNode() *wasmExprNode { return e.node }
+
+func exprType[E WasmTypedExpr]() types.WasmType {
+	var zero E
+	switch any(zero).(type) {
+	case I32Expr:
+		return types.I32
+	case I64Expr:
+		return types.I64
+	default:
+		return types.F64
+	}
+}
+
+func newExpr[E WasmTypedExpr](lower func(b *WasmFunctionBuilder)) E {
+	return E{node: &wasmExprNode{lower: lower, valueType: exprType[E]()}}
+}
+
+func opExpr[E WasmTypedExpr](op instructions.WasmInstruction, operands ...WasmExpr) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		for _, operand := range operands {
+			b.lowerExpr(operand)
+		}
+		b.addInstrNumeric(op)
+	})
+}
+
+func (b *WasmFunctionBuilder) lowerExpr(e WasmExpr) bool {
+	node := e.exprNode()
+	if node == nil {
+		b.fail(fmt.Errorf("%w: expression is not initialized", ErrInvalidExpr))
+		return false
+	}
+	node.lower(b)
+	return true
+}
+
+// Checks that a value of the expression can be stored in a location of the expected type.
+func (b *WasmFunctionBuilder) checkExprType(e WasmExpr, expected WasmValueType, what string) bool {
+	node := e.exprNode()
+	if node != nil && ValType(node.valueType) != expected {
+		b.fail(fmt.Errorf("%w: %s expects %v, got %v", ErrTypeMismatch, what, expected, ValType(node.valueType)))
+		return false
+	}
+	return true
+}
+
+func (b *WasmFunctionBuilder) checkExprArgs(params []WasmValueType, args []WasmExpr) bool {
+	if len(params) != len(args) {
+		b.fail(fmt.Errorf("%w: callee expects %d arguments, got %d", ErrTypeMismatch, len(params), len(args)))
+		return false
+	}
+	for i, arg := range args {
+		if !b.checkExprType(arg, params[i], fmt.Sprintf("argument %d", i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *WasmFunctionBuilder) checkExprResults(results []WasmValueType, expected types.WasmType) bool {
+	if len(results) != 1 || results[0] != ValType(expected) {
+		b.fail(fmt.Errorf("%w: callee returns %v, expected %v", ErrTypeMismatch, results, ValType(expected)))
+		return false
+	}
+	return true
+}
+
+func I32(value int32) I32Expr {
+	return newExpr[I32Expr](func(b *WasmFunctionBuilder) { b.AddInstrConstI32(value) })
+}
+
+func I64(value int64) I64Expr {
+	return newExpr[I64Expr](func(b *WasmFunctionBuilder) { b.AddInstrConstI64(value) })
+}
+
+func F64(value float64) F64Expr {
+	return newExpr[F64Expr](func(b *WasmFunctionBuilder) { b.AddInstrConstF64(value) })
+}
+
+func localExpr[E WasmTypedExpr](idx uint64) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if localType, ok := b.localType(idx); ok && localType != ValType(exprType[E]()) {
+			b.fail(fmt.Errorf("%w: local %d is %v, read as %v", ErrTypeMismatch, idx, localType, ValType(exprType[E]())))
+			return
+		}
+		b.AddInstrGetLocal(idx)
+	})
+}
+
+// Reads the parameter or local with the given index.
+func LocalI32(idx uint64) I32Expr { return localExpr[I32Expr](idx) }
+func LocalI64(idx uint64) I64Expr { return localExpr[I64Expr](idx) }
+func LocalF64(idx uint64) F64Expr { return localExpr[F64Expr](idx) }
+
+// Reads the parameter or local of the handle, such as LocalExpr[I32Expr](counter). The type
+// of the expression must match the type of the local.
+func LocalExpr[E WasmTypedExpr](local WasmLocal) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if !b.checkHandle(local) {
+			return
+		}
+		if local.valueType != ValType(exprType[E]()) {
+			b.fail(fmt.Errorf("%w: local %d is %v, read as %v", ErrTypeMismatch, local.index, local.valueType, ValType(exprType[E]())))
+			return
+		}
+		b.AddInstrGetLocal(local.index)
+	})
+}
+
+func globalExpr[E WasmTypedExpr](global *WasmGlobal) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if global.Type != ValType(exprType[E]()) {
+			b.fail(fmt.Errorf("%w: global %d is %v, read as %v", ErrTypeMismatch, global.index, global.Type, ValType(exprType[E]())))
+			return
+		}
+		b.AddInstrGlobalGet(global)
+	})
+}
+
+// Reads the value of a global declared on the symbol table of the function.
+func GlobalI32(global *WasmGlobal) I32Expr { return globalExpr[I32Expr](global) }
+func GlobalI64(global *WasmGlobal) I64Expr { return globalExpr[I64Expr](global) }
+func GlobalF64(global *WasmGlobal) F64Expr { return globalExpr[F64Expr](global) }
+
+// Returns the address type of the memory the memory argument refers to.
+func (b *WasmFunctionBuilder) addressType(memArg WasmMemArg) WasmValueType {
+	memory := memArg.Memory
+	if memory == nil {
+		memory = b.symbolTable.memory(0)
+	}
+	if memory != nil && memory.Memory64 {
+		return ValType(types.I64)
+	}
+	return ValType(types.I32)
+}
+
+func loadExpr[E WasmTypedExpr](addr WasmExpr, memArg WasmMemArg, load func(b *WasmFunctionBuilder, memArg WasmMemArg) *WasmFunctionBuilder) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if !b.checkExprType(addr, b.addressType(memArg), "address") || !b.lowerExpr(addr) {
+			return
+		}
+		load(b, memArg)
+	})
+}
+
+// Loads a value from linear memory. The address is an I32Expr, or an I64Expr for 64-bit
+// memories.
+func LoadI32(addr WasmExpr, memArg WasmMemArg) I32Expr {
+	return loadExpr[I32Expr](addr, memArg, (*WasmFunctionBuilder).AddInstrLoadI32)
+}
+
+func LoadI64(addr WasmExpr, memArg WasmMemArg) I64Expr {
+	return loadExpr[I64Expr](addr, memArg, (*WasmFunctionBuilder).AddInstrLoadI64)
+}
+
+func LoadF64(addr WasmExpr, memArg WasmMemArg) F64Expr {
+	return loadExpr[F64Expr](addr, memArg, (*WasmFunctionBuilder).AddInstrLoadF64)
+}
+
+// Calls a function with the given arguments. The function must return a single value of the
+// type of the expression, such as Call[I32Expr](f, LocalI32(0)).
+func Call[E WasmTypedExpr](f *WasmFunctionModule, args ...WasmExpr) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if !b.checkExprArgs(f.paramTypes, args) || !b.checkExprResults(f.resultTypes, exprType[E]()) {
+			return
+		}
+		for _, arg := range args {
+			b.lowerExpr(arg)
+		}
+		b.AddInstrCall(f)
+	})
+}
+
+// Calls an imported function with the given arguments.
+func CallImport[E WasmTypedExpr](f *WasmImportDeclaration, args ...WasmExpr) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if !b.checkExprArgs(valTypes(f.ParamTypes), args) || !b.checkExprResults(valTypes(f.ResultTypes), exprType[E]()) {
+			return
+		}
+		for _, arg := range args {
+			b.lowerExpr(arg)
+		}
+		b.AddInstrCallImport(f)
+	})
+}
+
+// Calls the function that is being built, which allows recursive expressions.
+func CallSelf[E WasmTypedExpr](args ...WasmExpr) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if !b.checkExprArgs(b.paramTypes, args) || !b.checkExprResults(b.resultTypes, exprType[E]()) {
+			return
+		}
+		for _, arg := range args {
+			b.lowerExpr(arg)
+		}
+		b.AddInstrCallSelf()
+	})
+}
+
+// Evaluates to then if the condition is not zero and to otherwise if it is. Only the selected
+// branch is evaluated.
+func IfElse[E WasmTypedExpr](cond I32Expr, then E, otherwise E) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		b.lowerExpr(cond)
+		b.AddInstrIf(exprType[E]())
+		b.lowerExpr(then)
+		b.AddInstrElse()
+		b.lowerExpr(otherwise)
+		b.AddInstrEnd()
+	})
+}
+
+// Evaluates both operands and picks a if the condition is not zero, or b if it is.
+func Select[E WasmTypedExpr](cond I32Expr, a E, b E) E {
+	return opExpr[E](instructions.Select, a, b, cond)
+}
+
+func teeExpr[E WasmTypedExpr](e E, idx uint64) E {
+	return newExpr[E](func(b *WasmFunctionBuilder) {
+		if localType, ok := b.localType(idx); ok && !b.checkExprType(e, localType, fmt.Sprintf("local %d", idx)) {
+			return
+		}
+		b.lowerExpr(e)
+		b.AddInstrLocalTee(idx)
+	})
+}
+
+func (e I32Expr) Add(o I32Expr) I32Expr { return opExpr[I32Expr](instructions.AddI32, e, o) }
+func (e I32Expr) Sub(o I32Expr) I32Expr { return opExpr[I32Expr](instructions.SubI32, e, o) }
+func (e I32Expr) Mul(o I32Expr) I32Expr { return opExpr[I32Expr](instructions.MulI32, e, o) }
+func (e I32Expr) DivS(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.DivI32, e, o)
+}
+func (e I32Expr) And(o I32Expr) I32Expr { return opExpr[I32Expr](instructions.AndI32, e, o) }
+func (e I32Expr) Or(o I32Expr) I32Expr  { return opExpr[I32Expr](instructions.OrI32, e, o) }
+func (e I32Expr) Eq(o I32Expr) I32Expr  { return opExpr[I32Expr](instructions.EqualI32, e, o) }
+func (e I32Expr) Ne(o I32Expr) I32Expr  { return opExpr[I32Expr](instructions.NotEqualI32, e, o) }
+func (e I32Expr) LtS(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanSignedI32, e, o)
+}
+func (e I32Expr) LtU(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanUnsignedI32, e, o)
+}
+func (e I32Expr) GtS(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanSignedI32, e, o)
+}
+func (e I32Expr) GtU(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanUnsignedI32, e, o)
+}
+func (e I32Expr) LeS(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanEqualSignedI32, e, o)
+}
+func (e I32Expr) LeU(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanEqualUnsignedI32, e, o)
+}
+func (e I32Expr) GeS(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanEqualSignedI32, e, o)
+}
+func (e I32Expr) GeU(o I32Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanEqualUnsignedI32, e, o)
+}
+func (e I32Expr) Eqz() I32Expr      { return opExpr[I32Expr](instructions.EqzI32, e) }
+func (e I32Expr) ExtendS() I64Expr  { return opExpr[I64Expr](instructions.ExtendI32SignedI64, e) }
+func (e I32Expr) ExtendU() I64Expr  { return opExpr[I64Expr](instructions.ExtendI32UnsignedI64, e) }
+func (e I32Expr) ConvertS() F64Expr { return opExpr[F64Expr](instructions.ConvertI32SignedF64, e) }
+
+// Stores the value in a local and keeps it as the value of the expression.
+func (e I32Expr) Tee(idx uint64) I32Expr { return teeExpr(e, idx) }
+
+func (e I64Expr) Add(o I64Expr) I64Expr { return opExpr[I64Expr](instructions.AddI64, e, o) }
+func (e I64Expr) Sub(o I64Expr) I64Expr { return opExpr[I64Expr](instructions.SubI64, e, o) }
+func (e I64Expr) Mul(o I64Expr) I64Expr { return opExpr[I64Expr](instructions.MulI64, e, o) }
+func (e I64Expr) DivS(o I64Expr) I64Expr {
+	return opExpr[I64Expr](instructions.DivI64, e, o)
+}
+func (e I64Expr) Eq(o I64Expr) I32Expr { return opExpr[I32Expr](instructions.EqualI64, e, o) }
+func (e I64Expr) Ne(o I64Expr) I32Expr { return opExpr[I32Expr](instructions.NotEqualI64, e, o) }
+func (e I64Expr) LtS(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanSignedI64, e, o)
+}
+func (e I64Expr) LtU(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanUnsignedI64, e, o)
+}
+func (e I64Expr) GtS(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanSignedI64, e, o)
+}
+func (e I64Expr) GtU(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanUnsignedI64, e, o)
+}
+func (e I64Expr) LeS(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanEqualSignedI64, e, o)
+}
+func (e I64Expr) LeU(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanEqualUnsignedI64, e, o)
+}
+func (e I64Expr) GeS(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanEqualSignedI64, e, o)
+}
+func (e I64Expr) GeU(o I64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanEqualUnsignedI64, e, o)
+}
+func (e I64Expr) Eqz() I32Expr           { return opExpr[I32Expr](instructions.EqzI64, e) }
+func (e I64Expr) Wrap() I32Expr          { return opExpr[I32Expr](instructions.WrapI64, e) }
+func (e I64Expr) ConvertS() F64Expr      { return opExpr[F64Expr](instructions.ConvertI64SignedF64, e) }
+func (e I64Expr) Tee(idx uint64) I64Expr { return teeExpr(e, idx) }
+
+func (e F64Expr) Add(o F64Expr) F64Expr { return opExpr[F64Expr](instructions.AddF64, e, o) }
+func (e F64Expr) Sub(o F64Expr) F64Expr { return opExpr[F64Expr](instructions.SubF64, e, o) }
+func (e F64Expr) Mul(o F64Expr) F64Expr { return opExpr[F64Expr](instructions.MulF64, e, o) }
+func (e F64Expr) Div(o F64Expr) F64Expr { return opExpr[F64Expr](instructions.DivF64, e, o) }
+func (e F64Expr) Neg() F64Expr          { return opExpr[F64Expr](instructions.NegF64, e) }
+func (e F64Expr) Eq(o F64Expr) I32Expr  { return opExpr[I32Expr](instructions.EqualF64, e, o) }
+func (e F64Expr) Ne(o F64Expr) I32Expr  { return opExpr[I32Expr](instructions.NotEqualF64, e, o) }
+func (e F64Expr) Lt(o F64Expr) I32Expr  { return opExpr[I32Expr](instructions.LessThanF64, e, o) }
+func (e F64Expr) Gt(o F64Expr) I32Expr  { return opExpr[I32Expr](instructions.GreaterThanF64, e, o) }
+func (e F64Expr) Le(o F64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.LessThanEqualF64, e, o)
+}
+func (e F64Expr) Ge(o F64Expr) I32Expr {
+	return opExpr[I32Expr](instructions.GreaterThanEqualF64, e, o)
+}
+
+// Truncates towards zero. Traps if the value does not fit the integer type.
+func (e F64Expr) TruncS() I32Expr        { return opExpr[I32Expr](instructions.TruncF64SignedI32, e) }
+func (e F64Expr) TruncI64S() I64Expr     { return opExpr[I64Expr](instructions.TruncF64SignedI64, e) }
+func (e F64Expr) Tee(idx uint64) F64Expr { return teeExpr(e, idx) }
+
+// Lowers the expression and leaves its value on the stack, for example as the result of the
+// function.
+func (b *WasmFunctionBuilder) AddExpr(e WasmExpr) *WasmFunctionBuilder {
+	b.lowerExpr(e)
+	return b
+}
+
+// Evaluates the expression for its side effects and discards its value.
+func (b *WasmFunctionBuilder) AddExprDrop(e WasmExpr) *WasmFunctionBuilder {
+	if b.lowerExpr(e) {
+		b.AddInstrDrop()
+	}
+	return b
+}
+
+// Returns the value of the expression from the function.
+func (b *WasmFunctionBuilder) AddExprReturn(e WasmExpr) *WasmFunctionBuilder {
+	if b.lowerExpr(e) {
+		b.AddInstrReturn()
+	}
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddExprSetLocal(idx uint64, e WasmExpr) *WasmFunctionBuilder {
+	if localType, ok := b.localType(idx); ok && !b.checkExprType(e, localType, fmt.Sprintf("local %d", idx)) {
+		return b
+	}
+	if b.lowerExpr(e) {
+		b.AddInstrSetLocal(idx)
+	}
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddExprSetLocalHandle(local WasmLocal, e WasmExpr) *WasmFunctionBuilder {
+	if !b.checkHandle(local) {
+		return b
+	}
+	return b.AddExprSetLocal(local.index, e)
+}
+
+func (b *WasmFunctionBuilder) AddExprSetGlobal(global *WasmGlobal, e WasmExpr) *WasmFunctionBuilder {
+	if !b.checkExprType(e, global.Type, fmt.Sprintf("global %d", global.index)) {
+		return b
+	}
+	if b.lowerExpr(e) {
+		b.AddInstrGlobalSet(global)
+	}
+	return b
+}
+
+// Stores the value in linear memory, using the store instruction of the type of the value.
+func (b *WasmFunctionBuilder) AddExprStore(addr WasmExpr, value WasmExpr, memArg WasmMemArg) *WasmFunctionBuilder {
+	if !b.checkExprType(addr, b.addressType(memArg), "address") || !b.lowerExpr(addr) || !b.lowerExpr(value) {
+		return b
+	}
+
+	switch value.exprNode().valueType {
+	case types.I32:
+		b.AddInstrStoreI32(memArg)
+	case types.I64:
+		b.AddInstrStoreI64(memArg)
+	default:
+		b.AddInstrStoreF64(memArg)
+	}
+	return b
+}
+
+// Runs then if the condition is not zero, and otherwise if it is. The otherwise branch may be
+// nil. Both branches must leave the stack as they found it.
+func (b *WasmFunctionBuilder) AddIfElse(cond I32Expr, then func(b *WasmFunctionBuilder), otherwise func(b *WasmFunctionBuilder)) *WasmFunctionBuilder {
+	if !b.lowerExpr(cond) {
+		return b
+	}
+
+	b.AddInstrIf(types.EmptyType)
+	then(b)
+	if otherwise != nil {
+		b.AddInstrElse()
+		otherwise(b)
+	}
+	return b.AddInstrEnd()
+}
+
+// Runs the body as long as the condition is not zero. Directly inside the body, AddInstrBr(0)
+// continues with the next iteration and AddInstrBr(2) leaves the loop.
+func (b *WasmFunctionBuilder) AddWhile(cond I32Expr, body func(b *WasmFunctionBuilder)) *WasmFunctionBuilder {
+	return b.AddFor(nil, cond, nil, body)
+}
+
+// Runs init once, then runs the body followed by step as long as the condition is not zero.
+// Init and step may be nil. Directly inside the body, AddInstrBr(0) continues with the step
+// and AddInstrBr(2) leaves the loop.
+func (b *WasmFunctionBuilder) AddFor(init func(b *WasmFunctionBuilder), cond I32Expr, step func(b *WasmFunctionBuilder), body func(b *WasmFunctionBuilder)) *WasmFunctionBuilder {
+	if init != nil {
+		init(b)
+	}
+
+	// block $break (loop $next (br_if $break (eqz cond)) (block $continue body) step (br $next))
+	b.AddInstrBlock(types.EmptyType)
+	b.AddInstrLoop(types.EmptyType)
+	if b.lowerExpr(cond) {
+		b.AddInstrEqzI32()
+	}
+	b.AddInstrBrIf(1)
+
+	b.AddInstrBlock(types.EmptyType)
+	body(b)
+	b.AddInstrEnd()
+
+	if step != nil {
+		step(b)
+	}
+	b.AddInstrBr(0)
+	b.AddInstrEnd()
+	return b.AddInstrEnd()
+}
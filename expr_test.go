@@ -0,0 +1,162 @@
+package gowasmtk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestExpr(t *testing.T) {
+	t.Run("should lower for loops over typed locals", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		n, acc, i := LocalI32(0), LocalI64(1), LocalI32(2)
+
+		// factorial(n) computed with a for loop over an i64 accumulator
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I64).
+			AddLocal(1, types.I64).
+			AddLocal(1, types.I32).
+			AddExprSetLocal(1, I64(1)).
+			AddFor(
+				func(b *WasmFunctionBuilder) { b.AddExprSetLocal(2, I32(1)) },
+				i.LeS(n),
+				func(b *WasmFunctionBuilder) { b.AddExprSetLocal(2, i.Add(I32(1))) },
+				func(b *WasmFunctionBuilder) { b.AddExprSetLocal(1, acc.Mul(i.ExtendS())) },
+			).
+			AddExpr(acc).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{10},
+			expected:   int64(3628800),
+		})
+	})
+
+	t.Run("should lower recursive conditional expressions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		n := LocalI32(0)
+
+		fib := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(IfElse(n.LtS(I32(2)),
+				n,
+				CallSelf[I32Expr](n.Sub(I32(1))).Add(CallSelf[I32Expr](n.Sub(I32(2)))),
+			)).
+			AddInstrEnd().
+			Build()
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddExpr(Call[I32Expr](&fib, I32(20))).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&fib).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{},
+			expected:   int32(6765),
+		})
+	})
+
+	t.Run("should break out of while loops and access memory", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		x, sum := LocalF64(0), LocalF64(1)
+		stored := LoadF64(I32(16), WasmMemArg{Align: 3})
+
+		// add x to the value in memory until it exceeds 100, then return it rounded down
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.F64).
+			AddReturn(types.I32).
+			AddLocal(1, types.F64).
+			AddExprStore(I32(16), F64(0.5), WasmMemArg{Align: 3}).
+			AddWhile(I32(1), func(b *WasmFunctionBuilder) {
+				b.AddExprStore(I32(16), stored.Add(x), WasmMemArg{Align: 3}).
+					AddIfElse(stored.Gt(F64(100)), func(b *WasmFunctionBuilder) {
+						b.AddInstrBr(3)
+					}, nil)
+			}).
+			AddExprSetLocal(1, stored).
+			AddExpr(Select(sum.Lt(F64(0)), sum.Neg(), sum).TruncS()).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{7.5},
+			expected:   int32(105),
+		})
+	})
+
+	t.Run("should reject expressions that do not match locals and callees", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		callee := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(LocalI32(0)).
+			AddInstrEnd().
+			Build()
+
+		wrongLocal := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddExprDrop(LocalI64(0))
+		if err := wrongLocal.Err(); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected %v, got %v", ErrTypeMismatch, err)
+		}
+
+		wrongResult := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddExprDrop(Call[I64Expr](&callee, I32(1)))
+		if err := wrongResult.Err(); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected %v, got %v", ErrTypeMismatch, err)
+		}
+
+		wrongArgs := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddExprDrop(Call[I32Expr](&callee, F64(1)))
+		if err := wrongArgs.Err(); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected %v, got %v", ErrTypeMismatch, err)
+		}
+
+		uninitialized := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddExprDrop(I32Expr{})
+		if err := uninitialized.Err(); !errors.Is(err, ErrInvalidExpr) {
+			t.Fatalf("expected %v, got %v", ErrInvalidExpr, err)
+		}
+	})
+}
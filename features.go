@@ -0,0 +1,187 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmFeatures is a set of post-MVP WebAssembly proposals. A module builder only accepts
+// instructions, types and sections of the enabled proposals, so that modules can target
+// runtimes that implement the MVP or a specific subset of the proposals.
+type WasmFeatures uint32
+
+const (
+	FeatureMultiValue WasmFeatures = 1 << iota
+	FeatureSIMD
+	FeatureThreads
+	FeatureTailCall
+	FeatureGC
+	FeatureExceptions
+	FeatureReferenceTypes
+	FeatureFunctionReferences
+	FeatureMultiMemory
+	FeatureMemory64
+	FeatureExtendedConst
+	FeatureMutableGlobals
+
+	FeaturesMVP WasmFeatures = 0
+	FeaturesAll WasmFeatures = 1<<iota - 1
+)
+
+// Names of the features as they appear in the target_features custom section.
+var featureNames = []struct {
+	feature WasmFeatures
+	name    string
+}{
+	{FeatureMultiValue, "multivalue"},
+	{FeatureSIMD, "simd128"},
+	{FeatureThreads, "atomics"},
+	{FeatureTailCall, "tail-call"},
+	{FeatureGC, "gc"},
+	{FeatureExceptions, "exception-handling"},
+	{FeatureReferenceTypes, "reference-types"},
+	{FeatureFunctionReferences, "function-references"},
+	{FeatureMultiMemory, "multimemory"},
+	{FeatureMemory64, "memory64"},
+	{FeatureExtendedConst, "extended-const"},
+	{FeatureMutableGlobals, "mutable-globals"},
+}
+
+// Returns the names of the features in the set.
+func (f WasmFeatures) Names() []string {
+	names := []string{}
+	for _, entry := range featureNames {
+		if f&entry.feature != 0 {
+			names = append(names, entry.name)
+		}
+	}
+	return names
+}
+
+func (f WasmFeatures) String() string {
+	if f == FeaturesMVP {
+		return "mvp"
+	}
+	return strings.Join(f.Names(), ",")
+}
+
+func (b *WasmFunctionBuilder) use(features WasmFeatures) {
+	b.features |= features
+}
+
+// Returns the features required by a value type.
+func valueTypeFeatures(v WasmValueType) WasmFeatures {
+	code := v.code
+	if v.isRef() {
+		if v.heap.isConcrete() || !v.nullable {
+			// Concrete and non-nullable references are typed function references.
+			if v.heap.isConcrete() {
+				return FeatureFunctionReferences
+			}
+			return FeatureFunctionReferences | valueTypeFeatures(ValType(v.heap.abstract))
+		}
+		code = v.heap.abstract
+	}
+
+	switch code {
+	case types.V128:
+		return FeatureSIMD
+	case types.FuncRef, types.ExternRef:
+		return FeatureReferenceTypes
+	case types.ExnRef:
+		return FeatureExceptions
+	case types.AnyRef, types.EqRef, types.I31Ref, types.StructRef, types.ArrayRef,
+		types.NullRef, types.NullExternRef, types.NullFuncRef:
+		return FeatureGC
+	}
+	return FeaturesMVP
+}
+
+// Returns the features required by the types of a rec group.
+func (g *wasmRecGroup) requiredFeatures() WasmFeatures {
+	features := FeaturesMVP
+	if len(g.types) > 1 {
+		features |= FeatureGC
+	}
+
+	for _, t := range g.types {
+		sub := t.subType
+		if sub.composite != compositeFunc || !sub.final || len(sub.supertypes) > 0 {
+			features |= FeatureGC
+		}
+		if len(sub.results) > 1 {
+			features |= FeatureMultiValue
+		}
+		for _, v := range append(append([]WasmValueType{}, sub.params...), sub.results...) {
+			features |= valueTypeFeatures(v)
+		}
+		for _, field := range sub.fields {
+			features |= valueTypeFeatures(field.Type)
+		}
+	}
+	return features
+}
+
+// Returns the features used by the module, from the entities declared in the symbol table
+// and from the functions, segments and exports added to the module.
+func (b *WasmModuleBuilder) UsedFeatures() WasmFeatures {
+	features := b.usedFeatures
+
+	for _, group := range b.symbolTable.typeGroups {
+		features |= group.requiredFeatures()
+	}
+
+	if len(b.symbolTable.tags) > 0 {
+		features |= FeatureExceptions
+	}
+
+	if len(b.symbolTable.memories) > 1 {
+		features |= FeatureMultiMemory
+	}
+	for _, memory := range b.symbolTable.memories {
+		if memory.Shared {
+			features |= FeatureThreads
+		}
+		if memory.Memory64 {
+			features |= FeatureMemory64
+		}
+	}
+
+	for _, global := range b.symbolTable.globals {
+		features |= valueTypeFeatures(global.Type)
+		if global.imported() && global.Mutable {
+			features |= FeatureMutableGlobals
+		}
+		if global.init != nil {
+			features |= global.init.requiredFeatures()
+		}
+	}
+
+	return features
+}
+
+// Restricts the module to the given set of features. Using an instruction, type or section of
+// a proposal outside of the set makes Err and BuildWasmFile report ErrFeatureDisabled. All
+// features are enabled by default.
+func (b *WasmModuleBuilder) WithFeatures(features WasmFeatures) *WasmModuleBuilder {
+	b.features = features
+	return b
+}
+
+func (b *WasmModuleBuilder) checkFeatures() error {
+	if disabled := b.UsedFeatures() &^ b.features; disabled != 0 {
+		return fmt.Errorf("%w: %s", ErrFeatureDisabled, disabled)
+	}
+	return nil
+}
+
+func sectionTargetFeatures(features WasmFeatures) wasmSection {
+	entries := [][]byte{}
+	for _, name := range features.Names() {
+		// The '+' prefix marks a feature that is used by the module.
+		entries = append(entries, append([]byte{'+'}, encodeString(name)...))
+	}
+	return sectionCustom("target_features", vecNested(entries))
+}
@@ -0,0 +1,139 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestFeatures(t *testing.T) {
+	t.Run("should not emit target features for MVP modules", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			WithFeatures(FeaturesMVP).
+			AddFunction(&main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if used := mod.UsedFeatures(); used != FeaturesMVP {
+			t.Fatalf("expected no features, got %v", used)
+		}
+		if bytes.Contains(mod.Build(), []byte("target_features")) {
+			t.Fatalf("expected no target_features section")
+		}
+	})
+
+	t.Run("should reject instructions of disabled proposals", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrReturnCallSelf().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			WithFeatures(FeaturesMVP).
+			AddFunction(&main)
+
+		if err := mod.Err(); !errors.Is(err, ErrFeatureDisabled) {
+			t.Fatalf("expected %v, got %v", ErrFeatureDisabled, err)
+		}
+		if err := mod.BuildWasmFile("tailcall.wasm"); !errors.Is(err, ErrFeatureDisabled) {
+			t.Fatalf("expected %v, got %v", ErrFeatureDisabled, err)
+		}
+
+		mod.WithFeatures(FeatureTailCall)
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("should describe the used features in the target_features section", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1, Max: 1, HasMax: true, Shared: true})
+		counter := wasmSymbolTable.AddGlobal(ValType(types.I32), true, NewWasmConstExpr().AddInstrConstI32(0))
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrConstI32(1).
+			AddInstrAtomic(instructions.AtomicRmwAddI32, WasmMemArg{Align: 2}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("memory", types.ExportMemoryType, memory).
+			Export("counter", types.ExportGlobalType, counter)
+
+		used := mod.UsedFeatures()
+		if !slices.Equal(used.Names(), []string{"atomics", "mutable-globals"}) {
+			t.Fatalf("expected atomics and mutable-globals, got %v", used)
+		}
+
+		section := []byte{
+			0x00, 0x2B, 0x0F, 't', 'a', 'r', 'g', 'e', 't', '_', 'f', 'e', 'a', 't', 'u', 'r', 'e', 's',
+			0x02,
+			'+', 0x07, 'a', 't', 'o', 'm', 'i', 'c', 's',
+			'+', 0x0F, 'm', 'u', 't', 'a', 'b', 'l', 'e', '-', 'g', 'l', 'o', 'b', 'a', 'l', 's',
+		}
+		if !bytes.HasSuffix(mod.Build(), section) {
+			t.Fatalf("expected target_features section %x at the end of %x", section, mod.Build())
+		}
+	})
+
+	t.Run("should derive features from declared types", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddType(StructType(WasmFieldType{Type: ValType(types.I32), Mutable: true}))
+		wasmSymbolTable.AddType(FuncType(nil, []WasmValueType{ValType(types.I32), ValType(types.I64)}))
+		wasmSymbolTable.AddTag(types.I32)
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			WithFeatures(FeatureGC | FeatureMultiValue)
+
+		if used := mod.UsedFeatures(); used != FeatureGC|FeatureMultiValue|FeatureExceptions {
+			t.Fatalf("expected gc, multivalue and exception-handling, got %v", used)
+		}
+		if err := mod.Err(); !errors.Is(err, ErrFeatureDisabled) {
+			t.Fatalf("expected %v, got %v", ErrFeatureDisabled, err)
+		}
+	})
+	t.Run("should require simd128 for v128 values", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		identity := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.V128).
+			AddReturn(types.V128).
+			AddInstrGetLocal(0).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&identity).
+			WithFeatures(FeaturesMVP)
+
+		if used := mod.UsedFeatures(); used != FeatureSIMD {
+			t.Fatalf("expected simd128, got %v", used)
+		}
+		if err := mod.Err(); !errors.Is(err, ErrFeatureDisabled) {
+			t.Fatalf("expected %v, got %v", ErrFeatureDisabled, err)
+		}
+		if wasm := mod.Build(); !bytes.Contains(wasm, []byte("+\x07simd128")) {
+			t.Fatalf("expected simd128 in the target_features section of %x", wasm)
+		}
+	})
+}
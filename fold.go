@@ -0,0 +1,672 @@
+package gowasmtk
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Folds arithmetic on constants, replaces reads of locals that hold a known constant with the
+// constant, and removes branches on constant conditions. Instructions that would trap, such
+// as division by zero, are left in place.
+func WithConstantFolding() WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		FoldConstants(m)
+		return nil
+	}
+}
+
+// Applies the constant folding of WithConstantFolding to every function of the module.
+func FoldConstants(m *WasmDecodedModule) {
+	for i := range m.Code {
+		params := 0
+		if t := m.typeAt(m.Functions[i]); t != nil {
+			params = len(t.Params)
+		}
+		m.Code[i].Body = foldConstants(m.Code[i], params)
+	}
+}
+
+// A constant of a numeric type. The bits of i32 and f32 constants are zero-extended.
+type wasmConst struct {
+	t    types.WasmType
+	bits uint64
+}
+
+// The bits of the canonical NaNs, which are the results of arithmetic on constants whose
+// result is not a number.
+const (
+	canonicalNaN32 uint64 = 0x7FC00000
+	canonicalNaN64 uint64 = 0x7FF8000000000000
+)
+
+func constOf(in WasmInstr) (wasmConst, bool) {
+	if in.data != nil {
+		// the address of a data symbol is only known once the linker placed it
+		return wasmConst{}, false
+	}
+	switch in.Opcode {
+	case WasmOpcode(instructions.ConstI32):
+		return wasmConst{types.I32, uint64(uint32(in.Immediates[0]))}, true
+	case WasmOpcode(instructions.ConstI64):
+		return wasmConst{types.I64, in.Immediates[0]}, true
+	case WasmOpcode(instructions.ConstF32):
+		return wasmConst{types.F32, in.Immediates[0]}, true
+	case WasmOpcode(instructions.ConstF64):
+		return wasmConst{types.F64, in.Immediates[0]}, true
+	}
+	return wasmConst{}, false
+}
+
+func (c wasmConst) instr() WasmInstr {
+	switch c.t {
+	case types.I32:
+		return Instr(WasmOpcode(instructions.ConstI32), uint64(int64(int32(c.bits))))
+	case types.I64:
+		return Instr(WasmOpcode(instructions.ConstI64), c.bits)
+	case types.F32:
+		return Instr(WasmOpcode(instructions.ConstF32), c.bits)
+	}
+	return Instr(WasmOpcode(instructions.ConstF64), c.bits)
+}
+
+func i32Const(v uint32) wasmConst { return wasmConst{types.I32, uint64(v)} }
+func i64Const(v uint64) wasmConst { return wasmConst{types.I64, v} }
+
+func boolConst(b bool) wasmConst {
+	if b {
+		return i32Const(1)
+	}
+	return i32Const(0)
+}
+
+func f32Const(f float32) wasmConst {
+	if f != f {
+		return wasmConst{types.F32, canonicalNaN32}
+	}
+	return wasmConst{types.F32, uint64(math.Float32bits(f))}
+}
+
+func f64Const(f float64) wasmConst {
+	if f != f {
+		return wasmConst{types.F64, canonicalNaN64}
+	}
+	return wasmConst{types.F64, math.Float64bits(f)}
+}
+
+func (c wasmConst) i32() uint32  { return uint32(c.bits) }
+func (c wasmConst) f32() float32 { return math.Float32frombits(uint32(c.bits)) }
+func (c wasmConst) f64() float64 { return math.Float64frombits(c.bits) }
+
+// Returns the operand type of a numeric instruction that consumes one or two operands of the
+// same type, or false if the instruction is not such an instruction.
+func numericOperand(op WasmOpcode) (types.WasmType, bool) {
+	switch {
+	case op == 0x45 || op >= 0x46 && op <= 0x4F || op >= 0x67 && op <= 0x78:
+		return types.I32, true
+	case op >= 0x50 && op <= 0x5A || op >= 0x79 && op <= 0x8A:
+		return types.I64, true
+	case op >= 0x5B && op <= 0x60 || op >= 0x8B && op <= 0x98:
+		return types.F32, true
+	case op >= 0x61 && op <= 0x66 || op >= 0x99 && op <= 0xA6:
+		return types.F64, true
+	}
+	return 0, false
+}
+
+// Returns whether the numeric instruction consumes two operands.
+func isBinary(op WasmOpcode) bool {
+	switch {
+	case op == 0x45 || op == 0x50 || op >= 0x67 && op <= 0x69 || op >= 0x79 && op <= 0x7B:
+		return false
+	case op >= 0x8B && op <= 0x91 || op >= 0x99 && op <= 0x9F:
+		return false
+	}
+	return true
+}
+
+// Evaluates an instruction with one operand, which is a comparison with zero, a bit count, a
+// float operation with one operand or a conversion. Returns false for instructions that are
+// not known or would trap.
+func foldUnary(op WasmOpcode, a wasmConst) (wasmConst, bool) {
+	switch op {
+	case 0x45:
+		return boolConst(a.i32() == 0), a.t == types.I32
+	case 0x50:
+		return boolConst(a.bits == 0), a.t == types.I64
+	case 0x67:
+		return i32Const(uint32(bits.LeadingZeros32(a.i32()))), true
+	case 0x68:
+		return i32Const(uint32(bits.TrailingZeros32(a.i32()))), true
+	case 0x69:
+		return i32Const(uint32(bits.OnesCount32(a.i32()))), true
+	case 0x79:
+		return i64Const(uint64(bits.LeadingZeros64(a.bits))), true
+	case 0x7A:
+		return i64Const(uint64(bits.TrailingZeros64(a.bits))), true
+	case 0x7B:
+		return i64Const(uint64(bits.OnesCount64(a.bits))), true
+
+	// abs, neg and copysign only change the sign bit, also of NaNs
+	case 0x8B:
+		return wasmConst{types.F32, a.bits &^ (1 << 31)}, true
+	case 0x8C:
+		return wasmConst{types.F32, a.bits ^ (1 << 31)}, true
+	case 0x8D:
+		return f32Const(float32(math.Ceil(float64(a.f32())))), true
+	case 0x8E:
+		return f32Const(float32(math.Floor(float64(a.f32())))), true
+	case 0x8F:
+		return f32Const(float32(math.Trunc(float64(a.f32())))), true
+	case 0x90:
+		return f32Const(float32(math.RoundToEven(float64(a.f32())))), true
+	case 0x91:
+		return f32Const(float32(math.Sqrt(float64(a.f32())))), true
+	case 0x99:
+		return wasmConst{types.F64, a.bits &^ (1 << 63)}, true
+	case 0x9A:
+		return wasmConst{types.F64, a.bits ^ (1 << 63)}, true
+	case 0x9B:
+		return f64Const(math.Ceil(a.f64())), true
+	case 0x9C:
+		return f64Const(math.Floor(a.f64())), true
+	case 0x9D:
+		return f64Const(math.Trunc(a.f64())), true
+	case 0x9E:
+		return f64Const(math.RoundToEven(a.f64())), true
+	case 0x9F:
+		return f64Const(math.Sqrt(a.f64())), true
+	}
+	return foldConversion(op, a)
+}
+
+// Truncates the float to a signed or unsigned integer of the given width. Returns false if
+// the conversion traps, which the saturating conversions never do.
+func truncate(f float64, signed bool, width uint, saturating bool) (uint64, bool) {
+	lo, hi := 0.0, math.Ldexp(1, int(width))
+	if signed {
+		lo, hi = -math.Ldexp(1, int(width)-1), math.Ldexp(1, int(width)-1)
+	}
+	mask := uint64(math.MaxUint64) >> (64 - width)
+
+	t := math.Trunc(f)
+	switch {
+	case f != f && saturating:
+		return 0, true
+	case f != f:
+		return 0, false
+	case t < lo && saturating:
+		return uint64(int64(lo)) & mask, true
+	case t >= hi && saturating && signed:
+		return mask >> 1, true
+	case t >= hi && saturating:
+		return mask, true
+	case t < lo || t >= hi:
+		return 0, false
+	case signed:
+		return uint64(int64(t)) & mask, true
+	}
+	return uint64(t), true
+}
+
+// A conversion between numeric types, and whether integers are treated as signed.
+type wasmConversion struct {
+	from, to types.WasmType
+	signed   bool
+}
+
+var conversions = map[WasmOpcode]wasmConversion{
+	0xA7: {types.I64, types.I32, false},
+	0xA8: {types.F32, types.I32, true}, 0xA9: {types.F32, types.I32, false},
+	0xAA: {types.F64, types.I32, true}, 0xAB: {types.F64, types.I32, false},
+	0xAC: {types.I32, types.I64, true}, 0xAD: {types.I32, types.I64, false},
+	0xAE: {types.F32, types.I64, true}, 0xAF: {types.F32, types.I64, false},
+	0xB0: {types.F64, types.I64, true}, 0xB1: {types.F64, types.I64, false},
+	0xB2: {types.I32, types.F32, true}, 0xB3: {types.I32, types.F32, false},
+	0xB4: {types.I64, types.F32, true}, 0xB5: {types.I64, types.F32, false},
+	0xB6: {types.F64, types.F32, false},
+	0xB7: {types.I32, types.F64, true}, 0xB8: {types.I32, types.F64, false},
+	0xB9: {types.I64, types.F64, true}, 0xBA: {types.I64, types.F64, false},
+	0xBB: {types.F32, types.F64, false},
+
+	// the saturating truncations
+	PrefixedOpcode(prefixMisc, 0): {types.F32, types.I32, true},
+	PrefixedOpcode(prefixMisc, 1): {types.F32, types.I32, false},
+	PrefixedOpcode(prefixMisc, 2): {types.F64, types.I32, true},
+	PrefixedOpcode(prefixMisc, 3): {types.F64, types.I32, false},
+	PrefixedOpcode(prefixMisc, 4): {types.F32, types.I64, true},
+	PrefixedOpcode(prefixMisc, 5): {types.F32, types.I64, false},
+	PrefixedOpcode(prefixMisc, 6): {types.F64, types.I64, true},
+	PrefixedOpcode(prefixMisc, 7): {types.F64, types.I64, false},
+}
+
+func foldConversion(op WasmOpcode, a wasmConst) (wasmConst, bool) {
+	// reinterpretations and sign extensions keep or extend the bits
+	switch op {
+	case 0xBC:
+		return wasmConst{types.I32, a.bits}, a.t == types.F32
+	case 0xBD:
+		return wasmConst{types.I64, a.bits}, a.t == types.F64
+	case 0xBE:
+		return wasmConst{types.F32, a.bits}, a.t == types.I32
+	case 0xBF:
+		return wasmConst{types.F64, a.bits}, a.t == types.I64
+	case 0xC0:
+		return i32Const(uint32(int32(int8(a.bits)))), a.t == types.I32
+	case 0xC1:
+		return i32Const(uint32(int32(int16(a.bits)))), a.t == types.I32
+	case 0xC2:
+		return i64Const(uint64(int64(int8(a.bits)))), a.t == types.I64
+	case 0xC3:
+		return i64Const(uint64(int64(int16(a.bits)))), a.t == types.I64
+	case 0xC4:
+		return i64Const(uint64(int64(int32(a.bits)))), a.t == types.I64
+	}
+
+	c, ok := conversions[op]
+	if !ok || c.from != a.t {
+		return wasmConst{}, false
+	}
+
+	switch {
+	case c.to == types.I32 && c.from == types.I64:
+		return i32Const(uint32(a.bits)), true
+	case c.to == types.I64 && c.from == types.I32 && c.signed:
+		return i64Const(uint64(int64(int32(a.bits)))), true
+	case c.to == types.I64 && c.from == types.I32:
+		return i64Const(uint64(uint32(a.bits))), true
+	case c.to == types.F64 && c.from == types.F32:
+		return f64Const(float64(a.f32())), true
+	case c.to == types.F32 && c.from == types.F64:
+		return f32Const(float32(a.f64())), true
+	}
+
+	if c.to == types.F32 || c.to == types.F64 {
+		var f float64
+		var f32 float32
+		switch {
+		case c.from == types.I32 && c.signed:
+			f, f32 = float64(int32(a.bits)), float32(int32(a.bits))
+		case c.from == types.I32:
+			f, f32 = float64(uint32(a.bits)), float32(uint32(a.bits))
+		case c.signed:
+			f, f32 = float64(int64(a.bits)), float32(int64(a.bits))
+		default:
+			f, f32 = float64(a.bits), float32(a.bits)
+		}
+		if c.to == types.F32 {
+			return f32Const(f32), true
+		}
+		return f64Const(f), true
+	}
+
+	f := a.f64()
+	if c.from == types.F32 {
+		f = float64(a.f32())
+	}
+	width := uint(32)
+	if c.to == types.I64 {
+		width = 64
+	}
+	v, ok := truncate(f, c.signed, width, op > 0xFF)
+	return wasmConst{c.to, v}, ok
+}
+
+// Evaluates an instruction with two operands of the same type. Returns false for
+// instructions that are not known or would trap.
+func foldBinary(op WasmOpcode, a, b wasmConst) (wasmConst, bool) {
+	switch op {
+	case 0x46:
+		return boolConst(a.i32() == b.i32()), true
+	case 0x47:
+		return boolConst(a.i32() != b.i32()), true
+	case 0x48:
+		return boolConst(int32(a.i32()) < int32(b.i32())), true
+	case 0x49:
+		return boolConst(a.i32() < b.i32()), true
+	case 0x4A:
+		return boolConst(int32(a.i32()) > int32(b.i32())), true
+	case 0x4B:
+		return boolConst(a.i32() > b.i32()), true
+	case 0x4C:
+		return boolConst(int32(a.i32()) <= int32(b.i32())), true
+	case 0x4D:
+		return boolConst(a.i32() <= b.i32()), true
+	case 0x4E:
+		return boolConst(int32(a.i32()) >= int32(b.i32())), true
+	case 0x4F:
+		return boolConst(a.i32() >= b.i32()), true
+
+	case 0x51:
+		return boolConst(a.bits == b.bits), true
+	case 0x52:
+		return boolConst(a.bits != b.bits), true
+	case 0x53:
+		return boolConst(int64(a.bits) < int64(b.bits)), true
+	case 0x54:
+		return boolConst(a.bits < b.bits), true
+	case 0x55:
+		return boolConst(int64(a.bits) > int64(b.bits)), true
+	case 0x56:
+		return boolConst(a.bits > b.bits), true
+	case 0x57:
+		return boolConst(int64(a.bits) <= int64(b.bits)), true
+	case 0x58:
+		return boolConst(a.bits <= b.bits), true
+	case 0x59:
+		return boolConst(int64(a.bits) >= int64(b.bits)), true
+	case 0x5A:
+		return boolConst(a.bits >= b.bits), true
+
+	case 0x5B:
+		return boolConst(a.f32() == b.f32()), true
+	case 0x5C:
+		return boolConst(a.f32() != b.f32()), true
+	case 0x5D:
+		return boolConst(a.f32() < b.f32()), true
+	case 0x5E:
+		return boolConst(a.f32() > b.f32()), true
+	case 0x5F:
+		return boolConst(a.f32() <= b.f32()), true
+	case 0x60:
+		return boolConst(a.f32() >= b.f32()), true
+	case 0x61:
+		return boolConst(a.f64() == b.f64()), true
+	case 0x62:
+		return boolConst(a.f64() != b.f64()), true
+	case 0x63:
+		return boolConst(a.f64() < b.f64()), true
+	case 0x64:
+		return boolConst(a.f64() > b.f64()), true
+	case 0x65:
+		return boolConst(a.f64() <= b.f64()), true
+	case 0x66:
+		return boolConst(a.f64() >= b.f64()), true
+	}
+
+	if op >= 0x6A && op <= 0x78 {
+		r, ok := foldInt(op-0x6A, uint64(a.i32()), uint64(b.i32()), 32)
+		return i32Const(uint32(r)), ok
+	}
+	if op >= 0x7C && op <= 0x8A {
+		r, ok := foldInt(op-0x7C, a.bits, b.bits, 64)
+		return i64Const(r), ok
+	}
+
+	switch op {
+	case 0x92:
+		return f32Const(a.f32() + b.f32()), true
+	case 0x93:
+		return f32Const(a.f32() - b.f32()), true
+	case 0x94:
+		return f32Const(float32(a.f32() * b.f32())), true
+	case 0x95:
+		return f32Const(a.f32() / b.f32()), true
+	case 0x96:
+		return f32Const(float32(math.Min(float64(a.f32()), float64(b.f32())))), true
+	case 0x97:
+		return f32Const(float32(math.Max(float64(a.f32()), float64(b.f32())))), true
+	case 0x98:
+		return wasmConst{types.F32, a.bits&^(1<<31) | b.bits&(1<<31)}, true
+	case 0xA0:
+		return f64Const(a.f64() + b.f64()), true
+	case 0xA1:
+		return f64Const(a.f64() - b.f64()), true
+	case 0xA2:
+		return f64Const(float64(a.f64() * b.f64())), true
+	case 0xA3:
+		return f64Const(a.f64() / b.f64()), true
+	case 0xA4:
+		return f64Const(math.Min(a.f64(), b.f64())), true
+	case 0xA5:
+		return f64Const(math.Max(a.f64(), b.f64())), true
+	case 0xA6:
+		return wasmConst{types.F64, a.bits&^(1<<63) | b.bits&(1<<63)}, true
+	}
+	return wasmConst{}, false
+}
+
+// Evaluates an integer instruction on operands of the given width. The instruction is given
+// relative to add, the first binary integer instruction.
+func foldInt(op WasmOpcode, a, b uint64, width uint) (uint64, bool) {
+	mask := uint64(math.MaxUint64) >> (64 - width)
+	signed := func(v uint64) int64 { return int64(v<<(64-width)) >> (64 - width) }
+	minSigned := uint64(1) << (width - 1)
+
+	var r uint64
+	switch op {
+	case 0: // add
+		r = a + b
+	case 1: // sub
+		r = a - b
+	case 2: // mul
+		r = a * b
+	case 3: // div_s
+		if b == 0 || a == minSigned && b == mask {
+			return 0, false
+		}
+		r = uint64(signed(a) / signed(b))
+	case 4: // div_u
+		if b == 0 {
+			return 0, false
+		}
+		r = a / b
+	case 5: // rem_s
+		if b == 0 {
+			return 0, false
+		}
+		r = uint64(signed(a) % signed(b))
+	case 6: // rem_u
+		if b == 0 {
+			return 0, false
+		}
+		r = a % b
+	case 7:
+		r = a & b
+	case 8:
+		r = a | b
+	case 9:
+		r = a ^ b
+	case 10: // shl
+		r = a << (b % uint64(width))
+	case 11: // shr_s
+		r = uint64(signed(a) >> (b % uint64(width)))
+	case 12: // shr_u
+		r = a >> (b % uint64(width))
+	case 13, 14: // rotl, rotr
+		k := int(b % uint64(width))
+		if op == 14 {
+			k = -k
+		}
+		if width == 32 {
+			r = uint64(bits.RotateLeft32(uint32(a), k))
+		} else {
+			r = bits.RotateLeft64(a, k)
+		}
+	default:
+		return 0, false
+	}
+	return r & mask, true
+}
+
+type wasmFolder struct {
+	out []WasmInstr
+	// The constants that locals are known to hold on the current path.
+	known map[uint32]wasmConst
+	// For every open block, whether it replaced an if whose else branch is skipped.
+	skipElse []bool
+}
+
+// Returns the constant on top of the output, if the last instruction pushed one.
+func (f *wasmFolder) top(n int) (wasmConst, bool) {
+	if len(f.out) < n {
+		return wasmConst{}, false
+	}
+	return constOf(f.out[len(f.out)-n])
+}
+
+func (f *wasmFolder) pop(n int) {
+	f.out = f.out[:len(f.out)-n]
+}
+
+// Returns the index of the else or end that belongs to the block opened before start, which is
+// the first instruction of the block.
+func matchingEnd(body []WasmInstr, start int, stopAtElse bool) int {
+	depth := 0
+	for i := start; i < len(body); i++ {
+		switch op := body[i].Opcode; {
+		case op.opensBlock():
+			depth++
+		case op == WasmOpcode(instructions.Else) && depth == 0 && stopAtElse:
+			return i
+		case op == WasmOpcode(instructions.End) || op == 0x18:
+			// end, and the legacy delegate that closes a try
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return len(body)
+}
+
+func foldConstants(c WasmDecodedCode, params int) []WasmInstr {
+	f := &wasmFolder{known: map[uint32]wasmConst{}}
+
+	// declared locals of numeric types start out as zero
+	index := uint32(params)
+	for _, l := range c.Locals {
+		for k := uint32(0); k < l.Count; k++ {
+			switch l.Type.Code {
+			case types.I32, types.I64, types.F32, types.F64:
+				f.known[index+k] = wasmConst{l.Type.Code, 0}
+			}
+		}
+		index += l.Count
+	}
+
+	body := c.Body
+	for i := 0; i < len(body); i++ {
+		in := body[i]
+		switch op := in.Opcode; {
+		case op == WasmOpcode(instructions.GetLocal):
+			if value, ok := f.known[uint32(in.Immediates[0])]; ok {
+				in = value.instr()
+			}
+		case op == WasmOpcode(instructions.SetLocal) || op == WasmOpcode(instructions.TeeLocal):
+			if value, ok := f.top(1); ok {
+				f.known[uint32(in.Immediates[0])] = value
+			} else {
+				delete(f.known, uint32(in.Immediates[0]))
+			}
+
+		case op == WasmOpcode(instructions.If):
+			cond, ok := f.top(1)
+			if !ok {
+				f.skipElse = append(f.skipElse, false)
+				break
+			}
+			// the if becomes a block that holds the branch that is taken
+			f.pop(1)
+			in = Instr(WasmOpcode(instructions.Block), in.Immediates...)
+			if cond.i32() != 0 {
+				f.skipElse = append(f.skipElse, true)
+			} else {
+				i = matchingEnd(body, i+1, true)
+				f.skipElse = append(f.skipElse, false)
+				if body[i].Opcode == WasmOpcode(instructions.End) {
+					i--
+				}
+			}
+		case op == WasmOpcode(instructions.Else) && f.skipElse[len(f.skipElse)-1]:
+			i = matchingEnd(body, i+1, false) - 1
+			continue
+		case op.opensBlock():
+			f.skipElse = append(f.skipElse, false)
+			if op == WasmOpcode(instructions.Loop) {
+				clear(f.known)
+			}
+		case op == WasmOpcode(instructions.End) || op == 0x18:
+			// end, and the legacy delegate that closes a try
+			if len(f.skipElse) > 0 {
+				f.skipElse = f.skipElse[:len(f.skipElse)-1]
+			}
+			clear(f.known)
+		case op == WasmOpcode(instructions.Else) || op == 0x07 || op == 0x19:
+			// else, and the legacy catch and catch_all
+			clear(f.known)
+
+		case op == WasmOpcode(instructions.BrIf):
+			if cond, ok := f.top(1); ok {
+				f.pop(1)
+				if cond.i32() == 0 {
+					continue
+				}
+				in = Instr(WasmOpcode(instructions.Br), in.Immediates...)
+			}
+		case op == WasmOpcode(instructions.BrTable):
+			if selector, ok := f.top(1); ok {
+				f.pop(1)
+				n := in.Immediates[0]
+				in = Instr(WasmOpcode(instructions.Br), in.Immediates[1+min(uint64(selector.i32()), n)])
+			}
+		case op == WasmOpcode(instructions.Select) || op == 0x1C:
+			cond, ok := f.top(1)
+			if !ok {
+				break
+			}
+			// keeps the first operand by dropping the second, or the second if both are constants
+			_, firstConst := f.top(3)
+			_, secondConst := f.top(2)
+			if cond.i32() != 0 {
+				f.pop(1)
+				in = Instr(WasmOpcode(instructions.Drop))
+			} else if firstConst && secondConst {
+				f.out = append(f.out[:len(f.out)-3], f.out[len(f.out)-2])
+				continue
+			}
+		case op == WasmOpcode(instructions.Drop):
+			if _, ok := f.top(1); ok {
+				f.pop(1)
+				continue
+			}
+		default:
+			if folded, ok := f.fold(op); ok {
+				in = folded
+			}
+		}
+		f.out = append(f.out, in)
+	}
+	return f.out
+}
+
+// Evaluates the numeric instruction if its operands are constants on top of the output, and
+// removes the operands. Returns false if the instruction cannot be evaluated.
+func (f *wasmFolder) fold(op WasmOpcode) (WasmInstr, bool) {
+	operand, ok := numericOperand(op)
+	var result wasmConst
+	switch {
+	case ok && isBinary(op):
+		a, okA := f.top(2)
+		b, okB := f.top(1)
+		if !okA || !okB || a.t != operand || b.t != operand {
+			return WasmInstr{}, false
+		}
+		if result, ok = foldBinary(op, a, b); !ok {
+			return WasmInstr{}, false
+		}
+		f.pop(2)
+	default:
+		a, ok := f.top(1)
+		if !ok || operand != 0 && a.t != operand {
+			return WasmInstr{}, false
+		}
+		if result, ok = foldUnary(op, a); !ok {
+			return WasmInstr{}, false
+		}
+		f.pop(1)
+	}
+	return result.instr(), true
+}
@@ -0,0 +1,156 @@
+package gowasmtk
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func ins(code byte, immediates ...uint64) WasmInstr {
+	return Instr(WasmOpcode(code), immediates...)
+}
+
+func constI32(n int32) WasmInstr { return ins(instructions.ConstI32, uint64(int64(n))) }
+
+// Returns the immediates of a block type given by a single byte.
+func blockType(code byte) []uint64 {
+	return blockTypeImmediates(WasmDecodedValType{Code: code, Heap: noHeapType})
+}
+
+func TestConstantFolding(t *testing.T) {
+	t.Run("should fold arithmetic with wasm semantics", func(t *testing.T) {
+		f32 := func(f float32) WasmInstr { return ins(instructions.ConstF32, uint64(math.Float32bits(f))) }
+		f64 := func(f float64) WasmInstr { return ins(instructions.ConstF64, math.Float64bits(f)) }
+
+		cases := []struct {
+			name     string
+			body     []WasmInstr
+			expected []WasmInstr
+		}{
+			{"nested arithmetic", []WasmInstr{constI32(2), constI32(3), ins(instructions.AddI32), constI32(7), ins(instructions.MulI32)}, []WasmInstr{constI32(35)}},
+			{"wrapping addition", []WasmInstr{constI32(math.MaxInt32), constI32(1), ins(instructions.AddI32)}, []WasmInstr{constI32(math.MinInt32)}},
+			{"shift counts modulo the width", []WasmInstr{constI32(1), constI32(33), ins(0x74)}, []WasmInstr{constI32(2)}},
+			{"unsigned comparison", []WasmInstr{constI32(-1), constI32(1), ins(instructions.LessThanUnsignedI32)}, []WasmInstr{constI32(0)}},
+			{"canonical NaN", []WasmInstr{f64(0), f64(0), ins(instructions.DivF64)}, []WasmInstr{ins(instructions.ConstF64, 0x7FF8000000000000)}},
+			{"negation of NaN bits", []WasmInstr{ins(instructions.ConstF64, 0x7FF0000000000001), ins(instructions.NegF64)}, []WasmInstr{ins(instructions.ConstF64, 0xFFF0000000000001)}},
+			{"single precision", []WasmInstr{f32(16777216), f32(1), ins(0x92)}, []WasmInstr{f32(16777216)}},
+			{"signed minimum of zeros", []WasmInstr{f64(0), f64(math.Copysign(0, -1)), ins(0xA4)}, []WasmInstr{f64(math.Copysign(0, -1))}},
+			{"saturating truncation", []WasmInstr{f64(1e10), Instr(PrefixedOpcode(prefixMisc, 2))}, []WasmInstr{constI32(math.MaxInt32)}},
+			{"division by zero", []WasmInstr{constI32(1), constI32(0), ins(instructions.DivI32)}, []WasmInstr{constI32(1), constI32(0), ins(instructions.DivI32)}},
+			{"overflowing division", []WasmInstr{constI32(math.MinInt32), constI32(-1), ins(instructions.DivI32)}, []WasmInstr{constI32(math.MinInt32), constI32(-1), ins(instructions.DivI32)}},
+			{"trapping truncation", []WasmInstr{f64(1e10), ins(instructions.TruncF64SignedI32)}, []WasmInstr{f64(1e10), ins(instructions.TruncF64SignedI32)}},
+		}
+
+		for _, c := range cases {
+			body := append(c.body, ins(instructions.End))
+			folded := foldConstants(WasmDecodedCode{Body: body}, 0)
+			if expected := append(c.expected, ins(instructions.End)); !reflect.DeepEqual(folded, expected) {
+				t.Fatalf("%s: expected %v, got %v", c.name, expected, folded)
+			}
+		}
+	})
+
+	t.Run("should propagate constant locals and remove constant branches", func(t *testing.T) {
+		code := WasmDecodedCode{
+			Locals: []WasmDecodedLocals{{Count: 2, Type: WasmDecodedValType{Code: types.I32, Heap: noHeapType}}},
+			Body: []WasmInstr{
+				constI32(4), ins(instructions.SetLocal, 2),
+				// local 1 is zero, so the if takes its else branch
+				ins(instructions.GetLocal, 1), ins(instructions.If, blockType(types.I32)...),
+				ins(instructions.GetLocal, 0),
+				ins(instructions.Else),
+				ins(instructions.GetLocal, 2), ins(instructions.GetLocal, 2), ins(instructions.MulI32),
+				ins(instructions.End),
+				ins(instructions.End),
+			},
+		}
+
+		expected := []WasmInstr{
+			constI32(4), ins(instructions.SetLocal, 2),
+			ins(instructions.Block, blockType(types.I32)...),
+			constI32(16),
+			ins(instructions.End),
+			ins(instructions.End),
+		}
+		if folded := foldConstants(code, 1); !reflect.DeepEqual(folded, expected) {
+			t.Fatalf("expected %v, got %v", expected, folded)
+		}
+
+		loop := []WasmInstr{
+			constI32(1), ins(instructions.SetLocal, 0),
+			ins(instructions.Loop, blockType(0x40)...),
+			// local 0 changes in the loop, so it is not a constant here
+			ins(instructions.GetLocal, 0), ins(instructions.BrIf, 1),
+			constI32(0), ins(instructions.SetLocal, 0),
+			constI32(1), ins(instructions.BrIf, 0),
+			ins(instructions.End),
+			ins(instructions.End),
+		}
+		expected = []WasmInstr{
+			constI32(1), ins(instructions.SetLocal, 0),
+			ins(instructions.Loop, blockType(0x40)...),
+			ins(instructions.GetLocal, 0), ins(instructions.BrIf, 1),
+			constI32(0), ins(instructions.SetLocal, 0),
+			ins(instructions.Br, 0),
+			ins(instructions.End),
+			ins(instructions.End),
+		}
+		if folded := foldConstants(WasmDecodedCode{Body: loop}, 1); !reflect.DeepEqual(folded, expected) {
+			t.Fatalf("expected %v, got %v", expected, folded)
+		}
+	})
+
+	t.Run("should treat delegate as the end of a try in constant branches", func(t *testing.T) {
+		try := []WasmInstr{
+			ins(0x06, blockType(0x40)...),
+			ins(instructions.GetLocal, 0), ins(instructions.Drop),
+			ins(0x18, 0),
+		}
+		branches := func(cond int32) []WasmInstr {
+			body := []WasmInstr{constI32(cond), ins(instructions.If, blockType(0x40)...)}
+			body = append(body, try...)
+			body = append(body, ins(instructions.Else), ins(instructions.Unreachable), ins(instructions.End), ins(instructions.End))
+			return body
+		}
+
+		expected := append([]WasmInstr{ins(instructions.Block, blockType(0x40)...)}, try...)
+		expected = append(expected, ins(instructions.End), ins(instructions.End))
+		if folded := foldConstants(WasmDecodedCode{Body: branches(1)}, 1); !reflect.DeepEqual(folded, expected) {
+			t.Fatalf("expected %v, got %v", expected, folded)
+		}
+
+		expected = []WasmInstr{ins(instructions.Block, blockType(0x40)...), ins(instructions.Unreachable), ins(instructions.End), ins(instructions.End)}
+		if folded := foldConstants(WasmDecodedCode{Body: branches(0)}, 1); !reflect.DeepEqual(folded, expected) {
+			t.Fatalf("expected %v, got %v", expected, folded)
+		}
+	})
+
+	t.Run("should keep the results of folded functions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddExprSetLocal(1, I32(6).Mul(I32(7))).
+			AddExpr(IfElse(LocalI32(1).Eq(I32(42)), LocalI32(1).Add(LocalI32(0)), I32(0))).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		checkRoundTrip(t, mod.Build(WithConstantFolding()))
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{8},
+			expected:   int32(50),
+			options:    []WasmBuildOption{WithConstantFolding()},
+		})
+	})
+}
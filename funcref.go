@@ -0,0 +1,110 @@
+package gowasmtk
+
+import (
+	"github.com/Orphoros/gowasmtk/instructions"
+)
+
+func (b *WasmFunctionBuilder) AddInstrRefNull(heap WasmHeapType) *WasmFunctionBuilder {
+	immediate, ok := b.heapTypeImmediate(heap)
+	if !ok {
+		return b
+	}
+
+	b.use(FeatureReferenceTypes)
+	b.instructions = append(b.instructions, instructions.RefNull)
+	b.instructions = append(b.instructions, immediate...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrRefIsNull() *WasmFunctionBuilder {
+	b.use(FeatureReferenceTypes)
+	b.instructions = append(b.instructions, instructions.RefIsNull)
+	return b
+}
+
+// Pushes a reference to the function. The module declares the function as referenced, which
+// is required for ref.func to validate.
+func (b *WasmFunctionBuilder) AddInstrRefFunc(f *WasmFunctionModule) *WasmFunctionBuilder {
+	b.use(FeatureReferenceTypes)
+	b.instructions = append(b.instructions, instructions.RefFunc)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(f.GetIndex()))...)
+	b.refFuncs = append(b.refFuncs, uint64(f.GetIndex()))
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrRefAsNonNull() *WasmFunctionBuilder {
+	b.use(FeatureFunctionReferences)
+	b.instructions = append(b.instructions, instructions.RefAsNonNull)
+	return b
+}
+
+// Branches to the label if the reference on the stack is null. Otherwise the reference stays
+// on the stack as a non-nullable reference.
+func (b *WasmFunctionBuilder) AddInstrBrOnNull(label uint64) *WasmFunctionBuilder {
+	if !b.checkLabel(label) {
+		return b
+	}
+
+	b.use(FeatureFunctionReferences)
+	b.instructions = append(b.instructions, instructions.BrOnNull)
+	b.instructions = append(b.instructions, leb128EncodeU(label)...)
+	return b
+}
+
+// Branches to the label with the reference on the stack if it is not null. Otherwise the
+// null reference is dropped.
+func (b *WasmFunctionBuilder) AddInstrBrOnNonNull(label uint64) *WasmFunctionBuilder {
+	if !b.checkLabel(label) {
+		return b
+	}
+
+	b.use(FeatureFunctionReferences)
+	b.instructions = append(b.instructions, instructions.BrOnNonNull)
+	b.instructions = append(b.instructions, leb128EncodeU(label)...)
+	return b
+}
+
+// Calls the function reference on the stack, which must be of the given function type. Since
+// the signature is known statically, no table lookup or runtime signature check is needed.
+func (b *WasmFunctionBuilder) AddInstrCallRef(t *WasmDefinedType) *WasmFunctionBuilder {
+	if !b.checkComposite(t, compositeFunc) {
+		return b
+	}
+
+	b.use(FeatureFunctionReferences)
+	b.instructions = append(b.instructions, instructions.CallRef)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(t.GetIndex()))...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrReturnCallRef(t *WasmDefinedType) *WasmFunctionBuilder {
+	if !b.checkComposite(t, compositeFunc) || !b.checkTailCallResults(t.subType.results) {
+		return b
+	}
+
+	b.use(FeatureTailCall | FeatureFunctionReferences)
+	b.instructions = append(b.instructions, instructions.ReturnCallRef)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(t.GetIndex()))...)
+	return b
+}
+
+// Returns the indices of the functions referenced by ref.func in the registered functions,
+// which have to be declared in the element section.
+func (b *WasmModuleBuilder) declaredFunctions() []uint64 {
+	declared := []uint64{}
+	seen := map[uint64]bool{}
+
+	for _, f := range b.symbolTable.functions {
+		if _, ok := b.functionsMap[f.codeIndex]; !ok {
+			continue
+		}
+		for _, idx := range f.refFuncs {
+			if !seen[idx] {
+				seen[idx] = true
+				declared = append(declared, idx)
+			}
+		}
+	}
+
+	return declared
+}
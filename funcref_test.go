@@ -0,0 +1,177 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestFunctionReferences(t *testing.T) {
+	t.Run("should call typed function references", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		binop := wasmSymbolTable.AddType(FuncType(
+			[]WasmValueType{ValType(types.I32), ValType(types.I32)},
+			[]WasmValueType{ValType(types.I32)},
+		))
+
+		adder := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrGetLocal(1).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		if adder.typeIndex != binop.GetIndex() {
+			t.Fatalf("expected the adder to have type %d, got %d", binop.GetIndex(), adder.typeIndex)
+		}
+
+		apply := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParamRef(RefNullType(HeapDefined(binop))).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocalRef(1, RefType(HeapDefined(binop))).
+			AddInstrGetLocal(0).
+			AddInstrRefAsNonNull().
+			AddInstrSetLocal(2).
+			AddInstrGetLocal(1).
+			AddInstrGetLocal(1).
+			AddInstrGetLocal(2).
+			AddInstrReturnCallRef(binop).
+			AddInstrEnd().
+			Build()
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrRefFunc(&adder).
+			AddInstrGetLocal(0).
+			AddInstrCall(&apply).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&adder).
+			AddFunction(&apply).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+		checkRoundTrip(t, wasm)
+
+		applyType := []byte{0x60, 0x02, 0x63, 0x00, 0x7F, 0x01, 0x7F}
+		if !bytes.Contains(wasm, applyType) {
+			t.Fatalf("expected function type %x in %x", applyType, wasm)
+		}
+
+		applyBody := []byte{
+			0x01, 0x01, 0x64, 0x00, // one local of type (ref 0)
+			0x20, 0x00, 0xD4, 0x21, 0x02, // local.get 0, ref.as_non_null, local.set 2
+			0x20, 0x01, 0x20, 0x01, 0x20, 0x02, // local.get 1, local.get 1, local.get 2
+			0x15, 0x00, 0x0B, // return_call_ref 0
+		}
+		if !bytes.Contains(wasm, applyBody) {
+			t.Fatalf("expected function body %x in %x", applyBody, wasm)
+		}
+
+		declaredElements := []byte{0x09, 0x05, 0x01, 0x03, 0x00, 0x01, 0x00}
+		if !bytes.Contains(wasm, declaredElements) {
+			t.Fatalf("expected declarative element segment %x in %x", declaredElements, wasm)
+		}
+	})
+
+	t.Run("should require non-nullable locals to be initialized", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		thunk := wasmSymbolTable.AddType(FuncType([]WasmValueType{}, []WasmValueType{}))
+		local := RefType(HeapDefined(thunk))
+
+		builder := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParamRef(local).
+			AddLocalRef(1, local).
+			AddInstrGetLocal(0).
+			AddInstrLocalTee(1).
+			AddInstrGetLocal(1).
+			AddInstrCallRef(thunk).
+			AddInstrEnd()
+
+		if err := builder.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		builder = NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParamRef(local).
+			AddLocalRef(1, local).
+			AddInstrGetLocal(1)
+
+		if err := builder.Err(); !errors.Is(err, ErrUninitializedLocal) {
+			t.Fatalf("expected %v, got %v", ErrUninitializedLocal, err)
+		}
+
+		// initialization inside a block does not outlive the block
+		builder = NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParamRef(local).
+			AddLocalRef(1, local).
+			AddInstrBlock(types.EmptyType).
+			AddInstrGetLocal(0).
+			AddInstrSetLocal(1).
+			AddInstrGetLocal(1).
+			AddInstrCallRef(thunk).
+			AddInstrEnd().
+			AddInstrGetLocal(1)
+
+		if err := builder.Err(); !errors.Is(err, ErrUninitializedLocal) {
+			t.Fatalf("expected %v, got %v", ErrUninitializedLocal, err)
+		}
+
+		// the else branch does not see locals initialized by the then branch
+		builder = NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParamRef(local).
+			AddLocalRef(1, local).
+			AddInstrConstI32(1).
+			AddInstrIf(types.EmptyType).
+			AddInstrGetLocal(0).
+			AddInstrSetLocal(1).
+			AddInstrElse().
+			AddInstrGetLocal(1)
+
+		if err := builder.Err(); !errors.Is(err, ErrUninitializedLocal) {
+			t.Fatalf("expected %v, got %v", ErrUninitializedLocal, err)
+		}
+	})
+
+	t.Run("should reject tail calls through references with mismatching results", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		producer := wasmSymbolTable.AddType(FuncType([]WasmValueType{}, []WasmValueType{ValType(types.I64)}))
+
+		builder := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrReturnCallRef(producer)
+
+		if err := builder.Err(); !errors.Is(err, ErrTailCallResults) {
+			t.Fatalf("expected %v, got %v", ErrTailCallResults, err)
+		}
+	})
+	t.Run("should reject references to types of another symbol table", func(t *testing.T) {
+		foreign := NewSymbolTable(nil).AddType(FuncType([]WasmValueType{}, []WasmValueType{}))
+
+		for _, builder := range []*WasmFunctionBuilder{
+			NewWasmFunctionBuilder(NewSymbolTable(nil)).AddParamRef(RefNullType(HeapDefined(foreign))),
+			NewWasmFunctionBuilder(NewSymbolTable(nil)).AddReturnRef(RefNullType(HeapDefined(foreign))),
+		} {
+			f := builder.
+				AddInstrEnd().
+				Build()
+			if err := f.err; !errors.Is(err, ErrUnknownType) {
+				t.Fatalf("expected %v, got %v", ErrUnknownType, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package gowasmtk
+
+import (
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmGasCosts is the gas that instructions cost. Instructions that are not in Opcodes cost
+// Default.
+type WasmGasCosts struct {
+	Default uint64
+	Opcodes map[WasmOpcode]uint64
+}
+
+// Returns costs where every instruction costs one unit of gas.
+func DefaultGasCosts() WasmGasCosts {
+	return WasmGasCosts{Default: 1}
+}
+
+func (c WasmGasCosts) of(op WasmOpcode) uint64 {
+	if cost, ok := c.Opcodes[op]; ok {
+		return cost
+	}
+	return c.Default
+}
+
+// WasmGasMeter selects how an instrumented module pays for the instructions it executes.
+type WasmGasMeter struct {
+	Costs WasmGasCosts
+	// If ImportName is set, gas is charged by calling the imported function with this module
+	// and name, which takes the gas as an i64 and traps to stop the execution.
+	ImportModule string
+	ImportName   string
+	// Otherwise, the remaining gas is held by a mutable i64 global that starts out as Gas, and
+	// that is exported as GlobalName if it is set. The module traps when the gas runs out.
+	Gas        uint64
+	GlobalName string
+}
+
+// Charges the gas of every instruction at the start of the straight-line sequence that the
+// instruction belongs to, so that a module runs out of gas before it executes instructions
+// it cannot pay for.
+func WithGasMetering(meter WasmGasMeter) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		InstrumentGas(m, meter)
+		return nil
+	}
+}
+
+// Applies the gas metering of WithGasMetering to the module.
+func InstrumentGas(m *WasmDecodedModule, meter WasmGasMeter) {
+	i64 := WasmDecodedValType{Code: types.I64, Heap: noHeapType}
+	chargeType := m.funcType([]WasmDecodedValType{i64}, []WasmDecodedValType{})
+
+	if meter.ImportName != "" {
+		charge := addFunctionImport(m, meter.ImportModule, meter.ImportName, chargeType)
+		for i := range m.Code {
+			m.Code[i].Body = chargeGas(m.Code[i].Body, meter.Costs, charge)
+		}
+		return
+	}
+
+	charge := uint32(m.importCount(types.ImportFunctionType) + len(m.Code))
+	for i := range m.Code {
+		m.Code[i].Body = chargeGas(m.Code[i].Body, meter.Costs, charge)
+	}
+
+	gas := uint64(m.importCount(types.ImportGlobalType) + len(m.Globals))
+	m.Globals = append(m.Globals, WasmDecodedGlobal{
+		Type:    i64,
+		Mutable: true,
+		Init:    []WasmInstr{Instr(WasmOpcode(instructions.ConstI64), meter.Gas), Instr(WasmOpcode(instructions.End))},
+	})
+	if meter.GlobalName != "" {
+		m.Exports = append(m.Exports, WasmDecodedExport{Name: meter.GlobalName, Kind: types.ExportGlobalType, Index: uint32(gas)})
+	}
+
+	// traps if the gas is less than the cost, and subtracts the cost otherwise
+	m.Functions = append(m.Functions, chargeType)
+	m.Code = append(m.Code, WasmDecodedCode{Locals: []WasmDecodedLocals{}, Body: []WasmInstr{
+		Instr(WasmOpcode(instructions.GlobalGet), gas),
+		Instr(WasmOpcode(instructions.GetLocal), 0),
+		Instr(WasmOpcode(instructions.LessThanUnsignedI64)),
+		Instr(WasmOpcode(instructions.If), blockTypeImmediates(WasmDecodedValType{Code: types.EmptyType, Heap: noHeapType})...),
+		Instr(WasmOpcode(instructions.Unreachable)),
+		Instr(WasmOpcode(instructions.End)),
+		Instr(WasmOpcode(instructions.GlobalGet), gas),
+		Instr(WasmOpcode(instructions.GetLocal), 0),
+		Instr(WasmOpcode(instructions.SubI64)),
+		Instr(WasmOpcode(instructions.GlobalSet), gas),
+		Instr(WasmOpcode(instructions.End)),
+	}})
+}
+
+// Returns whether the instruction is the last of a straight-line sequence, because it starts
+// or ends a block or branches.
+func endsStraightLine(op WasmOpcode) bool {
+	switch op {
+	case WasmOpcode(instructions.Else), WasmOpcode(instructions.End),
+		WasmOpcode(instructions.Br), WasmOpcode(instructions.BrIf), WasmOpcode(instructions.BrTable),
+		WasmOpcode(instructions.BrOnNull), WasmOpcode(instructions.BrOnNonNull),
+		PrefixedOpcode(prefixGC, instructions.BrOnCast), PrefixedOpcode(prefixGC, instructions.BrOnCastFail),
+		WasmOpcode(instructions.Return), WasmOpcode(instructions.ReturnCall),
+		WasmOpcode(instructions.ReturnCallIndirect), WasmOpcode(instructions.ReturnCallRef),
+		WasmOpcode(instructions.Unreachable), WasmOpcode(instructions.Throw), WasmOpcode(instructions.ThrowRef),
+		0x07, 0x09, 0x18, 0x19: // catch, rethrow, delegate and catch_all
+		return true
+	}
+	return op.opensBlock()
+}
+
+// Returns the body with a call of charge before every straight-line sequence of instructions,
+// which passes the cost of the sequence.
+func chargeGas(body []WasmInstr, costs WasmGasCosts, charge uint32) []WasmInstr {
+	charged := []WasmInstr{}
+	start := 0
+	for i, instr := range body {
+		if !endsStraightLine(instr.Opcode) && i+1 < len(body) {
+			continue
+		}
+		cost := uint64(0)
+		for _, in := range body[start : i+1] {
+			cost += costs.of(in.Opcode)
+		}
+		if cost > 0 {
+			charged = append(charged, Instr(WasmOpcode(instructions.ConstI64), cost), Instr(WasmOpcode(instructions.CallFunc), uint64(charge)))
+		}
+		charged = append(charged, body[start:i+1]...)
+		start = i + 1
+	}
+	return charged
+}
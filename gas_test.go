@@ -0,0 +1,147 @@
+package gowasmtk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Instantiates the module with the given imports of the env module.
+func instantiate(t *testing.T, store *wasmer.Store, wasm []byte, env map[string]wasmer.IntoExtern) *wasmer.Instance {
+	t.Helper()
+	checkRoundTrip(t, wasm)
+
+	module, err := wasmer.NewModule(store, wasm)
+	if err != nil {
+		t.Fatalf("module compilation error: %v", err)
+	}
+	importObject := wasmer.NewImportObject()
+	importObject.Register("env", env)
+	instance, err := wasmer.NewInstance(module, importObject)
+	if err != nil {
+		t.Fatalf("instance error: %v", err)
+	}
+	return instance
+}
+
+func TestGasMetering(t *testing.T) {
+	t.Run("should charge a global and trap when it runs out", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		add := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddExpr(I32(1).Add(I32(2))).
+			AddInstrEnd().
+			Build()
+		spin := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrLoop(types.EmptyType).
+			AddInstrBr(0).
+			AddInstrEnd().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&add).
+			AddFunction(&spin).
+			Export("add", types.ExportFunctionType, &add).
+			Export("spin", types.ExportFunctionType, &spin)
+
+		wasm := mod.Build(WithGasMetering(WasmGasMeter{Costs: DefaultGasCosts(), Gas: 1000, GlobalName: "gas"}))
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		instance := instantiate(t, wasmer.NewStore(wasmer.NewEngine()), wasm, nil)
+		gas, _ := instance.Exports.GetGlobal("gas")
+
+		main, _ := instance.Exports.GetFunction("add")
+		if result, err := main(); err != nil || result != int32(3) {
+			t.Fatalf("expected 3, got %v and %v", result, err)
+		}
+		// two constants, the addition and the end
+		if left, _ := gas.Get(); left != int64(1000-4) {
+			t.Fatalf("expected 996 gas to be left, got %v", left)
+		}
+
+		main, _ = instance.Exports.GetFunction("spin")
+		if _, err := main(); err == nil {
+			t.Fatalf("expected the loop to run out of gas")
+		}
+		if left, _ := gas.Get(); left.(int64) >= 2 {
+			t.Fatalf("expected less gas than an iteration costs to be left, got %v", left)
+		}
+	})
+
+	t.Run("should charge the costs of the table through a host function", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "id", ParamTypes: []types.WasmType{types.I32}, ResultTypes: []types.WasmType{types.I32}},
+		}
+		wasmSymbolTable := NewSymbolTable(&imports)
+
+		double := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(LocalI32(0).Add(LocalI32(0))).
+			AddInstrEnd().
+			Build()
+		// doubles n n times, or stops early if the host runs out of gas
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddExprSetLocal(1, I32(1)).
+			AddInstrLoop(types.EmptyType).
+			AddInstrGetLocal(1).
+			AddInstrCall(&double).
+			AddInstrCallImport(&imports[0]).
+			AddInstrSetLocal(1).
+			AddExprSetLocal(0, LocalI32(0).Sub(I32(1))).
+			AddExpr(LocalI32(0).GtS(I32(0))).
+			AddInstrBrIf(0).
+			AddInstrEnd().
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&double).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		costs := WasmGasCosts{Opcodes: map[WasmOpcode]uint64{WasmOpcode(instructions.CallFunc): 10}}
+		wasm := mod.Build(WithGasMetering(WasmGasMeter{Costs: costs, ImportModule: "env", ImportName: "gas"}))
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		store := wasmer.NewStore(wasmer.NewEngine())
+		used := int64(0)
+		limit := int64(1000)
+		charge := wasmer.NewFunction(store,
+			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I64), wasmer.NewValueTypes()),
+			func(args []wasmer.Value) ([]wasmer.Value, error) {
+				used += args[0].I64()
+				if used > limit {
+					return nil, errors.New("out of gas")
+				}
+				return []wasmer.Value{}, nil
+			})
+		id := wasmer.NewFunction(store,
+			wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes(wasmer.I32)),
+			func(args []wasmer.Value) ([]wasmer.Value, error) {
+				return []wasmer.Value{wasmer.NewI32(args[0].I32())}, nil
+			})
+		instance := instantiate(t, store, wasm, map[string]wasmer.IntoExtern{"id": id, "gas": charge})
+		run, _ := instance.Exports.GetFunction("main")
+
+		// every iteration makes two calls
+		if result, err := run(5); err != nil || result != int32(32) || used != 5*20 {
+			t.Fatalf("expected 32 for 100 gas, got %v for %d gas and %v", result, used, err)
+		}
+		used = 0
+		if _, err := run(60); err == nil || used != limit+20 {
+			t.Fatalf("expected to run out of gas in the 51st iteration, got %d gas used and %v", used, err)
+		}
+	})
+}
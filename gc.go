@@ -0,0 +1,267 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func (f WasmFieldType) isPacked() bool {
+	return !f.Type.isRef() && (f.Type.code == types.I8 || f.Type.code == types.I16)
+}
+
+func (b *WasmFunctionBuilder) addInstrGC(op instructions.WasmGCInstruction, immediates ...uint64) *WasmFunctionBuilder {
+	b.use(FeatureGC)
+	b.instructions = append(b.instructions, instructions.GCPrefix)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(op))...)
+	for _, imm := range immediates {
+		b.instructions = append(b.instructions, leb128EncodeU(imm)...)
+	}
+	return b
+}
+
+func (b *WasmFunctionBuilder) checkComposite(t *WasmDefinedType, composite byte) bool {
+	if t == nil || t.subType.composite != composite {
+		b.fail(fmt.Errorf("%w: expected composite type 0x%02X", ErrTypeMismatch, composite))
+		return false
+	}
+	return true
+}
+
+// Checks the field accessed by a get or set instruction. Packed fields can only be read with
+// the sign or zero extending variants, and only mutable fields can be written.
+func (b *WasmFunctionBuilder) checkFieldAccess(field WasmFieldType, op instructions.WasmGCInstruction) bool {
+	switch op {
+	case instructions.StructGet, instructions.ArrayGet:
+		if field.isPacked() {
+			b.fail(fmt.Errorf("%w: packed fields must be read with get_s or get_u", ErrTypeMismatch))
+			return false
+		}
+	case instructions.StructGetS, instructions.StructGetU, instructions.ArrayGetS, instructions.ArrayGetU:
+		if !field.isPacked() {
+			b.fail(fmt.Errorf("%w: get_s and get_u can only read packed fields", ErrTypeMismatch))
+			return false
+		}
+	case instructions.StructSet, instructions.ArraySet, instructions.ArrayFill, instructions.ArrayCopy:
+		if !field.Mutable {
+			b.fail(fmt.Errorf("%w: field is immutable", ErrTypeMismatch))
+			return false
+		}
+	}
+	return true
+}
+
+func (b *WasmFunctionBuilder) addInstrStructField(op instructions.WasmGCInstruction, t *WasmDefinedType, field uint32) *WasmFunctionBuilder {
+	if !b.checkComposite(t, compositeStruct) {
+		return b
+	}
+	if int(field) >= len(t.subType.fields) {
+		b.fail(fmt.Errorf("%w: struct type %d has no field %d", ErrTypeMismatch, t.GetIndex(), field))
+		return b
+	}
+	if !b.checkFieldAccess(t.subType.fields[field], op) {
+		return b
+	}
+
+	return b.addInstrGC(op, uint64(t.GetIndex()), uint64(field))
+}
+
+func (b *WasmFunctionBuilder) addInstrArray(op instructions.WasmGCInstruction, t *WasmDefinedType, immediates ...uint64) *WasmFunctionBuilder {
+	if !b.checkComposite(t, compositeArray) || !b.checkFieldAccess(t.subType.fields[0], op) {
+		return b
+	}
+
+	return b.addInstrGC(op, append([]uint64{uint64(t.GetIndex())}, immediates...)...)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStructNew(t *WasmDefinedType) *WasmFunctionBuilder {
+	if !b.checkComposite(t, compositeStruct) {
+		return b
+	}
+	return b.addInstrGC(instructions.StructNew, uint64(t.GetIndex()))
+}
+
+func (b *WasmFunctionBuilder) AddInstrStructNewDefault(t *WasmDefinedType) *WasmFunctionBuilder {
+	if !b.checkComposite(t, compositeStruct) {
+		return b
+	}
+	return b.addInstrGC(instructions.StructNewDefault, uint64(t.GetIndex()))
+}
+
+func (b *WasmFunctionBuilder) AddInstrStructGet(t *WasmDefinedType, field uint32) *WasmFunctionBuilder {
+	return b.addInstrStructField(instructions.StructGet, t, field)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStructGetS(t *WasmDefinedType, field uint32) *WasmFunctionBuilder {
+	return b.addInstrStructField(instructions.StructGetS, t, field)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStructGetU(t *WasmDefinedType, field uint32) *WasmFunctionBuilder {
+	return b.addInstrStructField(instructions.StructGetU, t, field)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStructSet(t *WasmDefinedType, field uint32) *WasmFunctionBuilder {
+	return b.addInstrStructField(instructions.StructSet, t, field)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayNew(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayNew, t)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayNewDefault(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayNewDefault, t)
+}
+
+// Creates an array of the given type from the topmost n values on the stack.
+func (b *WasmFunctionBuilder) AddInstrArrayNewFixed(t *WasmDefinedType, n uint32) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayNewFixed, t, uint64(n))
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayGet(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayGet, t)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayGetS(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayGetS, t)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayGetU(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayGetU, t)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArraySet(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArraySet, t)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayLen() *WasmFunctionBuilder {
+	return b.addInstrGC(instructions.ArrayLen)
+}
+
+func (b *WasmFunctionBuilder) AddInstrArrayFill(t *WasmDefinedType) *WasmFunctionBuilder {
+	return b.addInstrArray(instructions.ArrayFill, t)
+}
+
+// Copies elements from an array of type src into an array of type dst. Both arrays must have
+// the same packing, and the elements of dst must be mutable.
+func (b *WasmFunctionBuilder) AddInstrArrayCopy(dst *WasmDefinedType, src *WasmDefinedType) *WasmFunctionBuilder {
+	if !b.checkComposite(src, compositeArray) {
+		return b
+	}
+	if dst != nil && dst.subType.composite == compositeArray && dst.subType.fields[0].isPacked() != src.subType.fields[0].isPacked() {
+		b.fail(fmt.Errorf("%w: cannot copy between packed and unpacked arrays", ErrTypeMismatch))
+		return b
+	}
+
+	return b.addInstrArray(instructions.ArrayCopy, dst, uint64(src.GetIndex()))
+}
+
+func (b *WasmFunctionBuilder) heapTypeImmediate(heap WasmHeapType) ([]byte, bool) {
+	if heap.rec > 0 {
+		b.fail(fmt.Errorf("%w: rec group positions can only be used in type definitions", ErrUnknownType))
+		return nil, false
+	}
+	if !heap.isConcrete() && heap.abstract == 0 {
+		b.fail(fmt.Errorf("%w: missing heap type", ErrUnknownType))
+		return nil, false
+	}
+	return heap.encode(0, false), true
+}
+
+func (b *WasmFunctionBuilder) addInstrRefCheck(op instructions.WasmGCInstruction, heap WasmHeapType) *WasmFunctionBuilder {
+	immediate, ok := b.heapTypeImmediate(heap)
+	if !ok {
+		return b
+	}
+
+	b.addInstrGC(op)
+	b.instructions = append(b.instructions, immediate...)
+	return b
+}
+
+// Tests whether the reference on the stack is of the given heap type. If nullable is set, a
+// null reference passes the test as well.
+func (b *WasmFunctionBuilder) AddInstrRefTest(heap WasmHeapType, nullable bool) *WasmFunctionBuilder {
+	if nullable {
+		return b.addInstrRefCheck(instructions.RefTestNull, heap)
+	}
+	return b.addInstrRefCheck(instructions.RefTest, heap)
+}
+
+// Casts the reference on the stack to the given heap type, trapping if the cast fails. If
+// nullable is set, a null reference passes the cast as well.
+func (b *WasmFunctionBuilder) AddInstrRefCast(heap WasmHeapType, nullable bool) *WasmFunctionBuilder {
+	if nullable {
+		return b.addInstrRefCheck(instructions.RefCastNull, heap)
+	}
+	return b.addInstrRefCheck(instructions.RefCast, heap)
+}
+
+func (b *WasmFunctionBuilder) addInstrBrOnCast(op instructions.WasmGCInstruction, label uint64, from WasmValueType, to WasmValueType) *WasmFunctionBuilder {
+	from, to = from.expanded(), to.expanded()
+	if !from.isRef() || !to.isRef() {
+		b.fail(fmt.Errorf("%w: br_on_cast operates on reference types", ErrTypeMismatch))
+		return b
+	}
+	if !b.symbolTable.valueMatches(to, nil, from, nil) {
+		b.fail(fmt.Errorf("%w: br_on_cast target type is not a subtype of the source type", ErrTypeMismatch))
+		return b
+	}
+	if !b.checkLabel(label) {
+		return b
+	}
+
+	fromHeap, ok := b.heapTypeImmediate(from.heap)
+	if !ok {
+		return b
+	}
+	toHeap, ok := b.heapTypeImmediate(to.heap)
+	if !ok {
+		return b
+	}
+
+	var flags byte = 0x00
+	if from.nullable {
+		flags |= 0x01
+	}
+	if to.nullable {
+		flags |= 0x02
+	}
+
+	b.addInstrGC(op)
+	b.instructions = append(b.instructions, flags)
+	b.instructions = append(b.instructions, leb128EncodeU(label)...)
+	b.instructions = append(b.instructions, fromHeap...)
+	b.instructions = append(b.instructions, toHeap...)
+	return b
+}
+
+// Branches to the label if the reference on the stack, of type from, can be cast to the type
+// to. Otherwise the reference stays on the stack.
+func (b *WasmFunctionBuilder) AddInstrBrOnCast(label uint64, from WasmValueType, to WasmValueType) *WasmFunctionBuilder {
+	return b.addInstrBrOnCast(instructions.BrOnCast, label, from, to)
+}
+
+// Branches to the label if the reference on the stack, of type from, cannot be cast to the
+// type to. Otherwise the cast reference stays on the stack.
+func (b *WasmFunctionBuilder) AddInstrBrOnCastFail(label uint64, from WasmValueType, to WasmValueType) *WasmFunctionBuilder {
+	return b.addInstrBrOnCast(instructions.BrOnCastFail, label, from, to)
+}
+
+func (b *WasmFunctionBuilder) AddInstrRefI31() *WasmFunctionBuilder {
+	return b.addInstrGC(instructions.RefI31)
+}
+
+func (b *WasmFunctionBuilder) AddInstrI31GetS() *WasmFunctionBuilder {
+	return b.addInstrGC(instructions.I31GetS)
+}
+
+func (b *WasmFunctionBuilder) AddInstrI31GetU() *WasmFunctionBuilder {
+	return b.addInstrGC(instructions.I31GetU)
+}
+
+func (b *WasmFunctionBuilder) AddInstrRefEq() *WasmFunctionBuilder {
+	b.use(FeatureGC)
+	b.instructions = append(b.instructions, instructions.RefEq)
+	return b
+}
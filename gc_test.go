@@ -0,0 +1,267 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestGC(t *testing.T) {
+	t.Run("should encode recursive type groups", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		// a tree whose nodes refer to a forest, and a forest which is an array of trees
+		group := wasmSymbolTable.AddRecGroup(
+			StructType(
+				WasmFieldType{Type: ValType(types.I32)},
+				WasmFieldType{Type: RefNullType(HeapRec(1)), Mutable: true},
+			),
+			ArrayType(WasmFieldType{Type: RefType(HeapRec(0))}),
+		)
+
+		if len(group) != 2 || group[0].GetIndex() != 0 || group[1].GetIndex() != 1 {
+			t.Fatalf("expected types 0 and 1, got %v", group)
+		}
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable)
+		typeSection := []byte{
+			0x01, 0x0E, 0x01, // type section with one entry
+			0x4E, 0x02, // rec group of two types
+			0x5F, 0x02, 0x7F, 0x00, 0x63, 0x01, 0x01, // struct (field i32) (field (mut (ref null 1)))
+			0x5E, 0x64, 0x00, 0x00, // array (ref 0)
+		}
+		if wasm := mod.Build(); !bytes.Contains(wasm, typeSection) {
+			t.Fatalf("expected type section %x in %x", typeSection, wasm)
+		}
+	})
+
+	t.Run("should canonicalize identical rec groups", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		list := func() *WasmSubType {
+			return StructType(
+				WasmFieldType{Type: ValType(types.I64)},
+				WasmFieldType{Type: RefNullType(HeapRec(0))},
+			)
+		}
+
+		first := wasmSymbolTable.AddType(list())
+		pair := wasmSymbolTable.AddType(StructType(
+			WasmFieldType{Type: RefNullType(HeapDefined(first))},
+			WasmFieldType{Type: RefNullType(HeapDefined(first))},
+		))
+		second := wasmSymbolTable.AddType(list())
+
+		if first != second {
+			t.Fatalf("expected identical groups to share type %d, got %d", first.GetIndex(), second.GetIndex())
+		}
+		if pair.GetIndex() != 1 || wasmSymbolTable.typeCount != 2 {
+			t.Fatalf("expected two distinct types, got %d", wasmSymbolTable.typeCount)
+		}
+
+		// the same structure in a group with a different shape is a different type
+		grouped := wasmSymbolTable.AddRecGroup(list(), list())
+		if grouped[0] == first || grouped[0].GetIndex() != 2 {
+			t.Fatalf("expected a new type for the larger group, got %d", grouped[0].GetIndex())
+		}
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrEnd().
+			Build()
+		if main.typeIndex != 4 {
+			t.Fatalf("expected function type 4 after the struct types, got %d", main.typeIndex)
+		}
+	})
+
+	t.Run("should encode subtypes and GC instructions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		shape := wasmSymbolTable.AddType(StructType(
+			WasmFieldType{Type: ValType(types.I32), Mutable: true},
+		).NonFinal())
+		circle := wasmSymbolTable.AddType(StructType(
+			WasmFieldType{Type: ValType(types.I32), Mutable: true},
+			WasmFieldType{Type: ValType(types.I8)},
+		).Extends(HeapDefined(shape)))
+		bytesType := wasmSymbolTable.AddType(ArrayType(WasmFieldType{Type: ValType(types.I8), Mutable: true}))
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrBlock(types.EqRef).
+			AddInstrGetLocal(0).
+			AddInstrConstI32(3).
+			AddInstrStructNew(circle).
+			AddInstrBrOnCast(0, RefType(HeapDefined(shape)), RefType(HeapDefined(circle))).
+			AddInstrStructGet(shape, 0).
+			AddInstrRefI31().
+			AddInstrEnd().
+			AddInstrRefCast(HeapDefined(circle), false).
+			AddInstrStructGetS(circle, 1).
+			AddInstrConstI32(4).
+			AddInstrConstI32(2).
+			AddInstrArrayNew(bytesType).
+			AddInstrArrayLen().
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+		checkRoundTrip(t, wasm)
+
+		subtype := []byte{0x4F, 0x01, 0x00, 0x5F, 0x02, 0x7F, 0x01, 0x78, 0x00}
+		if !bytes.Contains(wasm, subtype) {
+			t.Fatalf("expected final subtype %x in %x", subtype, wasm)
+		}
+
+		body := []byte{
+			0x02, 0x6D, // block (result eqref)
+			0x20, 0x00, 0x41, 0x03, // local.get 0, i32.const 3
+			0xFB, 0x00, 0x01, // struct.new 1
+			0xFB, 0x18, 0x00, 0x00, 0x00, 0x01, // br_on_cast 0 (ref 0) (ref 1)
+			0xFB, 0x02, 0x00, 0x00, // struct.get 0 0
+			0xFB, 0x1C, // ref.i31
+			0x0B,
+			0xFB, 0x16, 0x01, // ref.cast (ref 1)
+			0xFB, 0x03, 0x01, 0x01, // struct.get_s 1 1
+			0x41, 0x04, 0x41, 0x02, // i32.const 4, i32.const 2
+			0xFB, 0x06, 0x02, // array.new 2
+			0xFB, 0x0F, // array.len
+			0x6A, 0x0B,
+		}
+		if !bytes.Contains(wasm, body) {
+			t.Fatalf("expected function body %x in %x", body, wasm)
+		}
+	})
+
+	t.Run("should reject invalid subtypes", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		final := wasmSymbolTable.AddType(StructType())
+		wasmSymbolTable.AddType(StructType().Extends(HeapDefined(final)))
+
+		if err := wasmSymbolTable.err; !errors.Is(err, ErrInvalidSubtype) {
+			t.Fatalf("expected %v, got %v", ErrInvalidSubtype, err)
+		}
+
+		wasmSymbolTable = NewSymbolTable(nil)
+		wasmSymbolTable.AddRecGroup(
+			StructType().Extends(HeapRec(1)),
+			StructType().NonFinal(),
+		)
+
+		if err := wasmSymbolTable.err; !errors.Is(err, ErrInvalidSubtype) {
+			t.Fatalf("expected %v, got %v", ErrInvalidSubtype, err)
+		}
+
+		wasmSymbolTable = NewSymbolTable(nil)
+		first := wasmSymbolTable.AddType(StructType().NonFinal())
+		second := wasmSymbolTable.AddType(StructType().NonFinal())
+		wasmSymbolTable.AddType(StructType().Extends(HeapDefined(first), HeapDefined(second)))
+
+		if err := wasmSymbolTable.err; !errors.Is(err, ErrInvalidSubtype) {
+			t.Fatalf("expected %v for two supertypes, got %v", ErrInvalidSubtype, err)
+		}
+	})
+
+	t.Run("should check the types of br_on_cast", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		shape := wasmSymbolTable.AddType(StructType().NonFinal())
+		circle := wasmSymbolTable.AddType(StructType().Extends(HeapDefined(shape)))
+
+		cast := func(from, to WasmValueType) error {
+			return NewWasmFunctionBuilder(wasmSymbolTable).
+				AddInstrBlock(types.AnyRef).
+				AddInstrBrOnCast(0, from, to).
+				Err()
+		}
+		if err := cast(ValType(types.AnyRef), RefType(HeapDefined(circle))); err != nil {
+			t.Fatalf("unexpected error for an abbreviated source type: %v", err)
+		}
+		if err := cast(ValType(types.AnyRef), ValType(types.EqRef)); err != nil {
+			t.Fatalf("unexpected error for abbreviated types: %v", err)
+		}
+
+		cases := map[string][2]WasmValueType{
+			"supertype target":            {RefType(HeapDefined(circle)), RefType(HeapDefined(shape))},
+			"nullable target":             {RefType(HeapDefined(shape)), RefNullType(HeapDefined(circle))},
+			"target of another hierarchy": {ValType(types.EqRef), ValType(types.FuncRef)},
+		}
+		for name, c := range cases {
+			if err := cast(c[0], c[1]); !errors.Is(err, ErrTypeMismatch) {
+				t.Fatalf("%s: expected %v, got %v", name, ErrTypeMismatch, err)
+			}
+		}
+	})
+
+	t.Run("should check the variance of fields, elements, parameters and results", func(t *testing.T) {
+		i32, f64 := ValType(types.I32), ValType(types.F64)
+		anyRef, eqRef := ValType(types.AnyRef), ValType(types.EqRef)
+		field := func(v WasmValueType, mutable bool) WasmFieldType {
+			return WasmFieldType{Type: v, Mutable: mutable}
+		}
+		fn := func(params, results []WasmValueType) *WasmSubType {
+			return FuncType(params, results)
+		}
+		values := func(v ...WasmValueType) []WasmValueType {
+			return v
+		}
+
+		tests := []struct {
+			name  string
+			super *WasmSubType
+			sub   *WasmSubType
+			valid bool
+		}{
+			{"immutable field of another type", StructType(field(i32, false)), StructType(field(f64, false)), false},
+			{"covariant immutable field", StructType(field(anyRef, false)), StructType(field(eqRef, false)), true},
+			{"supertype of an immutable field", StructType(field(eqRef, false)), StructType(field(anyRef, false)), false},
+			{"covariant mutable field", StructType(field(anyRef, true)), StructType(field(eqRef, true)), false},
+			{"same mutable field", StructType(field(eqRef, true)), StructType(field(eqRef, true), field(i32, false)), true},
+			{"array element of another type", ArrayType(field(i32, false)), ArrayType(field(f64, false)), false},
+			{"covariant mutable array element", ArrayType(field(anyRef, true)), ArrayType(field(eqRef, true)), false},
+			{"contravariant parameter", fn(values(eqRef), nil), fn(values(anyRef), nil), true},
+			{"covariant parameter", fn(values(anyRef), nil), fn(values(eqRef), nil), false},
+			{"covariant result", fn(nil, values(anyRef)), fn(nil, values(eqRef)), true},
+			{"contravariant result", fn(nil, values(eqRef)), fn(nil, values(anyRef)), false},
+			{"other parameters", fn(values(i32), nil), fn(values(i32, i32), nil), false},
+		}
+		for _, test := range tests {
+			wasmSymbolTable := NewSymbolTable(nil)
+			super := wasmSymbolTable.AddType(test.super.NonFinal())
+			wasmSymbolTable.AddType(test.sub.Extends(HeapDefined(super)))
+
+			if err := wasmSymbolTable.err; test.valid && err != nil || !test.valid && !errors.Is(err, ErrInvalidSubtype) {
+				t.Fatalf("%s: expected valid %v, got %v", test.name, test.valid, err)
+			}
+		}
+	})
+
+	t.Run("should reject invalid field accesses", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		point := wasmSymbolTable.AddType(StructType(
+			WasmFieldType{Type: ValType(types.I16)},
+		))
+
+		cases := map[string]*WasmFunctionBuilder{
+			"packed get":      NewWasmFunctionBuilder(wasmSymbolTable).AddInstrStructGet(point, 0),
+			"immutable set":   NewWasmFunctionBuilder(wasmSymbolTable).AddInstrStructSet(point, 0),
+			"missing field":   NewWasmFunctionBuilder(wasmSymbolTable).AddInstrStructGetS(point, 1),
+			"array on struct": NewWasmFunctionBuilder(wasmSymbolTable).AddInstrArrayLen().AddInstrArrayGet(point),
+		}
+
+		for name, builder := range cases {
+			if err := builder.Err(); !errors.Is(err, ErrTypeMismatch) {
+				t.Fatalf("%s: expected %v, got %v", name, ErrTypeMismatch, err)
+			}
+		}
+	})
+}
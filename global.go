@@ -0,0 +1,101 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+)
+
+// WasmGlobal is a global variable. Globals are declared on the symbol table, so that every
+// function built on the same table can read and write them. The index of the global is
+// assigned when it is declared.
+type WasmGlobal struct {
+	moduleName string
+	name       string
+	init       *WasmConstExpr
+	Type       WasmValueType
+	index      int
+	Mutable    bool
+}
+
+func (g *WasmGlobal) GetIndex() int {
+	return g.index
+}
+
+func (g *WasmGlobal) imported() bool {
+	return g.moduleName != "" || g.name != ""
+}
+
+// Returns the global with the given index, or nil if there is no such global.
+func (s *wasmSymbolTable) global(index int) *WasmGlobal {
+	if index < 0 || index >= len(s.globals) {
+		return nil
+	}
+	return s.globals[index]
+}
+
+// Declares a global defined by the module, initialized by a constant expression of the type
+// of the global. The initializer may only read imported and previously declared globals.
+func (s *wasmSymbolTable) AddGlobal(valueType WasmValueType, mutable bool, init *WasmConstExpr) *WasmGlobal {
+	global := &WasmGlobal{Type: valueType, Mutable: mutable, init: init, index: len(s.globals)}
+
+	if init == nil {
+		s.fail(fmt.Errorf("%w: global %d has no initializer", ErrInvalidConstExpr, global.index))
+		return global
+	}
+	if err := init.validate(s, valueType, len(s.globals)); err != nil {
+		s.fail(err)
+		return global
+	}
+
+	s.globals = append(s.globals, global)
+	return global
+}
+
+// Imports a global from the host, such as the __memory_base of a relocatable module. Imported
+// globals come first in the global index space, so all global imports must be declared before
+// any global is added.
+func (s *wasmSymbolTable) ImportGlobal(moduleName, name string, valueType WasmValueType, mutable bool) *WasmGlobal {
+	global := &WasmGlobal{moduleName: moduleName, name: name, Type: valueType, Mutable: mutable, index: len(s.globals)}
+
+	if len(s.globals) > s.importedGlobals {
+		s.fail(fmt.Errorf("%w: global %s.%s imported after a global definition", ErrImportOrder, moduleName, name))
+		return global
+	}
+
+	s.globals = append(s.globals, global)
+	s.importedGlobals++
+	return global
+}
+
+func (b *WasmFunctionBuilder) checkGlobal(global *WasmGlobal) bool {
+	if b.symbolTable.global(global.index) != global {
+		b.fail(fmt.Errorf("%w: global is not declared in the symbol table", ErrUnknownGlobal))
+		return false
+	}
+	return true
+}
+
+func (b *WasmFunctionBuilder) AddInstrGlobalGet(global *WasmGlobal) *WasmFunctionBuilder {
+	if !b.checkGlobal(global) {
+		return b
+	}
+
+	b.instructions = append(b.instructions, instructions.GlobalGet)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(global.index))...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGlobalSet(global *WasmGlobal) *WasmFunctionBuilder {
+	if !b.checkGlobal(global) {
+		return b
+	}
+	if !global.Mutable {
+		b.fail(fmt.Errorf("%w: global %d", ErrImmutableGlobal, global.index))
+		return b
+	}
+
+	b.instructions = append(b.instructions, instructions.GlobalSet)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(global.index))...)
+	return b
+}
@@ -0,0 +1,309 @@
+package gowasmtk
+
+import (
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// The number of instructions up to which WithInlining inlines functions by default.
+const DefaultInlineThreshold = 16
+
+// Marks the function to be inlined into its callers by WithInlining, regardless of its size.
+func (b *WasmFunctionBuilder) AlwaysInline() *WasmFunctionBuilder {
+	b.alwaysInline = true
+	return b
+}
+
+// Replaces calls of small functions with their bodies. Functions are inlined if their body has
+// at most maxInstructions instructions, or if they are marked with AlwaysInline. Recursive
+// functions and imports are not inlined, and functions that are no longer called after
+// inlining are removed.
+func WithInlining(maxInstructions int) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		InlineFunctions(m, maxInstructions)
+		return nil
+	}
+}
+
+// Marks the function with the given index to be inlined by InlineFunctions regardless of its
+// size, like AlwaysInline does for functions of a builder.
+func (m *WasmDecodedModule) SetAlwaysInline(funcIndex uint32) {
+	if m.alwaysInline == nil {
+		m.alwaysInline = map[uint32]bool{}
+	}
+	m.alwaysInline[funcIndex] = true
+}
+
+// Applies the inlining of WithInlining to the module.
+func InlineFunctions(m *WasmDecodedModule, maxInstructions int) {
+	in := &wasmInliner{m: m, imported: uint32(m.importCount(types.ImportFunctionType))}
+
+	inlined := make([]bool, len(m.Code))
+	recursive := in.recursive()
+	for _, f := range in.callOrder() {
+		in.inlineCalls(f, func(callee uint32) bool {
+			if callee < in.imported || recursive[callee-in.imported] {
+				return false
+			}
+			if !m.alwaysInline[callee] && len(m.Code[callee-in.imported].Body)-1 > maxInstructions {
+				return false
+			}
+			inlined[callee-in.imported] = true
+			return true
+		})
+	}
+
+	in.removeUnused(inlined)
+}
+
+type wasmInliner struct {
+	m        *WasmDecodedModule
+	imported uint32
+}
+
+// Returns the defined functions that the body calls directly, including tail calls.
+func (in *wasmInliner) callees(body []WasmInstr) []uint32 {
+	callees := []uint32{}
+	for _, instr := range body {
+		if instr.Opcode == WasmOpcode(instructions.CallFunc) || instr.Opcode == WasmOpcode(instructions.ReturnCall) {
+			if f := uint32(instr.Immediates[0]); f >= in.imported {
+				callees = append(callees, f-in.imported)
+			}
+		}
+	}
+	return callees
+}
+
+// Returns the defined functions in an order in which every function comes after the functions
+// it calls, unless they call each other recursively.
+func (in *wasmInliner) callOrder() []uint32 {
+	order := []uint32{}
+	visited := make([]bool, len(in.m.Code))
+	var visit func(f uint32)
+	visit = func(f uint32) {
+		visited[f] = true
+		for _, callee := range in.callees(in.m.Code[f].Body) {
+			if !visited[callee] {
+				visit(callee)
+			}
+		}
+		order = append(order, f+in.imported)
+	}
+	for f := range in.m.Code {
+		if !visited[f] {
+			visit(uint32(f))
+		}
+	}
+	return order
+}
+
+// Returns for every defined function whether it can call itself through direct calls.
+func (in *wasmInliner) recursive() []bool {
+	recursive := make([]bool, len(in.m.Code))
+	for f := range in.m.Code {
+		reached := make([]bool, len(in.m.Code))
+		work := in.callees(in.m.Code[f].Body)
+		for len(work) > 0 && !recursive[f] {
+			callee := work[len(work)-1]
+			work = work[:len(work)-1]
+			if reached[callee] {
+				continue
+			}
+			reached[callee] = true
+			recursive[f] = callee == uint32(f)
+			work = append(work, in.callees(in.m.Code[callee].Body)...)
+		}
+	}
+	return recursive
+}
+
+// Returns the number of locals of the function, including its parameters.
+func (in *wasmInliner) localCount(f uint32) uint32 {
+	count := uint32(len(in.m.typeAt(in.m.Functions[f]).Params))
+	for _, l := range in.m.Code[f].Locals {
+		count += l.Count
+	}
+	return count
+}
+
+// Replaces the calls of the function with the bodies of the callees that shouldInline accepts.
+func (in *wasmInliner) inlineCalls(f uint32, shouldInline func(callee uint32) bool) {
+	code := &in.m.Code[f-in.imported]
+	body := []WasmInstr{}
+	// whether the open blocks are loops
+	loops := []bool{}
+
+	for _, instr := range code.Body {
+		switch {
+		case instr.Opcode.opensBlock():
+			loops = append(loops, instr.Opcode == WasmOpcode(instructions.Loop))
+		case instr.Opcode == WasmOpcode(instructions.End) && len(loops) > 0:
+			loops = loops[:len(loops)-1]
+		case instr.Opcode == WasmOpcode(instructions.CallFunc):
+			callee := uint32(instr.Immediates[0])
+			if callee != f && shouldInline(callee) {
+				body = append(body, in.inlineBody(f-in.imported, callee-in.imported, slices.Contains(loops, true))...)
+				continue
+			}
+		}
+		body = append(body, instr)
+	}
+	code.Body = body
+}
+
+// Returns the instructions that replace a call of the callee in the caller. The arguments are
+// moved into new locals of the caller, and the body of the callee becomes a block whose label
+// is the target of its returns. Locals of the callee are reset to their default value if the
+// call can be executed more than once, which is only the case in loops.
+func (in *wasmInliner) inlineBody(caller, callee uint32, inLoop bool) []WasmInstr {
+	m := in.m
+	calleeType := m.typeAt(m.Functions[callee])
+	base := in.localCount(caller)
+
+	body := []WasmInstr{}
+	for i := len(calleeType.Params) - 1; i >= 0; i-- {
+		body = append(body, Instr(WasmOpcode(instructions.SetLocal), uint64(base)+uint64(i)))
+	}
+	for _, p := range calleeType.Params {
+		m.Code[caller].Locals = append(m.Code[caller].Locals, WasmDecodedLocals{Count: 1, Type: p})
+	}
+
+	local := base + uint32(len(calleeType.Params))
+	for _, l := range m.Code[callee].Locals {
+		m.Code[caller].Locals = append(m.Code[caller].Locals, l)
+		init, ok := defaultValue(l.Type)
+		for k := uint32(0); k < l.Count && inLoop && ok; k++ {
+			body = append(body, init, Instr(WasmOpcode(instructions.SetLocal), uint64(local+k)))
+		}
+		local += l.Count
+	}
+
+	body = append(body, Instr(WasmOpcode(instructions.Block), in.m.blockType(calleeType.Results)...))
+	depth := uint64(0)
+	calleeBody := m.Code[callee].Body
+	for _, instr := range calleeBody[:len(calleeBody)-1] {
+		instr.Immediates = slices.Clone(instr.Immediates)
+		switch instr.Opcode {
+		case WasmOpcode(instructions.GetLocal), WasmOpcode(instructions.SetLocal), WasmOpcode(instructions.TeeLocal):
+			instr.Immediates[0] += uint64(base)
+		case WasmOpcode(instructions.Return):
+			instr = Instr(WasmOpcode(instructions.Br), depth)
+		case WasmOpcode(instructions.ReturnCall), WasmOpcode(instructions.ReturnCallIndirect), WasmOpcode(instructions.ReturnCallRef):
+			// a tail call returns the results of the call from the callee
+			instr.Opcode = tailCallTargets[instr.Opcode]
+			body = append(body, instr)
+			instr = Instr(WasmOpcode(instructions.Br), depth)
+		case WasmOpcode(instructions.End):
+			depth--
+		}
+		if instr.Opcode.opensBlock() {
+			depth++
+		}
+		body = append(body, instr)
+	}
+	return append(body, Instr(WasmOpcode(instructions.End)))
+}
+
+// The calls that replace tail calls in inlined functions.
+var tailCallTargets = map[WasmOpcode]WasmOpcode{
+	WasmOpcode(instructions.ReturnCall):         WasmOpcode(instructions.CallFunc),
+	WasmOpcode(instructions.ReturnCallIndirect): WasmOpcode(instructions.CallIndirect),
+	WasmOpcode(instructions.ReturnCallRef):      WasmOpcode(instructions.CallRef),
+}
+
+// Returns the block type of a block without parameters and with the given results, which
+// refers to a function type if there is more than one result.
+func (m *WasmDecodedModule) blockType(results []WasmDecodedValType) []uint64 {
+	switch len(results) {
+	case 0:
+		return blockTypeImmediates(WasmDecodedValType{Code: types.EmptyType, Heap: noHeapType})
+	case 1:
+		return blockTypeImmediates(results[0])
+	}
+	heap := noHeapType
+	return []uint64{uint64(m.funcType([]WasmDecodedValType{}, results)), uint64(heap)}
+}
+
+// Returns the instruction that pushes the default value of a local of the type. Returns false
+// for non-nullable references, which have no default value.
+func defaultValue(t WasmDecodedValType) (WasmInstr, bool) {
+	switch t.Code {
+	case types.I32, types.I64, types.F32, types.F64:
+		return wasmConst{t.Code, 0}.instr(), true
+	case types.V128:
+		return Instr(PrefixedOpcode(prefixSIMD, 12), 0, 0), true
+	case refTypePrefix:
+		return WasmInstr{}, false
+	case refNullTypePrefix:
+		return Instr(WasmOpcode(instructions.RefNull), uint64(t.Heap)), true
+	}
+	// the abbreviations of nullable references are their heap type
+	return Instr(WasmOpcode(instructions.RefNull), uint64(int64(t.Code)-0x80)), true
+}
+
+// Removes the inlined functions that are no longer referenced by the module or by functions
+// that are kept.
+func (in *wasmInliner) removeUnused(inlined []bool) {
+	m := in.m
+	live := make([]bool, len(m.Code))
+	work := []uint32{}
+	reference := func(f uint32) {
+		if f >= in.imported && !live[f-in.imported] {
+			live[f-in.imported] = true
+			work = append(work, f-in.imported)
+		}
+	}
+	referenceExpr := func(body []WasmInstr) {
+		for i := range body {
+			body[i].visitImmediates(func(kind wasmImmediate, value *uint64) {
+				if kind == immFunc {
+					reference(uint32(*value))
+				}
+			})
+		}
+	}
+
+	for f := range m.Code {
+		if !inlined[f] {
+			reference(uint32(f) + in.imported)
+		}
+	}
+	for _, e := range m.Exports {
+		if e.Kind == types.ExportFunctionType {
+			reference(e.Index)
+		}
+	}
+	if m.Start != nil {
+		reference(*m.Start)
+	}
+	for _, e := range m.Elements {
+		for _, f := range e.Funcs {
+			reference(f)
+		}
+		for _, expr := range e.Exprs {
+			referenceExpr(expr)
+		}
+	}
+	for _, g := range m.Globals {
+		referenceExpr(g.Init)
+	}
+	for _, t := range m.Tables {
+		referenceExpr(t.Init)
+	}
+
+	for len(work) > 0 {
+		f := work[len(work)-1]
+		work = work[:len(work)-1]
+		referenceExpr(m.Code[f].Body)
+	}
+
+	removed := make([]bool, int(in.imported)+len(m.Code))
+	for f := range m.Code {
+		removed[int(in.imported)+f] = !live[f]
+	}
+	if slices.Contains(removed, true) {
+		removeFunctions(m, removed)
+	}
+}
@@ -0,0 +1,171 @@
+package gowasmtk
+
+import (
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Returns the number of call instructions in the functions of the module.
+func countCalls(m *WasmDecodedModule) int {
+	calls := 0
+	for _, c := range m.Code {
+		for _, in := range c.Body {
+			if in.Opcode == WasmOpcode(instructions.CallFunc) {
+				calls++
+			}
+		}
+	}
+	return calls
+}
+
+func TestInlining(t *testing.T) {
+	t.Run("should inline small functions called from loops", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		adder := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrGetLocal(1).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		// adds n to itself n times
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(2, types.I32).
+			AddInstrLoop(types.EmptyType).
+			AddExprSetLocal(1, Call[I32Expr](&adder, LocalI32(1), LocalI32(0))).
+			AddExprSetLocal(2, LocalI32(2).Add(I32(1))).
+			AddExpr(LocalI32(2).LtS(LocalI32(0))).
+			AddInstrBrIf(0).
+			AddInstrEnd().
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&adder).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		m, err := DecodeModule(mod.Build(WithInlining(DefaultInlineThreshold)))
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		if len(m.Functions) != 1 || countCalls(m) != 0 {
+			t.Fatalf("expected the adder to be inlined and removed, got %d functions and %d calls", len(m.Functions), countCalls(m))
+		}
+
+		checkRoundTrip(t, mod.Build(WithInlining(DefaultInlineThreshold)))
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{7},
+			expected:   int32(49),
+			options:    []WasmBuildOption{WithInlining(DefaultInlineThreshold)},
+		})
+	})
+
+	t.Run("should turn returns into branches and reset locals of the callee", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		// returns n, or 100 for negative n, through a local that starts out as zero
+		clamp := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddExpr(LocalI32(0).LtS(I32(0))).
+			AddInstrIf(types.EmptyType).
+			AddInstrConstI32(100).
+			AddInstrReturn().
+			AddInstrEnd().
+			AddExprSetLocal(1, LocalI32(1).Add(LocalI32(0))).
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		// sums clamp(n) + clamp(n-1) + ... + clamp(-1)
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddInstrLoop(types.EmptyType).
+			AddExprSetLocal(1, LocalI32(1).Add(Call[I32Expr](&clamp, LocalI32(0)))).
+			AddExprSetLocal(0, LocalI32(0).Sub(I32(1))).
+			AddExpr(LocalI32(0).GeS(I32(-1))).
+			AddInstrBrIf(0).
+			AddInstrEnd().
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&clamp).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if m, _ := DecodeModule(mod.Build(WithInlining(DefaultInlineThreshold))); countCalls(m) != 0 {
+			t.Fatalf("expected clamp to be inlined, got %d calls", countCalls(m))
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{4},
+			expected:   int32(4 + 3 + 2 + 1 + 0 + 100),
+			options:    []WasmBuildOption{WithInlining(DefaultInlineThreshold)},
+		})
+	})
+
+	t.Run("should inline functions marked always-inline but not recursive functions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		double := NewWasmFunctionBuilder(wasmSymbolTable).
+			AlwaysInline().
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(LocalI32(0).Mul(I32(2))).
+			AddInstrEnd().
+			Build()
+
+		// 2^n, computed recursively
+		power := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(IfElse(
+				LocalI32(0).Eqz(),
+				I32(1),
+				Call[I32Expr](&double, CallSelf[I32Expr](LocalI32(0).Sub(I32(1)))),
+			)).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&double).
+			AddFunction(&power).
+			Export("main", types.ExportFunctionType, &power)
+
+		m, err := DecodeModule(mod.Build(WithInlining(0)))
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		if len(m.Functions) != 1 || countCalls(m) != 1 {
+			t.Fatalf("expected only the recursive call to remain, got %d functions and %d calls", len(m.Functions), countCalls(m))
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{10},
+			expected:   int32(1024),
+			options:    []WasmBuildOption{WithInlining(0)},
+		})
+	})
+}
@@ -0,0 +1,77 @@
+package instructions
+
+type WasmAtomicInstruction = uint32
+
+// Atomic instructions are encoded as the AtomicPrefix byte followed by one of the
+// sub-opcodes below. Every instruction except AtomicFence takes a memory argument.
+const (
+	MemoryAtomicNotify WasmAtomicInstruction = 0x00
+	MemoryAtomicWait32 WasmAtomicInstruction = 0x01
+	MemoryAtomicWait64 WasmAtomicInstruction = 0x02
+	AtomicFence        WasmAtomicInstruction = 0x03
+
+	AtomicLoadI32    WasmAtomicInstruction = 0x10
+	AtomicLoadI64    WasmAtomicInstruction = 0x11
+	AtomicLoad8UI32  WasmAtomicInstruction = 0x12
+	AtomicLoad16UI32 WasmAtomicInstruction = 0x13
+	AtomicLoad8UI64  WasmAtomicInstruction = 0x14
+	AtomicLoad16UI64 WasmAtomicInstruction = 0x15
+	AtomicLoad32UI64 WasmAtomicInstruction = 0x16
+	AtomicStoreI32   WasmAtomicInstruction = 0x17
+	AtomicStoreI64   WasmAtomicInstruction = 0x18
+	AtomicStore8I32  WasmAtomicInstruction = 0x19
+	AtomicStore16I32 WasmAtomicInstruction = 0x1A
+	AtomicStore8I64  WasmAtomicInstruction = 0x1B
+	AtomicStore16I64 WasmAtomicInstruction = 0x1C
+	AtomicStore32I64 WasmAtomicInstruction = 0x1D
+
+	AtomicRmwAddI32        WasmAtomicInstruction = 0x1E
+	AtomicRmwAddI64        WasmAtomicInstruction = 0x1F
+	AtomicRmw8AddUI32      WasmAtomicInstruction = 0x20
+	AtomicRmw16AddUI32     WasmAtomicInstruction = 0x21
+	AtomicRmw8AddUI64      WasmAtomicInstruction = 0x22
+	AtomicRmw16AddUI64     WasmAtomicInstruction = 0x23
+	AtomicRmw32AddUI64     WasmAtomicInstruction = 0x24
+	AtomicRmwSubI32        WasmAtomicInstruction = 0x25
+	AtomicRmwSubI64        WasmAtomicInstruction = 0x26
+	AtomicRmw8SubUI32      WasmAtomicInstruction = 0x27
+	AtomicRmw16SubUI32     WasmAtomicInstruction = 0x28
+	AtomicRmw8SubUI64      WasmAtomicInstruction = 0x29
+	AtomicRmw16SubUI64     WasmAtomicInstruction = 0x2A
+	AtomicRmw32SubUI64     WasmAtomicInstruction = 0x2B
+	AtomicRmwAndI32        WasmAtomicInstruction = 0x2C
+	AtomicRmwAndI64        WasmAtomicInstruction = 0x2D
+	AtomicRmw8AndUI32      WasmAtomicInstruction = 0x2E
+	AtomicRmw16AndUI32     WasmAtomicInstruction = 0x2F
+	AtomicRmw8AndUI64      WasmAtomicInstruction = 0x30
+	AtomicRmw16AndUI64     WasmAtomicInstruction = 0x31
+	AtomicRmw32AndUI64     WasmAtomicInstruction = 0x32
+	AtomicRmwOrI32         WasmAtomicInstruction = 0x33
+	AtomicRmwOrI64         WasmAtomicInstruction = 0x34
+	AtomicRmw8OrUI32       WasmAtomicInstruction = 0x35
+	AtomicRmw16OrUI32      WasmAtomicInstruction = 0x36
+	AtomicRmw8OrUI64       WasmAtomicInstruction = 0x37
+	AtomicRmw16OrUI64      WasmAtomicInstruction = 0x38
+	AtomicRmw32OrUI64      WasmAtomicInstruction = 0x39
+	AtomicRmwXorI32        WasmAtomicInstruction = 0x3A
+	AtomicRmwXorI64        WasmAtomicInstruction = 0x3B
+	AtomicRmw8XorUI32      WasmAtomicInstruction = 0x3C
+	AtomicRmw16XorUI32     WasmAtomicInstruction = 0x3D
+	AtomicRmw8XorUI64      WasmAtomicInstruction = 0x3E
+	AtomicRmw16XorUI64     WasmAtomicInstruction = 0x3F
+	AtomicRmw32XorUI64     WasmAtomicInstruction = 0x40
+	AtomicRmwXchgI32       WasmAtomicInstruction = 0x41
+	AtomicRmwXchgI64       WasmAtomicInstruction = 0x42
+	AtomicRmw8XchgUI32     WasmAtomicInstruction = 0x43
+	AtomicRmw16XchgUI32    WasmAtomicInstruction = 0x44
+	AtomicRmw8XchgUI64     WasmAtomicInstruction = 0x45
+	AtomicRmw16XchgUI64    WasmAtomicInstruction = 0x46
+	AtomicRmw32XchgUI64    WasmAtomicInstruction = 0x47
+	AtomicRmwCmpxchgI32    WasmAtomicInstruction = 0x48
+	AtomicRmwCmpxchgI64    WasmAtomicInstruction = 0x49
+	AtomicRmw8CmpxchgUI32  WasmAtomicInstruction = 0x4A
+	AtomicRmw16CmpxchgUI32 WasmAtomicInstruction = 0x4B
+	AtomicRmw8CmpxchgUI64  WasmAtomicInstruction = 0x4C
+	AtomicRmw16CmpxchgUI64 WasmAtomicInstruction = 0x4D
+	AtomicRmw32CmpxchgUI64 WasmAtomicInstruction = 0x4E
+)
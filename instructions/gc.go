@@ -0,0 +1,32 @@
+package instructions
+
+type WasmGCInstruction = uint32
+
+// GC instructions are encoded as the GCPrefix byte followed by one of the sub-opcodes below.
+const (
+	StructNew        WasmGCInstruction = 0x00
+	StructNewDefault WasmGCInstruction = 0x01
+	StructGet        WasmGCInstruction = 0x02
+	StructGetS       WasmGCInstruction = 0x03
+	StructGetU       WasmGCInstruction = 0x04
+	StructSet        WasmGCInstruction = 0x05
+	ArrayNew         WasmGCInstruction = 0x06
+	ArrayNewDefault  WasmGCInstruction = 0x07
+	ArrayNewFixed    WasmGCInstruction = 0x08
+	ArrayGet         WasmGCInstruction = 0x0B
+	ArrayGetS        WasmGCInstruction = 0x0C
+	ArrayGetU        WasmGCInstruction = 0x0D
+	ArraySet         WasmGCInstruction = 0x0E
+	ArrayLen         WasmGCInstruction = 0x0F
+	ArrayFill        WasmGCInstruction = 0x10
+	ArrayCopy        WasmGCInstruction = 0x11
+	RefTest          WasmGCInstruction = 0x14
+	RefTestNull      WasmGCInstruction = 0x15
+	RefCast          WasmGCInstruction = 0x16
+	RefCastNull      WasmGCInstruction = 0x17
+	BrOnCast         WasmGCInstruction = 0x18
+	BrOnCastFail     WasmGCInstruction = 0x19
+	RefI31           WasmGCInstruction = 0x1C
+	I31GetS          WasmGCInstruction = 0x1D
+	I31GetU          WasmGCInstruction = 0x1E
+)
@@ -12,9 +12,44 @@ const (
 	SubI32                      WasmInstruction = 0x6B // (-)
 	MulI32                      WasmInstruction = 0x6C // (*)
 	DivI32                      WasmInstruction = 0x6D // (/)
+	AddI64                      WasmInstruction = 0x7C // (+)
+	SubI64                      WasmInstruction = 0x7D // (-)
+	MulI64                      WasmInstruction = 0x7E // (*)
+	DivI64                      WasmInstruction = 0x7F // (/)
+	EqzI64                      WasmInstruction = 0x50 // (a == 0)
+	EqualI64                    WasmInstruction = 0x51 // (1 == 1)
+	NotEqualI64                 WasmInstruction = 0x52 // (1 != 1)
+	LessThanSignedI64           WasmInstruction = 0x53 // (-1 < -1)
+	LessThanUnsignedI64         WasmInstruction = 0x54 // (1 < 1)
+	GreaterThanSignedI64        WasmInstruction = 0x55 // (-1 > -1)
+	GreaterThanUnsignedI64      WasmInstruction = 0x56 // (1 > 1)
+	LessThanEqualSignedI64      WasmInstruction = 0x57 // (-1 <= -1)
+	LessThanEqualUnsignedI64    WasmInstruction = 0x58 // (1 <= 1)
+	GreaterThanEqualSignedI64   WasmInstruction = 0x59 // (-1 >= -1)
+	GreaterThanEqualUnsignedI64 WasmInstruction = 0x5A // (1 >= 1)
+	EqualF64                    WasmInstruction = 0x61 // (1.0 == 1.0)
+	NotEqualF64                 WasmInstruction = 0x62 // (1.0 != 1.0)
+	LessThanF64                 WasmInstruction = 0x63 // (1.0 < 1.0)
+	GreaterThanF64              WasmInstruction = 0x64 // (1.0 > 1.0)
+	LessThanEqualF64            WasmInstruction = 0x65 // (1.0 <= 1.0)
+	GreaterThanEqualF64         WasmInstruction = 0x66 // (1.0 >= 1.0)
+	NegF64                      WasmInstruction = 0x9A // (-a)
+	AddF64                      WasmInstruction = 0xA0 // (+)
+	SubF64                      WasmInstruction = 0xA1 // (-)
+	MulF64                      WasmInstruction = 0xA2 // (*)
+	DivF64                      WasmInstruction = 0xA3 // (/)
+	WrapI64                     WasmInstruction = 0xA7 // i32.wrap_i64
+	TruncF64SignedI32           WasmInstruction = 0xAA // i32.trunc_f64_s
+	ExtendI32SignedI64          WasmInstruction = 0xAC // i64.extend_i32_s
+	ExtendI32UnsignedI64        WasmInstruction = 0xAD // i64.extend_i32_u
+	TruncF64SignedI64           WasmInstruction = 0xB0 // i64.trunc_f64_s
+	ConvertI32SignedF64         WasmInstruction = 0xB7 // f64.convert_i32_s
+	ConvertI64SignedF64         WasmInstruction = 0xB9 // f64.convert_i64_s
 	GetLocal                    WasmInstruction = 0x20
 	SetLocal                    WasmInstruction = 0x21
 	TeeLocal                    WasmInstruction = 0x22
+	GlobalGet                   WasmInstruction = 0x23
+	GlobalSet                   WasmInstruction = 0x24
 	CallFunc                    WasmInstruction = 0x10
 	If                          WasmInstruction = 0x04
 	Else                        WasmInstruction = 0x05
@@ -35,4 +70,44 @@ const (
 	Loop                        WasmInstruction = 0x03
 	Br                          WasmInstruction = 0x0C
 	BrIf                        WasmInstruction = 0x0D
+	BrTable                     WasmInstruction = 0x0E
+	Unreachable                 WasmInstruction = 0x00
+	Return                      WasmInstruction = 0x0F
+	Drop                        WasmInstruction = 0x1A
+	Select                      WasmInstruction = 0x1B
+	LoadI32                     WasmInstruction = 0x28
+	LoadI64                     WasmInstruction = 0x29
+	LoadF64                     WasmInstruction = 0x2B
+	StoreI32                    WasmInstruction = 0x36
+	StoreI64                    WasmInstruction = 0x37
+	StoreF64                    WasmInstruction = 0x39
+	MemorySize                  WasmInstruction = 0x3F
+	MemoryGrow                  WasmInstruction = 0x40
+	AtomicPrefix                WasmInstruction = 0xFE
+	Throw                       WasmInstruction = 0x08
+	ThrowRef                    WasmInstruction = 0x0A
+	TryTable                    WasmInstruction = 0x1F
+	CallIndirect                WasmInstruction = 0x11
+	ReturnCall                  WasmInstruction = 0x12
+	ReturnCallIndirect          WasmInstruction = 0x13
+	CallRef                     WasmInstruction = 0x14
+	ReturnCallRef               WasmInstruction = 0x15
+	RefNull                     WasmInstruction = 0xD0
+	RefIsNull                   WasmInstruction = 0xD1
+	RefFunc                     WasmInstruction = 0xD2
+	RefEq                       WasmInstruction = 0xD3
+	RefAsNonNull                WasmInstruction = 0xD4
+	BrOnNull                    WasmInstruction = 0xD5
+	BrOnNonNull                 WasmInstruction = 0xD6
+	GCPrefix                    WasmInstruction = 0xFB
+)
+
+type WasmCatchKind = byte
+
+// Kinds of the catch clauses of a try_table instruction.
+const (
+	Catch       WasmCatchKind = 0x00
+	CatchRef    WasmCatchKind = 0x01
+	CatchAll    WasmCatchKind = 0x02
+	CatchAllRef WasmCatchKind = 0x03
 )
@@ -0,0 +1,227 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// A run of locals of the same type, as declared in the code section.
+type wasmLocalDecl struct {
+	valueType WasmValueType
+	count     uint32
+}
+
+// WasmLocal is a handle to a parameter or local, returned by NewParam and NewLocal. A handle
+// can only be used by the function builder that declared it.
+type WasmLocal struct {
+	builder   *WasmFunctionBuilder
+	valueType WasmValueType
+	index     uint64
+}
+
+// Tracks which non-defaultable locals have been initialized. The log lists the locals in the
+// order they were initialized, so that a control frame can restore the state it started with.
+type wasmLocalInits struct {
+	initialized map[uint64]bool
+	log         []uint64
+}
+
+func (i *wasmLocalInits) set(idx uint64) {
+	if i.initialized == nil {
+		i.initialized = map[uint64]bool{}
+	}
+	if !i.initialized[idx] {
+		i.initialized[idx] = true
+		i.log = append(i.log, idx)
+	}
+}
+
+func (i *wasmLocalInits) reset(height int) {
+	for _, idx := range i.log[height:] {
+		delete(i.initialized, idx)
+	}
+	i.log = i.log[:height]
+}
+
+// Non-nullable references have no default value, so locals of such a type must be set before
+// they can be read.
+func (v WasmValueType) isDefaultable() bool {
+	return !v.isRef() || v.nullable
+}
+
+func (b *WasmFunctionBuilder) localType(idx uint64) (WasmValueType, bool) {
+	if idx < uint64(len(b.paramTypes)) {
+		return b.paramTypes[idx], true
+	}
+
+	idx -= uint64(len(b.paramTypes))
+	for _, decl := range b.locals {
+		if idx < uint64(decl.count) {
+			return decl.valueType, true
+		}
+		idx -= uint64(decl.count)
+	}
+	return WasmValueType{}, false
+}
+
+func (b *WasmFunctionBuilder) checkLocal(idx uint64) (WasmValueType, bool) {
+	localType, ok := b.localType(idx)
+	if !ok {
+		b.fail(fmt.Errorf("%w: local %d", ErrUnknownLocal, idx))
+	}
+	return localType, ok
+}
+
+func (b *WasmFunctionBuilder) checkLocalGet(idx uint64) bool {
+	localType, ok := b.checkLocal(idx)
+	if !ok {
+		return false
+	}
+
+	isParam := idx < uint64(len(b.paramTypes))
+	if !isParam && !localType.isDefaultable() && !b.localInits.initialized[idx] {
+		b.fail(fmt.Errorf("%w: local %d of type %v", ErrUninitializedLocal, idx, localType))
+		return false
+	}
+	return true
+}
+
+func (b *WasmFunctionBuilder) checkLocalSet(idx uint64) bool {
+	localType, ok := b.checkLocal(idx)
+	if !ok {
+		return false
+	}
+
+	if !localType.isDefaultable() {
+		b.localInits.set(idx)
+	}
+	return true
+}
+
+func (l WasmLocal) GetIndex() int {
+	return int(l.index)
+}
+
+func (l WasmLocal) Type() WasmValueType {
+	return l.valueType
+}
+
+func (b *WasmFunctionBuilder) numLocals() uint64 {
+	count := uint64(0)
+	for _, decl := range b.locals {
+		count += uint64(decl.count)
+	}
+	return count
+}
+
+// Parameters come first in the local index space, so adding a parameter after a local would
+// shift the indices of the locals.
+func (b *WasmFunctionBuilder) addParam(paramType WasmValueType) (uint64, bool) {
+	if len(b.locals) > 0 {
+		b.fail(fmt.Errorf("%w: parameter %v declared after a local", ErrLocalOrder, paramType))
+		return 0, false
+	}
+	if !b.checkValueType(paramType) {
+		return 0, false
+	}
+
+	b.paramTypes = append(b.paramTypes, paramType)
+	return uint64(len(b.paramTypes) - 1), true
+}
+
+// Declares n locals and returns the index of the first one. Consecutive locals of the same
+// type share a single declaration in the code section.
+func (b *WasmFunctionBuilder) declareLocals(n uint32, localType WasmValueType) uint64 {
+	first := uint64(len(b.paramTypes)) + b.numLocals()
+
+	if last := len(b.locals) - 1; last >= 0 && b.locals[last].valueType == localType {
+		b.locals[last].count += n
+	} else {
+		b.locals = append(b.locals, wasmLocalDecl{count: n, valueType: localType})
+	}
+	return first
+}
+
+// Adds a parameter of any value type, such as a typed reference created with RefType.
+func (b *WasmFunctionBuilder) AddParamRef(paramType WasmValueType) *WasmFunctionBuilder {
+	b.addParam(paramType)
+	return b
+}
+
+// Adds a result of any value type, such as a typed reference created with RefType.
+func (b *WasmFunctionBuilder) AddReturnRef(resultType WasmValueType) *WasmFunctionBuilder {
+	if b.checkValueType(resultType) {
+		b.resultTypes = append(b.resultTypes, resultType)
+	}
+	return b
+}
+
+// Records an error if the value type refers to a type that is not defined in the symbol table
+// of the builder. Returns whether the type is valid.
+func (b *WasmFunctionBuilder) checkValueType(valueType WasmValueType) bool {
+	if err := b.symbolTable.validateHeapType(valueType.heap, nil); err != nil {
+		b.fail(err)
+		return false
+	}
+	return true
+}
+
+// Adds n locals of any value type. Locals of a non-nullable reference type must be set before
+// they are read, and a value set inside a block only counts as initialized until its end.
+func (b *WasmFunctionBuilder) AddLocalRef(n uint32, localType WasmValueType) *WasmFunctionBuilder {
+	b.checkValueType(localType)
+	b.declareLocals(n, localType)
+	return b
+}
+
+// Adds a parameter and returns a handle to it. All parameters must be added before the first
+// local.
+func (b *WasmFunctionBuilder) NewParam(paramType types.WasmType) WasmLocal {
+	return b.NewParamRef(ValType(paramType))
+}
+
+func (b *WasmFunctionBuilder) NewParamRef(paramType WasmValueType) WasmLocal {
+	index, _ := b.addParam(paramType)
+	return WasmLocal{builder: b, valueType: paramType, index: index}
+}
+
+// Adds a local and returns a handle to it, so that its index does not have to be computed
+// from the number of parameters and locals declared before it.
+func (b *WasmFunctionBuilder) NewLocal(localType types.WasmType) WasmLocal {
+	return b.NewLocalRef(ValType(localType))
+}
+
+func (b *WasmFunctionBuilder) NewLocalRef(localType WasmValueType) WasmLocal {
+	b.checkValueType(localType)
+	return WasmLocal{builder: b, valueType: localType, index: b.declareLocals(1, localType)}
+}
+
+func (b *WasmFunctionBuilder) checkHandle(local WasmLocal) bool {
+	if local.builder != b {
+		b.fail(fmt.Errorf("%w: local %d", ErrForeignLocal, local.index))
+		return false
+	}
+	return true
+}
+
+func (b *WasmFunctionBuilder) AddInstrGetLocalHandle(local WasmLocal) *WasmFunctionBuilder {
+	if !b.checkHandle(local) {
+		return b
+	}
+	return b.AddInstrGetLocal(local.index)
+}
+
+func (b *WasmFunctionBuilder) AddInstrSetLocalHandle(local WasmLocal) *WasmFunctionBuilder {
+	if !b.checkHandle(local) {
+		return b
+	}
+	return b.AddInstrSetLocal(local.index)
+}
+
+func (b *WasmFunctionBuilder) AddInstrLocalTeeHandle(local WasmLocal) *WasmFunctionBuilder {
+	if !b.checkHandle(local) {
+		return b
+	}
+	return b.AddInstrLocalTee(local.index)
+}
@@ -0,0 +1,97 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestLocalHandles(t *testing.T) {
+	t.Run("should resolve handles and compact local declarations", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		builder := NewWasmFunctionBuilder(wasmSymbolTable).AddReturn(types.I64)
+
+		a := builder.NewParam(types.I32)
+		b := builder.NewParam(types.I32)
+		sum := builder.NewLocal(types.I32)
+		doubled := builder.NewLocal(types.I32)
+		wide := builder.NewLocal(types.I64)
+
+		if sum.GetIndex() != 2 || doubled.GetIndex() != 3 || wide.GetIndex() != 4 {
+			t.Fatalf("expected local indices 2, 3 and 4, got %d, %d and %d", sum.GetIndex(), doubled.GetIndex(), wide.GetIndex())
+		}
+
+		main := builder.
+			AddInstrGetLocalHandle(a).
+			AddInstrGetLocalHandle(b).
+			AddInstrAddI32().
+			AddInstrLocalTeeHandle(sum).
+			AddInstrGetLocalHandle(sum).
+			AddInstrAddI32().
+			AddInstrSetLocalHandle(doubled).
+			AddExprSetLocalHandle(wide, LocalExpr[I32Expr](doubled).ExtendS()).
+			AddExpr(LocalExpr[I64Expr](wide)).
+			AddInstrEnd().
+			Build()
+
+		// 2 locals of type i32 followed by 1 local of type i64
+		decls := []byte{0x02, 0x02, 0x7F, 0x01, 0x7E}
+		if !bytes.Contains(main.sectionCode, decls) {
+			t.Fatalf("expected local declarations %x in %x", decls, main.sectionCode)
+		}
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{20, 1},
+			expected:   int64(42),
+		})
+	})
+
+	t.Run("should reject handles of another function", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		other := NewWasmFunctionBuilder(wasmSymbolTable)
+		foreign := other.NewLocal(types.I32)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable)
+		main.NewLocal(types.I32)
+		main.AddInstrGetLocalHandle(foreign)
+
+		if err := main.Err(); !errors.Is(err, ErrForeignLocal) {
+			t.Fatalf("expected %v, got %v", ErrForeignLocal, err)
+		}
+		if err := other.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("should reject parameters declared after locals", func(t *testing.T) {
+		builder := NewWasmFunctionBuilder(NewSymbolTable(nil))
+		builder.NewLocal(types.I32)
+		builder.NewParam(types.I32)
+
+		if err := builder.Err(); !errors.Is(err, ErrLocalOrder) {
+			t.Fatalf("expected %v, got %v", ErrLocalOrder, err)
+		}
+	})
+
+	t.Run("should reject expressions of another type than the local", func(t *testing.T) {
+		builder := NewWasmFunctionBuilder(NewSymbolTable(nil))
+		local := builder.NewLocal(types.F64)
+		builder.AddExprDrop(LocalExpr[I32Expr](local))
+
+		if err := builder.Err(); !errors.Is(err, ErrTypeMismatch) {
+			t.Fatalf("expected %v, got %v", ErrTypeMismatch, err)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// The maximum number of 64 KiB pages a 32-bit and a 64-bit linear memory can address.
+const (
+	maxMemoryPages   = 1 << 16
+	maxMemory64Pages = 1 << 48
+)
+
+// WasmMemArg is the memory argument of load, store and atomic instructions. Align is the
+// base 2 logarithm of the alignment in bytes, exactly as it is encoded in the binary format.
+// The instruction accesses the given memory, or the memory with index 0 if Memory is nil.
+// Offsets above 4 GiB require a 64-bit memory.
+type WasmMemArg struct {
+	Memory *WasmMemory
+	Offset uint64
+	Align  uint32
+}
+
+// WasmMemory describes a linear memory, with sizes given in 64 KiB pages. The index of the
+// memory is assigned when it is declared in a symbol table or module. Shared memories, which
+// are required by the atomic wait and notify instructions, must declare a maximum size.
+// A 64-bit memory is addressed with i64 values and can grow beyond 4 GiB.
+type WasmMemory struct {
+	moduleName string
+	name       string
+	Min        uint64
+	Max        uint64
+	index      int
+	HasMax     bool
+	Shared     bool
+	Memory64   bool
+}
+
+func (m *WasmMemory) GetIndex() int {
+	return m.index
+}
+
+func (m *WasmMemory) imported() bool {
+	return m.moduleName != "" || m.name != ""
+}
+
+func (m *WasmMemory) validate() error {
+	maxPages := uint64(maxMemoryPages)
+	if m.Memory64 {
+		maxPages = maxMemory64Pages
+	}
+
+	if m.Min > maxPages || (m.HasMax && m.Max > maxPages) {
+		return fmt.Errorf("%w: memory size exceeds %d pages", ErrInvalidMemoryLimits, maxPages)
+	}
+	if m.HasMax && m.Min > m.Max {
+		return fmt.Errorf("%w: minimum %d is larger than maximum %d", ErrInvalidMemoryLimits, m.Min, m.Max)
+	}
+	if m.Shared && !m.HasMax {
+		return ErrSharedMemoryMax
+	}
+	return nil
+}
+
+// Returns the base 2 logarithm of the natural alignment of an atomic instruction that takes
+// a memory argument. The second result is false for unknown instructions and atomic.fence.
+func atomicAlignment(op instructions.WasmAtomicInstruction) (uint32, bool) {
+	switch {
+	case op == instructions.MemoryAtomicNotify, op == instructions.MemoryAtomicWait32:
+		return 2, true
+	case op == instructions.MemoryAtomicWait64:
+		return 3, true
+	case op >= instructions.AtomicLoadI32 && op <= instructions.AtomicRmw32CmpxchgUI64:
+		// Loads, stores and every read-modify-write group share the same layout of
+		// seven instructions: i32, i64, i32 8u, i32 16u, i64 8u, i64 16u, i64 32u.
+		return [...]uint32{2, 3, 0, 1, 0, 1, 2}[(op-instructions.AtomicLoadI32)%7], true
+	}
+	return 0, false
+}
+
+// Encodes the memory argument, checking that the memory is declared in the symbol table and
+// that the offset fits the address space of the memory.
+func (b *WasmFunctionBuilder) memarg(arg WasmMemArg) ([]byte, bool) {
+	memory := arg.Memory
+	if memory == nil {
+		memory = b.symbolTable.memory(0)
+	} else if b.symbolTable.memory(memory.index) != memory {
+		b.fail(fmt.Errorf("%w: memory is not declared in the symbol table", ErrUnknownMemory))
+		return nil, false
+	}
+
+	if arg.Offset > math.MaxUint32 && (memory == nil || !memory.Memory64) {
+		b.fail(fmt.Errorf("%w: offset %d exceeds the address space of a 32-bit memory", ErrInvalidMemArg, arg.Offset))
+		return nil, false
+	}
+
+	if arg.Memory == nil || arg.Memory.index == 0 {
+		return append(leb128EncodeU(uint64(arg.Align)), leb128EncodeU(arg.Offset)...), true
+	}
+
+	b.use(FeatureMultiMemory)
+
+	// Bit 6 of the alignment field signals that an explicit memory index follows.
+	result := leb128EncodeU(uint64(arg.Align | 0x40))
+	result = append(result, leb128EncodeU(uint64(arg.Memory.index))...)
+	return append(result, leb128EncodeU(arg.Offset)...), true
+}
+
+func (b *WasmFunctionBuilder) addInstrMemory(op instructions.WasmInstruction, naturalAlign uint32, memArg WasmMemArg) *WasmFunctionBuilder {
+	if memArg.Align > naturalAlign {
+		b.fail(fmt.Errorf("%w: instruction 0x%02X allows alignment %d, got %d", ErrOveralignedAccess, op, naturalAlign, memArg.Align))
+		return b
+	}
+
+	encoded, ok := b.memarg(memArg)
+	if !ok {
+		return b
+	}
+
+	b.instructions = append(b.instructions, op)
+	b.instructions = append(b.instructions, encoded...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLoadI32(memArg WasmMemArg) *WasmFunctionBuilder {
+	return b.addInstrMemory(instructions.LoadI32, 2, memArg)
+}
+
+func (b *WasmFunctionBuilder) AddInstrLoadI64(memArg WasmMemArg) *WasmFunctionBuilder {
+	return b.addInstrMemory(instructions.LoadI64, 3, memArg)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStoreI32(memArg WasmMemArg) *WasmFunctionBuilder {
+	return b.addInstrMemory(instructions.StoreI32, 2, memArg)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStoreI64(memArg WasmMemArg) *WasmFunctionBuilder {
+	return b.addInstrMemory(instructions.StoreI64, 3, memArg)
+}
+
+func (b *WasmFunctionBuilder) AddInstrLoadF64(memArg WasmMemArg) *WasmFunctionBuilder {
+	return b.addInstrMemory(instructions.LoadF64, 3, memArg)
+}
+
+func (b *WasmFunctionBuilder) AddInstrStoreF64(memArg WasmMemArg) *WasmFunctionBuilder {
+	return b.addInstrMemory(instructions.StoreF64, 3, memArg)
+}
+
+// Adds an atomic memory instruction: an atomic load, store, read-modify-write or compare
+// exchange, or one of memory.atomic.notify, memory.atomic.wait32 and memory.atomic.wait64.
+// Atomic accesses must be naturally aligned, so the alignment of the memory argument has to
+// match the access width of the instruction exactly.
+func (b *WasmFunctionBuilder) AddInstrAtomic(op instructions.WasmAtomicInstruction, memArg WasmMemArg) *WasmFunctionBuilder {
+	naturalAlign, ok := atomicAlignment(op)
+	if !ok {
+		b.fail(fmt.Errorf("%w: atomic instruction 0x%02X does not take a memory argument", ErrUnknownInstruction, op))
+		return b
+	}
+	if memArg.Align != naturalAlign {
+		b.fail(fmt.Errorf("%w: instruction 0x%02X requires alignment %d, got %d", ErrUnalignedAtomic, op, naturalAlign, memArg.Align))
+		return b
+	}
+
+	encoded, ok := b.memarg(memArg)
+	if !ok {
+		return b
+	}
+
+	b.use(FeatureThreads)
+	b.instructions = append(b.instructions, instructions.AtomicPrefix)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(op))...)
+	b.instructions = append(b.instructions, encoded...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrAtomicFence() *WasmFunctionBuilder {
+	b.use(FeatureThreads)
+	b.instructions = append(b.instructions, instructions.AtomicPrefix)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(instructions.AtomicFence))...)
+	b.instructions = append(b.instructions, 0x00)
+	return b
+}
+
+func (b *WasmFunctionBuilder) memoryIndex(memory *WasmMemory) (uint64, bool) {
+	if memory == nil {
+		return 0, true
+	}
+	if b.symbolTable.memory(memory.index) != memory {
+		b.fail(fmt.Errorf("%w: memory is not declared in the symbol table", ErrUnknownMemory))
+		return 0, false
+	}
+	if memory.index != 0 {
+		b.use(FeatureMultiMemory)
+	}
+	return uint64(memory.index), true
+}
+
+// Pushes the current size of the memory in pages. A nil memory refers to memory 0.
+func (b *WasmFunctionBuilder) AddInstrMemorySize(memory *WasmMemory) *WasmFunctionBuilder {
+	index, ok := b.memoryIndex(memory)
+	if !ok {
+		return b
+	}
+
+	b.instructions = append(b.instructions, instructions.MemorySize)
+	b.instructions = append(b.instructions, leb128EncodeU(index)...)
+	return b
+}
+
+// Grows the memory by the number of pages on the stack and pushes the previous size, or -1 if
+// the memory cannot grow. A nil memory refers to memory 0.
+func (b *WasmFunctionBuilder) AddInstrMemoryGrow(memory *WasmMemory) *WasmFunctionBuilder {
+	index, ok := b.memoryIndex(memory)
+	if !ok {
+		return b
+	}
+
+	b.instructions = append(b.instructions, instructions.MemoryGrow)
+	b.instructions = append(b.instructions, leb128EncodeU(index)...)
+	return b
+}
+
+// Returns the memory with the given index, or nil if there is no such memory.
+func (s *wasmSymbolTable) memory(index int) *WasmMemory {
+	if index < 0 || index >= len(s.memories) {
+		return nil
+	}
+	return s.memories[index]
+}
+
+// Declares a linear memory defined by the module and assigns its index. Memory instructions
+// of functions built on this symbol table can then refer to the memory.
+func (s *wasmSymbolTable) AddMemory(memory *WasmMemory) *WasmMemory {
+	if err := memory.validate(); err != nil {
+		s.fail(err)
+		return memory
+	}
+
+	memory.index = len(s.memories)
+	s.memories = append(s.memories, memory)
+
+	return memory
+}
+
+// Imports a linear memory from the host. Imported memories come first in the memory index
+// space, so all memory imports must be declared before any memory is added.
+func (s *wasmSymbolTable) ImportMemory(moduleName, name string, memory *WasmMemory) *WasmMemory {
+	if err := memory.validate(); err != nil {
+		s.fail(err)
+		return memory
+	}
+	if len(s.memories) > s.importedMemories {
+		s.fail(fmt.Errorf("%w: memory %s.%s imported after a memory definition", ErrImportOrder, moduleName, name))
+		return memory
+	}
+
+	memory.moduleName = moduleName
+	memory.name = name
+	memory.index = len(s.memories)
+	s.memories = append(s.memories, memory)
+	s.importedMemories++
+
+	return memory
+}
+
+// Defines a linear memory in the module and assigns its index, so that it can be exported
+// afterwards using the ExportMemoryType export type. See the AddMemory of the symbol table.
+func (b *WasmModuleBuilder) AddMemory(memory *WasmMemory) *WasmModuleBuilder {
+	b.symbolTable.AddMemory(memory)
+	return b
+}
+
+// Imports a linear memory from the host. See the ImportMemory of the symbol table.
+func (b *WasmModuleBuilder) ImportMemory(moduleName, name string, memory *WasmMemory) *WasmModuleBuilder {
+	b.symbolTable.ImportMemory(moduleName, name, memory)
+	return b
+}
+
+// Initializes a region of the memory with data when the module is instantiated, starting at
+// the given offset. A nil memory refers to memory 0.
+func (b *WasmModuleBuilder) AddData(memory *WasmMemory, offset uint64, data []byte) *WasmModuleBuilder {
+	if memory != nil && memory.Memory64 {
+		return b.AddDataAt(memory, NewWasmConstExpr().AddInstrConstI64(int64(offset)), data)
+	}
+	if offset > math.MaxUint32 {
+		b.fail(fmt.Errorf("%w: data offset %d exceeds the address space of a 32-bit memory", ErrInvalidMemArg, offset))
+		return b
+	}
+	return b.AddDataAt(memory, NewWasmConstExpr().AddInstrConstI32(int32(uint32(offset))), data)
+}
+
+// Initializes a region of the memory with data, starting at the address computed by the
+// constant expression, such as __memory_base plus an offset. The expression produces an i32,
+// or an i64 for 64-bit memories. A nil memory refers to memory 0.
+func (b *WasmModuleBuilder) AddDataAt(memory *WasmMemory, offset *WasmConstExpr, data []byte) *WasmModuleBuilder {
+	if memory == nil {
+		memory = b.symbolTable.memory(0)
+	}
+	if memory == nil || b.symbolTable.memory(memory.index) != memory {
+		b.fail(fmt.Errorf("%w: data segment for a memory that is not declared", ErrUnknownMemory))
+		return b
+	}
+
+	addressType := ValType(types.I32)
+	if memory.Memory64 {
+		addressType = ValType(types.I64)
+	}
+	if err := offset.validate(b.symbolTable, addressType, len(b.symbolTable.globals)); err != nil {
+		b.fail(err)
+		return b
+	}
+
+	b.usedFeatures |= offset.requiredFeatures()
+	b.sectionData = append(b.sectionData, dataSegment(memory, offset, data))
+
+	return b
+}
@@ -0,0 +1,286 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestMemory(t *testing.T) {
+	t.Run("should store and load values in linear memory", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := &WasmMemory{Min: 1}
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			// store the parameter at address 8, then load it back and add one
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrConstI32(8).
+			AddInstrGetLocal(0).
+			AddInstrStoreI32(WasmMemArg{Align: 2}).
+			AddInstrConstI32(4).
+			AddInstrLoadI32(WasmMemArg{Offset: 4, Align: 2}).
+			AddInstrConstI32(1).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddMemory(memory).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main).
+			Export("memory", types.ExportMemoryType, memory)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{41},
+			expected:   int32(42),
+		})
+	})
+
+	t.Run("should encode shared memory and atomic instructions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := &WasmMemory{Min: 1, Max: 2, HasMax: true, Shared: true}
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrGetLocal(0).
+			AddInstrAtomic(instructions.AtomicRmwAddI32, WasmMemArg{Align: 2}).
+			AddInstrAtomicFence().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddMemory(memory).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+
+		memorySection := []byte{0x05, 0x04, 0x01, 0x03, 0x01, 0x02}
+		if !bytes.Contains(wasm, memorySection) {
+			t.Fatalf("expected shared memory section %x in %x", memorySection, wasm)
+		}
+
+		body := []byte{
+			0x41, 0x00, // i32.const 0
+			0x20, 0x00, // local.get 0
+			0xFE, 0x1E, 0x02, 0x00, // i32.atomic.rmw.add align=2 offset=0
+			0xFE, 0x03, 0x00, // atomic.fence
+			0x0B, // end
+		}
+		if !bytes.Contains(wasm, body) {
+			t.Fatalf("expected function body %x in %x", body, wasm)
+		}
+	})
+
+	t.Run("should reject atomic instructions that are not naturally aligned", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I64).
+			AddInstrConstI32(0).
+			AddInstrAtomic(instructions.AtomicLoadI64, WasmMemArg{Align: 2}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main)
+
+		if err := mod.Err(); !errors.Is(err, ErrUnalignedAtomic) {
+			t.Fatalf("expected %v, got %v", ErrUnalignedAtomic, err)
+		}
+		if err := mod.BuildWasmFile("unaligned.wasm"); !errors.Is(err, ErrUnalignedAtomic) {
+			t.Fatalf("expected %v, got %v", ErrUnalignedAtomic, err)
+		}
+	})
+
+	t.Run("should require a maximum size for shared memories", func(t *testing.T) {
+		mod := NewWasmModuleBuilder(NewSymbolTable(nil)).
+			AddMemory(&WasmMemory{Min: 1, Shared: true})
+
+		if err := mod.Err(); !errors.Is(err, ErrSharedMemoryMax) {
+			t.Fatalf("expected %v, got %v", ErrSharedMemoryMax, err)
+		}
+	})
+
+	t.Run("should import memories before defining memories", func(t *testing.T) {
+		imported := &WasmMemory{Min: 1, Max: 1, HasMax: true, Shared: true}
+		defined := &WasmMemory{Min: 1}
+
+		mod := NewWasmModuleBuilder(NewSymbolTable(nil)).
+			ImportMemory("env", "memory", imported)
+
+		if imported.GetIndex() != 0 {
+			t.Fatalf("expected imported memory index 0, got %d", imported.GetIndex())
+		}
+
+		mod.AddMemory(defined)
+		if defined.GetIndex() != 1 {
+			t.Fatalf("expected defined memory index 1, got %d", defined.GetIndex())
+		}
+
+		mod.ImportMemory("env", "late", &WasmMemory{Min: 1})
+		if err := mod.Err(); !errors.Is(err, ErrImportOrder) {
+			t.Fatalf("expected %v, got %v", ErrImportOrder, err)
+		}
+	})
+
+	t.Run("should encode 64-bit memories and wide offsets", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1, Max: 1 << 20, HasMax: true, Memory64: true})
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I64).
+			AddInstrConstI64(0).
+			AddInstrLoadI64(WasmMemArg{Offset: 1 << 32, Align: 3}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			AddData(memory, 1<<32, []byte{0x2A})
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+
+		memorySection := []byte{0x05, 0x06, 0x01, 0x05, 0x01, 0x80, 0x80, 0x40}
+		if !bytes.Contains(wasm, memorySection) {
+			t.Fatalf("expected memory64 section %x in %x", memorySection, wasm)
+		}
+
+		load := []byte{0x29, 0x03, 0x80, 0x80, 0x80, 0x80, 0x10}
+		if !bytes.Contains(wasm, load) {
+			t.Fatalf("expected i64.load with a 64-bit offset %x in %x", load, wasm)
+		}
+
+		dataSection := []byte{0x0B, 0x0B, 0x01, 0x00, 0x42, 0x80, 0x80, 0x80, 0x80, 0x10, 0x0B, 0x01, 0x2A}
+		if !bytes.Contains(wasm, dataSection) {
+			t.Fatalf("expected data section %x in %x", dataSection, wasm)
+		}
+	})
+
+	t.Run("should encode memory indices of multiple memories", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+		second := wasmSymbolTable.AddMemory(&WasmMemory{Min: 2})
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrLoadI32(WasmMemArg{Memory: second, Offset: 4, Align: 2}).
+			AddInstrMemorySize(second).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			AddData(second, 16, []byte("hi"))
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+
+		body := []byte{
+			0x41, 0x00, // i32.const 0
+			0x28, 0x42, 0x01, 0x04, // i32.load align=2 memory=1 offset=4
+			0x3F, 0x01, // memory.size 1
+			0x6A, // i32.add
+			0x0B, // end
+		}
+		if !bytes.Contains(wasm, body) {
+			t.Fatalf("expected function body %x in %x", body, wasm)
+		}
+
+		dataSection := []byte{0x0B, 0x09, 0x01, 0x02, 0x01, 0x41, 0x10, 0x0B, 0x02, 'h', 'i'}
+		if !bytes.Contains(wasm, dataSection) {
+			t.Fatalf("expected data section %x in %x", dataSection, wasm)
+		}
+	})
+
+	t.Run("should load values initialized by a data segment", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrLoadI32(WasmMemArg{Offset: 8, Align: 2}).
+			AddInstrMemorySize(nil).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			AddData(memory, 8, []byte{41, 0, 0, 0}).
+			Export("main", types.ExportFunctionType, &main)
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{},
+			expected:   int32(42),
+		})
+	})
+
+	t.Run("should reject memory arguments that do not fit the memory", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrLoadI32(WasmMemArg{Offset: 1 << 32, Align: 2}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).AddFunction(&main)
+		if err := mod.Err(); !errors.Is(err, ErrInvalidMemArg) {
+			t.Fatalf("expected %v, got %v", ErrInvalidMemArg, err)
+		}
+
+		foreign := NewSymbolTable(nil).AddMemory(&WasmMemory{Min: 1})
+		other := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrMemoryGrow(foreign)
+		if err := other.Err(); !errors.Is(err, ErrUnknownMemory) {
+			t.Fatalf("expected %v, got %v", ErrUnknownMemory, err)
+		}
+	})
+
+	t.Run("should limit the size of 32-bit memories", func(t *testing.T) {
+		mod := NewWasmModuleBuilder(NewSymbolTable(nil)).
+			AddMemory(&WasmMemory{Min: 1 << 17})
+
+		if err := mod.Err(); !errors.Is(err, ErrInvalidMemoryLimits) {
+			t.Fatalf("expected %v, got %v", ErrInvalidMemoryLimits, err)
+		}
+
+		mod = NewWasmModuleBuilder(NewSymbolTable(nil)).
+			AddMemory(&WasmMemory{Min: 1 << 17, Memory64: true})
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
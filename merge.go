@@ -0,0 +1,135 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Merges defined functions that have the same type, locals and body, and redirects all
+// references to the removed copies to the first of them. Functions that only differ in the
+// copies they call are merged too. If saved is not nil, it is set to the number of bytes by
+// which the module became smaller.
+func WithFunctionMerging(saved *int) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		n := MergeIdenticalFunctions(m)
+		if saved != nil {
+			*saved = n
+		}
+		return nil
+	}
+}
+
+// Applies the function merging of WithFunctionMerging to the module, and returns the number of
+// bytes saved.
+func MergeIdenticalFunctions(m *WasmDecodedModule) int {
+	before := len(m.Encode())
+	imported := uint32(m.importCount(types.ImportFunctionType))
+
+	removed := make([]bool, int(imported)+len(m.Code))
+	for {
+		canonical := map[string]uint32{}
+		redirects := map[uint32]uint32{}
+		for i, c := range m.Code {
+			f := imported + uint32(i)
+			if removed[f] {
+				continue
+			}
+			key := fmt.Sprint(m.Functions[i], c.Locals, dataAddresses(c.Body)) + string(EncodeInstrs(c.Body))
+			if first, ok := canonical[key]; ok {
+				redirects[f] = first
+				removed[f] = true
+			} else {
+				canonical[key] = f
+			}
+		}
+		if len(redirects) == 0 {
+			break
+		}
+		redirectFunctions(m, redirects, true)
+		for from, to := range redirects {
+			if m.alwaysInline[from] {
+				m.SetAlwaysInline(to)
+			}
+		}
+	}
+
+	removeFunctions(m, removed)
+	return before - len(m.Encode())
+}
+
+// Replaces all references to the functions that are keys of redirects with references to
+// their values. Direct calls and tail calls are only redirected if calls is set.
+func redirectFunctions(m *WasmDecodedModule, redirects map[uint32]uint32, calls bool) {
+	index := func(f uint32) uint32 {
+		if to, ok := redirects[f]; ok {
+			return to
+		}
+		return f
+	}
+	expr := func(body []WasmInstr) {
+		for i := range body {
+			op := body[i].Opcode
+			if !calls && (op == WasmOpcode(instructions.CallFunc) || op == WasmOpcode(instructions.ReturnCall)) {
+				continue
+			}
+			body[i].visitImmediates(func(kind wasmImmediate, value *uint64) {
+				if kind == immFunc {
+					*value = uint64(index(uint32(*value)))
+				}
+			})
+		}
+	}
+
+	for _, c := range m.Code {
+		expr(c.Body)
+	}
+	for _, g := range m.Globals {
+		expr(g.Init)
+	}
+	for _, t := range m.Tables {
+		expr(t.Init)
+	}
+	for _, e := range m.Elements {
+		for k, f := range e.Funcs {
+			e.Funcs[k] = index(f)
+		}
+		for _, init := range e.Exprs {
+			expr(init)
+		}
+	}
+	for i, e := range m.Exports {
+		if e.Kind == types.ExportFunctionType {
+			m.Exports[i].Index = index(e.Index)
+		}
+	}
+	if m.Start != nil {
+		start := index(*m.Start)
+		m.Start = &start
+	}
+	for i, init := range m.initFunctions {
+		m.initFunctions[i].Function = index(init.Function)
+	}
+	// comdats hold the definitions themselves, which only move when calls are redirected too
+	for _, c := range m.comdats {
+		if !calls {
+			continue
+		}
+		for k, f := range c.Functions {
+			c.Functions[k] = index(f)
+		}
+	}
+}
+
+// Returns the data addresses that the instructions push, which functions that are merged must
+// agree on.
+func dataAddresses(body []WasmInstr) []wasmDataAddress {
+	addresses := []wasmDataAddress{}
+	for _, in := range body {
+		if in.data != nil {
+			addresses = append(addresses, *in.data)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,107 @@
+package gowasmtk
+
+import (
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestFunctionMerging(t *testing.T) {
+	t.Run("should merge identical functions and redirect their references", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		table := &WasmTable{RefType: types.FuncRef, Min: 1}
+
+		double := func() WasmFunctionModule {
+			return NewWasmFunctionBuilder(wasmSymbolTable).
+				AddParam(types.I32).
+				AddReturn(types.I32).
+				AddExpr(LocalI32(0).Mul(I32(2))).
+				AddInstrEnd().
+				Build()
+		}
+		doubleA, doubleB := double(), double()
+
+		// identical once doubleB is merged into doubleA
+		quadruple := func(f *WasmFunctionModule) WasmFunctionModule {
+			return NewWasmFunctionBuilder(wasmSymbolTable).
+				AddParam(types.I32).
+				AddReturn(types.I32).
+				AddExpr(Call[I32Expr](f, Call[I32Expr](f, LocalI32(0)))).
+				AddInstrEnd().
+				Build()
+		}
+		quadrupleA, quadrupleB := quadruple(&doubleA), quadruple(&doubleB)
+
+		// calls both copies and the copy in the table
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(Call[I32Expr](&quadrupleA, LocalI32(0)).Add(Call[I32Expr](&quadrupleB, LocalI32(0)))).
+			AddInstrGetLocal(0).
+			AddInstrConstI32(0).
+			AddInstrCallIndirect(0, []types.WasmType{types.I32}, []types.WasmType{types.I32}).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&doubleA).
+			AddFunction(&doubleB).
+			AddFunction(&quadrupleA).
+			AddFunction(&quadrupleB).
+			AddFunction(&main).
+			AddTable(table).
+			AddElements(table, 0, &doubleB).
+			Export("main", types.ExportFunctionType, &main).
+			Export("quadruple", types.ExportFunctionType, &quadrupleB)
+
+		saved := 0
+		m, err := DecodeModule(mod.Build(WithFunctionMerging(&saved)))
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		if len(m.Functions) != 3 {
+			t.Fatalf("expected three functions, got %d", len(m.Functions))
+		}
+		if m.Exports[1].Index != 1 || m.Elements[0].Funcs[0] != 0 {
+			t.Fatalf("expected the export and table to refer to the first copies, got %+v and %+v", m.Exports, m.Elements)
+		}
+		if unmerged := len(mod.Build()); saved <= 0 || len(m.Encode())+saved != unmerged {
+			t.Fatalf("expected %d bytes saved, got %d", unmerged-len(m.Encode()), saved)
+		}
+
+		checkRoundTrip(t, mod.Build(WithFunctionMerging(nil)))
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{3},
+			expected:   int32(12 + 12 + 6),
+			options:    []WasmBuildOption{WithFunctionMerging(nil)},
+		})
+	})
+
+	t.Run("should not merge functions of different types", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		identity := func(t types.WasmType) WasmFunctionModule {
+			return NewWasmFunctionBuilder(wasmSymbolTable).
+				AddParam(t).
+				AddReturn(t).
+				AddInstrGetLocal(0).
+				AddInstrEnd().
+				Build()
+		}
+		i32, i64 := identity(types.I32), identity(types.I64)
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&i32).
+			AddFunction(&i64).
+			Export("i32", types.ExportFunctionType, &i32).
+			Export("i64", types.ExportFunctionType, &i64)
+
+		m, _ := DecodeModule(mod.Build())
+		if saved := MergeIdenticalFunctions(m); saved != 0 || len(m.Functions) != 2 {
+			t.Fatalf("expected nothing to be merged, got %d functions and %d bytes saved", len(m.Functions), saved)
+		}
+	})
+}
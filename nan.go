@@ -0,0 +1,177 @@
+package gowasmtk
+
+import (
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Replaces every NaN that a float instruction produces with the canonical NaN of its type, and
+// every NaN lane of a float vector instruction with the canonical NaN of its lanes, so that the
+// results do not depend on the NaN payloads of the host. Instructions that only copy or change
+// the sign bit, like abs, neg, copysign, pmin, pmax, loads and reinterpretations, keep their
+// NaNs.
+func WithNaNCanonicalization() WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		CanonicalizeNaNs(m)
+		return nil
+	}
+}
+
+// Applies the canonicalization of WithNaNCanonicalization to the module.
+func CanonicalizeNaNs(m *WasmDecodedModule) {
+	for i := range m.Code {
+		c := &m.Code[i]
+		next := uint64(len(m.typeAt(m.Functions[i]).Params))
+		for _, l := range c.Locals {
+			next += uint64(l.Count)
+		}
+
+		temps := map[types.WasmType]uint64{}
+		body := []WasmInstr{}
+		temp := func(t types.WasmType) uint64 {
+			if _, ok := temps[t]; !ok {
+				temps[t] = next
+				next++
+				c.Locals = append(c.Locals, WasmDecodedLocals{Count: 1, Type: WasmDecodedValType{Code: t, Heap: noHeapType}})
+			}
+			return temps[t]
+		}
+		for _, instr := range c.Body {
+			body = append(body, instr)
+			if t, ok := nanResult(instr.Opcode); ok {
+				body = append(body, canonicalizeNaN(t, temp(t))...)
+			} else if lane, ok := nanLanes(instr.Opcode); ok {
+				body = append(body, canonicalizeNaNLanes(lane, temp(types.V128))...)
+			}
+		}
+		c.Body = body
+	}
+}
+
+// Returns the type of the result of a float instruction whose result can be a NaN with a
+// payload that is not deterministic.
+func nanResult(op WasmOpcode) (types.WasmType, bool) {
+	switch {
+	case op >= 0x8D && op <= 0x97, op == 0xB6: // f32 rounding, sqrt, arithmetic, min, max and demote
+		return types.F32, true
+	case op >= 0x9B && op <= 0xA5, op == 0xBB: // f64 rounding, sqrt, arithmetic, min, max and promote
+		return types.F64, true
+	}
+	return 0, false
+}
+
+// Returns the float type of the lanes of the result of a vector instruction whose lanes can be
+// NaNs with payloads that are not deterministic. The relaxed SIMD instructions are not included,
+// since their results differ between hosts even when they are not NaNs.
+func nanLanes(op WasmOpcode) (types.WasmType, bool) {
+	prefix, sub := op.Split()
+	if prefix != prefixSIMD {
+		return 0, false
+	}
+	switch {
+	case sub >= 0x67 && sub <= 0x6A, sub >= 0xE3 && sub <= 0xE9, sub == 0x5E: // f32x4 rounding, sqrt, arithmetic, min, max and demote
+		return types.F32, true
+	case sub == 0x74, sub == 0x75, sub == 0x7A, sub == 0x94, sub >= 0xEF && sub <= 0xF5, sub == 0x5F: // f64x2 rounding, sqrt, arithmetic, min, max and promote
+		return types.F64, true
+	}
+	return 0, false
+}
+
+// Returns the canonical NaN of the float type, with only the quiet bit of its payload set.
+func canonicalNaN(t types.WasmType) wasmConst {
+	if t == types.F32 {
+		return wasmConst{types.F32, 0x7FC00000}
+	}
+	return wasmConst{types.F64, 0x7FF8000000000000}
+}
+
+// Returns the instructions that replace the float on the stack with the canonical NaN if it is
+// a NaN, using the local temp of the same type.
+func canonicalizeNaN(t types.WasmType, temp uint64) []WasmInstr {
+	eq := WasmOpcode(instructions.EqualF64)
+	if t == types.F32 {
+		eq = 0x5B // f32.eq
+	}
+	return []WasmInstr{
+		Instr(WasmOpcode(instructions.TeeLocal), temp),
+		canonicalNaN(t).instr(),
+		Instr(WasmOpcode(instructions.GetLocal), temp),
+		Instr(WasmOpcode(instructions.GetLocal), temp),
+		Instr(eq),
+		Instr(WasmOpcode(instructions.Select)),
+	}
+}
+
+// Returns the instructions that replace every NaN lane of the vector on the stack with the
+// canonical NaN of the lane type, using the v128 local temp.
+func canonicalizeNaNLanes(lane types.WasmType, temp uint64) []WasmInstr {
+	splat, eq := uint64(0x7FC000007FC00000), PrefixedOpcode(prefixSIMD, 0x41) // f32x4.eq
+	if lane == types.F64 {
+		splat, eq = canonicalNaN(types.F64).bits, PrefixedOpcode(prefixSIMD, 0x47) // f64x2.eq
+	}
+	return []WasmInstr{
+		Instr(WasmOpcode(instructions.TeeLocal), temp),
+		Instr(PrefixedOpcode(prefixSIMD, 12), splat, splat), // v128.const
+		Instr(WasmOpcode(instructions.GetLocal), temp),
+		Instr(WasmOpcode(instructions.GetLocal), temp),
+		Instr(eq),
+		Instr(PrefixedOpcode(prefixSIMD, 0x52)), // v128.bitselect
+	}
+}
+
+// Makes the builder canonicalize the NaNs of the float arithmetic it emits afterwards, like
+// WithNaNCanonicalization does for a built module. The canonicalization uses a local that is
+// declared after all others when the function is built, so the indices of the other locals do
+// not change.
+func (b *WasmFunctionBuilder) CanonicalizeNaNs() *WasmFunctionBuilder {
+	b.canonicalizeNaNs = true
+	return b
+}
+
+// Appends a numeric instruction, followed by its NaN canonicalization if it is enabled.
+func (b *WasmFunctionBuilder) addInstrNumeric(op instructions.WasmInstruction) {
+	b.instructions = append(b.instructions, op)
+	t, ok := nanResult(WasmOpcode(op))
+	if !b.canonicalizeNaNs || !ok {
+		return
+	}
+	if b.nanTemps == nil {
+		b.nanTemps = map[types.WasmType][]int{}
+	}
+
+	// the index of the local replaces the placeholder when it is declared by Build
+	for _, instr := range canonicalizeNaN(t, 0) {
+		if instr.Opcode == WasmOpcode(instructions.TeeLocal) || instr.Opcode == WasmOpcode(instructions.GetLocal) {
+			b.instructions = append(b.instructions, byte(instr.Opcode))
+			b.nanTemps[t] = append(b.nanTemps[t], len(b.instructions))
+			b.instructions = append(b.instructions, leb128EncodePadded(0, 5)...)
+		} else {
+			b.instructions = append(b.instructions, instr.encode()...)
+		}
+	}
+}
+
+// Declares the locals of the NaN canonicalization and replaces the placeholders of their
+// indices in the instructions that use them, from the last to the first so that the positions
+// of the others stay valid.
+func (b *WasmFunctionBuilder) declareNaNTemps() {
+	indices := map[int]uint64{}
+	positions := []int{}
+	for _, t := range []types.WasmType{types.F32, types.F64} {
+		if len(b.nanTemps[t]) == 0 {
+			continue
+		}
+		index := b.declareLocals(1, ValType(t))
+		for _, pos := range b.nanTemps[t] {
+			indices[pos] = index
+			positions = append(positions, pos)
+		}
+	}
+	slices.Sort(positions)
+	for _, pos := range slices.Backward(positions) {
+		b.instructions = slices.Replace(b.instructions, pos, pos+5, leb128EncodeU(indices[pos])...)
+	}
+	b.nanTemps = nil
+}
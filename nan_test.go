@@ -0,0 +1,140 @@
+package gowasmtk
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// Runs div of the module for 0/0 and 6/3, and checks that the NaN is canonical.
+func checkCanonicalDivision(t *testing.T, wasm []byte) {
+	t.Helper()
+	instance := instantiate(t, wasmer.NewStore(wasmer.NewEngine()), wasm, nil)
+	div, _ := instance.Exports.GetFunction("div")
+	if result, err := div(0.0, 0.0); err != nil || math.Float64bits(result.(float64)) != 0x7FF8000000000000 {
+		t.Fatalf("expected the canonical NaN, got %v and %v", result, err)
+	}
+	if result, err := div(6.0, 3.0); err != nil || result != 2.0 {
+		t.Fatalf("expected 2, got %v and %v", result, err)
+	}
+}
+
+func TestNaNCanonicalization(t *testing.T) {
+	t.Run("should canonicalize the results of float arithmetic", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		div := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.F64).
+			AddParam(types.F64).
+			AddReturn(types.F64).
+			AddExpr(LocalF64(0).Div(LocalF64(1)).Neg()).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&div).
+			Export("div", types.ExportFunctionType, &div)
+
+		wasm := mod.Build(WithNaNCanonicalization())
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		m, _ := DecodeModule(wasm)
+		ops := []WasmOpcode{}
+		for _, instr := range m.Code[0].Body {
+			ops = append(ops, instr.Opcode)
+		}
+		// neg only flips the sign of the canonical NaN, so it is not canonicalized again
+		expected := []WasmOpcode{
+			WasmOpcode(instructions.GetLocal), WasmOpcode(instructions.GetLocal), WasmOpcode(instructions.DivF64),
+			WasmOpcode(instructions.TeeLocal), WasmOpcode(instructions.ConstF64), WasmOpcode(instructions.GetLocal),
+			WasmOpcode(instructions.GetLocal), WasmOpcode(instructions.EqualF64), WasmOpcode(instructions.Select),
+			WasmOpcode(instructions.NegF64), WasmOpcode(instructions.End),
+		}
+		if !slices.Equal(ops, expected) || len(m.Code[0].Locals) != 1 {
+			t.Fatalf("expected canonicalization after the division with a new local, got %v and %+v", ops, m.Code[0].Locals)
+		}
+
+		mod = NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&div).
+			Export("div", types.ExportFunctionType, &div)
+		wasm = mod.Build(func(m *WasmDecodedModule) error {
+			// without neg, so that the sign of the NaN is the canonical one
+			m.Code[0].Body = slices.Delete(m.Code[0].Body, 3, 4)
+			return nil
+		}, WithNaNCanonicalization())
+		checkCanonicalDivision(t, wasm)
+	})
+
+	t.Run("should canonicalize the lanes of float vector arithmetic", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		div := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.F64).
+			AddParam(types.F64).
+			AddReturn(types.F64).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&div).
+			Export("div", types.ExportFunctionType, &div)
+		simd := func(sub uint32, immediates ...uint64) WasmInstr {
+			return Instr(PrefixedOpcode(prefixSIMD, sub), immediates...)
+		}
+		wasm := mod.Build(func(m *WasmDecodedModule) error {
+			// divides splats of the parameters and extracts the first lane of the quotient
+			m.Code[0].Body = []WasmInstr{
+				Instr(WasmOpcode(instructions.GetLocal), 0), simd(0x14),
+				Instr(WasmOpcode(instructions.GetLocal), 1), simd(0x14),
+				simd(0xF3), simd(0x21, 0),
+				Instr(WasmOpcode(instructions.End)),
+			}
+			return nil
+		}, WithNaNCanonicalization())
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		m, _ := DecodeModule(wasm)
+		if locals := m.Code[0].Locals; len(locals) != 1 || locals[0].Type.Code != types.V128 {
+			t.Fatalf("expected a v128 local, got %+v", locals)
+		}
+		if bitselect := m.Code[0].Body[10]; bitselect.Opcode != PrefixedOpcode(prefixSIMD, 0x52) {
+			t.Fatalf("expected v128.bitselect after the division, got %+v", m.Code[0].Body)
+		}
+		checkCanonicalDivision(t, wasm)
+	})
+
+	t.Run("should canonicalize float arithmetic emitted by the builder", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		builder := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.F64).
+			AddParam(types.F64).
+			AddReturn(types.F64).
+			CanonicalizeNaNs().
+			AddExprSetLocal(0, LocalF64(0).Div(LocalF64(1)))
+		// declared after the division, but still the first local
+		quotient := builder.NewLocal(types.F64)
+		div := builder.
+			AddInstrGetLocal(0).
+			AddInstrSetLocal(uint64(quotient.GetIndex())).
+			AddInstrGetLocal(uint64(quotient.GetIndex())).
+			AddInstrEnd().
+			Build()
+		if uint64(quotient.GetIndex()) != 2 {
+			t.Fatalf("expected the local to have index 2, got %d", uint64(quotient.GetIndex()))
+		}
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&div).
+			Export("div", types.ExportFunctionType, &div)
+		wasm := mod.Build()
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		checkCanonicalDivision(t, wasm)
+	})
+}
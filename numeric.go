@@ -0,0 +1,179 @@
+package gowasmtk
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+)
+
+func (b *WasmFunctionBuilder) AddInstrConstF64(n float64) *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.ConstF64)
+	b.instructions = binary.LittleEndian.AppendUint64(b.instructions, math.Float64bits(n))
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrAddI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.AddI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrSubI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.SubI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrMulI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.MulI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrDivI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.DivI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrEqI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.EqualI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrNotEqI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.NotEqualI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLessThanI64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.LessThanSignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLessThanI64U() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.LessThanUnsignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGreaterThanI64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.GreaterThanSignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGreaterThanI64U() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.GreaterThanUnsignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLessThanEqI64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.LessThanEqualSignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLessThanEqI64U() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.LessThanEqualUnsignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGreaterThanEqI64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.GreaterThanEqualSignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGreaterThanEqI64U() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.GreaterThanEqualUnsignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrEqzI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.EqzI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrAddF64() *WasmFunctionBuilder {
+	b.addInstrNumeric(instructions.AddF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrSubF64() *WasmFunctionBuilder {
+	b.addInstrNumeric(instructions.SubF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrMulF64() *WasmFunctionBuilder {
+	b.addInstrNumeric(instructions.MulF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrDivF64() *WasmFunctionBuilder {
+	b.addInstrNumeric(instructions.DivF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrNegF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.NegF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrEqF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.EqualF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrNotEqF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.NotEqualF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLessThanF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.LessThanF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGreaterThanF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.GreaterThanF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrLessThanEqF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.LessThanEqualF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrGreaterThanEqF64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.GreaterThanEqualF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrWrapI64() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.WrapI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrExtendI32S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.ExtendI32SignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrExtendI32U() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.ExtendI32UnsignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrTruncF64I32S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.TruncF64SignedI32)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrTruncF64I64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.TruncF64SignedI64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrConvertI32F64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.ConvertI32SignedF64)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrConvertI64F64S() *WasmFunctionBuilder {
+	b.instructions = append(b.instructions, instructions.ConvertI64SignedF64)
+	return b
+}
@@ -0,0 +1,585 @@
+package gowasmtk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"strings"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmInitFunction is a function without parameters and results that the linker calls before
+// the program starts. Functions with lower priorities are called first.
+type WasmInitFunction struct {
+	Function uint32
+	Priority uint32
+}
+
+// WasmComdat is a group of functions of which the linker keeps only the definitions of the
+// first object file with a comdat of the same name.
+type WasmComdat struct {
+	Name      string
+	Functions []uint32
+}
+
+type wasmInitFunctionDecl struct {
+	function *WasmFunctionModule
+	priority uint32
+}
+
+type wasmComdatDecl struct {
+	name      string
+	functions []*WasmFunctionModule
+}
+
+// Makes Build emit a relocatable object file that wasm-ld can link with the object files of
+// other compilers, such as clang, as described by EncodeObject.
+func (b *WasmModuleBuilder) ObjectFile() *WasmModuleBuilder {
+	b.objectFile = true
+	return b
+}
+
+// Declares the function as an init function of the object file with the given priority.
+func (b *WasmModuleBuilder) AddInitFunction(function *WasmFunctionModule, priority uint32) *WasmModuleBuilder {
+	b.initFunctions = append(b.initFunctions, wasmInitFunctionDecl{function: function, priority: priority})
+	return b
+}
+
+// Declares the functions as a comdat of the object file with the given name.
+func (b *WasmModuleBuilder) AddComdat(name string, functions ...*WasmFunctionModule) *WasmModuleBuilder {
+	b.comdats = append(b.comdats, wasmComdatDecl{name: name, functions: functions})
+	return b
+}
+
+// Declares the function with the given index as an init function of the object file, like
+// AddInitFunction does for functions of a builder.
+func (m *WasmDecodedModule) AddInitFunction(funcIndex, priority uint32) {
+	m.initFunctions = append(m.initFunctions, WasmInitFunction{Function: funcIndex, Priority: priority})
+}
+
+// Declares the functions with the given indices as a comdat of the object file, like AddComdat
+// does for functions of a builder.
+func (m *WasmDecodedModule) AddComdat(name string, funcIndices ...uint32) {
+	m.comdats = append(m.comdats, WasmComdat{Name: name, Functions: slices.Clone(funcIndices)})
+}
+
+// WasmDataSymbol is data in memory 0 that code can push the address of with
+// AddInstrDataAddress, and that other data can store the address of. The linker relocates these
+// addresses when it places the data of an object file.
+type WasmDataSymbol struct {
+	offset   uint32
+	bytes    []byte
+	pointers []wasmDataPointer
+	index    int
+}
+
+// wasmDataAddress is the address of a data symbol, given by its segment index, plus an addend.
+type wasmDataAddress struct {
+	segment uint32
+	addend  uint32
+}
+
+// wasmDataPointer is a data address that is stored as an i32 at an offset of other data.
+type wasmDataPointer struct {
+	at      uint32
+	address wasmDataAddress
+}
+
+// wasmDataAddressDecl is a data address that the instruction at a position of a function body
+// pushes.
+type wasmDataAddressDecl struct {
+	instr   int
+	address wasmDataAddress
+}
+
+// Places the data at the offset of memory 0, which must be a 32-bit memory, as a data symbol.
+// Data symbols come before the data segments of AddData.
+func (s *wasmSymbolTable) AddDataSymbol(offset uint32, data []byte) *WasmDataSymbol {
+	symbol := &WasmDataSymbol{offset: offset, bytes: slices.Clone(data), index: len(s.data)}
+	if memory := s.memory(0); memory == nil || memory.Memory64 {
+		s.fail(fmt.Errorf("%w: data symbols need a 32-bit memory 0", ErrUnknownMemory))
+		return symbol
+	}
+	if uint64(offset)+uint64(len(data)) > math.MaxUint32 {
+		s.fail(fmt.Errorf("%w: data symbol at offset %d exceeds the address space of a 32-bit memory", ErrInvalidMemArg, offset))
+		return symbol
+	}
+	s.data = append(s.data, symbol)
+	return symbol
+}
+
+// Stores the address of the target plus the addend as an i32 at the offset at of the data.
+func (s *wasmSymbolTable) AddDataPointer(data *WasmDataSymbol, at uint32, target *WasmDataSymbol, addend uint32) {
+	if !s.checkData(data) || !s.checkData(target) {
+		return
+	}
+	if uint64(at)+4 > uint64(len(data.bytes)) {
+		s.fail(fmt.Errorf("%w: pointer at offset %d of data symbol %d with %d bytes", ErrInvalidMemArg, at, data.index, len(data.bytes)))
+		return
+	}
+	binary.LittleEndian.PutUint32(data.bytes[at:], target.offset+addend)
+	data.pointers = append(data.pointers, wasmDataPointer{at: at, address: wasmDataAddress{segment: uint32(target.index), addend: addend}})
+}
+
+func (s *wasmSymbolTable) checkData(data *WasmDataSymbol) bool {
+	if data == nil || data.index >= len(s.data) || s.data[data.index] != data {
+		s.fail(fmt.Errorf("%w: data symbol is not declared in this symbol table", ErrUnknownData))
+		return false
+	}
+	return true
+}
+
+// Pushes the address of the data symbol plus the addend as an i32.
+func (b *WasmFunctionBuilder) AddInstrDataAddress(data *WasmDataSymbol, addend uint32) *WasmFunctionBuilder {
+	if data == nil || data.index >= len(b.symbolTable.data) || b.symbolTable.data[data.index] != data {
+		b.fail(fmt.Errorf("%w: data symbol is not declared in this symbol table", ErrUnknownData))
+		return b
+	}
+
+	b.dataAddresses = append(b.dataAddresses, wasmDataAddressDecl{
+		instr:   b.instrCount(),
+		address: wasmDataAddress{segment: uint32(data.index), addend: addend},
+	})
+	b.instructions = append(b.instructions, instructions.ConstI32)
+	b.instructions = append(b.instructions, leb128EncodeI(int64(int32(data.offset+addend)))...)
+	return b
+}
+
+// Returns the number of instructions that the builder emitted so far.
+func (b *WasmFunctionBuilder) instrCount() int {
+	r := &wasmReader{data: b.instructions}
+	n := 0
+	for ; !r.done() && r.err == nil; n++ {
+		r.instr()
+	}
+	return n
+}
+
+// Subsections of the linking section.
+const (
+	linkingVersion     = 2
+	linkingSegmentInfo = 0x05
+	linkingInitFuncs   = 0x06
+	linkingComdatInfo  = 0x07
+	linkingSymbolTable = 0x08
+)
+
+// Symbol kinds and flags of the symbol table.
+const (
+	symbolFunction byte = 0x00
+	symbolData     byte = 0x01
+	symbolGlobal   byte = 0x02
+	symbolTag      byte = 0x04
+	symbolTable    byte = 0x05
+
+	symbolWeak      uint32 = 0x01
+	symbolLocal     uint32 = 0x02
+	symbolUndefined uint32 = 0x10
+	symbolExported  uint32 = 0x20
+	symbolNoStrip   uint32 = 0x80
+)
+
+// Relocation types of the indices and addresses that EncodeObject pads.
+const (
+	relocFunctionIndex  byte = 0x00
+	relocMemoryAddrSleb byte = 0x04
+	relocMemoryAddrI32  byte = 0x05
+	relocTypeIndex      byte = 0x06
+	relocGlobalIndex    byte = 0x07
+	relocTagIndex       byte = 0x0A
+	relocTableNumber    byte = 0x14
+)
+
+const comdatFunction byte = 0x01
+
+// The priority of the start function, which is called like a constructor without a priority.
+const startPriority uint32 = 65535
+
+// The largest alignment of a data segment, as a power of two, that is derived from its offset.
+const maxSegmentAlignment = 4
+
+// Encodes the module as a relocatable object file for wasm-ld. The indices of functions,
+// types, globals, tags and tables and the addresses of data symbols in function bodies are
+// encoded as 5 byte LEB128 numbers, and the relocations in the reloc.CODE section tell the
+// linker where they are. The addresses of data symbols that are stored in data are relocated
+// by the reloc.DATA section. Imports become undefined symbols. Exports become symbols that the
+// linker exports, and other definitions become local symbols, except for the functions of
+// comdats, which are weak. The start function becomes an init function.
+//
+// The memory is imported as env.__linear_memory, and every data segment is placed by the
+// linker, so code must only depend on the addresses of data symbols. Modules with more than one
+// memory, element segments, passive data segments, data segment offsets that are not
+// constants, types other than function types, or with instructions that refer to data or
+// element segments cannot be encoded.
+func (m *WasmDecodedModule) EncodeObject() ([]byte, error) {
+	if err := m.checkObject(); err != nil {
+		return nil, err
+	}
+
+	object := *m
+	object.Imports = slices.Clone(m.Imports)
+	for _, l := range m.Memories {
+		object.Imports = append(object.Imports, WasmDecodedImport{Module: "env", Name: "__linear_memory", Kind: types.ImportMemoryType, Memory: l})
+	}
+	object.Memories, object.Exports, object.Start = nil, nil, nil
+	object.sections = slices.DeleteFunc(slices.Clone(m.sections), func(id sectionId) bool {
+		return id == sectionIdMemory || id == sectionIdExport
+	})
+	object.Customs = slices.DeleteFunc(slices.Clone(m.Customs), func(c WasmDecodedCustom) bool {
+		return c.Name == "linking" || strings.HasPrefix(c.Name, "reloc.")
+	})
+
+	o := newObject(m)
+	sections := []wasmSection{}
+	emitCustoms := func(after sectionId) {
+		for _, c := range object.Customs {
+			if c.After == after {
+				sections = append(sections, sectionCustom(c.Name, c.Payload))
+			}
+		}
+	}
+	relocations := []byte{}
+	emitRelocations := func(name string, contents []byte, relocs []wasmRelocation) {
+		if len(relocs) > 0 {
+			payload := append(leb128EncodeU(uint64(len(sections))), leb128EncodeU(uint64(len(relocs)))...)
+			for _, r := range relocs {
+				payload = append(payload, r.encode()...)
+			}
+			relocations = append(relocations, sectionCustom(name, payload)...)
+		}
+		sections = append(sections, contents)
+	}
+
+	emitCustoms(0)
+	for _, id := range sectionOrder {
+		if object.hasSection(id) {
+			switch id {
+			case sectionIdCode:
+				payload, relocs := o.code()
+				emitRelocations("reloc.CODE", section(id, payload), relocs)
+			case sectionIdData:
+				payload, relocs := o.data()
+				emitRelocations("reloc.DATA", section(id, payload), relocs)
+			default:
+				sections = append(sections, section(id, object.encodeSection(id)))
+			}
+		}
+		// the relocations follow the linking section, after the last known section
+		if id == sectionIdData {
+			sections = append(sections, sectionCustom("linking", o.linking()), relocations)
+		}
+		emitCustoms(id)
+	}
+
+	return module(sections...), nil
+}
+
+// Returns an error if the module cannot be encoded as an object file.
+func (m *WasmDecodedModule) checkObject() error {
+	for i, g := range m.Types {
+		for _, t := range g.Types {
+			if g.Explicit || t.Sub || t.Composite != compositeFunc {
+				return fmt.Errorf("%w: type group %d is not a function type", ErrUnsupportedObject, i)
+			}
+		}
+	}
+	if memories := m.importCount(types.ImportMemoryType) + len(m.Memories); memories > 1 {
+		return fmt.Errorf("%w: %d memories", ErrUnsupportedObject, memories)
+	}
+	if len(m.Elements) > 0 {
+		return fmt.Errorf("%w: %d element segments", ErrUnsupportedObject, len(m.Elements))
+	}
+	for i, d := range m.Data {
+		if d.Flags == 1 || d.Memory != 0 {
+			return fmt.Errorf("%w: data segment %d is not active in memory 0", ErrUnsupportedObject, i)
+		}
+		if len(d.Offset) != 2 || !slices.Contains([]WasmOpcode{WasmOpcode(instructions.ConstI32), WasmOpcode(instructions.ConstI64)}, d.Offset[0].Opcode) {
+			return fmt.Errorf("%w: the offset of data segment %d is not a constant", ErrUnsupportedObject, i)
+		}
+	}
+
+	inits := [][]WasmInstr{}
+	for _, g := range m.Globals {
+		inits = append(inits, g.Init)
+	}
+	for _, t := range m.Tables {
+		inits = append(inits, t.Init)
+	}
+	for i, init := range inits {
+		for _, instr := range init {
+			refers := false
+			instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+				refers = refers || kind == immFunc || kind == immGlobal
+			})
+			if refers {
+				return fmt.Errorf("%w: initializer %d of a global or table refers to a function or global", ErrUnsupportedObject, i)
+			}
+		}
+	}
+
+	for i, c := range m.Code {
+		for _, instr := range c.Body {
+			unsupported := false
+			instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+				unsupported = unsupported || kind == immData || kind == immElem || kind == immHeapType && int64(*value) >= 0
+			})
+			if unsupported {
+				return fmt.Errorf("%w: function %d refers to a data segment, element segment or type with opcode 0x%X",
+					ErrUnsupportedObject, i, uint32(instr.Opcode))
+			}
+		}
+	}
+
+	for _, init := range m.objectInitFunctions() {
+		typeIndex, ok := m.funcTypeIndex(init.Function)
+		if t := m.typeAt(typeIndex); !ok || t == nil || len(t.Params) > 0 || len(t.Results) > 0 {
+			return fmt.Errorf("%w: init function %d must not have parameters or results", ErrUnsupportedObject, init.Function)
+		}
+	}
+	return nil
+}
+
+// Returns the init functions of the object file, including the start function.
+func (m *WasmDecodedModule) objectInitFunctions() []WasmInitFunction {
+	inits := slices.Clone(m.initFunctions)
+	if m.Start != nil {
+		inits = append(inits, WasmInitFunction{Function: *m.Start, Priority: startPriority})
+	}
+	return inits
+}
+
+// wasmRelocation is a relocation of a padded index or address at an offset of a section.
+type wasmRelocation struct {
+	kind   byte
+	offset uint32
+	// The symbol of the index, or the type index for type relocations.
+	index uint32
+	// The addend of addresses, which is added to the address of the symbol.
+	addend uint32
+}
+
+func (r wasmRelocation) encode() []byte {
+	encoded := append(append([]byte{r.kind}, leb128EncodeU(uint64(r.offset))...), leb128EncodeU(uint64(r.index))...)
+	if r.kind == relocMemoryAddrSleb || r.kind == relocMemoryAddrI32 {
+		encoded = append(encoded, leb128EncodeI(int64(int32(r.addend)))...)
+	}
+	return encoded
+}
+
+// wasmObject assigns the symbols of an object file and encodes its relocatable sections.
+type wasmObject struct {
+	m       *WasmDecodedModule
+	symbols [][]byte
+	// The symbol indices of functions, globals, tags, tables and data segments.
+	functions []uint32
+	globals   []uint32
+	tags      []uint32
+	tables    []uint32
+	segments  []uint32
+	inits     []WasmInitFunction
+}
+
+func newObject(m *WasmDecodedModule) *wasmObject {
+	o := &wasmObject{m: m, inits: m.objectInitFunctions()}
+
+	exports := map[types.WasmExportType]map[uint32]string{}
+	for _, e := range slices.Backward(m.Exports) {
+		if exports[e.Kind] == nil {
+			exports[e.Kind] = map[uint32]string{}
+		}
+		exports[e.Kind][e.Index] = e.Name
+	}
+	weak := map[uint32]bool{}
+	for _, c := range m.comdats {
+		for _, f := range c.Functions {
+			weak[f] = true
+		}
+	}
+	functionNames := m.functionNames()
+
+	// imports come first in every index space, and become undefined symbols
+	define := func(kind byte, export types.WasmExportType, imported, defined int, localName func(index uint32) string) []uint32 {
+		indices := []uint32{}
+		for index := range uint32(imported + defined) {
+			indices = append(indices, uint32(len(o.symbols)))
+			entry := []byte{kind}
+			if index < uint32(imported) {
+				o.symbols = append(o.symbols, append(append(entry, leb128EncodeU(uint64(symbolUndefined))...), leb128EncodeU(uint64(index))...))
+				continue
+			}
+			flags, exported := symbolLocal, false
+			symbolName := localName(index)
+			if exportName, ok := exports[export][index]; ok {
+				flags, exported, symbolName = 0, true, exportName
+			}
+			if kind == symbolFunction && weak[index] {
+				flags = symbolWeak
+			}
+			if exported {
+				flags |= symbolExported
+			}
+			entry = append(entry, leb128EncodeU(uint64(flags))...)
+			entry = append(entry, leb128EncodeU(uint64(index))...)
+			o.symbols = append(o.symbols, append(entry, name(symbolName)...))
+		}
+		return indices
+	}
+	o.functions = define(symbolFunction, types.ExportFunctionType, m.importCount(types.ImportFunctionType), len(m.Code),
+		func(index uint32) string { return functionNames[index] })
+	o.globals = define(symbolGlobal, types.ExportGlobalType, m.importCount(types.ImportGlobalType), len(m.Globals),
+		func(index uint32) string { return fmt.Sprintf("global%d", index) })
+	o.tags = define(symbolTag, types.ExportTagType, m.importCount(types.ImportTagType), len(m.Tags),
+		func(index uint32) string { return fmt.Sprintf("tag%d", index) })
+	o.tables = define(symbolTable, types.ExportTableType, m.importCount(types.ImportTableType), len(m.Tables),
+		func(index uint32) string { return fmt.Sprintf("table%d", index) })
+
+	// the data of every segment, which the linker keeps even if nothing refers to it
+	for i, d := range m.Data {
+		o.segments = append(o.segments, uint32(len(o.symbols)))
+		entry := append([]byte{symbolData}, leb128EncodeU(uint64(symbolLocal|symbolNoStrip))...)
+		entry = append(entry, name(segmentName(i))...)
+		entry = append(entry, leb128EncodeU(uint64(i))...)
+		entry = append(entry, leb128EncodeU(0)...)
+		o.symbols = append(o.symbols, append(entry, leb128EncodeU(uint64(len(d.Bytes)))...))
+	}
+	return o
+}
+
+func segmentName(index int) string {
+	return fmt.Sprintf(".data.%d", index)
+}
+
+// Returns the relocation of an index of the given kind, or false if it is not relocated.
+func (o *wasmObject) relocation(kind wasmImmediate, index uint32) (wasmRelocation, bool) {
+	switch kind {
+	case immFunc:
+		return wasmRelocation{kind: relocFunctionIndex, index: o.functions[index]}, true
+	case immType, immBlockType:
+		return wasmRelocation{kind: relocTypeIndex, index: index}, true
+	case immGlobal:
+		return wasmRelocation{kind: relocGlobalIndex, index: o.globals[index]}, true
+	case immTag:
+		return wasmRelocation{kind: relocTagIndex, index: o.tags[index]}, true
+	case immTable:
+		return wasmRelocation{kind: relocTableNumber, index: o.tables[index]}, true
+	}
+	return wasmRelocation{}, false
+}
+
+// Encodes the instructions with padded indices, and returns the relocations of the indices at
+// offsets relative to the given base.
+func (o *wasmObject) encode(body []WasmInstr, base int) ([]byte, []wasmRelocation) {
+	result := []byte{}
+	relocs := []wasmRelocation{}
+	for _, in := range body {
+		start := base + len(result)
+		if in.data != nil {
+			relocs = append(relocs, wasmRelocation{
+				kind:   relocMemoryAddrSleb,
+				offset: uint32(start + 1),
+				index:  o.segments[in.data.segment],
+				addend: in.data.addend,
+			})
+			result = append(append(result, instructions.ConstI32), leb128EncodePadded(in.Immediates[0], 5)...)
+			continue
+		}
+		result = append(result, in.encodeIndices(func(encoded []byte, kind wasmImmediate, index uint64) []byte {
+			r, ok := o.relocation(kind, uint32(index))
+			if !ok {
+				return encodeIndex(encoded, kind, index)
+			}
+			r.offset = uint32(start + len(encoded))
+			relocs = append(relocs, r)
+			return append(encoded, leb128EncodePadded(index, 5)...)
+		})...)
+	}
+	return result, relocs
+}
+
+// Returns the contents of the code section and their relocations.
+func (o *wasmObject) code() ([]byte, []wasmRelocation) {
+	payload := leb128EncodeU(uint64(len(o.m.Code)))
+	relocs := []wasmRelocation{}
+	for _, c := range o.m.Code {
+		locals := vecNested(c.localDecls())
+		body, bodyRelocs := o.encode(c.Body, 0)
+		size := leb128EncodeU(uint64(len(locals) + len(body)))
+		for _, r := range bodyRelocs {
+			r.offset += uint32(len(payload) + len(size) + len(locals))
+			relocs = append(relocs, r)
+		}
+		payload = append(append(append(payload, size...), locals...), body...)
+	}
+	return payload, relocs
+}
+
+// Returns the contents of the data section and the relocations of the data addresses stored in
+// it.
+func (o *wasmObject) data() ([]byte, []wasmRelocation) {
+	payload := leb128EncodeU(uint64(len(o.m.Data)))
+	relocs := []wasmRelocation{}
+	for _, d := range o.m.Data {
+		payload = append(payload, leb128EncodeU(uint64(d.Flags))...)
+		if d.Flags == 2 {
+			payload = append(payload, leb128EncodeU(uint64(d.Memory))...)
+		}
+		payload = append(append(payload, EncodeInstrs(d.Offset)...), leb128EncodeU(uint64(len(d.Bytes)))...)
+		for _, p := range d.pointers {
+			relocs = append(relocs, wasmRelocation{
+				kind:   relocMemoryAddrI32,
+				offset: uint32(len(payload)) + p.at,
+				index:  o.segments[p.address.segment],
+				addend: p.address.addend,
+			})
+		}
+		payload = append(payload, d.Bytes...)
+	}
+	return payload, relocs
+}
+
+// Returns the payload of the linking section.
+func (o *wasmObject) linking() []byte {
+	subsection := func(id byte, contents []byte) []byte {
+		return append([]byte{id}, vec(contents)...)
+	}
+	payload := leb128EncodeU(linkingVersion)
+	payload = append(payload, subsection(linkingSymbolTable, vecNested(o.symbols))...)
+
+	if len(o.m.Data) > 0 {
+		segments := [][]byte{}
+		for i, d := range o.m.Data {
+			alignment := maxSegmentAlignment
+			if len(d.Offset) > 0 && (d.Offset[0].Opcode == WasmOpcode(instructions.ConstI32) || d.Offset[0].Opcode == WasmOpcode(instructions.ConstI64)) {
+				alignment = min(bits.TrailingZeros64(d.Offset[0].Immediates[0]), maxSegmentAlignment)
+			}
+			segment := append(name(segmentName(i)), leb128EncodeU(uint64(alignment))...)
+			segments = append(segments, append(segment, leb128EncodeU(0)...))
+		}
+		payload = append(payload, subsection(linkingSegmentInfo, vecNested(segments))...)
+	}
+
+	if len(o.inits) > 0 {
+		inits := [][]byte{}
+		for _, init := range o.inits {
+			inits = append(inits, append(leb128EncodeU(uint64(init.Priority)), leb128EncodeU(uint64(o.functions[init.Function]))...))
+		}
+		payload = append(payload, subsection(linkingInitFuncs, vecNested(inits))...)
+	}
+
+	if len(o.m.comdats) > 0 {
+		comdats := [][]byte{}
+		for _, c := range o.m.comdats {
+			members := [][]byte{}
+			for _, f := range c.Functions {
+				members = append(members, append([]byte{comdatFunction}, leb128EncodeU(uint64(f))...))
+			}
+			comdats = append(comdats, append(append(name(c.Name), leb128EncodeU(0)...), vecNested(members)...))
+		}
+		payload = append(payload, subsection(linkingComdatInfo, vecNested(comdats))...)
+	}
+	return payload
+}
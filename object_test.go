@@ -0,0 +1,285 @@
+package gowasmtk
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+type objectSection struct {
+	id       byte
+	name     string
+	contents []byte
+}
+
+// Splits a binary module into its sections, with the contents of custom sections after their
+// names.
+func objectSections(t *testing.T, wasm []byte) []objectSection {
+	t.Helper()
+	r := &wasmReader{data: wasm[8:]}
+	sections := []objectSection{}
+	for !r.done() {
+		s := objectSection{id: r.byte()}
+		s.contents = r.bytes(uint64(r.u32()))
+		if s.id == sectionIdCustom {
+			c := &wasmReader{data: s.contents}
+			s.name = c.name()
+			s.contents = s.contents[c.pos:]
+		}
+		sections = append(sections, s)
+	}
+	if r.err != nil {
+		t.Fatalf("malformed module: %v", r.err)
+	}
+	return sections
+}
+
+type objectSymbol struct {
+	kind  byte
+	flags uint32
+	index uint32
+	name  string
+}
+
+func TestObjectFile(t *testing.T) {
+	t.Run("should emit symbols, relocations and linking metadata for wasm-ld", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "log", ParamTypes: []types.WasmType{types.I32}, ResultTypes: []types.WasmType{}},
+		}
+		wasmSymbolTable := NewSymbolTable(&imports)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+		counter := wasmSymbolTable.AddGlobal(ValType(types.I32), true, NewWasmConstExpr().AddInstrConstI32(2))
+		table := &WasmTable{RefType: types.FuncRef, Min: 1}
+
+		next := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrGlobalGet(counter).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrCall(&next).
+			AddInstrConstI32(0).
+			AddInstrCallIndirect(0, []types.WasmType{types.I32}, []types.WasmType{types.I32}).
+			AddInstrEnd().
+			Build()
+		setup := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrConstI32(1).
+			AddInstrCallImport(&imports[0]).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddTable(table).
+			AddFunction(&next).
+			AddFunction(&main).
+			AddFunction(&setup).
+			Export("main", types.ExportFunctionType, &main).
+			Export("memory", types.ExportMemoryType, memory).
+			AddData(memory, 1024, []byte("hi")).
+			AddInitFunction(&setup, 100).
+			AddComdat("next", &next).
+			ObjectFile()
+
+		// setup is only kept by its declaration as an init function
+		wasm := mod.Build(WithTreeShaking())
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		sections := objectSections(t, wasm)
+		names := []string{}
+		var code []byte
+		codeIndex := -1
+		for i, s := range sections {
+			names = append(names, s.name)
+			if s.id == sectionIdCode {
+				code, codeIndex = s.contents, i
+			}
+		}
+		if !slices.Equal(names[len(names)-3:], []string{"", "linking", "reloc.CODE"}) {
+			t.Fatalf("expected the linking and reloc.CODE sections after the data section, got %q", names)
+		}
+
+		linking := &wasmReader{data: sections[len(sections)-2].contents}
+		if version := linking.u32(); version != 2 {
+			t.Fatalf("expected version 2, got %d", version)
+		}
+		symbols := []objectSymbol{}
+		subsections := map[byte]*wasmReader{}
+		for !linking.done() {
+			id := linking.byte()
+			subsections[id] = &wasmReader{data: linking.bytes(uint64(linking.u32()))}
+		}
+		r := subsections[linkingSymbolTable]
+		for n := r.count(); n > 0; n-- {
+			s := objectSymbol{kind: r.byte(), flags: r.u32()}
+			if s.kind == symbolData {
+				s.name, s.index = r.name(), r.u32()
+				r.u32()
+				r.u32()
+			} else if s.index = r.u32(); s.flags&symbolUndefined == 0 {
+				s.name = r.name()
+			}
+			symbols = append(symbols, s)
+		}
+		expected := []objectSymbol{
+			{symbolFunction, symbolUndefined, 0, ""},
+			{symbolFunction, symbolWeak, 1, "func1"},
+			{symbolFunction, symbolExported, 2, "main"},
+			{symbolFunction, symbolLocal, 3, "func3"},
+			{symbolGlobal, symbolLocal, 0, "global0"},
+			{symbolTable, symbolLocal, 0, "table0"},
+			{symbolData, symbolLocal | symbolNoStrip, 0, ".data.0"},
+		}
+		if r.err != nil || !slices.Equal(symbols, expected) {
+			t.Fatalf("expected symbols %v, got %v and %v", expected, symbols, r.err)
+		}
+
+		r = subsections[linkingInitFuncs]
+		if r.count() != 1 || r.u32() != 100 || r.u32() != 3 {
+			t.Fatalf("expected setup as an init function with priority 100")
+		}
+		r = subsections[linkingComdatInfo]
+		if r.count() != 1 || r.name() != "next" || r.u32() != 0 || r.count() != 1 || r.byte() != comdatFunction || r.u32() != 1 {
+			t.Fatalf("expected a comdat with next")
+		}
+
+		// every relocation points at a padded index of its symbol
+		r = &wasmReader{data: sections[len(sections)-1].contents}
+		if index := r.u32(); int(index) != codeIndex {
+			t.Fatalf("expected relocations of section %d, got %d", codeIndex, index)
+		}
+		kinds := []byte{}
+		for n := r.count(); n > 0; n-- {
+			kind, offset, index := r.byte(), r.u32(), r.u32()
+			kinds = append(kinds, kind)
+			padded := code[offset : offset+5]
+			value := (&wasmReader{data: padded}).u32()
+			if kind != relocTypeIndex {
+				index = symbols[index].index
+			}
+			if padded[3]&0x80 == 0 || value != index {
+				t.Fatalf("expected the padded index %d at offset %d, got % X", index, offset, padded)
+			}
+		}
+		if !slices.Equal(kinds, []byte{relocGlobalIndex, relocFunctionIndex, relocTypeIndex, relocTableNumber, relocFunctionIndex}) {
+			t.Fatalf("unexpected relocations %v", kinds)
+		}
+
+		m, err := DecodeModule(wasm)
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		if imp := m.Imports[1]; imp.Name != "__linear_memory" || len(m.Memories) > 0 || len(m.Exports) > 0 {
+			t.Fatalf("expected the memory to be imported without exports, got %+v", m.Imports)
+		}
+	})
+
+	t.Run("should relocate the addresses of data symbols in code and data", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+		message := wasmSymbolTable.AddDataSymbol(16, []byte("hello"))
+		pointers := wasmSymbolTable.AddDataSymbol(32, make([]byte, 8))
+		wasmSymbolTable.AddDataPointer(pointers, 4, message, 1)
+
+		// loads the pointer to the second byte of the message
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrDataAddress(pointers, 4).
+			AddInstrLoadI32(WasmMemArg{Align: 2}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			expected:   int32(17),
+		})
+
+		// the address is not a constant that folding may change
+		wasm := mod.ObjectFile().Build(WithConstantFolding(), WithPeepholeOptimization())
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sections := objectSections(t, wasm)
+		contents := map[string][]byte{}
+		for _, s := range sections {
+			switch {
+			case s.id == sectionIdCode:
+				contents["code"] = s.contents
+			case s.id == sectionIdData:
+				contents["data"] = s.contents
+			default:
+				contents[s.name] = s.contents
+			}
+		}
+
+		// the data symbols follow the symbol of main
+		relocation := func(name string) (byte, uint32, uint32, int64) {
+			r := &wasmReader{data: contents[name]}
+			r.u32()
+			if n := r.count(); n != 1 {
+				t.Fatalf("expected one relocation in %s, got %d", name, n)
+			}
+			kind, offset, index := r.byte(), r.u32(), r.u32()
+			return kind, offset, index, r.s64()
+		}
+		kind, offset, index, addend := relocation("reloc.CODE")
+		if padded := contents["code"][offset : offset+5]; kind != relocMemoryAddrSleb || index != 2 || addend != 4 ||
+			padded[4]&0x80 != 0 || (&wasmReader{data: padded}).u32() != 36 {
+			t.Fatalf("expected a padded address of .data.1 plus 4, got kind %d, symbol %d, addend %d and % X", kind, index, addend, padded)
+		}
+		kind, offset, index, addend = relocation("reloc.DATA")
+		if stored := contents["data"][offset : offset+4]; kind != relocMemoryAddrI32 || index != 1 || addend != 1 ||
+			!slices.Equal(stored, []byte{17, 0, 0, 0}) {
+			t.Fatalf("expected the address of .data.0 plus 1, got kind %d, symbol %d, addend %d and % X", kind, index, addend, stored)
+		}
+	})
+
+	t.Run("should reject data symbols of another symbol table", func(t *testing.T) {
+		other := NewSymbolTable(nil)
+		other.AddMemory(&WasmMemory{Min: 1})
+		data := other.AddDataSymbol(0, []byte("hi"))
+
+		wasmSymbolTable := NewSymbolTable(nil)
+		builder := NewWasmFunctionBuilder(wasmSymbolTable).AddInstrDataAddress(data, 0)
+		if err := builder.Err(); !errors.Is(err, ErrUnknownData) {
+			t.Fatalf("expected %v, got %v", ErrUnknownData, err)
+		}
+		if wasmSymbolTable.AddDataSymbol(0, nil); !errors.Is(wasmSymbolTable.err, ErrUnknownMemory) {
+			t.Fatalf("expected %v without a memory, got %v", ErrUnknownMemory, wasmSymbolTable.err)
+		}
+	})
+
+	t.Run("should reject element segments", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		table := &WasmTable{RefType: types.FuncRef, Min: 1}
+		f := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddTable(table).
+			AddFunction(&f).
+			AddElements(table, 0, &f).
+			ObjectFile()
+		mod.Build()
+		if err := mod.Err(); !errors.Is(err, ErrUnsupportedObject) {
+			t.Fatalf("expected ErrUnsupportedObject, got %v", err)
+		}
+	})
+}
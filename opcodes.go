@@ -0,0 +1,277 @@
+package gowasmtk
+
+import (
+	"github.com/Orphoros/gowasmtk/instructions"
+)
+
+// WasmOpcode identifies a decoded instruction. Instructions with a prefix byte combine the
+// prefix with their sub-opcode, as returned by PrefixedOpcode.
+type WasmOpcode uint32
+
+// Prefix bytes of instructions with a sub-opcode.
+const (
+	prefixGC      byte = instructions.GCPrefix
+	prefixMisc    byte = 0xFC
+	prefixSIMD    byte = 0xFD
+	prefixAtomics byte = instructions.AtomicPrefix
+)
+
+func PrefixedOpcode(prefix byte, sub uint32) WasmOpcode {
+	return WasmOpcode(prefix)<<16 | WasmOpcode(sub)
+}
+
+// Returns the prefix byte and the sub-opcode of the opcode. The prefix is zero for
+// instructions that are encoded as a single byte.
+func (op WasmOpcode) Split() (byte, uint32) {
+	if op <= 0xFF {
+		return 0, uint32(op)
+	}
+	return byte(op >> 16), uint32(op & 0xFFFF)
+}
+
+// The kinds of immediates of an instruction, which determine how they are encoded and which
+// index space an index refers to.
+type wasmImmediate byte
+
+const (
+	immLabel wasmImmediate = iota
+	immFunc
+	immType
+	immTable
+	immMemory
+	immGlobal
+	immLocal
+	immTag
+	immData
+	immElem
+	immU32
+	immByte
+	immI32
+	immI64
+	immF32
+	immF64
+	// A block type, stored as its value as a signed 33-bit integer and a heap type. The value is
+	// a type index when it is not negative. The heap type belongs to the reference types 0x63
+	// and 0x64, and is -1 for other block types.
+	immBlockType
+	// A heap type, which is a type index when it is not negative.
+	immHeapType
+	// A memory argument, stored as its alignment, memory index and offset.
+	immMemArg
+	// 16 bytes, stored as two little-endian halves.
+	immV128
+	// The labels of br_table, stored as their count, the labels and the default label.
+	immLabels
+	// The value types of a typed select, stored as their count followed by the type code and
+	// heap type of every value type.
+	immValTypes
+	// The catch clauses of try_table, stored as their count followed by the kind, tag and
+	// label of every clause. The tag is zero for clauses that catch all exceptions.
+	immCatches
+)
+
+// Immediates of the instructions that have any. Instructions that are not listed but are
+// accepted by validOpcode have none.
+var opcodeImmediates = map[WasmOpcode][]wasmImmediate{
+	0x02: {immBlockType}, // block
+	0x03: {immBlockType}, // loop
+	0x04: {immBlockType}, // if
+	0x06: {immBlockType}, // try
+	0x07: {immTag},       // catch
+	0x08: {immTag},       // throw
+	0x09: {immLabel},     // rethrow
+	0x0C: {immLabel},     // br
+	0x0D: {immLabel},     // br_if
+	0x0E: {immLabels},    // br_table
+	0x10: {immFunc},      // call
+	0x11: {immType, immTable},
+	0x12: {immFunc}, // return_call
+	0x13: {immType, immTable},
+	0x14: {immType},  // call_ref
+	0x15: {immType},  // return_call_ref
+	0x18: {immLabel}, // delegate
+	0x1C: {immValTypes},
+	0x1F: {immBlockType, immCatches}, // try_table
+	0x20: {immLocal},
+	0x21: {immLocal},
+	0x22: {immLocal},
+	0x23: {immGlobal},
+	0x24: {immGlobal},
+	0x25: {immTable}, // table.get
+	0x26: {immTable}, // table.set
+	0x3F: {immMemory},
+	0x40: {immMemory},
+	0x41: {immI32},
+	0x42: {immI64},
+	0x43: {immF32},
+	0x44: {immF64},
+	0xD0: {immHeapType}, // ref.null
+	0xD2: {immFunc},     // ref.func
+	0xD5: {immLabel},    // br_on_null
+	0xD6: {immLabel},    // br_on_non_null
+
+	PrefixedOpcode(prefixMisc, 8):  {immData, immMemory}, // memory.init
+	PrefixedOpcode(prefixMisc, 9):  {immData},            // data.drop
+	PrefixedOpcode(prefixMisc, 10): {immMemory, immMemory},
+	PrefixedOpcode(prefixMisc, 11): {immMemory},
+	PrefixedOpcode(prefixMisc, 12): {immElem, immTable}, // table.init
+	PrefixedOpcode(prefixMisc, 13): {immElem},           // elem.drop
+	PrefixedOpcode(prefixMisc, 14): {immTable, immTable},
+	PrefixedOpcode(prefixMisc, 15): {immTable},
+	PrefixedOpcode(prefixMisc, 16): {immTable},
+	PrefixedOpcode(prefixMisc, 17): {immTable},
+
+	PrefixedOpcode(prefixGC, instructions.StructNew):        {immType},
+	PrefixedOpcode(prefixGC, instructions.StructNewDefault): {immType},
+	PrefixedOpcode(prefixGC, instructions.StructGet):        {immType, immU32},
+	PrefixedOpcode(prefixGC, instructions.StructGetS):       {immType, immU32},
+	PrefixedOpcode(prefixGC, instructions.StructGetU):       {immType, immU32},
+	PrefixedOpcode(prefixGC, instructions.StructSet):        {immType, immU32},
+	PrefixedOpcode(prefixGC, instructions.ArrayNew):         {immType},
+	PrefixedOpcode(prefixGC, instructions.ArrayNewDefault):  {immType},
+	PrefixedOpcode(prefixGC, instructions.ArrayNewFixed):    {immType, immU32},
+	PrefixedOpcode(prefixGC, 0x09):                          {immType, immData}, // array.new_data
+	PrefixedOpcode(prefixGC, 0x0A):                          {immType, immElem}, // array.new_elem
+	PrefixedOpcode(prefixGC, instructions.ArrayGet):         {immType},
+	PrefixedOpcode(prefixGC, instructions.ArrayGetS):        {immType},
+	PrefixedOpcode(prefixGC, instructions.ArrayGetU):        {immType},
+	PrefixedOpcode(prefixGC, instructions.ArraySet):         {immType},
+	PrefixedOpcode(prefixGC, instructions.ArrayFill):        {immType},
+	PrefixedOpcode(prefixGC, instructions.ArrayCopy):        {immType, immType},
+	PrefixedOpcode(prefixGC, 0x12):                          {immType, immData}, // array.init_data
+	PrefixedOpcode(prefixGC, 0x13):                          {immType, immElem}, // array.init_elem
+	PrefixedOpcode(prefixGC, instructions.RefTest):          {immHeapType},
+	PrefixedOpcode(prefixGC, instructions.RefTestNull):      {immHeapType},
+	PrefixedOpcode(prefixGC, instructions.RefCast):          {immHeapType},
+	PrefixedOpcode(prefixGC, instructions.RefCastNull):      {immHeapType},
+	PrefixedOpcode(prefixGC, instructions.BrOnCast):         {immByte, immLabel, immHeapType, immHeapType},
+	PrefixedOpcode(prefixGC, instructions.BrOnCastFail):     {immByte, immLabel, immHeapType, immHeapType},
+
+	PrefixedOpcode(prefixAtomics, instructions.AtomicFence): {immByte},
+
+	PrefixedOpcode(prefixSIMD, 12): {immV128}, // v128.const
+	PrefixedOpcode(prefixSIMD, 13): {immV128}, // i8x16.shuffle
+}
+
+func init() {
+	for sub := uint32(0); sub <= 11; sub++ {
+		opcodeImmediates[PrefixedOpcode(prefixSIMD, sub)] = []wasmImmediate{immMemArg}
+	}
+	for sub := uint32(21); sub <= 34; sub++ {
+		opcodeImmediates[PrefixedOpcode(prefixSIMD, sub)] = []wasmImmediate{immByte}
+	}
+	for sub := uint32(84); sub <= 91; sub++ {
+		opcodeImmediates[PrefixedOpcode(prefixSIMD, sub)] = []wasmImmediate{immMemArg, immByte}
+	}
+	for _, sub := range []uint32{92, 93} {
+		opcodeImmediates[PrefixedOpcode(prefixSIMD, sub)] = []wasmImmediate{immMemArg}
+	}
+	for op := WasmOpcode(0x28); op <= 0x3E; op++ {
+		opcodeImmediates[op] = []wasmImmediate{immMemArg}
+	}
+	for _, sub := range []uint32{0, 1, 2} {
+		opcodeImmediates[PrefixedOpcode(prefixAtomics, sub)] = []wasmImmediate{immMemArg}
+	}
+	for sub := uint32(0x10); sub <= 0x4E; sub++ {
+		opcodeImmediates[PrefixedOpcode(prefixAtomics, sub)] = []wasmImmediate{immMemArg}
+	}
+}
+
+// Reports whether the opcode is an instruction of the core specification or of one of the
+// proposals the decoder knows about.
+func validOpcode(op WasmOpcode) bool {
+	if _, ok := opcodeImmediates[op]; ok {
+		return true
+	}
+
+	prefix, sub := op.Split()
+	switch prefix {
+	case 0:
+		return sub <= 0x1F && sub != 0x16 && sub != 0x17 && sub != 0x1D && sub != 0x1E ||
+			sub >= 0x45 && sub <= 0xC4 ||
+			sub == 0xD1 || sub == 0xD3 || sub == 0xD4
+	case prefixMisc:
+		return sub <= 7
+	case prefixGC:
+		return sub == uint32(instructions.ArrayLen) || sub >= 0x1A && sub <= 0x1E
+	case prefixSIMD:
+		return sub <= 0x113
+	}
+	return false
+}
+
+// Returns whether the opcode opens a block that is closed by end.
+func (op WasmOpcode) opensBlock() bool {
+	switch op {
+	case WasmOpcode(instructions.Block), WasmOpcode(instructions.Loop), WasmOpcode(instructions.If),
+		WasmOpcode(instructions.TryTable), 0x06:
+		return true
+	}
+	return false
+}
+
+// WasmInstr is a decoded instruction. Its immediates are stored in the order they are
+// encoded, with signed integers sign-extended to 64 bits and floats as their bits. Vectors,
+// such as the labels of br_table, are stored as their length followed by their elements.
+type WasmInstr struct {
+	Opcode     WasmOpcode
+	Immediates []uint64
+	// The data symbol whose address an i32.const pushes, which EncodeObject relocates.
+	data *wasmDataAddress
+}
+
+func Instr(op WasmOpcode, immediates ...uint64) WasmInstr {
+	return WasmInstr{Opcode: op, Immediates: immediates}
+}
+
+// Returns the immediates of a block type that is a value type, or empty for types.EmptyType.
+func blockTypeImmediates(t WasmDecodedValType) []uint64 {
+	return []uint64{uint64(int64(t.Code) - 0x80), uint64(t.Heap)}
+}
+
+// Calls fn for every immediate together with its kind, so that indices can be rewritten in
+// place. Vector lengths are not visited, and neither are the tags of catch_all clauses.
+func (in *WasmInstr) visitImmediates(fn func(kind wasmImmediate, value *uint64)) {
+	imms := in.Immediates
+	i := 0
+	for _, kind := range opcodeImmediates[in.Opcode] {
+		switch kind {
+		case immMemArg:
+			fn(immU32, &imms[i])
+			fn(immMemory, &imms[i+1])
+			fn(immU32, &imms[i+2])
+			i += 3
+		case immBlockType:
+			fn(immBlockType, &imms[i])
+			fn(immHeapType, &imms[i+1])
+			i += 2
+		case immV128:
+			i += 2
+		case immLabels:
+			n := int(imms[i])
+			for k := 1; k <= n+1; k++ {
+				fn(immLabel, &imms[i+k])
+			}
+			i += n + 2
+		case immValTypes:
+			n := int(imms[i])
+			for k := 0; k < n; k++ {
+				fn(immHeapType, &imms[i+2+2*k])
+			}
+			i += 1 + 2*n
+		case immCatches:
+			n := int(imms[i])
+			for k := 0; k < n; k++ {
+				clause := imms[i+1+3*k:]
+				if clause[0] == uint64(instructions.Catch) || clause[0] == uint64(instructions.CatchRef) {
+					fn(immTag, &clause[1])
+				}
+				fn(immLabel, &clause[2])
+			}
+			i += 1 + 3*n
+		default:
+			fn(kind, &imms[i])
+			i++
+		}
+	}
+}
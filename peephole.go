@@ -0,0 +1,199 @@
+package gowasmtk
+
+import (
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Rewrites short wasteful instruction sequences of function bodies: a local.get after a
+// local.set of the same local becomes a local.tee, values that are dropped right after they
+// are pushed are not pushed, double negations of branch conditions and additions of zero
+// are removed, and so are empty blocks and branches to the end that directly follows them.
+func WithPeepholeOptimization() WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		for i := range m.Code {
+			OptimizePeephole(&m.Code[i])
+		}
+		return nil
+	}
+}
+
+// Applies the rewrites of WithPeepholeOptimization to the body of a function.
+func OptimizePeephole(c *WasmDecodedCode) {
+	p := &wasmPeephole{}
+	for _, instr := range c.Body {
+		p.add(instr)
+	}
+	c.Body = p.out
+}
+
+// An open block during the peephole optimization. Stack heights are relative to the start of
+// the block, and are -1 where they are not known.
+type wasmPeepholeFrame struct {
+	loop bool
+	// the number of results, or -1 if the block type is a type index
+	results int
+	height  int
+	// the height before the last unconditional branch
+	branchHeight int
+}
+
+type wasmPeephole struct {
+	out    []WasmInstr
+	frames []wasmPeepholeFrame
+}
+
+// Returns the number of results of a block type without parameters, or -1 for type indices,
+// whose blocks can have parameters.
+func blockResults(instr WasmInstr) int {
+	switch t := int64(instr.Immediates[0]); {
+	case t == int64(types.EmptyType)-0x80:
+		return 0
+	case t < 0:
+		return 1
+	}
+	return -1
+}
+
+// Returns how many values the instruction pushes minus how many it pops, or false if that is
+// not known without the types of the module.
+func stackEffect(op WasmOpcode) (int, bool) {
+	switch op {
+	case WasmOpcode(instructions.ConstI32), WasmOpcode(instructions.ConstI64), WasmOpcode(instructions.ConstF32),
+		WasmOpcode(instructions.ConstF64), WasmOpcode(instructions.GetLocal), WasmOpcode(instructions.GlobalGet):
+		return 1, true
+	case WasmOpcode(instructions.SetLocal), WasmOpcode(instructions.GlobalSet), WasmOpcode(instructions.Drop),
+		WasmOpcode(instructions.BrIf):
+		return -1, true
+	case WasmOpcode(instructions.TeeLocal), 0x01: // nop
+		return 0, true
+	case WasmOpcode(instructions.Select):
+		return -2, true
+	}
+	if _, ok := conversions[op]; ok {
+		return 0, true
+	}
+	if _, ok := numericOperand(op); ok {
+		if isBinary(op) {
+			return -1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Returns whether the last instructions of the output have the given opcodes.
+func (p *wasmPeephole) endsWith(ops ...WasmOpcode) bool {
+	if len(p.out) < len(ops) {
+		return false
+	}
+	for i, op := range ops {
+		if p.out[len(p.out)-len(ops)+i].Opcode != op {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the instruction n places from the end of the output, starting at 1.
+func (p *wasmPeephole) last(n int) WasmInstr {
+	return p.out[len(p.out)-n]
+}
+
+// Appends the instruction to the output, and rewrites the end of the output until none of the
+// patterns match.
+func (p *wasmPeephole) add(instr WasmInstr) {
+	p.track(instr)
+	p.out = append(p.out, instr)
+	for p.rewrite() {
+	}
+}
+
+// Updates the open blocks and their stack heights for the instruction that is added next. A
+// branch to the end of the enclosing block is removed here if the end directly follows it.
+func (p *wasmPeephole) track(instr WasmInstr) {
+	op := instr.Opcode
+	if op.opensBlock() {
+		if op == WasmOpcode(instructions.If) {
+			p.push(-1)
+		}
+		p.frames = append(p.frames, wasmPeepholeFrame{
+			loop:         op == WasmOpcode(instructions.Loop),
+			results:      blockResults(instr),
+			branchHeight: -1,
+		})
+		return
+	}
+	if len(p.frames) == 0 {
+		return
+	}
+	f := &p.frames[len(p.frames)-1]
+
+	switch op {
+	case WasmOpcode(instructions.End), WasmOpcode(instructions.Else), 0x18: // delegate
+		if !f.loop && f.results >= 0 && f.branchHeight == f.results &&
+			p.endsWith(WasmOpcode(instructions.Br)) && p.last(1).Immediates[0] == 0 {
+			p.out = p.out[:len(p.out)-1]
+		}
+		if op == WasmOpcode(instructions.Else) {
+			f.height, f.branchHeight = 0, -1
+			return
+		}
+		results := f.results
+		p.frames = p.frames[:len(p.frames)-1]
+		if len(p.frames) > 0 && results >= 0 {
+			p.push(results)
+		} else if len(p.frames) > 0 {
+			p.frames[len(p.frames)-1].height = -1
+		}
+	case WasmOpcode(instructions.Br):
+		f.branchHeight, f.height = f.height, -1
+	default:
+		if effect, ok := stackEffect(op); ok {
+			p.push(effect)
+		} else {
+			f.height = -1
+		}
+	}
+}
+
+// Changes the stack height of the innermost block by n values.
+func (p *wasmPeephole) push(n int) {
+	if len(p.frames) == 0 {
+		return
+	}
+	if f := &p.frames[len(p.frames)-1]; f.height >= 0 && f.height+n >= 0 {
+		f.height += n
+	} else {
+		f.height = -1
+	}
+}
+
+// Rewrites the end of the output once, and returns whether a pattern matched.
+func (p *wasmPeephole) rewrite() bool {
+	switch {
+	case p.endsWith(WasmOpcode(instructions.SetLocal), WasmOpcode(instructions.GetLocal)) &&
+		p.last(2).Immediates[0] == p.last(1).Immediates[0]:
+		p.replace(2, Instr(WasmOpcode(instructions.TeeLocal), p.last(1).Immediates[0]))
+	case p.endsWith(WasmOpcode(instructions.GetLocal), WasmOpcode(instructions.Drop)):
+		p.replace(2)
+	case p.endsWith(WasmOpcode(instructions.TeeLocal), WasmOpcode(instructions.Drop)):
+		p.replace(2, Instr(WasmOpcode(instructions.SetLocal), p.last(2).Immediates[0]))
+	case p.endsWith(WasmOpcode(instructions.EqzI32), WasmOpcode(instructions.EqzI32), WasmOpcode(instructions.BrIf)):
+		// br_if branches on any value that is not zero
+		p.replace(3, p.last(1))
+	case p.endsWith(WasmOpcode(instructions.ConstI32), WasmOpcode(instructions.AddI32)) && p.last(2).Immediates[0] == 0 && p.last(2).data == nil:
+		p.replace(2)
+	case (p.endsWith(WasmOpcode(instructions.Block), WasmOpcode(instructions.End)) ||
+		p.endsWith(WasmOpcode(instructions.Loop), WasmOpcode(instructions.End))) && blockResults(p.last(2)) == 0:
+		p.replace(2)
+	default:
+		return false
+	}
+	return true
+}
+
+// Replaces the last n instructions of the output with the given instructions.
+func (p *wasmPeephole) replace(n int, instrs ...WasmInstr) {
+	p.out = append(p.out[:len(p.out)-n], instrs...)
+}
@@ -0,0 +1,96 @@
+package gowasmtk
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestPeepholeOptimization(t *testing.T) {
+	t.Run("should rewrite wasteful patterns", func(t *testing.T) {
+		block := ins(instructions.Block, blockType(types.EmptyType)...)
+
+		cases := []struct {
+			name     string
+			body     []WasmInstr
+			expected []WasmInstr
+		}{
+			{"set and get", []WasmInstr{constI32(1), ins(instructions.SetLocal, 0), ins(instructions.GetLocal, 0)}, []WasmInstr{constI32(1), ins(instructions.TeeLocal, 0)}},
+			{"get and drop", []WasmInstr{ins(instructions.GetLocal, 0), ins(instructions.Drop)}, []WasmInstr{}},
+			{"set, get and drop", []WasmInstr{constI32(1), ins(instructions.SetLocal, 0), ins(instructions.GetLocal, 0), ins(instructions.Drop)}, []WasmInstr{constI32(1), ins(instructions.SetLocal, 0)}},
+			{"double eqz", []WasmInstr{block, ins(instructions.GetLocal, 0), ins(instructions.EqzI32), ins(instructions.EqzI32), ins(instructions.BrIf, 0), ins(0x01), ins(instructions.End)}, []WasmInstr{block, ins(instructions.GetLocal, 0), ins(instructions.BrIf, 0), ins(0x01), ins(instructions.End)}},
+			{"adding zero", []WasmInstr{ins(instructions.GetLocal, 0), constI32(0), ins(instructions.AddI32)}, []WasmInstr{ins(instructions.GetLocal, 0)}},
+			{"empty block", []WasmInstr{block, ins(instructions.End)}, []WasmInstr{}},
+			{"branch to the end", []WasmInstr{block, constI32(1), ins(instructions.SetLocal, 0), ins(instructions.Br, 0), ins(instructions.End)}, []WasmInstr{block, constI32(1), ins(instructions.SetLocal, 0), ins(instructions.End)}},
+			{"branch to an empty end", []WasmInstr{block, ins(instructions.Br, 0), ins(instructions.End)}, []WasmInstr{}},
+			{"branch with the result", []WasmInstr{ins(instructions.Block, blockType(types.I32)...), constI32(1), ins(instructions.Br, 0), ins(instructions.End)}, []WasmInstr{ins(instructions.Block, blockType(types.I32)...), constI32(1), ins(instructions.End)}},
+			{"branch out of then", []WasmInstr{constI32(1), ins(instructions.If, blockType(types.EmptyType)...), ins(instructions.Br, 0), ins(instructions.Else), ins(instructions.Unreachable), ins(instructions.End)}, []WasmInstr{constI32(1), ins(instructions.If, blockType(types.EmptyType)...), ins(instructions.Else), ins(instructions.Unreachable), ins(instructions.End)}},
+		}
+
+		for _, c := range cases {
+			code := WasmDecodedCode{Body: append(c.body, ins(instructions.End))}
+			OptimizePeephole(&code)
+			if expected := append(c.expected, ins(instructions.End)); !reflect.DeepEqual(code.Body, expected) {
+				t.Fatalf("%s: expected %v, got %v", c.name, expected, code.Body)
+			}
+		}
+	})
+
+	t.Run("should keep branches that discard values", func(t *testing.T) {
+		cases := [][]WasmInstr{
+			// the branch drops the constant
+			{ins(instructions.Block, blockType(types.EmptyType)...), constI32(1), ins(instructions.Br, 0), ins(instructions.End)},
+			// the stack height after the call is not known
+			{ins(instructions.Block, blockType(types.EmptyType)...), ins(instructions.CallFunc, 0), ins(instructions.Br, 0), ins(instructions.End)},
+			// the branch goes back to the start of the loop
+			{ins(instructions.Loop, blockType(types.EmptyType)...), ins(instructions.Br, 0), ins(instructions.End)},
+		}
+
+		for _, body := range cases {
+			body = append(body, ins(instructions.End))
+			code := WasmDecodedCode{Body: append([]WasmInstr{}, body...)}
+			OptimizePeephole(&code)
+			if !reflect.DeepEqual(code.Body, body) {
+				t.Fatalf("expected %v to be kept, got %v", body, code.Body)
+			}
+		}
+	})
+
+	t.Run("should keep the results of optimized functions", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddLocal(1, types.I32).
+			AddInstrBlock(types.EmptyType).
+			AddExprSetLocal(1, LocalI32(0).Add(I32(0))).
+			AddInstrGetLocal(1).
+			AddInstrDrop().
+			AddExpr(LocalI32(1).Eqz().Eqz()).
+			AddInstrBrIf(0).
+			AddExprSetLocal(1, I32(7)).
+			AddInstrBr(0).
+			AddInstrEnd().
+			AddInstrGetLocal(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		checkRoundTrip(t, mod.Build(WithPeepholeOptimization()))
+
+		for arg, expected := range map[int32]int32{0: 7, 5: 5} {
+			runModValueTest(t, apiTestCase{
+				input:      mod,
+				nameOfMain: "main",
+				args:       []interface{}{arg},
+				expected:   expected,
+				options:    []WasmBuildOption{WithPeepholeOptimization()},
+			})
+		}
+	})
+}
@@ -0,0 +1,553 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Composite type forms of the type section.
+const (
+	compositeArray  byte = 0x5E
+	compositeStruct byte = 0x5F
+	compositeFunc   byte = 0x60
+)
+
+// Prefixes of the type section entries introduced by the GC proposal.
+const (
+	recGroupPrefix    byte = 0x4E
+	subTypePrefix     byte = 0x50
+	subFinalPrefix    byte = 0x4F
+	refTypePrefix     byte = 0x64
+	refNullTypePrefix byte = 0x63
+)
+
+// WasmHeapType is the type a reference points to: either an abstract heap type such as
+// types.HeapAny, a type defined in the symbol table, or a type of the rec group that is
+// being defined, referred to by its position in the group.
+type WasmHeapType struct {
+	defined  *WasmDefinedType
+	rec      int
+	abstract types.WasmType
+}
+
+// WasmValueType is a value or field type that may refer to a defined type. Numeric types and
+// the abbreviated reference types such as types.AnyRef are given by their type code.
+type WasmValueType struct {
+	heap     WasmHeapType
+	code     types.WasmType
+	nullable bool
+}
+
+// WasmFieldType is the type of a struct field or of the elements of an array.
+type WasmFieldType struct {
+	Type    WasmValueType
+	Mutable bool
+}
+
+// WasmSubType is a struct, array or function type together with its supertypes. Types are
+// final unless NonFinal is called, and only non-final types can be extended.
+type WasmSubType struct {
+	fields     []WasmFieldType
+	params     []WasmValueType
+	results    []WasmValueType
+	supertypes []WasmHeapType
+	composite  byte
+	final      bool
+}
+
+// WasmDefinedType is a type of the type section. Its index is assigned when its rec group is
+// added to the symbol table.
+type WasmDefinedType struct {
+	subType *WasmSubType
+	index   int
+}
+
+type wasmRecGroup struct {
+	types []*WasmDefinedType
+	key   string
+}
+
+func HeapAbstract(code types.WasmType) WasmHeapType {
+	return WasmHeapType{abstract: code}
+}
+
+func HeapDefined(t *WasmDefinedType) WasmHeapType {
+	return WasmHeapType{defined: t}
+}
+
+// Refers to the type at the given position of the rec group being defined, which allows
+// types of a group to refer to each other and to themselves.
+func HeapRec(position int) WasmHeapType {
+	return WasmHeapType{rec: position + 1}
+}
+
+func ValType(code types.WasmType) WasmValueType {
+	return WasmValueType{code: code}
+}
+
+func valTypes(codes []types.WasmType) []WasmValueType {
+	values := []WasmValueType{}
+	for _, code := range codes {
+		values = append(values, ValType(code))
+	}
+	return values
+}
+
+func RefType(heap WasmHeapType) WasmValueType {
+	return WasmValueType{heap: heap}
+}
+
+func RefNullType(heap WasmHeapType) WasmValueType {
+	return WasmValueType{heap: heap, nullable: true}
+}
+
+func StructType(fields ...WasmFieldType) *WasmSubType {
+	return &WasmSubType{composite: compositeStruct, fields: fields, final: true}
+}
+
+func ArrayType(element WasmFieldType) *WasmSubType {
+	return &WasmSubType{composite: compositeArray, fields: []WasmFieldType{element}, final: true}
+}
+
+func FuncType(params []WasmValueType, results []WasmValueType) *WasmSubType {
+	return &WasmSubType{composite: compositeFunc, params: params, results: results, final: true}
+}
+
+// Allows the type to be used as the supertype of other types.
+func (t *WasmSubType) NonFinal() *WasmSubType {
+	t.final = false
+	return t
+}
+
+// Declares the supertypes of the type. Supertypes must be defined before the type, which
+// includes earlier positions of the same rec group, and a type can have at most one.
+func (t *WasmSubType) Extends(supertypes ...WasmHeapType) *WasmSubType {
+	t.supertypes = supertypes
+	return t
+}
+
+func (t *WasmDefinedType) GetIndex() int {
+	return t.index
+}
+
+var typeNames = map[types.WasmType]string{
+	types.I32:           "i32",
+	types.I64:           "i64",
+	types.F32:           "f32",
+	types.F64:           "f64",
+	types.I8:            "i8",
+	types.I16:           "i16",
+	types.FuncRef:       "funcref",
+	types.ExternRef:     "externref",
+	types.ExnRef:        "exnref",
+	types.AnyRef:        "anyref",
+	types.EqRef:         "eqref",
+	types.I31Ref:        "i31ref",
+	types.StructRef:     "structref",
+	types.ArrayRef:      "arrayref",
+	types.NullRef:       "nullref",
+	types.NullExternRef: "nullexternref",
+	types.NullFuncRef:   "nullfuncref",
+}
+
+var heapTypeNames = map[types.HeapType]string{
+	types.HeapFunc:     "func",
+	types.HeapExtern:   "extern",
+	types.HeapAny:      "any",
+	types.HeapEq:       "eq",
+	types.HeapI31:      "i31",
+	types.HeapStruct:   "struct",
+	types.HeapArray:    "array",
+	types.HeapExn:      "exn",
+	types.HeapNone:     "none",
+	types.HeapNoExtern: "noextern",
+	types.HeapNoFunc:   "nofunc",
+}
+
+func (h WasmHeapType) String() string {
+	switch {
+	case h.defined != nil:
+		return strconv.Itoa(h.defined.index)
+	case h.rec > 0:
+		return "rec " + strconv.Itoa(h.rec-1)
+	}
+
+	name, ok := heapTypeNames[h.abstract]
+	if !ok {
+		return fmt.Sprintf("0x%02X", h.abstract)
+	}
+	return name
+}
+
+func (v WasmValueType) String() string {
+	switch {
+	case v.isRef() && v.nullable:
+		return "(ref null " + v.heap.String() + ")"
+	case v.isRef():
+		return "(ref " + v.heap.String() + ")"
+	}
+
+	name, ok := typeNames[v.code]
+	if !ok {
+		return fmt.Sprintf("0x%02X", v.code)
+	}
+	return name
+}
+
+func (h WasmHeapType) isConcrete() bool {
+	return h.defined != nil || h.rec > 0
+}
+
+func (v WasmValueType) isRef() bool {
+	return v.heap.isConcrete() || v.heap.abstract != 0
+}
+
+// Encodes a heap type. In canonical mode, references into the group being defined are kept
+// relative to the group, so that structurally identical groups produce identical keys.
+func (h WasmHeapType) encode(groupStart int, canonical bool) []byte {
+	switch {
+	case h.abstract != 0 && canonical:
+		return []byte{0x00, h.abstract}
+	case h.abstract != 0:
+		return []byte{h.abstract}
+	case h.rec > 0 && canonical:
+		return append([]byte{0x01}, leb128EncodeU(uint64(h.rec-1))...)
+	case h.rec > 0:
+		return leb128EncodeI(int64(groupStart + h.rec - 1))
+	case canonical:
+		return append([]byte{0x02}, leb128EncodeU(uint64(h.defined.index))...)
+	default:
+		return leb128EncodeI(int64(h.defined.index))
+	}
+}
+
+func (v WasmValueType) encode(groupStart int, canonical bool) []byte {
+	if !v.isRef() {
+		return []byte{v.code}
+	}
+	// (ref null <abstract>) has a one byte shorthand, such as anyref for (ref null any).
+	if v.nullable && !v.heap.isConcrete() {
+		return []byte{v.heap.abstract}
+	}
+
+	prefix := refTypePrefix
+	if v.nullable {
+		prefix = refNullTypePrefix
+	}
+	return append([]byte{prefix}, v.heap.encode(groupStart, canonical)...)
+}
+
+func encodeValueTypes(values []WasmValueType, groupStart int, canonical bool) []byte {
+	result := leb128EncodeU(uint64(len(values)))
+	for _, v := range values {
+		result = append(result, v.encode(groupStart, canonical)...)
+	}
+	return result
+}
+
+func (f WasmFieldType) encode(groupStart int, canonical bool) []byte {
+	var mutability byte = 0x00
+	if f.Mutable {
+		mutability = 0x01
+	}
+	return append(f.Type.encode(groupStart, canonical), mutability)
+}
+
+func (t *WasmSubType) encode(groupStart int, canonical bool) []byte {
+	var result []byte
+
+	// A final type without supertypes is encoded as the bare composite type.
+	if !t.final || len(t.supertypes) > 0 {
+		if t.final {
+			result = append(result, subFinalPrefix)
+		} else {
+			result = append(result, subTypePrefix)
+		}
+		result = append(result, leb128EncodeU(uint64(len(t.supertypes)))...)
+		for _, super := range t.supertypes {
+			result = append(result, super.encode(groupStart, canonical)...)
+		}
+	}
+
+	result = append(result, t.composite)
+	switch t.composite {
+	case compositeStruct:
+		result = append(result, leb128EncodeU(uint64(len(t.fields)))...)
+		for _, f := range t.fields {
+			result = append(result, f.encode(groupStart, canonical)...)
+		}
+	case compositeArray:
+		result = append(result, t.fields[0].encode(groupStart, canonical)...)
+	case compositeFunc:
+		result = append(result, encodeValueTypes(t.params, groupStart, canonical)...)
+		result = append(result, encodeValueTypes(t.results, groupStart, canonical)...)
+	}
+
+	return result
+}
+
+func (g *wasmRecGroup) encode() []byte {
+	start := g.types[0].index
+	if len(g.types) == 1 {
+		return g.types[0].subType.encode(start, false)
+	}
+
+	subtypes := [][]byte{}
+	for _, t := range g.types {
+		subtypes = append(subtypes, t.subType.encode(start, false))
+	}
+	return append([]byte{recGroupPrefix}, vecNested(subtypes)...)
+}
+
+// Resolves the heap type to the sub type it refers to, if it is concrete, together with the
+// rec group that the positions in the references of the sub type refer to.
+func (s *wasmSymbolTable) resolveHeapType(h WasmHeapType, group []*WasmSubType) (*WasmSubType, []*WasmSubType) {
+	switch {
+	case h.defined != nil:
+		for _, g := range s.typeGroups {
+			if slices.Contains(g.types, h.defined) {
+				subTypes := []*WasmSubType{}
+				for _, t := range g.types {
+					subTypes = append(subTypes, t.subType)
+				}
+				return h.defined.subType, subTypes
+			}
+		}
+		return h.defined.subType, nil
+	case h.rec > 0:
+		return group[h.rec-1], group
+	}
+	return nil, nil
+}
+
+// Returns the value type with an abbreviated reference type, such as types.AnyRef, written as
+// a nullable reference to its heap type.
+func (v WasmValueType) expanded() WasmValueType {
+	if _, ok := heapTypeNames[v.code]; ok && !v.isRef() {
+		return RefNullType(HeapAbstract(v.code))
+	}
+	return v
+}
+
+// Returns the abstract heap type that the concrete types of the composite form are subtypes
+// of, and the bottom type of their hierarchy.
+func compositeHeapTypes(composite byte) (types.HeapType, types.HeapType) {
+	switch composite {
+	case compositeStruct:
+		return types.HeapStruct, types.HeapNone
+	case compositeArray:
+		return types.HeapArray, types.HeapNone
+	}
+	return types.HeapFunc, types.HeapNoFunc
+}
+
+// Returns whether the abstract heap type sub is a subtype of super.
+func abstractHeapMatches(sub, super types.HeapType) bool {
+	switch sub {
+	case super:
+		return true
+	case types.HeapNone:
+		return abstractHeapMatches(types.HeapI31, super) || abstractHeapMatches(types.HeapStruct, super) ||
+			abstractHeapMatches(types.HeapArray, super)
+	case types.HeapNoFunc:
+		return super == types.HeapFunc
+	case types.HeapNoExtern:
+		return super == types.HeapExtern
+	case types.HeapI31, types.HeapStruct, types.HeapArray:
+		return super == types.HeapEq || super == types.HeapAny
+	case types.HeapEq:
+		return super == types.HeapAny
+	}
+	return false
+}
+
+// Returns whether the heap type sub, which refers to positions of subGroup, is a subtype of
+// super, which refers to positions of superGroup. Concrete types match the types of their
+// chain of declared supertypes.
+func (s *wasmSymbolTable) heapMatches(sub WasmHeapType, subGroup []*WasmSubType, super WasmHeapType, superGroup []*WasmSubType) bool {
+	subType, subTypes := s.resolveHeapType(sub, subGroup)
+	superType, _ := s.resolveHeapType(super, superGroup)
+	switch {
+	case subType == nil && superType == nil:
+		return abstractHeapMatches(sub.abstract, super.abstract)
+	case subType == nil:
+		_, bottom := compositeHeapTypes(superType.composite)
+		return sub.abstract == bottom
+	case superType == nil:
+		top, _ := compositeHeapTypes(subType.composite)
+		return abstractHeapMatches(top, super.abstract)
+	}
+
+	for subType != nil && subType != superType {
+		if len(subType.supertypes) == 0 {
+			return false
+		}
+		subType, subTypes = s.resolveHeapType(subType.supertypes[0], subTypes)
+	}
+	return subType != nil
+}
+
+// Returns whether the value type sub is a subtype of super, like heapMatches.
+func (s *wasmSymbolTable) valueMatches(sub WasmValueType, subGroup []*WasmSubType, super WasmValueType, superGroup []*WasmSubType) bool {
+	sub, super = sub.expanded(), super.expanded()
+	if !sub.isRef() || !super.isRef() {
+		return !sub.isRef() && !super.isRef() && sub.code == super.code
+	}
+	if sub.nullable && !super.nullable {
+		return false
+	}
+	return s.heapMatches(sub.heap, subGroup, super.heap, superGroup)
+}
+
+func (s *wasmSymbolTable) validateHeapType(h WasmHeapType, group []*WasmSubType) error {
+	if h.rec > len(group) {
+		return fmt.Errorf("%w: position %d in a rec group of %d types", ErrUnknownType, h.rec-1, len(group))
+	}
+	if h.defined != nil && (h.defined.index >= s.typeCount || s.typeByIndex(h.defined.index) != h.defined) {
+		return fmt.Errorf("%w: type %d is not defined in this symbol table", ErrUnknownType, h.defined.index)
+	}
+	return nil
+}
+
+func (s *wasmSymbolTable) validateSubType(position int, t *WasmSubType, group []*WasmSubType) error {
+	values := append(append([]WasmValueType{}, t.params...), t.results...)
+	for _, f := range t.fields {
+		values = append(values, f.Type)
+	}
+	for _, v := range values {
+		if err := s.validateHeapType(v.heap, group); err != nil {
+			return err
+		}
+	}
+
+	if len(t.supertypes) > 1 {
+		return fmt.Errorf("%w: %d supertypes, but at most one is allowed", ErrInvalidSubtype, len(t.supertypes))
+	}
+	for _, super := range t.supertypes {
+		if err := s.validateHeapType(super, group); err != nil {
+			return err
+		}
+		if super.rec > position {
+			return fmt.Errorf("%w: supertype at position %d is defined after its subtype", ErrInvalidSubtype, super.rec-1)
+		}
+
+		superType, superGroup := s.resolveHeapType(super, group)
+		if superType == nil {
+			return fmt.Errorf("%w: abstract heap types cannot be supertypes", ErrInvalidSubtype)
+		}
+		if superType.final {
+			return fmt.Errorf("%w: supertype is final", ErrInvalidSubtype)
+		}
+		if superType.composite != t.composite {
+			return fmt.Errorf("%w: composite type 0x%02X cannot extend 0x%02X", ErrInvalidSubtype, t.composite, superType.composite)
+		}
+		if len(t.fields) < len(superType.fields) {
+			return fmt.Errorf("%w: subtype has %d fields, supertype %d", ErrInvalidSubtype, len(t.fields), len(superType.fields))
+		}
+		// immutable fields are covariant and mutable fields invariant
+		for i, f := range superType.fields {
+			if f.Mutable != t.fields[i].Mutable {
+				return fmt.Errorf("%w: mutability of field %d differs from the supertype", ErrInvalidSubtype, i)
+			}
+			covariant := s.valueMatches(t.fields[i].Type, group, f.Type, superGroup)
+			if !covariant || f.Mutable && !s.valueMatches(f.Type, superGroup, t.fields[i].Type, group) {
+				return fmt.Errorf("%w: type %v of field %d does not match %v of the supertype", ErrInvalidSubtype, t.fields[i].Type, i, f.Type)
+			}
+		}
+
+		// parameters are contravariant and results covariant
+		if len(t.params) != len(superType.params) || len(t.results) != len(superType.results) {
+			return fmt.Errorf("%w: function has %d parameters and %d results, supertype %d and %d", ErrInvalidSubtype,
+				len(t.params), len(t.results), len(superType.params), len(superType.results))
+		}
+		for i, p := range superType.params {
+			if !s.valueMatches(p, superGroup, t.params[i], group) {
+				return fmt.Errorf("%w: parameter %d of type %v does not match %v of the supertype", ErrInvalidSubtype, i, t.params[i], p)
+			}
+		}
+		for i, r := range superType.results {
+			if !s.valueMatches(t.results[i], group, r, superGroup) {
+				return fmt.Errorf("%w: result %d of type %v does not match %v of the supertype", ErrInvalidSubtype, i, t.results[i], r)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *wasmSymbolTable) typeByIndex(index int) *WasmDefinedType {
+	for _, g := range s.typeGroups {
+		start := g.types[0].index
+		if index >= start && index < start+len(g.types) {
+			return g.types[index-start]
+		}
+	}
+	return nil
+}
+
+// Adds a recursive type group to the symbol table and returns its types in order. Types in
+// a group can refer to each other with HeapRec. Groups are canonicalized: if a structurally
+// identical group has been added before, the types of that group are returned instead.
+func (s *wasmSymbolTable) AddRecGroup(subTypes ...*WasmSubType) []*WasmDefinedType {
+	if len(subTypes) == 0 {
+		return []*WasmDefinedType{}
+	}
+
+	for position, t := range subTypes {
+		if err := s.validateSubType(position, t, subTypes); err != nil {
+			s.fail(err)
+			return []*WasmDefinedType{}
+		}
+	}
+
+	var key []byte
+	for _, t := range subTypes {
+		key = append(key, t.encode(0, true)...)
+	}
+
+	for _, g := range s.typeGroups {
+		if g.key == string(key) && len(g.types) == len(subTypes) {
+			return slices.Clone(g.types)
+		}
+	}
+
+	group := &wasmRecGroup{key: string(key)}
+	for _, t := range subTypes {
+		group.types = append(group.types, &WasmDefinedType{subType: t, index: s.typeCount})
+		s.typeCount++
+	}
+	s.typeGroups = append(s.typeGroups, group)
+
+	return slices.Clone(group.types)
+}
+
+// Adds a type that forms a rec group on its own. See AddRecGroup.
+func (s *wasmSymbolTable) AddType(subType *WasmSubType) *WasmDefinedType {
+	definedTypes := s.AddRecGroup(subType)
+	if len(definedTypes) == 0 {
+		return nil
+	}
+	return definedTypes[0]
+}
+
+// Returns the index of the function type with the given signature, adding the type if it has
+// not been used before. Returns 0 if the type cannot be added, which is recorded as an error
+// of the symbol table.
+func (s *wasmSymbolTable) internFuncType(paramTypes []types.WasmType, resultTypes []types.WasmType) int {
+	definedType := s.AddType(FuncType(valTypes(paramTypes), valTypes(resultTypes)))
+	if definedType == nil {
+		return 0
+	}
+	return definedType.GetIndex()
+}
+
+func (s *wasmSymbolTable) encodeTypes() []wasmSectionFunctionType {
+	entries := []wasmSectionFunctionType{}
+	for _, g := range s.typeGroups {
+		entries = append(entries, g.encode())
+	}
+	return entries
+}
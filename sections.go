@@ -29,12 +29,24 @@ type wasmExportDescription = struct {
 
 var importdesc = struct {
 	function func(index uint32) wasmSectionImportedModule
+	memory   func(memtype []byte) wasmSectionImportedModule
+	tag      func(typeIndex uint32) wasmSectionImportedModule
+	global   func(globaltype []byte) wasmSectionImportedModule
 }{
 	func(index uint32) wasmSectionImportedModule {
 		ve := wasmSectionImportedModule{types.ImportFunctionType}
 		ve = append(ve, leb128EncodeU(uint64(index))...)
 		return ve
 	},
+	func(memtype []byte) wasmSectionImportedModule {
+		return append(wasmSectionImportedModule{types.ImportMemoryType}, memtype...)
+	},
+	func(typeIndex uint32) wasmSectionImportedModule {
+		return append(wasmSectionImportedModule{types.ImportTagType}, tagType(typeIndex)...)
+	},
+	func(globaltype []byte) wasmSectionImportedModule {
+		return append(wasmSectionImportedModule{types.ImportGlobalType}, globaltype...)
+	},
 }
 
 const (
@@ -42,8 +54,14 @@ const (
 	sectionIdType     sectionId = 0x01
 	sectionIdImport   sectionId = 0x02
 	sectionIdFunction sectionId = 0x03
+	sectionIdTable    sectionId = 0x04
+	sectionIdMemory   sectionId = 0x05
+	sectionIdGlobal   sectionId = 0x06
+	sectionIdTag      sectionId = 0x0D
 	sectionIdCode     sectionId = 0x0A
+	sectionIdData     sectionId = 0x0B
 	sectionIdExport   sectionId = 0x07
+	sectionIdElement  sectionId = 0x09
 )
 
 func name(s string) wasmVector {
@@ -129,6 +147,133 @@ func sectionFunc(typeidxs ...uint64) WasmSecionFunction {
 	return section(sectionIdFunction, vec(typeidxsBytes))
 }
 
+func tableType(table *WasmTable) []byte {
+	result := []byte{table.RefType}
+
+	if table.HasMax {
+		result = append(result, 0x01)
+		result = append(result, leb128EncodeU(uint64(table.Min))...)
+		return append(result, leb128EncodeU(uint64(table.Max))...)
+	}
+
+	result = append(result, 0x00)
+	return append(result, leb128EncodeU(uint64(table.Min))...)
+}
+
+func sectionTable(tabletypes ...[]byte) wasmSection {
+	return section(sectionIdTable, vecNested(tabletypes))
+}
+
+func elementSegment(tableIndex int, offset *WasmConstExpr, funcIndices []uint64) []byte {
+	var segment []byte
+
+	if tableIndex == 0 {
+		// Flag 0x00 is an active segment of function indices for table 0.
+		segment = append(segment, 0x00)
+	} else {
+		// Flag 0x02 carries an explicit table index, followed by the element kind 0x00
+		// (function references) after the offset expression.
+		segment = append(segment, 0x02)
+		segment = append(segment, leb128EncodeU(uint64(tableIndex))...)
+	}
+
+	segment = append(segment, offset.encode()...)
+
+	if tableIndex != 0 {
+		segment = append(segment, 0x00)
+	}
+
+	indices := [][]byte{}
+	for _, idx := range funcIndices {
+		indices = append(indices, leb128EncodeU(idx))
+	}
+
+	return append(segment, vecNested(indices)...)
+}
+
+func declarativeElementSegment(funcIndices []uint64) []byte {
+	indices := [][]byte{}
+	for _, idx := range funcIndices {
+		indices = append(indices, leb128EncodeU(idx))
+	}
+
+	// Flag 0x03 declares function references for ref.func without placing them in a table.
+	return append([]byte{0x03, 0x00}, vecNested(indices)...)
+}
+
+func sectionElement(segments ...[]byte) wasmSection {
+	return section(sectionIdElement, vecNested(segments))
+}
+
+func limits(memory *WasmMemory) []byte {
+	var flags byte = 0x00
+	if memory.HasMax {
+		flags |= 0x01
+	}
+	if memory.Shared {
+		flags |= 0x02
+	}
+	if memory.Memory64 {
+		flags |= 0x04
+	}
+
+	result := append([]byte{flags}, leb128EncodeU(memory.Min)...)
+	if memory.HasMax {
+		result = append(result, leb128EncodeU(memory.Max)...)
+	}
+
+	return result
+}
+
+func sectionMemory(memtypes ...[]byte) wasmSection {
+	return section(sectionIdMemory, vecNested(memtypes))
+}
+
+func tagType(typeIndex uint32) []byte {
+	// The only tag attribute defined so far is 0x00, an exception.
+	return append([]byte{0x00}, leb128EncodeU(uint64(typeIndex))...)
+}
+
+func sectionTag(tagtypes ...[]byte) wasmSection {
+	return section(sectionIdTag, vecNested(tagtypes))
+}
+
+func dataSegment(memory *WasmMemory, offset *WasmConstExpr, data []byte) []byte {
+	var segment []byte
+
+	if memory.index == 0 {
+		segment = append(segment, 0x00)
+	} else {
+		// Flag 0x02 is an active segment with an explicit memory index.
+		segment = append(segment, 0x02)
+		segment = append(segment, leb128EncodeU(uint64(memory.index))...)
+	}
+
+	segment = append(segment, offset.encode()...)
+
+	return append(segment, vec(data)...)
+}
+
+func globalType(global *WasmGlobal) []byte {
+	mutability := byte(0x00)
+	if global.Mutable {
+		mutability = 0x01
+	}
+	return append(global.Type.encode(0, false), mutability)
+}
+
+func sectionGlobal(globals ...*WasmGlobal) wasmSection {
+	entries := [][]byte{}
+	for _, global := range globals {
+		entries = append(entries, append(globalType(global), global.init.encode()...))
+	}
+	return section(sectionIdGlobal, vecNested(entries))
+}
+
+func sectionData(segments ...[]byte) wasmSection {
+	return section(sectionIdData, vecNested(segments))
+}
+
 func section(id sectionId, contents wasmVector) wasmSection {
 	wasmSection := wasmSection{}
 
@@ -0,0 +1,610 @@
+package gowasmtk
+
+import (
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Removes the functions, function and global imports, globals, types and passive data segments
+// that cannot be reached from the exports, the start function or the element segments, and
+// renumbers the remaining items. Memories, tables, tags and active data segments are kept.
+func WithTreeShaking() WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		TreeShake(m)
+		return nil
+	}
+}
+
+// Index spaces of the items that can be removed by tree shaking.
+type shakeSpace int
+
+const (
+	shakeFuncs shakeSpace = iota
+	shakeGlobals
+	shakeTypes
+	shakeData
+	shakeElems
+	shakeSpaces
+)
+
+type wasmShaker struct {
+	m    *WasmDecodedModule
+	live [shakeSpaces][]bool
+	// Functions and globals that are live but whose code or initializer is not marked yet.
+	pending [shakeSpaces][]uint32
+	// Maps old indices to new ones, or -1 for removed items.
+	remap [shakeSpaces][]int64
+	// The index of the first type of every rec group.
+	groupStart []uint32
+}
+
+// Removes the items of the module that are not reachable, as described by WithTreeShaking.
+func TreeShake(m *WasmDecodedModule) {
+	s := newShaker(m)
+	s.markRoots()
+	for s.markPending() {
+	}
+	s.apply()
+}
+
+// Removes the functions for which removed is set, and renumbers the remaining functions. The
+// removed functions must not be referenced by other functions or by the module.
+func removeFunctions(m *WasmDecodedModule, removed []bool) {
+	s := newShaker(m)
+	for space := range s.live {
+		for i := range s.live[space] {
+			s.live[space][i] = shakeSpace(space) != shakeFuncs || !removed[i]
+		}
+	}
+	s.apply()
+}
+
+// Adds an import of a function of the given type after the other function imports, renumbers
+// the defined functions, and returns the index of the imported function.
+func addFunctionImport(m *WasmDecodedModule, module, name string, typeIndex uint32) uint32 {
+	imported := m.importCount(types.ImportFunctionType)
+	s := newShaker(m)
+	for space := range s.live {
+		for i := range s.live[space] {
+			s.live[space][i] = true
+		}
+	}
+	s.computeRemap()
+	for f := imported; f < len(s.remap[shakeFuncs]); f++ {
+		s.remap[shakeFuncs][f]++
+	}
+	s.rewrite()
+
+	m.Imports = append(m.Imports, WasmDecodedImport{
+		Module:    module,
+		Name:      name,
+		Kind:      types.ImportFunctionType,
+		TypeIndex: typeIndex,
+	})
+	return uint32(imported)
+}
+
+func newShaker(m *WasmDecodedModule) *wasmShaker {
+	s := &wasmShaker{m: m}
+	s.live[shakeFuncs] = make([]bool, m.importCount(types.ImportFunctionType)+len(m.Functions))
+	s.live[shakeGlobals] = make([]bool, m.importCount(types.ImportGlobalType)+len(m.Globals))
+	s.live[shakeData] = make([]bool, len(m.Data))
+	s.live[shakeElems] = make([]bool, len(m.Elements))
+	typeCount := 0
+	for _, g := range m.Types {
+		s.groupStart = append(s.groupStart, uint32(typeCount))
+		typeCount += len(g.Types)
+	}
+	s.live[shakeTypes] = make([]bool, typeCount)
+	return s
+}
+
+// Removes the items that are not live and renumbers the others.
+func (s *wasmShaker) apply() {
+	s.filterDeclarative()
+	s.computeRemap()
+	s.rewrite()
+}
+
+func (s *wasmShaker) mark(space shakeSpace, index uint32) {
+	if int(index) >= len(s.live[space]) || s.live[space][index] {
+		return
+	}
+	s.live[space][index] = true
+	if space != shakeData && space != shakeElems {
+		s.pending[space] = append(s.pending[space], index)
+	}
+}
+
+func (s *wasmShaker) markValType(v WasmDecodedValType) {
+	if v.Heap >= 0 {
+		s.mark(shakeTypes, uint32(v.Heap))
+	}
+}
+
+func (s *wasmShaker) markExpr(body []WasmInstr) {
+	for i := range body {
+		if body[i].data != nil {
+			s.mark(shakeData, body[i].data.segment)
+		}
+		body[i].visitImmediates(func(kind wasmImmediate, value *uint64) {
+			switch kind {
+			case immFunc:
+				s.mark(shakeFuncs, uint32(*value))
+			case immGlobal:
+				s.mark(shakeGlobals, uint32(*value))
+			case immType:
+				s.mark(shakeTypes, uint32(*value))
+			case immBlockType, immHeapType:
+				if int64(*value) >= 0 {
+					s.mark(shakeTypes, uint32(*value))
+				}
+			case immData:
+				s.mark(shakeData, uint32(*value))
+			case immElem:
+				s.mark(shakeElems, uint32(*value))
+			}
+		})
+	}
+}
+
+func (s *wasmShaker) markRoots() {
+	m := s.m
+	for _, e := range m.Exports {
+		switch e.Kind {
+		case types.ExportFunctionType:
+			s.mark(shakeFuncs, e.Index)
+		case types.ExportGlobalType:
+			s.mark(shakeGlobals, e.Index)
+		}
+	}
+	if m.Start != nil {
+		s.mark(shakeFuncs, *m.Start)
+	}
+	for _, init := range m.initFunctions {
+		s.mark(shakeFuncs, init.Function)
+	}
+	for _, c := range m.comdats {
+		for _, f := range c.Functions {
+			s.mark(shakeFuncs, f)
+		}
+	}
+
+	for _, imp := range m.Imports {
+		switch imp.Kind {
+		case types.ImportTagType:
+			s.mark(shakeTypes, imp.TypeIndex)
+		case types.ImportTableType:
+			s.markValType(imp.Table.Type)
+		}
+	}
+	for _, t := range m.Tables {
+		s.markValType(t.Type)
+		s.markExpr(t.Init)
+	}
+	for _, tag := range m.Tags {
+		s.mark(shakeTypes, tag)
+	}
+
+	for i, e := range m.Elements {
+		s.markExpr(e.Offset)
+		s.markValType(e.Type)
+		// Declarative segments only allow ref.func, so they keep none of their functions alive.
+		if e.Flags&elemPassiveOrDeclarative != 0 && e.Flags&elemExplicitTable != 0 {
+			continue
+		}
+		s.live[shakeElems][i] = true
+		for _, f := range e.Funcs {
+			s.mark(shakeFuncs, f)
+		}
+		for _, expr := range e.Exprs {
+			s.markExpr(expr)
+		}
+	}
+
+	for i, d := range m.Data {
+		if d.Flags != 1 {
+			s.live[shakeData][i] = true
+			s.markExpr(d.Offset)
+		}
+	}
+}
+
+// Marks what the pending functions, globals and types refer to. Returns false once there is
+// nothing left to mark.
+func (s *wasmShaker) markPending() bool {
+	m := s.m
+	importedFuncs := uint32(m.importCount(types.ImportFunctionType))
+	importedGlobals := uint32(m.importCount(types.ImportGlobalType))
+
+	progress := false
+	for len(s.pending[shakeFuncs]) > 0 {
+		f := s.pending[shakeFuncs][0]
+		s.pending[shakeFuncs] = s.pending[shakeFuncs][1:]
+		progress = true
+
+		if typeIndex, ok := m.funcTypeIndex(f); ok {
+			s.mark(shakeTypes, typeIndex)
+		}
+		if f >= importedFuncs {
+			c := m.Code[f-importedFuncs]
+			for _, l := range c.Locals {
+				s.markValType(l.Type)
+			}
+			s.markExpr(c.Body)
+		}
+	}
+
+	for len(s.pending[shakeGlobals]) > 0 {
+		g := s.pending[shakeGlobals][0]
+		s.pending[shakeGlobals] = s.pending[shakeGlobals][1:]
+		progress = true
+
+		if g < importedGlobals {
+			s.markValType(s.importedGlobal(g).Type)
+		} else {
+			global := m.Globals[g-importedGlobals]
+			s.markValType(global.Type)
+			s.markExpr(global.Init)
+		}
+	}
+
+	// Rec groups are kept or removed as a whole, since removing a member changes the identity
+	// of the other types of the group.
+	for len(s.pending[shakeTypes]) > 0 {
+		t := s.pending[shakeTypes][0]
+		s.pending[shakeTypes] = s.pending[shakeTypes][1:]
+		progress = true
+
+		group := s.groupOf(t)
+		for k := range m.Types[group].Types {
+			s.mark(shakeTypes, s.groupStart[group]+uint32(k))
+		}
+
+		sub := m.typeAt(t)
+		for _, super := range sub.Supertypes {
+			s.mark(shakeTypes, super)
+		}
+		for _, f := range sub.Fields {
+			s.markValType(f.Type)
+		}
+		for _, v := range sub.Params {
+			s.markValType(v)
+		}
+		for _, v := range sub.Results {
+			s.markValType(v)
+		}
+	}
+
+	return progress
+}
+
+func (s *wasmShaker) groupOf(typeIndex uint32) int {
+	for g := len(s.groupStart) - 1; g > 0; g-- {
+		if s.groupStart[g] <= typeIndex {
+			return g
+		}
+	}
+	return 0
+}
+
+func (s *wasmShaker) importedGlobal(index uint32) *WasmDecodedGlobal {
+	for i := range s.m.Imports {
+		if s.m.Imports[i].Kind != types.ImportGlobalType {
+			continue
+		}
+		if index == 0 {
+			return &s.m.Imports[i].Global
+		}
+		index--
+	}
+	return nil
+}
+
+func (s *wasmShaker) computeRemap() {
+	for space := range s.live {
+		s.remap[space] = make([]int64, len(s.live[space]))
+		next := int64(0)
+		for i, live := range s.live[space] {
+			if live {
+				s.remap[space][i] = next
+				next++
+			} else {
+				s.remap[space][i] = -1
+			}
+		}
+	}
+}
+
+func (s *wasmShaker) index(space shakeSpace, index uint32) uint32 {
+	if int(index) >= len(s.remap[space]) {
+		return index
+	}
+	return uint32(s.remap[space][index])
+}
+
+func (s *wasmShaker) valType(v WasmDecodedValType) WasmDecodedValType {
+	if v.Heap >= 0 {
+		v.Heap = int64(s.index(shakeTypes, uint32(v.Heap)))
+	}
+	return v
+}
+
+func (s *wasmShaker) valTypes(values []WasmDecodedValType) {
+	for i := range values {
+		values[i] = s.valType(values[i])
+	}
+}
+
+func (s *wasmShaker) expr(body []WasmInstr) {
+	for i := range body {
+		if body[i].data != nil {
+			// the address may be shared with copies of the instruction
+			address := *body[i].data
+			address.segment = s.index(shakeData, address.segment)
+			body[i].data = &address
+		}
+		body[i].visitImmediates(func(kind wasmImmediate, value *uint64) {
+			switch kind {
+			case immFunc:
+				*value = uint64(s.index(shakeFuncs, uint32(*value)))
+			case immGlobal:
+				*value = uint64(s.index(shakeGlobals, uint32(*value)))
+			case immType:
+				*value = uint64(s.index(shakeTypes, uint32(*value)))
+			case immBlockType, immHeapType:
+				if int64(*value) >= 0 {
+					*value = uint64(s.index(shakeTypes, uint32(*value)))
+				}
+			case immData:
+				*value = uint64(s.index(shakeData, uint32(*value)))
+			case immElem:
+				*value = uint64(s.index(shakeElems, uint32(*value)))
+			}
+		})
+	}
+}
+
+// Returns the items whose entry in live is set. Offset is the index of the first item in live.
+func keepLive[T any](items []T, live []bool, offset int) []T {
+	kept := []T{}
+	for i, item := range items {
+		if live[offset+i] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func (s *wasmShaker) rewrite() {
+	m := s.m
+
+	groups := []WasmDecodedRecGroup{}
+	for g, group := range m.Types {
+		if !s.live[shakeTypes][s.groupStart[g]] {
+			continue
+		}
+		for k := range group.Types {
+			t := &group.Types[k]
+			for i, super := range t.Supertypes {
+				t.Supertypes[i] = s.index(shakeTypes, super)
+			}
+			for i := range t.Fields {
+				t.Fields[i].Type = s.valType(t.Fields[i].Type)
+			}
+			s.valTypes(t.Params)
+			s.valTypes(t.Results)
+		}
+		groups = append(groups, group)
+	}
+	m.Types = groups
+
+	imports := []WasmDecodedImport{}
+	funcs, globals := 0, 0
+	for _, imp := range m.Imports {
+		switch imp.Kind {
+		case types.ImportFunctionType:
+			funcs++
+			if !s.live[shakeFuncs][funcs-1] {
+				continue
+			}
+			imp.TypeIndex = s.index(shakeTypes, imp.TypeIndex)
+		case types.ImportGlobalType:
+			globals++
+			if !s.live[shakeGlobals][globals-1] {
+				continue
+			}
+			imp.Global.Type = s.valType(imp.Global.Type)
+		case types.ImportTagType:
+			imp.TypeIndex = s.index(shakeTypes, imp.TypeIndex)
+		case types.ImportTableType:
+			imp.Table.Type = s.valType(imp.Table.Type)
+		}
+		imports = append(imports, imp)
+	}
+	m.Imports = imports
+
+	m.Functions = keepLive(m.Functions, s.live[shakeFuncs], funcs)
+	for i, typeIndex := range m.Functions {
+		m.Functions[i] = s.index(shakeTypes, typeIndex)
+	}
+	m.Code = keepLive(m.Code, s.live[shakeFuncs], funcs)
+	for _, c := range m.Code {
+		for i := range c.Locals {
+			c.Locals[i].Type = s.valType(c.Locals[i].Type)
+		}
+		s.expr(c.Body)
+	}
+
+	for i := range m.Tables {
+		m.Tables[i].Type = s.valType(m.Tables[i].Type)
+		s.expr(m.Tables[i].Init)
+	}
+	for i, tag := range m.Tags {
+		m.Tags[i] = s.index(shakeTypes, tag)
+	}
+
+	m.Globals = keepLive(m.Globals, s.live[shakeGlobals], globals)
+	for i := range m.Globals {
+		m.Globals[i].Type = s.valType(m.Globals[i].Type)
+		s.expr(m.Globals[i].Init)
+	}
+
+	for i, e := range m.Exports {
+		switch e.Kind {
+		case types.ExportFunctionType:
+			m.Exports[i].Index = s.index(shakeFuncs, e.Index)
+		case types.ExportGlobalType:
+			m.Exports[i].Index = s.index(shakeGlobals, e.Index)
+		}
+	}
+	if m.Start != nil {
+		start := s.index(shakeFuncs, *m.Start)
+		m.Start = &start
+	}
+	alwaysInline := map[uint32]bool{}
+	for f := range m.alwaysInline {
+		if s.live[shakeFuncs][f] {
+			alwaysInline[s.index(shakeFuncs, f)] = true
+		}
+	}
+	m.alwaysInline = alwaysInline
+	initFunctions := []WasmInitFunction{}
+	for _, init := range m.initFunctions {
+		if s.live[shakeFuncs][init.Function] {
+			initFunctions = append(initFunctions, WasmInitFunction{Function: s.index(shakeFuncs, init.Function), Priority: init.Priority})
+		}
+	}
+	m.initFunctions = initFunctions
+	for i, c := range m.comdats {
+		functions := []uint32{}
+		for _, f := range c.Functions {
+			if s.live[shakeFuncs][f] {
+				functions = append(functions, s.index(shakeFuncs, f))
+			}
+		}
+		m.comdats[i].Functions = functions
+	}
+
+	s.rewriteElements()
+
+	m.Data = keepLive(m.Data, s.live[shakeData], 0)
+	for i, d := range m.Data {
+		s.expr(d.Offset)
+		pointers := slices.Clone(d.pointers)
+		for k := range pointers {
+			pointers[k].address.segment = s.index(shakeData, pointers[k].address.segment)
+		}
+		m.Data[i].pointers = pointers
+	}
+
+	for i, c := range m.Customs {
+		if c.Name == "name" {
+			m.Customs[i].Payload = s.rewriteNames(c.Payload)
+		}
+	}
+}
+
+// Removes the removed functions from declarative segments, and keeps the segments that still
+// declare a function or are referenced.
+func (s *wasmShaker) filterDeclarative() {
+	m := s.m
+	for i := range m.Elements {
+		e := &m.Elements[i]
+		if e.Flags&elemPassiveOrDeclarative == 0 || e.Flags&elemExplicitTable == 0 {
+			continue
+		}
+
+		funcs := []uint32{}
+		for _, f := range e.Funcs {
+			if s.live[shakeFuncs][f] {
+				funcs = append(funcs, f)
+			}
+		}
+		exprs := [][]WasmInstr{}
+		for _, expr := range e.Exprs {
+			if len(expr) == 2 && expr[0].Opcode == WasmOpcode(instructions.RefFunc) && !s.live[shakeFuncs][expr[0].Immediates[0]] {
+				continue
+			}
+			exprs = append(exprs, expr)
+		}
+		e.Funcs, e.Exprs = funcs, exprs
+		if len(funcs) > 0 || len(exprs) > 0 {
+			s.live[shakeElems][i] = true
+		}
+	}
+}
+
+func (s *wasmShaker) rewriteElements() {
+	m := s.m
+	m.Elements = keepLive(m.Elements, s.live[shakeElems], 0)
+	for i := range m.Elements {
+		e := &m.Elements[i]
+		e.Type = s.valType(e.Type)
+		s.expr(e.Offset)
+		for k, f := range e.Funcs {
+			e.Funcs[k] = s.index(shakeFuncs, f)
+		}
+		for _, expr := range e.Exprs {
+			s.expr(expr)
+		}
+	}
+}
+
+// Subsections of the name section whose name maps are indexed by the given index space, and
+// subsections whose indirect name maps are indexed by it.
+var (
+	nameMapSpaces = map[byte]shakeSpace{
+		0x01: shakeFuncs, 0x04: shakeTypes, 0x07: shakeGlobals, 0x08: shakeElems, 0x09: shakeData,
+	}
+	indirectNameMapSpaces = map[byte]shakeSpace{
+		0x02: shakeFuncs, 0x03: shakeFuncs, 0x0A: shakeTypes,
+	}
+)
+
+// Renumbers the entries of the name section and removes the names of removed items. Returns
+// the payload unchanged if it is malformed.
+func (s *wasmShaker) rewriteNames(payload []byte) []byte {
+	r := &wasmReader{data: payload}
+	result := []byte{}
+	for !r.done() {
+		id := r.byte()
+		contents := r.bytes(uint64(r.u32()))
+		if r.err != nil {
+			return payload
+		}
+
+		sub := &wasmReader{data: contents}
+		entries := [][]byte{}
+		if space, ok := nameMapSpaces[id]; ok {
+			for n := sub.count(); n > 0; n-- {
+				idx, name := sub.u32(), sub.name()
+				if int(idx) < len(s.live[space]) && s.live[space][idx] {
+					entries = append(entries, append(leb128EncodeU(uint64(s.index(space, idx))), vec([]byte(name))...))
+				}
+			}
+		} else if space, ok := indirectNameMapSpaces[id]; ok {
+			for n := sub.count(); n > 0; n-- {
+				idx := sub.u32()
+				start := sub.pos
+				for k := sub.count(); k > 0; k-- {
+					sub.u32()
+					sub.name()
+				}
+				if int(idx) < len(s.live[space]) && s.live[space][idx] {
+					entries = append(entries, append(leb128EncodeU(uint64(s.index(space, idx))), sub.data[start:sub.pos]...))
+				}
+			}
+		} else {
+			result = append(append(result, id), vec(contents)...)
+			continue
+		}
+		if sub.err != nil {
+			return payload
+		}
+		result = append(append(result, id), vec(vecNested(entries))...)
+	}
+	return result
+}
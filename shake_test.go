@@ -0,0 +1,246 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Checks that decoding and encoding the module again produces the same bytes.
+func checkRoundTrip(t *testing.T, wasm []byte) {
+	t.Helper()
+
+	m, err := DecodeModule(wasm)
+	if err != nil {
+		t.Fatalf("unexpected decode error: %v", err)
+	}
+	if encoded := m.Encode(); !bytes.Equal(encoded, wasm) {
+		t.Fatalf("expected %x after decoding and encoding, got %x", wasm, encoded)
+	}
+}
+
+func TestDecodeModule(t *testing.T) {
+	t.Run("should decode the sections of a module", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		memory := wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+		counter := wasmSymbolTable.AddGlobal(ValType(types.I64), true, NewWasmConstExpr().AddInstrConstI64(-3))
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I64).
+			AddLocal(2, types.F64).
+			AddExpr(GlobalI64(counter)).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main).
+			AddData(memory, 16, []byte("hello")).
+			AddMetaTool("GoWasmTK", "0.0.1")
+
+		wasm := mod.Build()
+		checkRoundTrip(t, wasm)
+
+		m, _ := DecodeModule(wasm)
+		if len(m.Functions) != 1 || len(m.Globals) != 1 || len(m.Memories) != 1 || len(m.Data) != 1 {
+			t.Fatalf("expected one function, global, memory and data segment, got %+v", m)
+		}
+		if init := m.Globals[0].Init[0]; int64(init.Immediates[0]) != -3 {
+			t.Fatalf("expected the global to be initialized with -3, got %v", init)
+		}
+		if locals := m.Code[0].Locals; len(locals) != 1 || locals[0].Count != 2 || locals[0].Type.Code != types.F64 {
+			t.Fatalf("expected two f64 locals, got %v", locals)
+		}
+		if len(m.Customs) != 1 || m.Customs[0].Name != "producers" {
+			t.Fatalf("expected the producers section, got %v", m.Customs)
+		}
+	})
+
+	t.Run("should decode the legacy try and delegate", func(t *testing.T) {
+		wasm := []byte{
+			0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00,
+			0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+			0x03, 0x02, 0x01, 0x00,
+			// try, nop, delegate 0 and the end of the body
+			0x0A, 0x09, 0x01, 0x07, 0x00, 0x06, 0x40, 0x01, 0x18, 0x00, 0x0B,
+		}
+		checkRoundTrip(t, wasm)
+
+		m, _ := DecodeModule(wasm)
+		if body := m.Code[0].Body; len(body) != 4 || body[2].Opcode != 0x18 || body[3].Opcode != WasmOpcode(instructions.End) {
+			t.Fatalf("expected the delegate to close the try, got %+v", body)
+		}
+	})
+
+	t.Run("should reject malformed modules", func(t *testing.T) {
+		cases := [][]byte{
+			{0x00, 0x61, 0x73},
+			{0x00, 0x61, 0x73, 0x6D, 0x02, 0x00, 0x00, 0x00},
+			// a type section that is longer than the module
+			{0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00, 0x01, 0x10, 0x01},
+			// a function body with an unknown instruction
+			{
+				0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00,
+				0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+				0x03, 0x02, 0x01, 0x00,
+				0x0A, 0x05, 0x01, 0x03, 0x00, 0xFF, 0x0B,
+			},
+			// a delegate outside of a try
+			{
+				0x00, 0x61, 0x73, 0x6D, 0x01, 0x00, 0x00, 0x00,
+				0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+				0x03, 0x02, 0x01, 0x00,
+				0x0A, 0x06, 0x01, 0x04, 0x00, 0x18, 0x00, 0x0B,
+			},
+		}
+
+		for _, wasm := range cases {
+			if _, err := DecodeModule(wasm); !errors.Is(err, ErrInvalidModule) {
+				t.Fatalf("expected %v for %x, got %v", ErrInvalidModule, wasm, err)
+			}
+		}
+	})
+}
+
+func TestTreeShaking(t *testing.T) {
+	t.Run("should remove items that are not reachable from the exports", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(&[]WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "unused", ParamTypes: []types.WasmType{types.F32}},
+		})
+		wasmSymbolTable.AddType(StructType(WasmFieldType{Type: ValType(types.I32)}))
+		unusedGlobal := wasmSymbolTable.AddGlobal(ValType(types.I32), false, NewWasmConstExpr().AddInstrConstI32(1))
+		offset := wasmSymbolTable.AddGlobal(ValType(types.I32), false, NewWasmConstExpr().AddInstrConstI32(40))
+
+		unused := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddExpr(GlobalI32(unusedGlobal)).
+			AddInstrEnd().
+			Build()
+		helper := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(GlobalI32(offset).Add(LocalI32(0))).
+			AddInstrEnd().
+			Build()
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrCall(&helper).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&unused).
+			AddFunction(&helper).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		wasm := mod.Build(WithTreeShaking())
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		checkRoundTrip(t, wasm)
+
+		m, err := DecodeModule(wasm)
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		if len(m.Imports) != 0 || len(m.Functions) != 2 || len(m.Globals) != 1 {
+			t.Fatalf("expected no imports, two functions and one global, got %+v", m)
+		}
+		// only the type shared by helper and main is left
+		if len(m.Types) != 1 || m.Types[0].Types[0].Composite != compositeFunc {
+			t.Fatalf("expected one function type, got %+v", m.Types)
+		}
+		if m.Exports[0].Index != 1 {
+			t.Fatalf("expected main to be function 1, got %d", m.Exports[0].Index)
+		}
+
+		// the unused import is gone, so the module can be instantiated without it
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{2},
+			expected:   int32(42),
+			options:    []WasmBuildOption{WithTreeShaking()},
+		})
+	})
+
+	t.Run("should keep functions referenced by tables and ref.func", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		table := &WasmTable{RefType: types.FuncRef, Min: 1}
+
+		constant := func(n int32) WasmFunctionModule {
+			return NewWasmFunctionBuilder(wasmSymbolTable).
+				AddReturn(types.I32).
+				AddInstrConstI32(n).
+				AddInstrEnd().
+				Build()
+		}
+		unused, inTable, referenced := constant(1), constant(2), constant(3)
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrRefFunc(&referenced).
+			AddInstrDrop().
+			AddInstrConstI32(0).
+			AddInstrCallIndirect(0, nil, []types.WasmType{types.I32}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&unused).
+			AddFunction(&inTable).
+			AddFunction(&referenced).
+			AddFunction(&main).
+			AddTable(table).
+			AddElements(table, 0, &inTable).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		m, err := DecodeModule(mod.Build(WithTreeShaking()))
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		if len(m.Functions) != 3 {
+			t.Fatalf("expected three functions, got %d", len(m.Functions))
+		}
+		// the declarative segment still declares the referenced function, now at index 1
+		declarative := m.Elements[len(m.Elements)-1]
+		if declarative.Flags != 3 || len(declarative.Funcs) != 1 || declarative.Funcs[0] != 1 {
+			t.Fatalf("expected a declarative segment of function 1, got %+v", declarative)
+		}
+	})
+
+	t.Run("should renumber the name section", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		unused := NewWasmFunctionBuilder(wasmSymbolTable).AddInstrEnd().Build()
+		main := NewWasmFunctionBuilder(wasmSymbolTable).AddInstrEnd().Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&unused).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		m, _ := DecodeModule(mod.Build())
+		// function names: 0 "unused", 1 "main"
+		m.Customs = append(m.Customs, WasmDecodedCustom{
+			Name:    "name",
+			Payload: []byte{0x01, 0x0F, 0x02, 0x00, 0x06, 'u', 'n', 'u', 's', 'e', 'd', 0x01, 0x04, 'm', 'a', 'i', 'n'},
+			After:   sectionIdCode,
+		})
+		TreeShake(m)
+
+		expected := []byte{0x01, 0x07, 0x01, 0x00, 0x04, 'm', 'a', 'i', 'n'}
+		if !bytes.Equal(m.Customs[0].Payload, expected) {
+			t.Fatalf("expected name section %x, got %x", expected, m.Customs[0].Payload)
+		}
+	})
+}
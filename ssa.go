@@ -0,0 +1,399 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+type ssaOp int
+
+const (
+	ssaConst ssaOp = iota
+	ssaParam
+	ssaPhi
+	ssaAdd
+	ssaSub
+	ssaMul
+	ssaDiv
+	ssaAnd
+	ssaOr
+	ssaEq
+	ssaNe
+	ssaLt
+	ssaLe
+	ssaGt
+	ssaGe
+	ssaEqz
+	ssaCall
+	ssaCallSelf
+	ssaLoad
+	ssaStore
+)
+
+// The instruction of an operator for each operand type. Comparisons of integers are signed.
+var ssaInstructions = map[ssaOp]map[types.WasmType]instructions.WasmInstruction{
+	ssaAdd: {types.I32: instructions.AddI32, types.I64: instructions.AddI64, types.F64: instructions.AddF64},
+	ssaSub: {types.I32: instructions.SubI32, types.I64: instructions.SubI64, types.F64: instructions.SubF64},
+	ssaMul: {types.I32: instructions.MulI32, types.I64: instructions.MulI64, types.F64: instructions.MulF64},
+	ssaDiv: {types.I32: instructions.DivI32, types.I64: instructions.DivI64, types.F64: instructions.DivF64},
+	ssaAnd: {types.I32: instructions.AndI32},
+	ssaOr:  {types.I32: instructions.OrI32},
+	ssaEq:  {types.I32: instructions.EqualI32, types.I64: instructions.EqualI64, types.F64: instructions.EqualF64},
+	ssaNe:  {types.I32: instructions.NotEqualI32, types.I64: instructions.NotEqualI64, types.F64: instructions.NotEqualF64},
+	ssaLt: {
+		types.I32: instructions.LessThanSignedI32, types.I64: instructions.LessThanSignedI64, types.F64: instructions.LessThanF64,
+	},
+	ssaLe: {
+		types.I32: instructions.LessThanEqualSignedI32, types.I64: instructions.LessThanEqualSignedI64, types.F64: instructions.LessThanEqualF64,
+	},
+	ssaGt: {
+		types.I32: instructions.GreaterThanSignedI32, types.I64: instructions.GreaterThanSignedI64, types.F64: instructions.GreaterThanF64,
+	},
+	ssaGe: {
+		types.I32: instructions.GreaterThanEqualSignedI32, types.I64: instructions.GreaterThanEqualSignedI64, types.F64: instructions.GreaterThanEqualF64,
+	},
+	ssaEqz: {types.I32: instructions.EqzI32, types.I64: instructions.EqzI64},
+}
+
+func (op ssaOp) isComparison() bool {
+	return op >= ssaEq && op <= ssaEqz
+}
+
+// SSAFunction is a function in static single assignment form, which frontends can target
+// instead of emitting stack code. Every value is defined exactly once, by an instruction in a
+// basic block or by a phi node that selects a value depending on the predecessor control came
+// from. Lower turns the function into a WasmFunctionModule. The first block added is the entry.
+type SSAFunction struct {
+	params  []*SSAValue
+	results []types.WasmType
+	blocks  []*SSABlock
+	values  int
+	err     error
+}
+
+// SSABlock is a basic block of an SSAFunction: phi nodes, followed by instructions, followed
+// by a terminator that transfers control to other blocks or returns from the function.
+type SSABlock struct {
+	fn         *SSAFunction
+	phis       []*SSAValue
+	values     []*SSAValue
+	terminator wasmTerminatorKind
+	operand    *SSAValue
+	targets    []*SSABlock
+}
+
+// SSAValue is a typed value of an SSAFunction. Instructions without a result, such as stores,
+// are values too, but cannot be used as operands.
+type SSAValue struct {
+	fn        *SSAFunction
+	block     *SSABlock
+	id        int
+	op        ssaOp
+	valueType types.WasmType
+	void      bool
+	args      []*SSAValue
+	incoming  []*SSABlock
+	bits      uint64
+	callee    *WasmFunctionModule
+	memArg    WasmMemArg
+}
+
+func isSSAType(t types.WasmType) bool {
+	return t == types.I32 || t == types.I64 || t == types.F64
+}
+
+// Creates a function with the given parameters and at most one result. Parameters and results
+// are limited to i32, i64 and f64.
+func NewSSAFunction(params []types.WasmType, results []types.WasmType) *SSAFunction {
+	f := &SSAFunction{results: results}
+
+	if len(results) > 1 {
+		f.fail(fmt.Errorf("%w: %d results, at most one is supported", ErrInvalidSSA, len(results)))
+	}
+	for _, t := range append(slices.Clone(params), results...) {
+		if !isSSAType(t) {
+			f.fail(fmt.Errorf("%w: unsupported value type %v", ErrTypeMismatch, ValType(t)))
+		}
+	}
+
+	for i, t := range params {
+		param := f.newValue(nil, ssaParam, t)
+		param.bits = uint64(i)
+		f.params = append(f.params, param)
+	}
+	return f
+}
+
+func (f *SSAFunction) Err() error {
+	return f.err
+}
+
+func (f *SSAFunction) fail(err error) {
+	if f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *SSAFunction) newValue(block *SSABlock, op ssaOp, valueType types.WasmType) *SSAValue {
+	v := &SSAValue{fn: f, block: block, id: f.values, op: op, valueType: valueType}
+	f.values++
+	return v
+}
+
+// Returns the value of the parameter at the given position.
+func (f *SSAFunction) Param(i int) *SSAValue {
+	if i < 0 || i >= len(f.params) {
+		f.fail(fmt.Errorf("%w: parameter %d of %d", ErrInvalidSSA, i, len(f.params)))
+		return nil
+	}
+	return f.params[i]
+}
+
+func (f *SSAFunction) NewBlock() *SSABlock {
+	block := &SSABlock{fn: f}
+	f.blocks = append(f.blocks, block)
+	return block
+}
+
+func (v *SSAValue) Type() types.WasmType {
+	return v.valueType
+}
+
+// Checks that v is a value of the same function that can be used as an operand.
+func (bb *SSABlock) checkOperand(v *SSAValue) bool {
+	switch {
+	case v == nil:
+		bb.fn.fail(fmt.Errorf("%w: operand is nil", ErrInvalidSSA))
+	case v.fn != bb.fn:
+		bb.fn.fail(fmt.Errorf("%w: value v%d belongs to another function", ErrInvalidSSA, v.id))
+	case v.void:
+		bb.fn.fail(fmt.Errorf("%w: value v%d has no result", ErrInvalidSSA, v.id))
+	default:
+		return true
+	}
+	return false
+}
+
+func (bb *SSABlock) add(op ssaOp, valueType types.WasmType, args ...*SSAValue) *SSAValue {
+	if bb.terminator != terminatorExit {
+		bb.fn.fail(fmt.Errorf("%w: instruction added after the terminator", ErrInvalidSSA))
+	}
+	for _, arg := range args {
+		bb.checkOperand(arg)
+	}
+
+	v := bb.fn.newValue(bb, op, valueType)
+	v.args = args
+	bb.values = append(bb.values, v)
+	return v
+}
+
+func (bb *SSABlock) ConstI32(n int32) *SSAValue {
+	v := bb.add(ssaConst, types.I32)
+	v.bits = uint64(n)
+	return v
+}
+
+func (bb *SSABlock) ConstI64(n int64) *SSAValue {
+	v := bb.add(ssaConst, types.I64)
+	v.bits = uint64(n)
+	return v
+}
+
+func (bb *SSABlock) ConstF64(n float64) *SSAValue {
+	v := bb.add(ssaConst, types.F64)
+	v.bits = math.Float64bits(n)
+	return v
+}
+
+func (bb *SSABlock) operator(op ssaOp, args ...*SSAValue) *SSAValue {
+	for _, arg := range args {
+		if !bb.checkOperand(arg) {
+			return bb.add(op, types.I32)
+		}
+	}
+
+	operandType := args[0].valueType
+	for _, arg := range args[1:] {
+		if arg.valueType != operandType {
+			bb.fn.fail(fmt.Errorf("%w: operands of %v and %v", ErrTypeMismatch, ValType(operandType), ValType(arg.valueType)))
+		}
+	}
+	if _, ok := ssaInstructions[op][operandType]; !ok {
+		bb.fn.fail(fmt.Errorf("%w: operator is not defined for %v", ErrTypeMismatch, ValType(operandType)))
+	}
+
+	resultType := operandType
+	if op.isComparison() {
+		resultType = types.I32
+	}
+	return bb.add(op, resultType, args...)
+}
+
+func (bb *SSABlock) Add(x, y *SSAValue) *SSAValue { return bb.operator(ssaAdd, x, y) }
+func (bb *SSABlock) Sub(x, y *SSAValue) *SSAValue { return bb.operator(ssaSub, x, y) }
+func (bb *SSABlock) Mul(x, y *SSAValue) *SSAValue { return bb.operator(ssaMul, x, y) }
+
+// Divides x by y. Integer division is signed and traps if y is zero.
+func (bb *SSABlock) Div(x, y *SSAValue) *SSAValue { return bb.operator(ssaDiv, x, y) }
+func (bb *SSABlock) And(x, y *SSAValue) *SSAValue { return bb.operator(ssaAnd, x, y) }
+func (bb *SSABlock) Or(x, y *SSAValue) *SSAValue  { return bb.operator(ssaOr, x, y) }
+func (bb *SSABlock) Eq(x, y *SSAValue) *SSAValue  { return bb.operator(ssaEq, x, y) }
+func (bb *SSABlock) Ne(x, y *SSAValue) *SSAValue  { return bb.operator(ssaNe, x, y) }
+func (bb *SSABlock) Lt(x, y *SSAValue) *SSAValue  { return bb.operator(ssaLt, x, y) }
+func (bb *SSABlock) Le(x, y *SSAValue) *SSAValue  { return bb.operator(ssaLe, x, y) }
+func (bb *SSABlock) Gt(x, y *SSAValue) *SSAValue  { return bb.operator(ssaGt, x, y) }
+func (bb *SSABlock) Ge(x, y *SSAValue) *SSAValue  { return bb.operator(ssaGe, x, y) }
+func (bb *SSABlock) Eqz(x *SSAValue) *SSAValue    { return bb.operator(ssaEqz, x) }
+
+func (bb *SSABlock) call(op ssaOp, params []WasmValueType, results []WasmValueType, args []*SSAValue) *SSAValue {
+	if len(params) != len(args) {
+		bb.fn.fail(fmt.Errorf("%w: callee expects %d arguments, got %d", ErrTypeMismatch, len(params), len(args)))
+	}
+	for i, arg := range args {
+		if i < len(params) && arg != nil && ValType(arg.valueType) != params[i] {
+			bb.fn.fail(fmt.Errorf("%w: argument %d expects %v, got %v", ErrTypeMismatch, i, params[i], ValType(arg.valueType)))
+		}
+	}
+	if len(results) > 1 {
+		bb.fn.fail(fmt.Errorf("%w: callee returns %d results", ErrInvalidSSA, len(results)))
+	}
+
+	v := bb.add(op, 0, args...)
+	if len(results) == 0 {
+		v.void = true
+	} else {
+		v.valueType = results[0].code
+		if results[0] != ValType(v.valueType) || !isSSAType(v.valueType) {
+			bb.fn.fail(fmt.Errorf("%w: unsupported result type %v", ErrTypeMismatch, results[0]))
+		}
+	}
+	return v
+}
+
+// Calls a function. The value is the result of the call, or has no result if the function
+// does not return one.
+func (bb *SSABlock) Call(f *WasmFunctionModule, args ...*SSAValue) *SSAValue {
+	v := bb.call(ssaCall, f.paramTypes, f.resultTypes, args)
+	v.callee = f
+	return v
+}
+
+// Calls the function being built.
+func (bb *SSABlock) CallSelf(args ...*SSAValue) *SSAValue {
+	params := []WasmValueType{}
+	for _, param := range bb.fn.params {
+		params = append(params, ValType(param.valueType))
+	}
+	results := []WasmValueType{}
+	for _, result := range bb.fn.results {
+		results = append(results, ValType(result))
+	}
+	return bb.call(ssaCallSelf, params, results, args)
+}
+
+func (bb *SSABlock) checkAddress(addr *SSAValue) {
+	if addr != nil && addr.valueType != types.I32 && addr.valueType != types.I64 {
+		bb.fn.fail(fmt.Errorf("%w: address of type %v", ErrTypeMismatch, ValType(addr.valueType)))
+	}
+}
+
+// Loads a value of the given type from linear memory.
+func (bb *SSABlock) Load(valueType types.WasmType, addr *SSAValue, memArg WasmMemArg) *SSAValue {
+	if !isSSAType(valueType) {
+		bb.fn.fail(fmt.Errorf("%w: unsupported value type %v", ErrTypeMismatch, ValType(valueType)))
+	}
+	bb.checkAddress(addr)
+
+	v := bb.add(ssaLoad, valueType, addr)
+	v.memArg = memArg
+	return v
+}
+
+// Stores a value to linear memory. The returned value has no result.
+func (bb *SSABlock) Store(addr *SSAValue, value *SSAValue, memArg WasmMemArg) *SSAValue {
+	bb.checkAddress(addr)
+
+	v := bb.add(ssaStore, 0, addr, value)
+	v.void = true
+	v.memArg = memArg
+	return v
+}
+
+// Adds a phi node of the given type. Its incoming values are added with AddIncoming, one for
+// every predecessor of the block.
+func (bb *SSABlock) Phi(valueType types.WasmType) *SSAValue {
+	if !isSSAType(valueType) {
+		bb.fn.fail(fmt.Errorf("%w: unsupported value type %v", ErrTypeMismatch, ValType(valueType)))
+	}
+
+	v := bb.fn.newValue(bb, ssaPhi, valueType)
+	bb.phis = append(bb.phis, v)
+	return v
+}
+
+// Sets the value the phi node takes when control comes from the predecessor.
+func (v *SSAValue) AddIncoming(pred *SSABlock, value *SSAValue) *SSAValue {
+	switch {
+	case v.op != ssaPhi:
+		v.fn.fail(fmt.Errorf("%w: v%d is not a phi node", ErrInvalidSSA, v.id))
+	case pred == nil || pred.fn != v.fn:
+		v.fn.fail(fmt.Errorf("%w: predecessor of v%d belongs to another function", ErrInvalidSSA, v.id))
+	case v.block.checkOperand(value) && value.valueType != v.valueType:
+		v.fn.fail(fmt.Errorf("%w: phi v%d of %v, incoming %v", ErrTypeMismatch, v.id, ValType(v.valueType), ValType(value.valueType)))
+	}
+
+	v.args = append(v.args, value)
+	v.incoming = append(v.incoming, pred)
+	return v
+}
+
+func (bb *SSABlock) terminate(kind wasmTerminatorKind, operand *SSAValue, targets ...*SSABlock) {
+	if bb.terminator != terminatorExit {
+		bb.fn.fail(fmt.Errorf("%w: block already has a terminator", ErrInvalidSSA))
+	}
+	for _, target := range targets {
+		if target == nil || target.fn != bb.fn {
+			bb.fn.fail(fmt.Errorf("%w: target belongs to another function", ErrInvalidSSA))
+		}
+	}
+
+	bb.terminator = kind
+	bb.operand = operand
+	bb.targets = targets
+}
+
+// Continues with the target block.
+func (bb *SSABlock) Jump(target *SSABlock) {
+	bb.terminate(terminatorJump, nil, target)
+}
+
+// Continues with then if the i32 condition is not zero, and with otherwise if it is.
+func (bb *SSABlock) Branch(cond *SSAValue, then *SSABlock, otherwise *SSABlock) {
+	if bb.checkOperand(cond) && cond.valueType != types.I32 {
+		bb.fn.fail(fmt.Errorf("%w: condition of type %v", ErrTypeMismatch, ValType(cond.valueType)))
+	}
+	bb.terminate(terminatorBranch, cond, then, otherwise)
+}
+
+// Returns the value from the function, which must be nil for functions without a result.
+func (bb *SSABlock) Return(value *SSAValue) {
+	switch {
+	case value == nil && len(bb.fn.results) != 0:
+		bb.fn.fail(fmt.Errorf("%w: return without a value", ErrTypeMismatch))
+	case value != nil && len(bb.fn.results) == 0:
+		bb.fn.fail(fmt.Errorf("%w: return with a value from a function without results", ErrTypeMismatch))
+	case value != nil && bb.checkOperand(value) && value.valueType != bb.fn.results[0]:
+		bb.fn.fail(fmt.Errorf("%w: returns %v, expected %v", ErrTypeMismatch, ValType(value.valueType), ValType(bb.fn.results[0])))
+	}
+	bb.terminate(terminatorReturn, value)
+}
+
+// Traps when control reaches the end of the block.
+func (bb *SSABlock) Unreachable() {
+	bb.terminate(terminatorUnreachable, nil)
+}
@@ -0,0 +1,608 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Lowers an SSAFunction in four steps. Verification checks that every block ends in a
+// terminator, that phi nodes have one incoming value per predecessor and that definitions
+// dominate their uses. Stackification picks the values that can be computed right where
+// their only use is, so that they never leave the operand stack. Out-of-SSA replaces phi nodes
+// with copies on the edges into their block, splitting the edges that leave a branch. Local
+// allocation then lets values share a local when their live ranges do not overlap.
+type wasmSSALowering struct {
+	f      *SSAFunction
+	b      *WasmFunctionBuilder
+	order  []*SSABlock
+	number map[*SSABlock]int
+	preds  [][]int
+	idom   []int
+	pos    []int
+	live   []bool
+	uses   []int
+	inline []bool
+	local  []WasmLocal
+	params []WasmLocal
+	nodes  []wasmSSANode
+	splits []wasmSSAEdge
+}
+
+// A node of the lowered graph: an SSA block, or a block of phi copies on a split edge. The
+// events are the points at which locals are read and written, in the order they happen.
+type wasmSSANode struct {
+	events []wasmSSAEvent
+	succs  []int
+}
+
+type wasmSSAEvent struct {
+	uses []*SSAValue
+	defs []*SSAValue
+}
+
+type wasmSSAEdge struct {
+	pred   *SSABlock
+	target *SSABlock
+}
+
+// Lowers the function into a WasmFunctionModule of the symbol table, like Build does for a
+// WasmFunctionBuilder. Errors recorded while building the function, or found by verifying
+// it, are reported by the Err of the module it is added to.
+func (f *SSAFunction) Lower(symbolTable *wasmSymbolTable) WasmFunctionModule {
+	b := NewWasmFunctionBuilder(symbolTable)
+	l := &wasmSSALowering{f: f, b: b, number: map[*SSABlock]int{}}
+
+	for _, param := range f.params {
+		l.params = append(l.params, b.NewParam(param.valueType))
+	}
+	for _, result := range f.results {
+		b.AddReturn(result)
+	}
+
+	if err := l.verify(); err != nil {
+		b.fail(err)
+		return b.AddInstrUnreachable().AddInstrEnd().Build()
+	}
+
+	l.markLive()
+	l.stackify()
+	l.buildNodes()
+	l.allocateLocals()
+	l.emit()
+
+	return b.AddInstrEnd().Build()
+}
+
+func (l *wasmSSALowering) verify() error {
+	if l.f.err != nil {
+		return l.f.err
+	}
+	if len(l.f.blocks) == 0 {
+		return fmt.Errorf("%w: function has no blocks", ErrInvalidSSA)
+	}
+
+	visited := map[*SSABlock]bool{}
+	var visit func(bb *SSABlock)
+	visit = func(bb *SSABlock) {
+		visited[bb] = true
+		for _, target := range bb.targets {
+			if !visited[target] {
+				visit(target)
+			}
+		}
+		l.order = append(l.order, bb)
+	}
+	visit(l.f.blocks[0])
+	slices.Reverse(l.order)
+
+	l.pos = make([]int, l.f.values)
+	l.preds = make([][]int, len(l.order))
+	for i, bb := range l.order {
+		l.number[bb] = i
+		for pos, v := range bb.values {
+			l.pos[v.id] = pos
+		}
+	}
+
+	for i, bb := range l.order {
+		if bb.terminator == terminatorExit {
+			return fmt.Errorf("%w: block %d has no terminator", ErrInvalidSSA, i)
+		}
+		for _, target := range bb.targets {
+			if t := l.number[target]; !slices.Contains(l.preds[t], i) {
+				l.preds[t] = append(l.preds[t], i)
+			}
+		}
+	}
+	if len(l.order[0].phis) > 0 {
+		return fmt.Errorf("%w: entry block has phi nodes", ErrInvalidSSA)
+	}
+
+	l.idom = dominators(l.preds)
+
+	for i, bb := range l.order {
+		for _, phi := range bb.phis {
+			seen := map[int]bool{}
+			for k, pred := range phi.incoming {
+				p, reachable := l.number[pred]
+				if !reachable {
+					continue
+				}
+				if !slices.Contains(l.preds[i], p) || seen[p] {
+					return fmt.Errorf("%w: phi v%d has an unexpected incoming value for block %d", ErrInvalidSSA, phi.id, p)
+				}
+				seen[p] = true
+				if !l.available(phi.args[k], p, len(pred.values)) {
+					return fmt.Errorf("%w: v%d does not dominate the end of block %d", ErrInvalidSSA, phi.args[k].id, p)
+				}
+			}
+			if len(seen) != len(l.preds[i]) {
+				return fmt.Errorf("%w: phi v%d lacks incoming values for some predecessors", ErrInvalidSSA, phi.id)
+			}
+		}
+
+		for pos, v := range bb.values {
+			for _, arg := range v.args {
+				if !l.available(arg, i, pos) {
+					return fmt.Errorf("%w: v%d is used by v%d before it is defined", ErrInvalidSSA, arg.id, v.id)
+				}
+			}
+		}
+		if bb.operand != nil && !l.available(bb.operand, i, len(bb.values)) {
+			return fmt.Errorf("%w: v%d is used by the terminator of block %d before it is defined", ErrInvalidSSA, bb.operand.id, i)
+		}
+	}
+	return nil
+}
+
+// Returns whether v is defined before the instruction at the position in the block.
+func (l *wasmSSALowering) available(v *SSAValue, block int, pos int) bool {
+	if v.op == ssaParam {
+		return true
+	}
+
+	def, reachable := l.number[v.block]
+	switch {
+	case !reachable:
+		return false
+	case def != block:
+		return dominates(l.idom, def, block)
+	default:
+		return v.op == ssaPhi || l.pos[v.id] < pos
+	}
+}
+
+// Instructions that have side effects, read memory or trap are never removed or reordered.
+func (v *SSAValue) hasEffects() bool {
+	switch v.op {
+	case ssaCall, ssaCallSelf, ssaLoad, ssaStore:
+		return true
+	case ssaDiv:
+		return v.valueType != types.F64
+	}
+	return false
+}
+
+// Marks the values that the effects and terminators of the function depend on, and counts
+// their uses. Everything else is dead and not emitted.
+func (l *wasmSSALowering) markLive() {
+	l.live = make([]bool, l.f.values)
+	l.uses = make([]int, l.f.values)
+
+	work := []*SSAValue{}
+	mark := func(v *SSAValue) {
+		if !l.live[v.id] {
+			l.live[v.id] = true
+			work = append(work, v)
+		}
+	}
+
+	for _, bb := range l.order {
+		for _, v := range bb.values {
+			if v.hasEffects() {
+				mark(v)
+			}
+		}
+		if bb.operand != nil {
+			mark(bb.operand)
+			l.uses[bb.operand.id]++
+		}
+	}
+
+	for len(work) > 0 {
+		v := work[len(work)-1]
+		work = work[:len(work)-1]
+		for k, arg := range v.args {
+			if v.op == ssaPhi {
+				if _, reachable := l.number[v.incoming[k]]; !reachable {
+					continue
+				}
+			}
+			mark(arg)
+			l.uses[arg.id]++
+		}
+	}
+}
+
+// Values of a block are visited from the last to the first, so that the position of the tree
+// a value is emitted in is known before its operands are considered. A value with a single use
+// in the same block moves to that position. Values with effects only move if no other effect
+// lies in between, which keeps the order of effects.
+func (l *wasmSSALowering) stackify() {
+	l.inline = make([]bool, l.f.values)
+
+	for _, bb := range l.order {
+		root := make([]int, len(bb.values))
+		try := func(v *SSAValue, at int) {
+			if v.op == ssaConst || v.op == ssaParam || v.op == ssaPhi || v.block != bb || l.uses[v.id] != 1 {
+				return
+			}
+			if v.hasEffects() {
+				for _, between := range bb.values[l.pos[v.id]+1 : at] {
+					if l.live[between.id] && between.hasEffects() {
+						return
+					}
+				}
+			}
+			l.inline[v.id] = true
+			root[l.pos[v.id]] = at
+		}
+
+		if bb.operand != nil {
+			try(bb.operand, len(bb.values))
+		}
+		for i := len(bb.values) - 1; i >= 0; i-- {
+			v := bb.values[i]
+			if !l.live[v.id] {
+				continue
+			}
+			at := i
+			if l.inline[v.id] {
+				at = root[i]
+			}
+			for _, arg := range v.args {
+				try(arg, at)
+			}
+		}
+	}
+}
+
+// Returns whether the value is kept in a local. Constants are emitted again at every use and
+// parameters already are locals.
+func (l *wasmSSALowering) needsLocal(v *SSAValue) bool {
+	return l.live[v.id] && !v.void && !l.inline[v.id] && l.uses[v.id] > 0 && v.op != ssaConst && v.op != ssaParam
+}
+
+// Appends the values whose locals are read when v is used as an operand.
+func (l *wasmSSALowering) reads(v *SSAValue, out []*SSAValue) []*SSAValue {
+	if l.inline[v.id] {
+		for _, arg := range v.args {
+			out = l.reads(arg, out)
+		}
+		return out
+	}
+	if l.needsLocal(v) {
+		out = append(out, v)
+	}
+	return out
+}
+
+func (l *wasmSSALowering) livePhis(bb *SSABlock) []*SSAValue {
+	phis := []*SSAValue{}
+	for _, phi := range bb.phis {
+		if l.live[phi.id] {
+			phis = append(phis, phi)
+		}
+	}
+	return phis
+}
+
+func incomingValue(phi *SSAValue, pred *SSABlock) *SSAValue {
+	return phi.args[slices.Index(phi.incoming, pred)]
+}
+
+// The copies on an edge into a block with phi nodes read all incoming values before they
+// write any phi, so that phis may swap values.
+func (l *wasmSSALowering) copyEvent(pred *SSABlock, target *SSABlock) wasmSSAEvent {
+	event := wasmSSAEvent{defs: l.livePhis(target)}
+	for _, phi := range event.defs {
+		event.uses = l.reads(incomingValue(phi, pred), event.uses)
+	}
+	return event
+}
+
+func (l *wasmSSALowering) buildNodes() {
+	l.nodes = make([]wasmSSANode, len(l.order))
+	splitNode := map[wasmSSAEdge]int{}
+
+	for i, bb := range l.order {
+		node := wasmSSANode{}
+
+		for _, v := range bb.values {
+			if !l.live[v.id] || l.inline[v.id] || v.op == ssaConst {
+				continue
+			}
+			event := wasmSSAEvent{}
+			for _, arg := range v.args {
+				event.uses = l.reads(arg, event.uses)
+			}
+			if l.needsLocal(v) {
+				event.defs = []*SSAValue{v}
+			}
+			node.events = append(node.events, event)
+		}
+		if bb.operand != nil {
+			node.events = append(node.events, wasmSSAEvent{uses: l.reads(bb.operand, nil)})
+		}
+
+		for _, target := range bb.targets {
+			t := l.number[target]
+			if len(l.livePhis(target)) == 0 {
+				node.succs = append(node.succs, t)
+				continue
+			}
+			if bb.terminator == terminatorJump {
+				node.events = append(node.events, l.copyEvent(bb, target))
+				node.succs = append(node.succs, t)
+				continue
+			}
+
+			edge := wasmSSAEdge{pred: bb, target: target}
+			split, ok := splitNode[edge]
+			if !ok {
+				split = len(l.order) + len(l.splits)
+				splitNode[edge] = split
+				l.splits = append(l.splits, edge)
+				l.nodes = append(l.nodes, wasmSSANode{events: []wasmSSAEvent{l.copyEvent(bb, target)}, succs: []int{t}})
+			}
+			node.succs = append(node.succs, split)
+		}
+
+		l.nodes[i] = node
+	}
+}
+
+// Computes which values are live at the end of every node, builds the graph of values that
+// are live at the same time, and colors it greedily with one local per color and type.
+func (l *wasmSSALowering) allocateLocals() {
+	liveOut := make([][]bool, len(l.nodes))
+	liveIn := make([][]bool, len(l.nodes))
+	for i := range l.nodes {
+		liveOut[i] = make([]bool, l.f.values)
+		liveIn[i] = make([]bool, l.f.values)
+	}
+
+	transfer := func(node wasmSSANode, live []bool, visit func(defs []*SSAValue, live []bool)) {
+		for e := len(node.events) - 1; e >= 0; e-- {
+			event := node.events[e]
+			if visit != nil {
+				visit(event.defs, live)
+			}
+			for _, def := range event.defs {
+				live[def.id] = false
+			}
+			for _, use := range event.uses {
+				live[use.id] = true
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(l.nodes) - 1; i >= 0; i-- {
+			for _, succ := range l.nodes[i].succs {
+				for id, isLive := range liveIn[succ] {
+					liveOut[i][id] = liveOut[i][id] || isLive
+				}
+			}
+
+			live := slices.Clone(liveOut[i])
+			transfer(l.nodes[i], live, nil)
+			if !slices.Equal(live, liveIn[i]) {
+				liveIn[i] = live
+				changed = true
+			}
+		}
+	}
+
+	values := make([]*SSAValue, l.f.values)
+	for _, node := range l.nodes {
+		for _, event := range node.events {
+			for _, def := range event.defs {
+				values[def.id] = def
+			}
+		}
+	}
+
+	interferes := make([]map[int]bool, l.f.values)
+	interfere := func(a, b *SSAValue) {
+		if a != b && a.valueType == b.valueType {
+			if interferes[a.id] == nil {
+				interferes[a.id] = map[int]bool{}
+			}
+			if interferes[b.id] == nil {
+				interferes[b.id] = map[int]bool{}
+			}
+			interferes[a.id][b.id] = true
+			interferes[b.id][a.id] = true
+		}
+	}
+
+	for i, node := range l.nodes {
+		transfer(node, slices.Clone(liveOut[i]), func(defs []*SSAValue, live []bool) {
+			for _, def := range defs {
+				for id, isLive := range live {
+					if isLive {
+						interfere(def, values[id])
+					}
+				}
+				for _, other := range defs {
+					interfere(def, other)
+				}
+			}
+		})
+	}
+
+	l.local = make([]WasmLocal, l.f.values)
+	color := make([]int, l.f.values)
+	pool := map[types.WasmType][]WasmLocal{}
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+
+		taken := map[int]bool{}
+		for id := range interferes[v.id] {
+			if id < v.id {
+				taken[color[id]] = true
+			}
+		}
+		c := 0
+		for taken[c] {
+			c++
+		}
+		if c == len(pool[v.valueType]) {
+			pool[v.valueType] = append(pool[v.valueType], l.b.NewLocal(v.valueType))
+		}
+		color[v.id] = c
+		l.local[v.id] = pool[v.valueType][c]
+	}
+}
+
+func (l *wasmSSALowering) emit() {
+	cfg := NewWasmCFG()
+	blocks := make([]*WasmBasicBlock, len(l.nodes))
+
+	for i, bb := range l.order {
+		blocks[i] = cfg.AddBlock(func(b *WasmFunctionBuilder) { l.emitBlock(bb) })
+	}
+	for k, edge := range l.splits {
+		blocks[len(l.order)+k] = cfg.AddBlock(func(b *WasmFunctionBuilder) { l.emitCopies(edge.pred, edge.target) })
+	}
+
+	for i, node := range l.nodes {
+		if i >= len(l.order) {
+			blocks[i].Jump(blocks[node.succs[0]])
+			continue
+		}
+
+		bb := l.order[i]
+		switch bb.terminator {
+		case terminatorJump:
+			blocks[i].Jump(blocks[node.succs[0]])
+		case terminatorBranch:
+			cond := newExpr[I32Expr](func(b *WasmFunctionBuilder) { l.emitOperand(bb.operand) })
+			blocks[i].Branch(cond, blocks[node.succs[0]], blocks[node.succs[1]])
+		case terminatorReturn:
+			blocks[i].Return(l.expr(bb.operand))
+		case terminatorUnreachable:
+			blocks[i].Unreachable()
+		}
+	}
+
+	l.b.AddCFG(cfg, blocks[0])
+}
+
+func (l *wasmSSALowering) expr(v *SSAValue) WasmExpr {
+	if v == nil {
+		return nil
+	}
+
+	lower := func(b *WasmFunctionBuilder) { l.emitOperand(v) }
+	switch v.valueType {
+	case types.I64:
+		return newExpr[I64Expr](lower)
+	case types.F64:
+		return newExpr[F64Expr](lower)
+	default:
+		return newExpr[I32Expr](lower)
+	}
+}
+
+func (l *wasmSSALowering) emitBlock(bb *SSABlock) {
+	for _, v := range bb.values {
+		if !l.live[v.id] || l.inline[v.id] || v.op == ssaConst {
+			continue
+		}
+
+		l.emitValue(v)
+		switch {
+		case l.needsLocal(v):
+			l.b.AddInstrSetLocalHandle(l.local[v.id])
+		case !v.void:
+			l.b.AddInstrDrop()
+		}
+	}
+
+	if bb.terminator == terminatorJump && len(l.livePhis(bb.targets[0])) > 0 {
+		l.emitCopies(bb, bb.targets[0])
+	}
+}
+
+func (l *wasmSSALowering) emitCopies(pred *SSABlock, target *SSABlock) {
+	phis := l.livePhis(target)
+	for _, phi := range phis {
+		l.emitOperand(incomingValue(phi, pred))
+	}
+	for i := len(phis) - 1; i >= 0; i-- {
+		l.b.AddInstrSetLocalHandle(l.local[phis[i].id])
+	}
+}
+
+func (l *wasmSSALowering) emitOperand(v *SSAValue) {
+	switch {
+	case v.op == ssaConst:
+		l.emitValue(v)
+	case v.op == ssaParam:
+		l.b.AddInstrGetLocalHandle(l.params[v.bits])
+	case l.inline[v.id]:
+		l.emitValue(v)
+	default:
+		l.b.AddInstrGetLocalHandle(l.local[v.id])
+	}
+}
+
+func (l *wasmSSALowering) emitValue(v *SSAValue) {
+	for _, arg := range v.args {
+		l.emitOperand(arg)
+	}
+
+	switch v.op {
+	case ssaConst:
+		switch v.valueType {
+		case types.I32:
+			l.b.AddInstrConstI32(int32(v.bits))
+		case types.I64:
+			l.b.AddInstrConstI64(int64(v.bits))
+		default:
+			l.b.AddInstrConstF64(math.Float64frombits(v.bits))
+		}
+	case ssaCall:
+		l.b.AddInstrCall(v.callee)
+	case ssaCallSelf:
+		l.b.AddInstrCallSelf()
+	case ssaLoad:
+		switch v.valueType {
+		case types.I32:
+			l.b.AddInstrLoadI32(v.memArg)
+		case types.I64:
+			l.b.AddInstrLoadI64(v.memArg)
+		default:
+			l.b.AddInstrLoadF64(v.memArg)
+		}
+	case ssaStore:
+		switch v.args[1].valueType {
+		case types.I32:
+			l.b.AddInstrStoreI32(v.memArg)
+		case types.I64:
+			l.b.AddInstrStoreI64(v.memArg)
+		default:
+			l.b.AddInstrStoreF64(v.memArg)
+		}
+	default:
+		l.b.instructions = append(l.b.instructions, ssaInstructions[v.op][v.args[0].valueType])
+	}
+}
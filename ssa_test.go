@@ -0,0 +1,258 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Lowers the function, exports it as main and runs it.
+func runSSATest(t *testing.T, wasmSymbolTable *wasmSymbolTable, f *SSAFunction, args []interface{}, expected interface{}) WasmFunctionModule {
+	t.Helper()
+
+	main := f.Lower(wasmSymbolTable)
+	mod := NewWasmModuleBuilder(wasmSymbolTable).
+		AddFunction(&main).
+		Export("main", types.ExportFunctionType, &main)
+
+	if err := mod.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runModValueTest(t, apiTestCase{
+		input:      mod,
+		nameOfMain: "main",
+		args:       args,
+		expected:   expected,
+	})
+	return main
+}
+
+func TestSSA(t *testing.T) {
+	t.Run("should lower loops with phi nodes", func(t *testing.T) {
+		// sum of 1..n
+		f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.I32})
+		entry, loop, exit := f.NewBlock(), f.NewBlock(), f.NewBlock()
+
+		one, zero := entry.ConstI32(1), entry.ConstI32(0)
+		entry.Jump(loop)
+
+		i := loop.Phi(types.I32)
+		sum := loop.Phi(types.I32)
+		nextSum := loop.Add(sum, i)
+		next := loop.Add(i, loop.ConstI32(1))
+		loop.Branch(loop.Gt(next, f.Param(0)), exit, loop)
+
+		i.AddIncoming(entry, one).AddIncoming(loop, next)
+		sum.AddIncoming(entry, zero).AddIncoming(loop, nextSum)
+
+		exit.Return(nextSum)
+
+		runSSATest(t, NewSymbolTable(nil), f, []interface{}{10}, int32(55))
+	})
+
+	t.Run("should copy phi nodes that swap values in parallel", func(t *testing.T) {
+		// the nth Fibonacci number, where a and b swap on every iteration
+		f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.I64})
+		entry, header, body, exit := f.NewBlock(), f.NewBlock(), f.NewBlock(), f.NewBlock()
+
+		first, second := entry.ConstI64(0), entry.ConstI64(1)
+		entry.Jump(header)
+
+		a := header.Phi(types.I64)
+		b := header.Phi(types.I64)
+		n := header.Phi(types.I32)
+		header.Branch(header.Eqz(n), exit, body)
+
+		sum := body.Add(a, b)
+		decremented := body.Sub(n, body.ConstI32(1))
+		body.Jump(header)
+
+		a.AddIncoming(entry, first).AddIncoming(body, b)
+		b.AddIncoming(entry, second).AddIncoming(body, sum)
+		n.AddIncoming(entry, f.Param(0)).AddIncoming(body, decremented)
+
+		exit.Return(a)
+
+		runSSATest(t, NewSymbolTable(nil), f, []interface{}{50}, int64(12586269025))
+	})
+
+	t.Run("should split edges so that copies do not clobber live phi nodes", func(t *testing.T) {
+		// the loop exits from its latch, and the value of i from before the increment is returned
+		f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.I32})
+		entry, loop, exit := f.NewBlock(), f.NewBlock(), f.NewBlock()
+
+		zero := entry.ConstI32(0)
+		entry.Jump(loop)
+
+		i := loop.Phi(types.I32)
+		next := loop.Add(i, loop.ConstI32(1))
+		loop.Branch(loop.Lt(next, f.Param(0)), loop, exit)
+		i.AddIncoming(entry, zero).AddIncoming(loop, next)
+
+		exit.Return(i)
+
+		runSSATest(t, NewSymbolTable(nil), f, []interface{}{7}, int32(6))
+	})
+
+	t.Run("should merge values of branches that skip a block", func(t *testing.T) {
+		// absolute value, where the edge from the entry to the join is critical
+		f := NewSSAFunction([]types.WasmType{types.I64}, []types.WasmType{types.I64})
+		entry, negate, join := f.NewBlock(), f.NewBlock(), f.NewBlock()
+		x := f.Param(0)
+
+		entry.Branch(entry.Lt(x, entry.ConstI64(0)), negate, join)
+
+		negated := negate.Sub(negate.ConstI64(0), x)
+		negate.Jump(join)
+
+		join.Return(join.Phi(types.I64).AddIncoming(entry, x).AddIncoming(negate, negated))
+
+		runSSATest(t, NewSymbolTable(nil), f, []interface{}{int64(-42)}, int64(42))
+	})
+
+	t.Run("should keep single-use values on the operand stack", func(t *testing.T) {
+		f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.I32})
+		entry := f.NewBlock()
+		x := f.Param(0)
+		entry.Return(entry.Mul(entry.Add(x, entry.ConstI32(1)), entry.Add(x, entry.ConstI32(2))))
+
+		main := runSSATest(t, NewSymbolTable(nil), f, []interface{}{5}, int32(42))
+
+		body := []byte{
+			0x00,       // no locals
+			0x02, 0x40, // block
+			0x20, 0x00, // local.get 0
+			0x41, 0x01, // i32.const 1
+			0x6A,       // i32.add
+			0x20, 0x00, // local.get 0
+			0x41, 0x02, // i32.const 2
+			0x6A, // i32.add
+			0x6C, // i32.mul
+			0x0F, // return
+		}
+		if !bytes.Contains(main.sectionCode, body) {
+			t.Fatalf("expected function body %x in %x", body, main.sectionCode)
+		}
+	})
+
+	t.Run("should share locals between values that are not live at the same time", func(t *testing.T) {
+		f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.I32})
+		entry := f.NewBlock()
+
+		v := entry.Add(f.Param(0), entry.ConstI32(1))
+		for range 4 {
+			v = entry.Mul(v, v)
+		}
+		entry.Return(v)
+
+		main := runSSATest(t, NewSymbolTable(nil), f, []interface{}{0}, int32(1))
+
+		// a single local of type i32
+		if !bytes.HasPrefix(main.sectionCode[1:], []byte{0x01, 0x01, 0x7F}) {
+			t.Fatalf("expected one local in %x", main.sectionCode)
+		}
+	})
+
+	t.Run("should keep the order of calls with side effects", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		counter := wasmSymbolTable.AddGlobal(ValType(types.I32), true, NewWasmConstExpr().AddInstrConstI32(0))
+
+		// increments the counter and returns it, scaled by the factor
+		tick := func(factor int32) WasmFunctionModule {
+			return NewWasmFunctionBuilder(wasmSymbolTable).
+				AddReturn(types.I32).
+				AddExprSetGlobal(counter, GlobalI32(counter).Add(I32(1))).
+				AddExpr(GlobalI32(counter).Mul(I32(factor))).
+				AddInstrEnd().
+				Build()
+		}
+		tens := tick(10)
+		ones := tick(1)
+
+		f := NewSSAFunction(nil, []types.WasmType{types.I32})
+		entry := f.NewBlock()
+		a := entry.Call(&tens)
+		b := entry.Call(&ones)
+		entry.Return(entry.Sub(b, a))
+
+		main := f.Lower(wasmSymbolTable)
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&tens).
+			AddFunction(&ones).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{},
+			expected:   int32(2 - 10),
+		})
+	})
+
+	t.Run("should lower memory accesses and recursive calls", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		wasmSymbolTable.AddMemory(&WasmMemory{Min: 1})
+
+		// every call stores a half at address 8*n, and the halves stored by the recursion are added up
+		f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.F64})
+		entry, recurse, done := f.NewBlock(), f.NewBlock(), f.NewBlock()
+		n := f.Param(0)
+		addr := entry.Mul(n, entry.ConstI32(8))
+		entry.Store(addr, entry.Div(entry.ConstF64(float64(1)), entry.ConstF64(float64(2))), WasmMemArg{Align: 3})
+		entry.Branch(entry.Eqz(n), done, recurse)
+
+		rest := recurse.CallSelf(recurse.Sub(n, recurse.ConstI32(1)))
+		recurse.Return(recurse.Add(rest, recurse.Load(types.F64, addr, WasmMemArg{Align: 3})))
+
+		done.Return(done.ConstF64(0))
+
+		runSSATest(t, wasmSymbolTable, f, []interface{}{4}, float64(2))
+	})
+
+	t.Run("should report malformed functions", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			build    func(f *SSAFunction)
+			expected error
+		}{
+			{"missing terminator", func(f *SSAFunction) {
+				entry := f.NewBlock()
+				entry.ConstI32(1)
+			}, ErrInvalidSSA},
+			{"missing incoming value", func(f *SSAFunction) {
+				entry, then, join := f.NewBlock(), f.NewBlock(), f.NewBlock()
+				one := entry.ConstI32(1)
+				entry.Branch(f.Param(0), then, join)
+				then.Jump(join)
+				join.Return(join.Phi(types.I32).AddIncoming(entry, one))
+			}, ErrInvalidSSA},
+			{"use that is not dominated", func(f *SSAFunction) {
+				entry, then, join := f.NewBlock(), f.NewBlock(), f.NewBlock()
+				entry.Branch(f.Param(0), then, join)
+				value := then.ConstI32(1)
+				then.Jump(join)
+				join.Return(value)
+			}, ErrInvalidSSA},
+			{"operands of different types", func(f *SSAFunction) {
+				entry := f.NewBlock()
+				entry.Return(entry.Add(f.Param(0), entry.ConstI64(1)))
+			}, ErrTypeMismatch},
+		}
+
+		for _, c := range cases {
+			f := NewSSAFunction([]types.WasmType{types.I32}, []types.WasmType{types.I32})
+			c.build(f)
+
+			wasmSymbolTable := NewSymbolTable(nil)
+			main := f.Lower(wasmSymbolTable)
+			mod := NewWasmModuleBuilder(wasmSymbolTable).AddFunction(&main)
+			if err := mod.Err(); !errors.Is(err, c.expected) {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.expected, err)
+			}
+		}
+	})
+}
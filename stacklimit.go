@@ -0,0 +1,320 @@
+package gowasmtk
+
+import (
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// Makes the module trap with unreachable when its calls nest so deeply that their frames would
+// use more than limit stack slots. A global counts the slots of the active calls, which are
+// the locals and the estimated maximum operand stack height of every called function. Calls
+// from outside the module, through exports, tables, references and the start function, are
+// counted by thunks with the same signature as the functions they call.
+//
+// Functions that catch exceptions restore the count of their own entry when they do. A trap,
+// or an exception that is not caught in the module, leaves the frames that it unwound in the
+// count, so a host that calls the instance again afterwards must first call the exported
+// function named by StackLimitReset, which sets the count to zero.
+func WithStackLimit(limit uint32) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		LimitStackDepth(m, limit)
+		return nil
+	}
+}
+
+// The name of the export that resets the count of WithStackLimit.
+const StackLimitReset = "stack_limit_reset"
+
+// Applies the stack limit of WithStackLimit to the module.
+func LimitStackDepth(m *WasmDecodedModule, limit uint32) {
+	l := &wasmStackLimiter{
+		imported: uint32(m.importCount(types.ImportFunctionType)),
+		depth:    uint64(m.importCount(types.ImportGlobalType) + len(m.Globals)),
+		limit:    limit,
+	}
+	for f := range m.Code {
+		l.sizes = append(l.sizes, m.frameSize(f))
+	}
+
+	m.Globals = append(m.Globals, WasmDecodedGlobal{
+		Type:    WasmDecodedValType{Code: types.I32, Heap: noHeapType},
+		Mutable: true,
+		Init:    []WasmInstr{i32Const(0).instr(), Instr(WasmOpcode(instructions.End))},
+	})
+
+	for i, c := range m.Code {
+		body := []WasmInstr{}
+		for _, instr := range c.Body {
+			if instr.Opcode == WasmOpcode(instructions.CallFunc) && uint32(instr.Immediates[0]) >= l.imported {
+				body = append(body, l.call(instr)...)
+			} else {
+				body = append(body, instr)
+			}
+		}
+		m.Code[i].Body = body
+		l.restoreAtCatches(m, i)
+	}
+
+	// functions that are called from outside the module or indirectly
+	referenced := m.indirectTargets()
+	for _, e := range m.Exports {
+		if e.Kind == types.ExportFunctionType {
+			referenced[e.Index] = true
+		}
+	}
+	if m.Start != nil {
+		referenced[*m.Start] = true
+	}
+	for _, init := range m.initFunctions {
+		referenced[init.Function] = true
+	}
+
+	thunks := map[uint32]uint32{}
+	for f, referenced := range referenced {
+		if !referenced || uint32(f) < l.imported {
+			continue
+		}
+		typeIndex := m.Functions[uint32(f)-l.imported]
+		body := []WasmInstr{}
+		for p := range m.typeAt(typeIndex).Params {
+			body = append(body, Instr(WasmOpcode(instructions.GetLocal), uint64(p)))
+		}
+		body = append(body, l.call(Instr(WasmOpcode(instructions.CallFunc), uint64(f)))...)
+
+		thunks[uint32(f)] = l.imported + uint32(len(m.Code))
+		m.Functions = append(m.Functions, typeIndex)
+		m.Code = append(m.Code, WasmDecodedCode{Locals: []WasmDecodedLocals{}, Body: append(body, Instr(WasmOpcode(instructions.End)))})
+	}
+	redirectFunctions(m, thunks, false)
+
+	m.Functions = append(m.Functions, m.funcType(nil, nil))
+	m.Code = append(m.Code, WasmDecodedCode{Locals: []WasmDecodedLocals{}, Body: []WasmInstr{
+		i32Const(0).instr(),
+		Instr(WasmOpcode(instructions.GlobalSet), l.depth),
+		Instr(WasmOpcode(instructions.End)),
+	}})
+	m.Exports = append(m.Exports, WasmDecodedExport{Name: StackLimitReset, Kind: types.ExportFunctionType, Index: l.imported + uint32(len(m.Code)-1)})
+}
+
+type wasmStackLimiter struct {
+	imported uint32
+	// The stack slots of the defined functions.
+	sizes []uint32
+	depth uint64
+	limit uint32
+}
+
+// Makes the function restore the depth when it catches an exception, because the frames of
+// the calls that the exception unwound are not removed from it. The depth at the entry of the
+// function is kept in a new local, and written back where the labels of try_table catches
+// and the legacy catch clauses continue.
+func (l *wasmStackLimiter) restoreAtCatches(m *WasmDecodedModule, f int) {
+	c := &m.Code[f]
+	type frame struct {
+		open    int
+		loop    bool
+		landing bool
+	}
+	frames := []frame{{open: -1}}
+	after := map[int]bool{}
+	catches, returns := false, false
+	for i, instr := range c.Body {
+		switch op := instr.Opcode; {
+		case op == WasmOpcode(instructions.TryTable):
+			instr.visitImmediates(func(kind wasmImmediate, value *uint64) {
+				if kind != immLabel {
+					return
+				}
+				// the labels of the catches are outside of the try_table block
+				target := &frames[len(frames)-1-int(*value)]
+				if target.loop {
+					after[target.open] = true
+				}
+				target.landing, catches = true, true
+			})
+			frames = append(frames, frame{open: i})
+		case op.opensBlock():
+			frames = append(frames, frame{open: i, loop: op == WasmOpcode(instructions.Loop)})
+		case op == 0x07, op == 0x19: // catch and catch_all
+			after[i], catches = true, true
+		case op == WasmOpcode(instructions.End), op == 0x18: // end and delegate
+			switch top := frames[len(frames)-1]; {
+			case top.open < 0:
+				returns = top.landing
+			case top.landing && !top.loop:
+				after[i] = true
+			}
+			frames = frames[:len(frames)-1]
+		}
+	}
+	if !catches {
+		return
+	}
+
+	saved := uint64(len(m.typeAt(m.Functions[f]).Params))
+	for _, decl := range c.Locals {
+		saved += uint64(decl.Count)
+	}
+	c.Locals = append(c.Locals, WasmDecodedLocals{Count: 1, Type: WasmDecodedValType{Code: types.I32, Heap: noHeapType}})
+	restore := []WasmInstr{Instr(WasmOpcode(instructions.GetLocal), saved), Instr(WasmOpcode(instructions.GlobalSet), l.depth)}
+
+	body := []WasmInstr{Instr(WasmOpcode(instructions.GlobalGet), l.depth), Instr(WasmOpcode(instructions.SetLocal), saved)}
+	for i, instr := range c.Body {
+		// a catch to the label of the function continues with its return
+		if i == len(c.Body)-1 && returns {
+			body = append(body, restore...)
+		}
+		body = append(body, instr)
+		if after[i] {
+			body = append(body, restore...)
+		}
+	}
+	c.Body = body
+}
+
+// Returns the instructions that count the frame of the call, trap if the limit is exceeded,
+// make the call, and remove the frame again.
+func (l *wasmStackLimiter) call(instr WasmInstr) []WasmInstr {
+	size := l.sizes[uint32(instr.Immediates[0])-l.imported]
+	return []WasmInstr{
+		Instr(WasmOpcode(instructions.GlobalGet), l.depth),
+		i32Const(size).instr(),
+		Instr(WasmOpcode(instructions.AddI32)),
+		Instr(WasmOpcode(instructions.GlobalSet), l.depth),
+		Instr(WasmOpcode(instructions.GlobalGet), l.depth),
+		i32Const(l.limit).instr(),
+		Instr(WasmOpcode(instructions.GreaterThanUnsignedI32)),
+		Instr(WasmOpcode(instructions.If), blockTypeImmediates(WasmDecodedValType{Code: types.EmptyType, Heap: noHeapType})...),
+		Instr(WasmOpcode(instructions.Unreachable)),
+		Instr(WasmOpcode(instructions.End)),
+		instr,
+		Instr(WasmOpcode(instructions.GlobalGet), l.depth),
+		i32Const(size).instr(),
+		Instr(WasmOpcode(instructions.SubI32)),
+		Instr(WasmOpcode(instructions.GlobalSet), l.depth),
+	}
+}
+
+// Returns for every function whether it can be called by an indirect call, because it is in
+// a table or referenced by an expression.
+func (m *WasmDecodedModule) indirectTargets() []bool {
+	targets := make([]bool, m.importCount(types.ImportFunctionType)+len(m.Code))
+	expr := func(body []WasmInstr) {
+		for i, instr := range body {
+			if instr.Opcode == WasmOpcode(instructions.CallFunc) || instr.Opcode == WasmOpcode(instructions.ReturnCall) {
+				continue
+			}
+			body[i].visitImmediates(func(kind wasmImmediate, value *uint64) {
+				if kind == immFunc {
+					targets[*value] = true
+				}
+			})
+		}
+	}
+
+	for _, e := range m.Elements {
+		for _, f := range e.Funcs {
+			targets[f] = true
+		}
+		for _, init := range e.Exprs {
+			expr(init)
+		}
+	}
+	for _, g := range m.Globals {
+		expr(g.Init)
+	}
+	for _, t := range m.Tables {
+		expr(t.Init)
+	}
+	for _, c := range m.Code {
+		expr(c.Body)
+	}
+	return targets
+}
+
+// Returns an estimate of the stack slots that a call of the defined function uses, which are
+// its parameters and locals and the maximum height of its operand stack.
+func (m *WasmDecodedModule) frameSize(f int) uint32 {
+	size := uint32(len(m.typeAt(m.Functions[f]).Params))
+	for _, l := range m.Code[f].Locals {
+		size += l.Count
+	}
+	return size + m.maxStackHeight(m.Code[f].Body)
+}
+
+// Returns the number of parameters and results of the block type of the instruction.
+func (m *WasmDecodedModule) blockArity(instr WasmInstr) (int, int) {
+	params, results := m.blockSignature(instr)
+	return len(params), len(results)
+}
+
+// Returns the parameters and results of the block type of the instruction.
+func (m *WasmDecodedModule) blockSignature(instr WasmInstr) ([]WasmDecodedValType, []WasmDecodedValType) {
+	switch t := int64(instr.Immediates[0]); {
+	case t == int64(types.EmptyType)-0x80:
+		return nil, nil
+	case t < 0:
+		return nil, []WasmDecodedValType{{Code: types.WasmType(t + 0x80), Heap: int64(instr.Immediates[1])}}
+	default:
+		blockType := m.typeAt(uint32(t))
+		return blockType.Params, blockType.Results
+	}
+}
+
+// Returns an upper bound of the height of the operand stack during the execution of the body.
+// Instructions whose effect on the stack is not known are assumed to push a value.
+func (m *WasmDecodedModule) maxStackHeight(body []WasmInstr) uint32 {
+	type frame struct{ start, params, results int }
+	frames := []frame{{}}
+	height, highest := 0, 0
+
+	for _, instr := range body {
+		f := frames[len(frames)-1]
+		switch op := instr.Opcode; op {
+		case WasmOpcode(instructions.Block), WasmOpcode(instructions.Loop), WasmOpcode(instructions.If),
+			WasmOpcode(instructions.TryTable), 0x06: // try
+			if op == WasmOpcode(instructions.If) {
+				height--
+			}
+			params, results := m.blockArity(instr)
+			frames = append(frames, frame{height - params, params, results})
+		case WasmOpcode(instructions.Else):
+			height = f.start + f.params
+		case 0x07: // catch
+			height = f.start
+			if tag := m.tagType(uint32(instr.Immediates[0])); tag != nil {
+				height += len(tag.Params)
+			}
+		case 0x19: // catch_all
+			height = f.start
+		case WasmOpcode(instructions.End), 0x18: // delegate
+			height = f.start + f.results
+			if len(frames) > 1 {
+				frames = frames[:len(frames)-1]
+			}
+		case WasmOpcode(instructions.Br), WasmOpcode(instructions.BrTable), WasmOpcode(instructions.Return),
+			WasmOpcode(instructions.Unreachable), WasmOpcode(instructions.Throw), WasmOpcode(instructions.ThrowRef),
+			0x09, // rethrow
+			WasmOpcode(instructions.ReturnCall), WasmOpcode(instructions.ReturnCallIndirect), WasmOpcode(instructions.ReturnCallRef):
+			// the rest of the block is not reachable
+			height = f.start
+		case WasmOpcode(instructions.CallFunc):
+			if index, ok := m.funcTypeIndex(uint32(instr.Immediates[0])); ok {
+				t := m.typeAt(index)
+				height += len(t.Results) - len(t.Params)
+			}
+		case WasmOpcode(instructions.CallIndirect), WasmOpcode(instructions.CallRef):
+			t := m.typeAt(uint32(instr.Immediates[0]))
+			height += len(t.Results) - len(t.Params) - 1
+		default:
+			effect, ok := stackEffect(op)
+			if !ok {
+				effect = 1
+			}
+			height += effect
+		}
+		height = max(height, 0)
+		highest = max(highest, height)
+	}
+	return uint32(highest)
+}
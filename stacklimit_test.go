@@ -0,0 +1,171 @@
+package gowasmtk
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+func TestStackLimit(t *testing.T) {
+	t.Run("should trap when recursion exceeds the limit", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+
+		// sums n + (n-1) + ... + 0 recursively
+		sum := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(IfElse(
+				LocalI32(0).Eqz(),
+				I32(0),
+				LocalI32(0).Add(CallSelf[I32Expr](LocalI32(0).Sub(I32(1)))),
+			)).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&sum).
+			Export("sum", types.ExportFunctionType, &sum)
+
+		m, _ := DecodeModule(mod.Build())
+		size := int32(m.frameSize(0))
+		if size < 3 {
+			t.Fatalf("expected the frame of sum to hold the parameter and at least two values, got %d", size)
+		}
+
+		const limit = 1000
+		wasm := mod.Build(WithStackLimit(limit))
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		instance := instantiate(t, wasmer.NewStore(wasmer.NewEngine()), wasm, nil)
+		run, _ := instance.Exports.GetFunction("sum")
+
+		// the thunk of the export counts the first call
+		n := limit/size - 1
+		if result, err := run(n); err != nil || result != n*(n+1)/2 {
+			t.Fatalf("expected %d for %d nested calls, got %v and %v", n*(n+1)/2, n+1, result, err)
+		}
+		if _, err := run(n + 1); err == nil {
+			t.Fatalf("expected %d nested calls to exceed the limit", n+2)
+		}
+	})
+
+	t.Run("should call exports and table elements through thunks", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		table := &WasmTable{RefType: types.FuncRef, Min: 1}
+
+		seven := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(7).
+			AddInstrEnd().
+			Build()
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrConstI32(0).
+			AddInstrCallIndirect(0, nil, []types.WasmType{types.I32}).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&seven).
+			AddFunction(&main).
+			AddTable(table).
+			AddElements(table, 0, &seven).
+			Export("main", types.ExportFunctionType, &main)
+
+		m, err := DecodeModule(mod.Build(WithStackLimit(100)))
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		// the thunks of seven and main follow the original functions, and the reset follows them
+		if len(m.Functions) != 5 || m.Elements[0].Funcs[0] != 2 || m.Exports[0].Index != 3 {
+			t.Fatalf("expected the table and export to refer to thunks, got %+v and %+v", m.Elements, m.Exports)
+		}
+
+		checkRoundTrip(t, mod.Build(WithStackLimit(100)))
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			expected:   int32(7),
+			options:    []WasmBuildOption{WithStackLimit(100)},
+		})
+	})
+	t.Run("should restore the depth where exceptions are caught", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		tag := wasmSymbolTable.AddTag()
+
+		fail := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddInstrThrow(tag).
+			AddInstrEnd().
+			Build()
+		// calls fail n times, catching every exception inside the loop
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrLoop(types.EmptyType).
+			AddInstrBlock(types.EmptyType).
+			AddInstrTryTable(types.EmptyType, CatchAll(0)).
+			AddInstrConstI32(0).
+			AddInstrCall(&fail).
+			AddInstrEnd().
+			AddInstrEnd().
+			AddInstrGetLocal(0).
+			AddInstrConstI32(1).
+			AddInstrSubI32().
+			AddInstrLocalTee(0).
+			AddInstrBrIf(0).
+			AddInstrEnd().
+			AddInstrConstI32(1).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&fail).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+		m, err := DecodeModule(mod.Build(WithStackLimit(100)))
+		if err != nil || mod.Err() != nil {
+			t.Fatalf("unexpected errors: %v and %v", err, mod.Err())
+		}
+
+		same := func(a, b WasmInstr) bool {
+			return a.Opcode == b.Opcode && slices.Equal(a.Immediates, b.Immediates)
+		}
+		depth := uint64(len(m.Globals) - 1)
+		body := m.Code[1].Body
+		saved := Instr(WasmOpcode(instructions.GetLocal), 1)
+		restore := Instr(WasmOpcode(instructions.GlobalSet), depth)
+		if len(m.Code[1].Locals) != 1 || !slices.EqualFunc(body[:2], []WasmInstr{
+			Instr(WasmOpcode(instructions.GlobalGet), depth), Instr(WasmOpcode(instructions.SetLocal), 1),
+		}, same) {
+			t.Fatalf("expected the depth to be saved at the entry of main, got %+v", body[:2])
+		}
+
+		// the catch branches to the end of the block, where the depth is restored
+		restores := 0
+		for i := 2; i < len(body); i++ {
+			if same(body[i], restore) && same(body[i-1], saved) {
+				restores++
+				if body[i-2].Opcode != WasmOpcode(instructions.End) || body[i+1].Opcode != WasmOpcode(instructions.GetLocal) {
+					t.Fatalf("expected the depth to be restored after the block, got %+v", body[i-2:i+2])
+				}
+			}
+		}
+		if restores != 1 {
+			t.Fatalf("expected the depth to be restored once, got %d", restores)
+		}
+		if len(m.Code[0].Locals) > 0 {
+			t.Fatalf("expected no local in fail, which catches nothing")
+		}
+
+		reset := m.Exports[len(m.Exports)-1]
+		if reset.Name != StackLimitReset || !same(m.Code[reset.Index].Body[1], restore) {
+			t.Fatalf("expected the reset export to set the depth, got %+v", reset)
+		}
+	})
+}
@@ -1,15 +1,33 @@
 package gowasmtk
 
 type wasmSymbolTable struct {
-	functionTypes []wasmSectionFunctionType
-	functions     []WasmFunctionModule
-	imports       *[]WasmImportDeclaration
+	typeGroups       []*wasmRecGroup
+	functions        []WasmFunctionModule
+	imports          *[]WasmImportDeclaration
+	tags             []*WasmTag
+	memories         []*WasmMemory
+	globals          []*WasmGlobal
+	data             []*WasmDataSymbol
+	err              error
+	typeCount        int
+	importedTags     int
+	importedMemories int
+	importedGlobals  int
 }
 
 func NewSymbolTable(imports *[]WasmImportDeclaration) *wasmSymbolTable {
 	return &wasmSymbolTable{
-		functionTypes: []wasmSectionFunctionType{},
-		functions:     []WasmFunctionModule{},
-		imports:       imports,
+		typeGroups: []*wasmRecGroup{},
+		functions:  []WasmFunctionModule{},
+		imports:    imports,
+		tags:       []*WasmTag{},
+		memories:   []*WasmMemory{},
+		globals:    []*WasmGlobal{},
+	}
+}
+
+func (s *wasmSymbolTable) fail(err error) {
+	if s.err == nil {
+		s.err = err
 	}
 }
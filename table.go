@@ -0,0 +1,98 @@
+package gowasmtk
+
+import (
+	"fmt"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmTable describes a table of references, such as the function table used by indirect
+// calls. The index of the table is assigned when it is added to a module.
+type WasmTable struct {
+	RefType types.PrimitiveType
+	Min     uint32
+	Max     uint32
+	HasMax  bool
+	index   int
+}
+
+func (t *WasmTable) GetIndex() int {
+	return t.index
+}
+
+func (t *WasmTable) validate() error {
+	if t.HasMax && t.Min > t.Max {
+		return fmt.Errorf("%w: minimum %d is larger than maximum %d", ErrInvalidTableLimits, t.Min, t.Max)
+	}
+	return nil
+}
+
+// Adds an indirect call through the table with the given index. The signature of the callee
+// is checked at runtime against the given parameter and result types.
+func (b *WasmFunctionBuilder) AddInstrCallIndirect(tableIndex uint32, paramTypes []types.WasmType, resultTypes []types.WasmType) *WasmFunctionBuilder {
+	typeIndex := b.symbolTable.internFuncType(paramTypes, resultTypes)
+	if tableIndex != 0 {
+		b.use(FeatureReferenceTypes)
+	}
+
+	b.instructions = append(b.instructions, instructions.CallIndirect)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(typeIndex))...)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(tableIndex))...)
+	return b
+}
+
+// Defines a table in the module and assigns its index, so that it can be filled with
+// AddElements and exported with the ExportTableType export type.
+func (b *WasmModuleBuilder) AddTable(table *WasmTable) *WasmModuleBuilder {
+	if err := table.validate(); err != nil {
+		b.fail(err)
+		return b
+	}
+
+	table.index = len(b.sectionTables)
+	if table.index > 0 || table.RefType != types.FuncRef {
+		b.usedFeatures |= FeatureReferenceTypes
+	}
+	b.sectionTables = append(b.sectionTables, tableType(table))
+	b.tables = append(b.tables, table)
+
+	return b
+}
+
+// Places references to the given functions into a table, starting at the offset, when the
+// module is instantiated.
+func (b *WasmModuleBuilder) AddElements(table *WasmTable, offset uint32, functions ...*WasmFunctionModule) *WasmModuleBuilder {
+	return b.AddElementsAt(table, NewWasmConstExpr().AddInstrConstI32(int32(offset)), functions...)
+}
+
+// Places references to the given functions into a table, starting at the i32 offset computed
+// by the constant expression, such as __table_base plus an offset. The table must be a funcref
+// table added to this module.
+func (b *WasmModuleBuilder) AddElementsAt(table *WasmTable, offset *WasmConstExpr, functions ...*WasmFunctionModule) *WasmModuleBuilder {
+	if table == nil || table.index >= len(b.tables) || b.tables[table.index] != table {
+		b.fail(fmt.Errorf("%w: elements for a table that is not added to the module", ErrUnknownTable))
+		return b
+	}
+	if table.RefType != types.FuncRef {
+		b.fail(fmt.Errorf("%w: function elements for a table of type 0x%X", ErrTypeMismatch, table.RefType))
+		return b
+	}
+	if err := offset.validate(b.symbolTable, ValType(types.I32), len(b.symbolTable.globals)); err != nil {
+		b.fail(err)
+		return b
+	}
+	b.usedFeatures |= offset.requiredFeatures()
+	if table.GetIndex() != 0 {
+		b.usedFeatures |= FeatureReferenceTypes
+	}
+
+	funcIndices := []uint64{}
+	for _, f := range functions {
+		funcIndices = append(funcIndices, uint64(f.GetIndex()))
+	}
+
+	b.sectionElements = append(b.sectionElements, elementSegment(table.GetIndex(), offset, funcIndices))
+
+	return b
+}
@@ -0,0 +1,77 @@
+package gowasmtk
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// A tail call returns the results of the callee to the caller of the current function, so
+// the callee must produce exactly the results of the current function.
+func (b *WasmFunctionBuilder) checkTailCallResults(resultTypes []WasmValueType) bool {
+	if !slices.Equal(resultTypes, b.resultTypes) {
+		b.fail(fmt.Errorf("%w: callee returns %v, caller returns %v", ErrTailCallResults, resultTypes, b.resultTypes))
+		return false
+	}
+	return true
+}
+
+// Adds a return_call to the function, which replaces the current call frame instead of
+// growing the stack. The results of the callee must match the results of this function.
+func (b *WasmFunctionBuilder) AddInstrReturnCall(f *WasmFunctionModule) *WasmFunctionBuilder {
+	if !b.checkTailCallResults(f.resultTypes) {
+		return b
+	}
+
+	b.use(FeatureTailCall)
+	b.instructions = append(b.instructions, instructions.ReturnCall)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(f.GetIndex()))...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrReturnCallImport(f *WasmImportDeclaration) *WasmFunctionBuilder {
+	if !b.checkTailCallResults(valTypes(f.ResultTypes)) {
+		return b
+	}
+
+	index := -1
+	if b.symbolTable.imports != nil {
+		index = slices.IndexFunc(*b.symbolTable.imports, func(imp WasmImportDeclaration) bool {
+			return imp.ModuleName == f.ModuleName && imp.FunctionName == f.FunctionName
+		})
+	}
+	if index < 0 {
+		b.fail(fmt.Errorf("%w: %s.%s is not imported", ErrUnknownFunction, f.ModuleName, f.FunctionName))
+		return b
+	}
+
+	b.use(FeatureTailCall)
+	b.instructions = append(b.instructions, instructions.ReturnCall)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(index))...)
+	return b
+}
+
+// Adds a tail call of the function being built. Unlike AddInstrCallSelf, recursion through
+// a tail call runs in constant stack space, so it can be used to express loops.
+func (b *WasmFunctionBuilder) AddInstrReturnCallSelf() *WasmFunctionBuilder {
+	b.use(FeatureTailCall)
+	b.instructions = append(b.instructions, instructions.ReturnCall)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(b.codeIndex))...)
+	return b
+}
+
+func (b *WasmFunctionBuilder) AddInstrReturnCallIndirect(tableIndex uint32, paramTypes []types.WasmType, resultTypes []types.WasmType) *WasmFunctionBuilder {
+	if !b.checkTailCallResults(valTypes(resultTypes)) {
+		return b
+	}
+
+	typeIndex := b.symbolTable.internFuncType(paramTypes, resultTypes)
+
+	b.use(FeatureTailCall)
+	b.instructions = append(b.instructions, instructions.ReturnCallIndirect)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(typeIndex))...)
+	b.instructions = append(b.instructions, leb128EncodeU(uint64(tableIndex))...)
+	return b
+}
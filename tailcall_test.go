@@ -0,0 +1,182 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+func TestTailCall(t *testing.T) {
+	t.Run("should encode tail calls", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		// sum(n, acc) returns acc + n + (n - 1) + ... + 1 using a tail call instead of a loop
+		sum := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrEqzI32().
+			AddInstrIf(types.I32).
+			AddInstrGetLocal(1).
+			AddInstrElse().
+			AddInstrGetLocal(0).
+			AddInstrConstI32(1).
+			AddInstrSubI32().
+			AddInstrGetLocal(1).
+			AddInstrGetLocal(0).
+			AddInstrAddI32().
+			AddInstrReturnCallSelf().
+			AddInstrEnd().
+			AddInstrEnd().
+			Build()
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrConstI32(0).
+			AddInstrReturnCall(&sum).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&sum).
+			AddFunction(&main).
+			Export("main", types.ExportFunctionType, &main)
+
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		wasm := mod.Build()
+
+		selfCall := []byte{0x6A, 0x12, 0x00, 0x0B, 0x0B}
+		if !bytes.Contains(wasm, selfCall) {
+			t.Fatalf("expected return_call 0 %x in %x", selfCall, wasm)
+		}
+
+		mainCall := []byte{0x20, 0x00, 0x41, 0x00, 0x12, 0x00, 0x0B}
+		if !bytes.Contains(wasm, mainCall) {
+			t.Fatalf("expected return_call 0 %x in %x", mainCall, wasm)
+		}
+	})
+
+	t.Run("should reject tail calls with mismatching results", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		callee := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I64).
+			AddInstrConstI64(1).
+			AddInstrEnd().
+			Build()
+
+		caller := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddReturn(types.I32).
+			AddInstrReturnCall(&callee)
+
+		if err := caller.Err(); !errors.Is(err, ErrTailCallResults) {
+			t.Fatalf("expected %v, got %v", ErrTailCallResults, err)
+		}
+
+		caller = NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrReturnCallIndirect(0, []types.WasmType{}, []types.WasmType{types.I32})
+
+		if err := caller.Err(); !errors.Is(err, ErrTailCallResults) {
+			t.Fatalf("expected %v, got %v", ErrTailCallResults, err)
+		}
+	})
+
+	t.Run("should reject tail calls of functions that are not imported", func(t *testing.T) {
+		imports := []WasmImportDeclaration{
+			{ModuleName: "env", FunctionName: "log", ParamTypes: []types.WasmType{}, ResultTypes: []types.WasmType{}},
+		}
+		missing := WasmImportDeclaration{ModuleName: "env", FunctionName: "exit", ParamTypes: []types.WasmType{}, ResultTypes: []types.WasmType{}}
+
+		for _, symbolTable := range []*wasmSymbolTable{NewSymbolTable(&imports), NewSymbolTable(nil)} {
+			caller := NewWasmFunctionBuilder(symbolTable).
+				AddInstrReturnCallImport(&missing)
+
+			if err := caller.Err(); !errors.Is(err, ErrUnknownFunction) {
+				t.Fatalf("expected %v, got %v", ErrUnknownFunction, err)
+			}
+		}
+	})
+
+	t.Run("should call functions indirectly through a table", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		double := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrGetLocal(0).
+			AddInstrAddI32().
+			AddInstrEnd().
+			Build()
+
+		square := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrGetLocal(0).
+			AddInstrMulI32().
+			AddInstrEnd().
+			Build()
+
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			// call the function at table slot 2 with the parameter
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrConstI32(2).
+			AddInstrCallIndirect(0, []types.WasmType{types.I32}, []types.WasmType{types.I32}).
+			AddInstrEnd().
+			Build()
+
+		table := &WasmTable{RefType: types.FuncRef, Min: 3}
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&double).
+			AddFunction(&square).
+			AddFunction(&main).
+			AddTable(table).
+			AddElements(table, 1, &double, &square).
+			Export("main", types.ExportFunctionType, &main)
+
+		runModValueTest(t, apiTestCase{
+			input:      mod,
+			nameOfMain: "main",
+			args:       []interface{}{7},
+			expected:   int32(49),
+		})
+	})
+
+	t.Run("should reject elements for tables that cannot hold them", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		f := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddInstrEnd().
+			Build()
+
+		cases := map[string]struct {
+			table    *WasmTable
+			added    bool
+			expected error
+		}{
+			"table of another module": {&WasmTable{RefType: types.FuncRef, Min: 1}, false, ErrUnknownTable},
+			"missing table":           {nil, false, ErrUnknownTable},
+			"externref table":         {&WasmTable{RefType: types.ExternRef, Min: 1}, true, ErrTypeMismatch},
+		}
+		for name, c := range cases {
+			mod := NewWasmModuleBuilder(wasmSymbolTable).
+				AddFunction(&f).
+				AddTable(&WasmTable{RefType: types.FuncRef, Min: 1})
+			if c.added {
+				mod.AddTable(c.table)
+			}
+			mod.AddElements(c.table, 0, &f)
+
+			if err := mod.Err(); !errors.Is(err, c.expected) {
+				t.Fatalf("%s: expected %v, got %v", name, c.expected, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package gowasmtk
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/Orphoros/gowasmtk/instructions"
+	"github.com/Orphoros/gowasmtk/types"
+)
+
+// WasmTraceHooks names the imported functions of Module that an instrumented function calls
+// with its index as an i32 when it is entered and when it returns. Exit is not called when the
+// function traps or throws.
+type WasmTraceHooks struct {
+	Module string
+	Enter  string
+	Exit   string
+}
+
+// Calls the hooks at the entry and exit of every defined function. The functions are numbered
+// as in the instrumented module, after the imports of the hooks.
+func WithCallTracing(hooks WasmTraceHooks) WasmBuildOption {
+	return func(m *WasmDecodedModule) error {
+		InstrumentCalls(m, hooks)
+		return nil
+	}
+}
+
+// Applies the instrumentation of WithCallTracing to the module.
+func InstrumentCalls(m *WasmDecodedModule, hooks WasmTraceHooks) {
+	i32 := WasmDecodedValType{Code: types.I32, Heap: noHeapType}
+	hookType := m.funcType([]WasmDecodedValType{i32}, []WasmDecodedValType{})
+	enter := addFunctionImport(m, hooks.Module, hooks.Enter, hookType)
+	exit := addFunctionImport(m, hooks.Module, hooks.Exit, hookType)
+	imported := uint32(m.importCount(types.ImportFunctionType))
+
+	for i, c := range m.Code {
+		f := i32Const(imported + uint32(i)).instr()
+		call := func(hook uint32) []WasmInstr {
+			return []WasmInstr{f, Instr(WasmOpcode(instructions.CallFunc), uint64(hook))}
+		}
+
+		// the body runs in a block, so that returns can branch to the exit hook
+		body := append(call(enter), Instr(WasmOpcode(instructions.Block), m.blockType(m.typeAt(m.Functions[i]).Results)...))
+		depth := 0
+		for _, instr := range c.Body {
+			switch op := instr.Opcode; {
+			case op.opensBlock():
+				depth++
+			case op == WasmOpcode(instructions.End):
+				depth--
+			case op == WasmOpcode(instructions.Return):
+				instr = Instr(WasmOpcode(instructions.Br), uint64(depth))
+			case op == WasmOpcode(instructions.ReturnCall), op == WasmOpcode(instructions.ReturnCallIndirect),
+				op == WasmOpcode(instructions.ReturnCallRef):
+				body = append(body, call(exit)...)
+			}
+			body = append(body, instr)
+		}
+		m.Code[i].Body = append(append(body, call(exit)...), Instr(WasmOpcode(instructions.End)))
+	}
+}
+
+// WasmTraceEvent is a call of the enter or exit hook of a function, at a time in nanoseconds.
+type WasmTraceEvent struct {
+	Function uint32
+	Exit     bool
+	Time     int64
+}
+
+// Writes the events of the instrumented module as a gzipped pprof profile, with the number of
+// calls and the time spent in every call stack, not counting the time of the calls it makes.
+// Functions are named after the name section of the module. Calls that have not returned at
+// the last event end at its time.
+func WriteTraceProfile(w io.Writer, m *WasmDecodedModule, events []WasmTraceEvent) error {
+	p := &wasmProfile{strings: map[string]uint64{}, samples: map[string]int{}, locations: map[uint32]uint64{}}
+	p.string("")
+
+	type frame struct {
+		function uint32
+		start    int64
+		// the time spent in the calls that the frame made
+		children int64
+	}
+	stack := []frame{}
+	pop := func(end int64) {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		functions := []uint32{}
+		for _, caller := range stack {
+			functions = append(functions, caller.function)
+		}
+		p.sample(append(functions, f.function), end-f.start-f.children)
+		if len(stack) > 0 {
+			stack[len(stack)-1].children += end - f.start
+		}
+	}
+
+	var start, end int64
+	for k, e := range events {
+		if k == 0 {
+			start = e.Time
+		}
+		end = e.Time
+		if !e.Exit {
+			stack = append(stack, frame{function: e.Function, start: e.Time})
+			continue
+		}
+		// exits of functions that trapped are missing
+		for len(stack) > 0 && stack[len(stack)-1].function != e.Function {
+			pop(e.Time)
+		}
+		if len(stack) > 0 {
+			pop(e.Time)
+		}
+	}
+	for len(stack) > 0 {
+		pop(end)
+	}
+
+	names := m.functionNames()
+	profile := []byte{}
+	for _, t := range [][2]string{{"calls", "count"}, {"time", "nanoseconds"}} {
+		profile = append(profile, protoMessage(1, append(protoVarint(1, p.string(t[0])), protoVarint(2, p.string(t[1]))...))...)
+	}
+	for _, s := range p.sampleList {
+		profile = append(profile, protoMessage(2, append(protoPacked(1, s.locations), protoPacked(2, []uint64{s.calls, uint64(s.time)})...))...)
+	}
+	for _, f := range p.functions {
+		id := p.locations[f]
+		line := append(protoVarint(1, id), protoVarint(2, 0)...)
+		profile = append(profile, protoMessage(4, append(protoVarint(1, id), protoMessage(4, line)...))...)
+		profile = append(profile, protoMessage(5, append(protoVarint(1, id), protoVarint(2, p.string(names[f]))...))...)
+	}
+	// the names of the functions are added to the strings above
+	for _, s := range p.stringList {
+		profile = append(profile, protoMessage(6, []byte(s))...)
+	}
+	profile = append(profile, protoVarint(9, uint64(start))...)
+	profile = append(profile, protoVarint(10, uint64(end-start))...)
+
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(profile); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// wasmProfile collects the samples of a pprof profile. Every function has a location with the
+// same id.
+type wasmProfile struct {
+	strings    map[string]uint64
+	stringList []string
+	samples    map[string]int
+	sampleList []wasmProfileSample
+	locations  map[uint32]uint64
+	functions  []uint32
+}
+
+type wasmProfileSample struct {
+	// The locations of the call stack, starting with the innermost call.
+	locations []uint64
+	calls     uint64
+	time      int64
+}
+
+// Returns the index of the string in the string table, and adds it if it is not there.
+func (p *wasmProfile) string(s string) uint64 {
+	if index, ok := p.strings[s]; ok {
+		return index
+	}
+	p.strings[s] = uint64(len(p.stringList))
+	p.stringList = append(p.stringList, s)
+	return p.strings[s]
+}
+
+// Adds a call with the given call stack, outermost call first, and time.
+func (p *wasmProfile) sample(functions []uint32, time int64) {
+	locations := []uint64{}
+	for k := len(functions) - 1; k >= 0; k-- {
+		f := functions[k]
+		if _, ok := p.locations[f]; !ok {
+			p.locations[f] = uint64(len(p.functions) + 1)
+			p.functions = append(p.functions, f)
+		}
+		locations = append(locations, p.locations[f])
+	}
+
+	key := string(protoPacked(1, locations))
+	index, ok := p.samples[key]
+	if !ok {
+		index = len(p.sampleList)
+		p.samples[key] = index
+		p.sampleList = append(p.sampleList, wasmProfileSample{locations: locations})
+	}
+	p.sampleList[index].calls++
+	p.sampleList[index].time += time
+}
+
+// Protocol buffer fields, whose varints are encoded like unsigned LEB128.
+func protoVarint(field int, v uint64) []byte {
+	return append(leb128EncodeU(uint64(field<<3)), leb128EncodeU(v)...)
+}
+
+func protoMessage(field int, contents []byte) []byte {
+	return append(append(leb128EncodeU(uint64(field<<3|2)), leb128EncodeU(uint64(len(contents)))...), contents...)
+}
+
+func protoPacked(field int, values []uint64) []byte {
+	contents := []byte{}
+	for _, v := range values {
+		contents = append(contents, leb128EncodeU(v)...)
+	}
+	return protoMessage(field, contents)
+}
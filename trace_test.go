@@ -0,0 +1,151 @@
+package gowasmtk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/Orphoros/gowasmtk/types"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+type protoField struct {
+	field    int
+	value    uint64
+	contents []byte
+}
+
+// Splits a protocol buffer message into its varint and length-delimited fields.
+func protoFields(t *testing.T, message []byte) []protoField {
+	t.Helper()
+	r := &wasmReader{data: message}
+	fields := []protoField{}
+	for !r.done() {
+		key := r.u64()
+		f := protoField{field: int(key >> 3)}
+		if key&7 == 2 {
+			f.contents = r.bytes(r.u64())
+		} else {
+			f.value = r.u64()
+		}
+		fields = append(fields, f)
+	}
+	if r.err != nil {
+		t.Fatalf("malformed message: %v", r.err)
+	}
+	return fields
+}
+
+func protoUnpack(t *testing.T, packed []byte) []uint64 {
+	t.Helper()
+	r := &wasmReader{data: packed}
+	values := []uint64{}
+	for !r.done() {
+		values = append(values, r.u64())
+	}
+	return values
+}
+
+func TestCallTracing(t *testing.T) {
+	t.Run("should call the hooks around calls and returns and write a profile", func(t *testing.T) {
+		wasmSymbolTable := NewSymbolTable(nil)
+		sq := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddInstrGetLocal(0).
+			AddInstrGetLocal(0).
+			AddInstrMulI32().
+			AddInstrReturn().
+			AddInstrEnd().
+			Build()
+		main := NewWasmFunctionBuilder(wasmSymbolTable).
+			AddParam(types.I32).
+			AddReturn(types.I32).
+			AddExpr(Call[I32Expr](&sq, LocalI32(0)).Add(Call[I32Expr](&sq, LocalI32(0).Add(I32(1))))).
+			AddInstrEnd().
+			Build()
+
+		mod := NewWasmModuleBuilder(wasmSymbolTable).
+			AddFunction(&sq).
+			AddFunction(&main).
+			Export("sq", types.ExportFunctionType, &sq).
+			Export("main", types.ExportFunctionType, &main)
+
+		wasm := mod.Build(WithCallTracing(WasmTraceHooks{Module: "env", Enter: "enter", Exit: "exit"}))
+		if err := mod.Err(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		store := wasmer.NewStore(wasmer.NewEngine())
+		events := []WasmTraceEvent{}
+		hook := func(exit bool) *wasmer.Function {
+			return wasmer.NewFunction(store,
+				wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes()),
+				func(args []wasmer.Value) ([]wasmer.Value, error) {
+					events = append(events, WasmTraceEvent{Function: uint32(args[0].I32()), Exit: exit, Time: int64(10 * len(events))})
+					return []wasmer.Value{}, nil
+				})
+		}
+		instance := instantiate(t, store, wasm, map[string]wasmer.IntoExtern{"enter": hook(false), "exit": hook(true)})
+		run, _ := instance.Exports.GetFunction("main")
+		if result, err := run(3); err != nil || result != int32(25) {
+			t.Fatalf("expected 25, got %v and %v", result, err)
+		}
+
+		// the hooks are imported before sq and main
+		expected := []WasmTraceEvent{
+			{3, false, 0}, {2, false, 10}, {2, true, 20}, {2, false, 30}, {2, true, 40}, {3, true, 50},
+		}
+		if !slices.Equal(events, expected) {
+			t.Fatalf("expected events %v, got %v", expected, events)
+		}
+
+		m, err := DecodeModule(wasm)
+		if err != nil {
+			t.Fatalf("unexpected decode error: %v", err)
+		}
+		var profile bytes.Buffer
+		if err := WriteTraceProfile(&profile, m, events); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		z, err := gzip.NewReader(&profile)
+		if err != nil {
+			t.Fatalf("expected a gzipped profile: %v", err)
+		}
+		message, _ := io.ReadAll(z)
+
+		strings := []string{}
+		functions := map[uint64]string{}
+		samples := map[string][]uint64{}
+		fields := protoFields(t, message)
+		for _, f := range fields {
+			if f.field == 6 {
+				strings = append(strings, string(f.contents))
+			}
+		}
+		for _, f := range fields {
+			if f.field == 5 {
+				function := protoFields(t, f.contents)
+				functions[function[0].value] = strings[function[1].value]
+			}
+		}
+		// locations have the ids of their functions
+		for _, f := range fields {
+			if f.field == 2 {
+				sample := protoFields(t, f.contents)
+				stack := ""
+				for _, id := range protoUnpack(t, sample[0].contents) {
+					stack += functions[id] + ";"
+				}
+				samples[stack] = protoUnpack(t, sample[1].contents)
+			}
+		}
+
+		// main runs for 30 of its 50 nanoseconds itself, sq for 10 in each call
+		if !slices.Equal(samples["main;"], []uint64{1, 30}) || !slices.Equal(samples["sq;main;"], []uint64{2, 20}) {
+			t.Fatalf("unexpected samples %v", samples)
+		}
+	})
+}
@@ -6,4 +6,6 @@ const (
 	ExportFunctionType WasmExportType = 0x00
 	ExportTableType    WasmExportType = 0x01
 	ExportMemoryType   WasmExportType = 0x02
+	ExportGlobalType   WasmExportType = 0x03
+	ExportTagType      WasmExportType = 0x04
 )
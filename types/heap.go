@@ -0,0 +1,17 @@
+package types
+
+type HeapType = WasmType
+
+const (
+	HeapFunc     HeapType = 0x70
+	HeapExtern   HeapType = 0x6F
+	HeapAny      HeapType = 0x6E
+	HeapEq       HeapType = 0x6D
+	HeapI31      HeapType = 0x6C
+	HeapStruct   HeapType = 0x6B
+	HeapArray    HeapType = 0x6A
+	HeapExn      HeapType = 0x69
+	HeapNone     HeapType = 0x71
+	HeapNoExtern HeapType = 0x72
+	HeapNoFunc   HeapType = 0x73
+)
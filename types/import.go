@@ -4,4 +4,8 @@ type WasmImportType = WasmType
 
 const (
 	ImportFunctionType WasmImportType = 0x00
+	ImportTableType    WasmImportType = 0x01
+	ImportMemoryType   WasmImportType = 0x02
+	ImportGlobalType   WasmImportType = 0x03
+	ImportTagType      WasmImportType = 0x04
 )
@@ -7,5 +7,23 @@ const (
 	I64       PrimitiveType = 0x7E
 	F32       PrimitiveType = 0x7D
 	F64       PrimitiveType = 0x7C
+	V128      PrimitiveType = 0x7B
+	FuncRef   PrimitiveType = 0x70
+	ExternRef PrimitiveType = 0x6F
+	ExnRef    PrimitiveType = 0x69
 	EmptyType PrimitiveType = 0x40
+
+	// Abbreviated nullable references to the abstract heap types of the GC proposal.
+	AnyRef        PrimitiveType = 0x6E
+	EqRef         PrimitiveType = 0x6D
+	I31Ref        PrimitiveType = 0x6C
+	StructRef     PrimitiveType = 0x6B
+	ArrayRef      PrimitiveType = 0x6A
+	NullRef       PrimitiveType = 0x71
+	NullExternRef PrimitiveType = 0x72
+	NullFuncRef   PrimitiveType = 0x73
+
+	// Packed types are only valid as the types of struct fields and array elements.
+	I8  PrimitiveType = 0x78
+	I16 PrimitiveType = 0x77
 )
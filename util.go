@@ -30,6 +30,18 @@ func leb128EncodeU(n uint64) wasmVector {
 	return leb128.EncodeU64(n)
 }
 
+// Encodes n as an unsigned LEB128 of exactly width bytes, padded with continuation bytes, so
+// that it can be replaced later without moving the bytes after it.
+func leb128EncodePadded(n uint64, width int) wasmVector {
+	result := make([]byte, width)
+	for i := range result {
+		result[i] = byte(n&0x7F) | 0x80
+		n >>= 7
+	}
+	result[width-1] &^= 0x80
+	return result
+}
+
 func leb128EncodeI(n int64) wasmVector {
 	return leb128.EncodeS64(n)
 }
@@ -58,9 +70,9 @@ func module(sections ...wasmSection) []byte {
 	return mod
 }
 
-func locals(amount uint32, localType types.WasmType) []byte {
+func locals(amount uint32, localType ...types.WasmType) []byte {
 	return append(
 		leb128EncodeU(uint64(amount)),
-		localType,
+		localType...,
 	)
 }